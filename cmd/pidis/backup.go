@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/joway/pidis/db"
+	"github.com/urfave/cli"
+)
+
+// flags of the backup command overriding params of the config file
+var backupFlagParams = map[string]string{
+	"dir":                 "dir",
+	"encryption-key-file": "encryption-key-file",
+	"backup-dir":          "backup-dir",
+	"s3-endpoint":         "backup-s3-endpoint",
+	"s3-region":           "backup-s3-region",
+	"s3-bucket":           "backup-s3-bucket",
+	"s3-prefix":           "backup-s3-prefix",
+	"retention":           "backup-retention",
+	"retention-age":       "backup-retention-age",
+}
+
+var backupCommand = cli.Command{
+	Name:      "backup",
+	Usage:     "back up a data dir which isn't served, BGSAVE backs up a running server",
+	ArgsUsage: " ",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "dir, d",
+			Usage: "data dir to back up",
+		},
+		cli.StringFlag{
+			Name:  "config, c",
+			Usage: "config file of the database, flags take precedence over it",
+		},
+		cli.StringFlag{
+			Name: "encryption-key-file",
+		},
+		cli.StringFlag{
+			Name:  "backup-dir",
+			Usage: "dir the backups are written to, <dir>/backups by default",
+		},
+		cli.StringFlag{
+			Name:  "s3-endpoint",
+			Usage: "S3 compatible endpoint the backups are uploaded to, with AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY",
+		},
+		cli.StringFlag{
+			Name: "s3-region",
+		},
+		cli.StringFlag{
+			Name: "s3-bucket",
+		},
+		cli.StringFlag{
+			Name: "s3-prefix",
+		},
+		cli.BoolFlag{
+			Name:  "incremental",
+			Usage: "only back up the writes made since the last backup",
+		},
+		cli.StringFlag{
+			Name:  "retention",
+			Usage: "number of full backups kept along with their incremental ones, 0 keeps all of them",
+		},
+		cli.StringFlag{
+			Name:  "retention-age",
+			Usage: "seconds after which backups not followed by newer ones are removed, 0 keeps them",
+		},
+	},
+	Action: backup,
+}
+
+func backup(c *cli.Context) error {
+	config := db.NewConfig()
+	if file := c.String("config"); file != "" {
+		var err error
+		if config, err = db.LoadConfig(file); err != nil {
+			return err
+		}
+	}
+	for flag, param := range backupFlagParams {
+		if !c.IsSet(flag) {
+			continue
+		}
+		if err := config.Set(param, c.String(flag)); err != nil {
+			return fmt.Errorf("invalid --%s: %v", flag, err)
+		}
+	}
+	options, err := config.Options()
+	if err != nil {
+		return err
+	}
+	database, err := db.New(options)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = database.Close() }()
+
+	target, err := database.BackupTarget()
+	if err != nil {
+		return err
+	}
+	backupOptions := database.BackupOptions()
+	backupOptions.Incremental = c.Bool("incremental")
+	manifest, err := database.Backup(context.Background(), target, backupOptions)
+	if err != nil {
+		return err
+	}
+	kind := "full"
+	if manifest.Base != "" {
+		kind = "incremental over " + manifest.Base
+	}
+	fmt.Printf("backup %s (%s, %d bytes) saved to %s\n", manifest.ID, kind, manifest.Size, target)
+	return nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/tls"
 	"fmt"
 	"github.com/joway/loki"
 	"github.com/joway/pidis"
@@ -8,16 +9,33 @@ import (
 	"github.com/tidwall/redcon"
 	"github.com/urfave/cli"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
 )
 
 var logger = loki.New("pidis:main")
 
-type Config struct {
-	port    string
-	rpcPort string
-	dir     string
+// flags overriding params of the config file
+var flagParams = map[string]string{
+	"port":                   "port",
+	"rpcPort":                "rpc-port",
+	"metrics-port":           "metrics-port",
+	"dir":                    "dir",
+	"notify-keyspace-events": "notify-keyspace-events",
+	"aclfile":                "aclfile",
+	"tls-cert-file":          "tls-cert-file",
+	"tls-key-file":           "tls-key-file",
+	"tls-ca-cert-file":       "tls-ca-cert-file",
+	"tls-auth-clients":       "tls-auth-clients",
+	"tls-replication":        "tls-replication",
+	"masterauth":             "masterauth",
+	"encryption-key-file":    "encryption-key-file",
+}
+
+var boolFlags = map[string]bool{
+	"tls-auth-clients": true,
+	"tls-replication":  true,
 }
 
 func main() {
@@ -25,10 +43,15 @@ func main() {
 	app.Name = "pidis"
 	app.Version = pidis.VERSION
 	app.Usage = ""
+	app.ArgsUsage = "[config file]"
 	cli.VersionFlag = cli.BoolFlag{
 		Name: "version, v",
 	}
 	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:  "config, c",
+			Usage: "redis.conf like config file, flags take precedence over it",
+		},
 		cli.StringFlag{
 			Name:  "port, p",
 			Value: "6380",
@@ -37,22 +60,81 @@ func main() {
 			Name:  "rpcPort",
 			Value: "6381",
 		},
+		cli.StringFlag{
+			Name:  "metrics-port",
+			Usage: "serve prometheus metrics at http://:<port>/metrics",
+		},
 		cli.StringFlag{
 			Name:  "dir, d",
 			Value: "/tmp/pidis",
 		},
+		cli.StringFlag{
+			Name:  "notify-keyspace-events",
+			Value: "",
+		},
+		cli.StringFlag{
+			Name:  "aclfile",
+			Value: "",
+		},
+		cli.StringFlag{
+			Name:  "tls-cert-file",
+			Usage: "serve redis protocol over tls with the certificate",
+		},
+		cli.StringFlag{
+			Name: "tls-key-file",
+		},
+		cli.StringFlag{
+			Name:  "tls-ca-cert-file",
+			Usage: "CA certificate to verify clients and replication peers",
+		},
+		cli.BoolFlag{
+			Name:  "tls-auth-clients",
+			Usage: "require clients to authenticate with a certificate",
+		},
+		cli.BoolFlag{
+			Name:  "tls-replication",
+			Usage: "use tls for the replication rpc server and for following a master",
+		},
+		cli.StringFlag{
+			Name:   "masterauth",
+			Usage:  "shared secret required from followers and presented when following a master",
+			EnvVar: "PIDIS_MASTERAUTH",
+		},
+		cli.StringFlag{
+			Name:  "encryption-key-file",
+			Usage: "hex encoded AES master key encrypting data at rest, PIDIS_ENCRYPTION_KEY is read without it",
+		},
 	}
+	app.Commands = []cli.Command{backupCommand, restoreCommand}
 	app.Action = func(c *cli.Context) error {
-		port := c.String("port")
-		rpcPort := c.String("rpcPort")
-		dir := c.String("dir")
-		cfg := Config{
-			port:    port,
-			rpcPort: rpcPort,
-			dir:     dir,
+		config := db.NewConfig()
+		file := c.String("config")
+		if file == "" {
+			file = c.Args().First()
+		}
+		if file != "" {
+			var err error
+			if config, err = db.LoadConfig(file); err != nil {
+				return err
+			}
+		}
+		for flag, param := range flagParams {
+			if !c.IsSet(flag) {
+				continue
+			}
+			value := c.String(flag)
+			if boolFlags[flag] {
+				value = "no"
+				if c.Bool(flag) {
+					value = "yes"
+				}
+			}
+			if err := config.Set(param, value); err != nil {
+				return fmt.Errorf("invalid --%s: %v", flag, err)
+			}
 		}
 
-		return startServer(cfg)
+		return startServer(config)
 	}
 
 	if err := app.Run(os.Args); err != nil {
@@ -60,10 +142,12 @@ func main() {
 	}
 }
 
-func startServer(cfg Config) error {
-	database, err := db.New(db.Options{
-		DBDir: cfg.dir,
-	})
+func startServer(config *db.Config) error {
+	options, err := config.Options()
+	if err != nil {
+		return err
+	}
+	database, err := db.New(options)
 	if err != nil {
 		return err
 	}
@@ -74,20 +158,46 @@ func startServer(cfg Config) error {
 		}
 	}()
 	database.Run()
+	if host, port := config.ReplicaOf(); host != "" {
+		if err := database.SlaveOf(host, port); err != nil {
+			logger.Error("failed to follow %s:%s: %v", host, port, err)
+		}
+	}
 
-	rdsAddr := fmt.Sprintf(":%s", cfg.port)
-	rpcAddr := fmt.Sprintf(":%s", cfg.rpcPort)
+	rdsAddr := fmt.Sprintf(":%s", config.Get("port"))
+	rpcAddr := fmt.Sprintf(":%s", config.Get("rpc-port"))
 	rdsLis, err := net.Listen("tcp", rdsAddr)
 	logger.Info("running pidis server at: %s", rdsAddr)
 	if err != nil {
 		logger.Fatal("%v", err)
 	}
+	if tlsOptions := config.TLS(); tlsOptions.Enabled() {
+		tlsConfig, err := tlsOptions.ServerConfig()
+		if err != nil {
+			return err
+		}
+		rdsLis = tls.NewListener(rdsLis, tlsConfig)
+		logger.Info("serving redis protocol over tls")
+	}
 	rpcLis, err := net.Listen("tcp", rpcAddr)
 	logger.Info("running redis server at: %s", rpcAddr)
 	if err != nil {
 		logger.Fatal("%v", err)
 	}
 
+	var metricsServer *http.Server
+	if port := config.Get("metrics-port"); port != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", database.MetricsHandler())
+		metricsServer = &http.Server{Addr: fmt.Sprintf(":%s", port), Handler: mux}
+		logger.Info("serving metrics at: %s", metricsServer.Addr)
+		go func() {
+			if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Fatal("%v", err)
+			}
+		}()
+	}
+
 	rpcServer := db.NewRpcServer(database)
 	go func() {
 		if err := rpcServer.Serve(rpcLis); err != nil {
@@ -98,8 +208,8 @@ func startServer(cfg Config) error {
 	redisServer := redcon.NewServer(
 		rdsAddr,
 		db.GetRedisCmdHandler(database),
-		nil,
-		nil,
+		db.GetRedisAcceptHandler(database),
+		db.GetRedisClosedHandler(database),
 	)
 	go func() {
 		if err := redisServer.Serve(rdsLis); err != nil {
@@ -116,5 +226,10 @@ func startServer(cfg Config) error {
 		logger.Error("%v", err)
 	}
 	rpcServer.GracefulStop()
+	if metricsServer != nil {
+		if err := metricsServer.Close(); err != nil {
+			logger.Error("%v", err)
+		}
+	}
 	return nil
 }
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/joway/pidis/db"
+	"github.com/urfave/cli"
+	"strconv"
+	"time"
+)
+
+var restoreCommand = cli.Command{
+	Name:      "restore",
+	Usage:     "restore a data dir to a point in time from its snapshots and aof",
+	ArgsUsage: " ",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "from",
+			Usage: "data dir whose aof is replayed",
+		},
+		cli.StringFlag{
+			Name:  "snapshots",
+			Usage: "dir of the snapshots or backups, the data dir restored from by default",
+		},
+		cli.StringFlag{
+			Name:  "to-time",
+			Usage: "RFC3339 time or unix seconds to restore to",
+		},
+		cli.StringFlag{
+			Name:  "dir, d",
+			Usage: "fresh data dir restored into",
+		},
+		cli.StringFlag{
+			Name:  "config, c",
+			Usage: "config file of the restored database",
+		},
+		cli.StringFlag{
+			Name:  "encryption-key-file",
+			Usage: "master key of the data dir restored from, the restored one is encrypted with it as well",
+		},
+		cli.BoolFlag{
+			Name:  "legacy-snapshots",
+			Usage: "restore from <unix time>.snapshot files too, skipping the commands of their second",
+		},
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "only report the snapshot and the number of commands which would be applied",
+		},
+	},
+	Action: restore,
+}
+
+func restore(c *cli.Context) error {
+	if c.String("from") == "" || c.String("to-time") == "" {
+		return fmt.Errorf("--from and --to-time are required")
+	}
+	toTime, err := parseTime(c.String("to-time"))
+	if err != nil {
+		return fmt.Errorf("invalid --to-time: %v", err)
+	}
+	config := db.NewConfig()
+	if file := c.String("config"); file != "" {
+		if config, err = db.LoadConfig(file); err != nil {
+			return err
+		}
+	}
+	for _, flag := range []string{"dir", "encryption-key-file"} {
+		if c.IsSet(flag) {
+			if err := config.Set(flag, c.String(flag)); err != nil {
+				return fmt.Errorf("invalid --%s: %v", flag, err)
+			}
+		}
+	}
+	target, err := config.Options()
+	if err != nil {
+		return err
+	}
+	if !c.Bool("dry-run") && !c.IsSet("dir") {
+		return fmt.Errorf("--dir is required")
+	}
+
+	report, err := db.Restore(context.Background(), db.RestoreOptions{
+		Source:            c.String("from"),
+		Snapshots:         c.String("snapshots"),
+		EncryptionKeyFile: target.EncryptionKeyFile,
+		LegacySnapshots:   c.Bool("legacy-snapshots"),
+		ToTime:            toTime,
+		DryRun:            c.Bool("dry-run"),
+		Target:            target,
+	})
+	if err != nil {
+		return err
+	}
+	snapshot := report.Snapshot
+	if snapshot == "" {
+		snapshot = "none, the aof is replayed from scratch"
+	}
+	fmt.Printf("snapshot: %s\n", snapshot)
+	fmt.Printf("skipped commands: %d\n", report.Skipped)
+	if report.Overlap > 0 {
+		fmt.Printf("skipped commands the legacy snapshot may not hold: %d\n", report.Overlap)
+	}
+	if c.Bool("dry-run") {
+		fmt.Printf("commands to apply: %d\n", report.Applied)
+	} else {
+		fmt.Printf("applied commands: %d\n", report.Applied)
+	}
+	if !report.LastApplied.IsZero() {
+		fmt.Printf("last command at: %s\n", report.LastApplied.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// parseTime reads a RFC3339 time or unix seconds
+func parseTime(value string) (time.Time, error) {
+	if unix, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(unix, 0), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
@@ -0,0 +1,791 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/gobwas/glob"
+	"github.com/joway/pidis/executor"
+	"github.com/joway/pidis/types"
+	"github.com/joway/pidis/util"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultUser = "default"
+
+	aclLogMaxLen = 128
+)
+
+// aclCategories maps every category to its commands, as declared by the command table
+var aclCategories = func() map[string][]string {
+	categories := make(map[string][]string)
+	for _, cmd := range executor.Commands() {
+		for _, category := range cmd.AllCategories() {
+			categories[category] = append(categories[category], cmd.Name)
+		}
+	}
+	return categories
+}()
+
+func aclCategory(name string) ([]string, bool) {
+	if name == "all" {
+		return aclCommands(), true
+	}
+	cmds, ok := aclCategories[name]
+	return cmds, ok
+}
+
+func aclCommands() []string {
+	set := make(map[string]struct{})
+	for _, cmds := range aclCategories {
+		for _, cmd := range cmds {
+			set[cmd] = struct{}{}
+		}
+	}
+	return sortedKeys(set)
+}
+
+func inCategory(category, cmd string) bool {
+	cmds, _ := aclCategory(category)
+	for _, c := range cmds {
+		if c == cmd {
+			return true
+		}
+	}
+	return false
+}
+
+type User struct {
+	name      string
+	enabled   bool
+	nopass    bool
+	passwords []string
+	//command rules are evaluated in order, the last matching one wins
+	commands []string
+	keys     []string
+	channels []string
+
+	keyGlobs     []glob.Glob
+	channelGlobs []glob.Glob
+}
+
+// NewUser returns a user without any permission, the same as the "reset" rule
+func NewUser(name string) *User {
+	return &User{name: name}
+}
+
+func (u *User) Name() string {
+	return u.name
+}
+
+func (u *User) clone() *User {
+	c := *u
+	c.passwords = append([]string(nil), u.passwords...)
+	c.commands = append([]string(nil), u.commands...)
+	c.keys = append([]string(nil), u.keys...)
+	c.channels = append([]string(nil), u.channels...)
+	c.keyGlobs = append([]glob.Glob(nil), u.keyGlobs...)
+	c.channelGlobs = append([]glob.Glob(nil), u.channelGlobs...)
+	return &c
+}
+
+func (u *User) Apply(rule string) error {
+	lower := strings.ToLower(rule)
+	switch lower {
+	case "on":
+		u.enabled = true
+		return nil
+	case "off":
+		u.enabled = false
+		return nil
+	case "nopass":
+		u.nopass = true
+		u.passwords = nil
+		return nil
+	case "resetpass":
+		u.nopass = false
+		u.passwords = nil
+		return nil
+	case "allkeys":
+		return u.Apply("~*")
+	case "resetkeys":
+		u.keys, u.keyGlobs = nil, nil
+		return nil
+	case "allchannels":
+		return u.Apply("&*")
+	case "resetchannels":
+		u.channels, u.channelGlobs = nil, nil
+		return nil
+	case "allcommands":
+		return u.Apply("+@all")
+	case "nocommands":
+		return u.Apply("-@all")
+	case "reset":
+		*u = *NewUser(u.name)
+		return nil
+	}
+	if rule == "" {
+		return aclRuleError(rule, "Syntax error")
+	}
+
+	switch rule[0] {
+	case '>':
+		return u.Apply("#" + passwordHash(rule[1:]))
+	case '<':
+		return u.Apply("!" + passwordHash(rule[1:]))
+	case '#', '!':
+		hash := rule[1:]
+		if !isPasswordHash(hash) {
+			return aclRuleError(rule, "The password hash must be exactly 64 characters and contain only lowercase hexadecimal characters")
+		}
+		u.passwords = removeString(u.passwords, hash)
+		if rule[0] == '#' {
+			u.passwords = append(u.passwords, hash)
+			u.nopass = false
+		}
+		return nil
+	case '~', '&':
+		pattern := rule[1:]
+		g, err := glob.Compile(pattern)
+		if err != nil {
+			return aclRuleError(rule, "Syntax error")
+		}
+		if rule[0] == '~' {
+			if !containsString(u.keys, pattern) {
+				u.keys = append(u.keys, pattern)
+				u.keyGlobs = append(u.keyGlobs, g)
+			}
+		} else if !containsString(u.channels, pattern) {
+			u.channels = append(u.channels, pattern)
+			u.channelGlobs = append(u.channelGlobs, g)
+		}
+		return nil
+	case '+', '-':
+		name := lower[1:]
+		if strings.HasPrefix(name, "@") {
+			if _, ok := aclCategory(name[1:]); !ok {
+				return aclRuleError(rule, "Unknown command or category name in ACL")
+			}
+			if name == "@all" {
+				//every previous rule is overridden
+				u.commands = nil
+			}
+		} else if !inCategory("all", strings.ToUpper(name)) {
+			return aclRuleError(rule, "Unknown command or category name in ACL")
+		}
+		u.commands = append(u.commands, rule[:1]+name)
+		return nil
+	default:
+		return aclRuleError(rule, "Syntax error")
+	}
+}
+
+func (u *User) CanRun(cmd string) bool {
+	allowed := false
+	for _, rule := range u.commands {
+		name := rule[1:]
+		var match bool
+		if strings.HasPrefix(name, "@") {
+			match = inCategory(name[1:], cmd)
+		} else {
+			match = strings.ToUpper(name) == cmd
+		}
+		if match {
+			allowed = rule[0] == '+'
+		}
+	}
+	return allowed
+}
+
+func (u *User) CanAccessKey(key []byte) bool {
+	for _, g := range u.keyGlobs {
+		if g.Match(string(key)) {
+			return true
+		}
+	}
+	return false
+}
+
+// CanAccessChannel checks a channel, a subscribed pattern is only allowed
+// if it is one of the channel patterns of the user
+func (u *User) CanAccessChannel(channel []byte, isPattern bool) bool {
+	for i, g := range u.channelGlobs {
+		if u.channels[i] == "*" || u.channels[i] == string(channel) {
+			return true
+		}
+		if !isPattern && g.Match(string(channel)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *User) CheckPassword(password string) bool {
+	if !u.enabled {
+		return false
+	}
+	if u.nopass {
+		return true
+	}
+	return containsString(u.passwords, passwordHash(password))
+}
+
+func (u *User) flags() []string {
+	flags := []string{"off"}
+	if u.enabled {
+		flags[0] = "on"
+	}
+	if u.nopass {
+		flags = append(flags, "nopass")
+	}
+	return flags
+}
+
+func (u *User) commandRules() string {
+	if len(u.commands) == 0 {
+		return "-@all"
+	}
+	return strings.Join(u.commands, " ")
+}
+
+func (u *User) keyRules() string {
+	var rules []string
+	for _, k := range u.keys {
+		rules = append(rules, "~"+k)
+	}
+	return strings.Join(rules, " ")
+}
+
+func (u *User) channelRules() string {
+	var rules []string
+	for _, c := range u.channels {
+		rules = append(rules, "&"+c)
+	}
+	return strings.Join(rules, " ")
+}
+
+// Describe returns the user in the ACL file format
+func (u *User) Describe() string {
+	rules := []string{"user", u.name}
+	rules = append(rules, u.flags()...)
+	for _, p := range u.passwords {
+		rules = append(rules, "#"+p)
+	}
+	if keys := u.keyRules(); keys != "" {
+		rules = append(rules, keys)
+	}
+	if channels := u.channelRules(); channels != "" {
+		rules = append(rules, channels)
+	} else {
+		rules = append(rules, "resetchannels")
+	}
+	rules = append(rules, u.commandRules())
+	return strings.Join(rules, " ")
+}
+
+type aclLogEntry struct {
+	id       int64
+	count    int64
+	reason   string
+	context  string
+	object   string
+	username string
+	client   string
+	created  time.Time
+	updated  time.Time
+}
+
+type ACL struct {
+	lock sync.RWMutex
+
+	path  string
+	users map[string]*User
+
+	log    []*aclLogEntry
+	lastID int64
+}
+
+func NewACL(path string) (*ACL, error) {
+	acl := &ACL{path: path}
+	if err := acl.Load(); err != nil {
+		return nil, errors.Wrap(err, "load acl file failed")
+	}
+	return acl, nil
+}
+
+func defaultUser() *User {
+	u := NewUser(DefaultUser)
+	for _, rule := range []string{"on", "nopass", "~*", "&*", "+@all"} {
+		_ = u.Apply(rule)
+	}
+	return u
+}
+
+// Load replaces all users with the ones defined in the ACL file
+func (a *ACL) Load() error {
+	users := map[string]*User{DefaultUser: defaultUser()}
+	content, err := ioutil.ReadFile(a.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 || fields[0] != "user" {
+			return types.ReplyError(fmt.Sprintf("ERR %s:%d should start with user keyword", a.path, line))
+		}
+		u := NewUser(fields[1])
+		for _, rule := range fields[2:] {
+			if err := u.Apply(rule); err != nil {
+				return types.ReplyError(fmt.Sprintf("ERR %s:%d: %v", a.path, line, err))
+			}
+		}
+		users[u.name] = u
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.users = users
+	return nil
+}
+
+func (a *ACL) Save() error {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	return a.save()
+}
+
+func (a *ACL) save() error {
+	if a.path == "" {
+		return nil
+	}
+	var buf bytes.Buffer
+	for _, name := range a.names() {
+		buf.WriteString(a.users[name].Describe())
+		buf.WriteByte('\n')
+	}
+	tmp := a.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, a.path)
+}
+
+func (a *ACL) names() []string {
+	names := make([]string, 0, len(a.users))
+	for name := range a.users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (a *ACL) Get(name string) *User {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	return a.users[name]
+}
+
+// SetUser applies rules to a copy of the user, so it's either fully updated or not at all
+func (a *ACL) SetUser(name string, rules []string) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	u, ok := a.users[name]
+	if ok {
+		u = u.clone()
+	} else {
+		u = NewUser(name)
+	}
+	for _, rule := range rules {
+		if err := u.Apply(rule); err != nil {
+			return err
+		}
+	}
+	a.users[name] = u
+	return a.save()
+}
+
+func (a *ACL) DelUser(names []string) (int, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	deleted := 0
+	for _, name := range names {
+		if name == DefaultUser {
+			return 0, types.ErrDeleteDefaultUser
+		}
+	}
+	for _, name := range names {
+		if _, ok := a.users[name]; ok {
+			delete(a.users, name)
+			deleted++
+		}
+	}
+	return deleted, a.save()
+}
+
+func (a *ACL) Users() []*User {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	var users []*User
+	for _, name := range a.names() {
+		users = append(users, a.users[name])
+	}
+	return users
+}
+
+// Authenticate returns the user if password matches
+func (a *ACL) Authenticate(name, password string) (*User, bool) {
+	u := a.Get(name)
+	if u == nil || !u.CheckPassword(password) {
+		return nil, false
+	}
+	return u, true
+}
+
+// Log records a denied access, entries of the same failure are merged
+func (a *ACL) Log(reason, context, object, username, client string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	now := time.Now()
+	for _, e := range a.log {
+		if e.reason == reason && e.context == context && e.object == object && e.username == username {
+			e.count++
+			e.client = client
+			e.updated = now
+			return
+		}
+	}
+	a.lastID++
+	entry := &aclLogEntry{
+		id:       a.lastID,
+		count:    1,
+		reason:   reason,
+		context:  context,
+		object:   object,
+		username: username,
+		client:   client,
+		created:  now,
+		updated:  now,
+	}
+	a.log = append([]*aclLogEntry{entry}, a.log...)
+	if len(a.log) > aclLogMaxLen {
+		a.log = a.log[:aclLogMaxLen]
+	}
+}
+
+func (a *ACL) logEntries(count int) []aclLogEntry {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	if count < 0 || count > len(a.log) {
+		count = len(a.log)
+	}
+	entries := make([]aclLogEntry, count)
+	for i := range entries {
+		entries[i] = *a.log[i]
+	}
+	return entries
+}
+
+func (a *ACL) ResetLog() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.log = nil
+}
+
+// checkACL verifies the client is allowed to run a command against its keys and channels
+func (db *Database) checkACL(client *Client, name string, args [][]byte) error {
+	if executor.Lookup(name).HasFlag(executor.FlagNoAuth) {
+		return nil
+	}
+	if !client.authenticated {
+		return types.ErrNoAuth
+	}
+	context := "toplevel"
+	if client.multi {
+		context = "multi"
+	}
+	return db.checkPermissions(client, context, name, args)
+}
+
+// checkScriptACL verifies the client running a script is allowed to run a command it calls,
+// commands of internal callers aren't checked
+func (db *Database) checkScriptACL(client *Client, name string, args [][]byte) error {
+	if client == nil {
+		return nil
+	}
+	return db.checkPermissions(client, "lua", name, args)
+}
+
+// checkPermissions verifies the user of client can run a command against its keys and channels,
+// denials are logged with the context the command has been issued in
+func (db *Database) checkPermissions(client *Client, context, name string, args [][]byte) error {
+	u := db.acl.Get(client.user)
+	if u == nil || !u.enabled {
+		return types.ErrNoAuth
+	}
+	if !u.CanRun(name) {
+		db.acl.Log("command", context, strings.ToLower(name), u.name, client.Info())
+		return types.ReplyError(fmt.Sprintf(
+			"NOPERM User %s has no permissions to run the '%s' command",
+			u.name, strings.ToLower(name),
+		))
+	}
+	for _, key := range commandKeys(name, args) {
+		if !u.CanAccessKey(key) {
+			db.acl.Log("key", context, string(key), u.name, client.Info())
+			return types.ErrNoPermKey
+		}
+	}
+	channels, isPattern := commandChannels(name, args)
+	for _, channel := range channels {
+		if !u.CanAccessChannel(channel, isPattern) {
+			db.acl.Log("channel", context, string(channel), u.name, client.Info())
+			return types.ErrNoPermChannel
+		}
+	}
+	return nil
+}
+
+// commandChannels returns the channels or patterns of pub/sub commands
+func commandChannels(name string, args [][]byte) ([][]byte, bool) {
+	switch name {
+	case executor.SUBSCRIBE, executor.SSUBSCRIBE:
+		return args[1:], false
+	case executor.PSUBSCRIBE:
+		return args[1:], true
+	case executor.PUBLISH, executor.SPUBLISH:
+		if len(args) < 2 {
+			return nil, false
+		}
+		return args[1:2], false
+	default:
+		return nil, false
+	}
+}
+
+func (db *Database) auth(client *Client, name, password string) error {
+	u, ok := db.acl.Authenticate(name, password)
+	if !ok {
+		db.acl.Log("auth", "toplevel", "AUTH", name, client.Info())
+		return types.ErrWrongPass
+	}
+	client.user = u.name
+	client.authenticated = true
+	return nil
+}
+
+func execACL(database *Database, client *Client, name string, args [][]byte) ([]byte, bool, error) {
+	switch name {
+	case executor.AUTH:
+		var err error
+		switch len(args) {
+		case 2:
+			if u := database.acl.Get(DefaultUser); u != nil && u.nopass {
+				return nil, true, types.ErrAuthWithoutPassword
+			}
+			err = database.auth(client, DefaultUser, string(args[1]))
+		case 3:
+			err = database.auth(client, string(args[1]), string(args[2]))
+		default:
+			return nil, true, types.ErrInvalidNumberOfArgs
+		}
+		if err != nil {
+			return nil, true, err
+		}
+		return util.MessageOK(), true, nil
+	case executor.ACL:
+		if len(args) < 2 {
+			return nil, true, types.ErrInvalidNumberOfArgs
+		}
+		output, err := database.ACL(client, strings.ToUpper(string(args[1])), args[2:])
+		return output, true, err
+	default:
+		return nil, false, nil
+	}
+}
+
+func (db *Database) ACL(client *Client, sub string, args [][]byte) ([]byte, error) {
+	reply := util.NewReply(client.Proto())
+	switch sub {
+	case "WHOAMI":
+		return reply.BulkString(client.user).Bytes(), nil
+	case "USERS":
+		users := db.acl.Users()
+		reply.Array(len(users))
+		for _, u := range users {
+			reply.BulkString(u.name)
+		}
+		return reply.Bytes(), nil
+	case "LIST":
+		users := db.acl.Users()
+		reply.Array(len(users))
+		for _, u := range users {
+			reply.BulkString(u.Describe())
+		}
+		return reply.Bytes(), nil
+	case "SETUSER":
+		if len(args) < 1 {
+			return nil, types.ErrInvalidNumberOfArgs
+		}
+		var rules []string
+		for _, rule := range args[1:] {
+			rules = append(rules, string(rule))
+		}
+		if err := db.acl.SetUser(string(args[0]), rules); err != nil {
+			return nil, err
+		}
+		return util.MessageOK(), nil
+	case "GETUSER":
+		if len(args) != 1 {
+			return nil, types.ErrInvalidNumberOfArgs
+		}
+		u := db.acl.Get(string(args[0]))
+		if u == nil {
+			return reply.Null().Bytes(), nil
+		}
+		flags := u.flags()
+		reply.Map(5)
+		reply.BulkString("flags").Set(len(flags))
+		for _, flag := range flags {
+			reply.BulkString(flag)
+		}
+		reply.BulkString("passwords").Array(len(u.passwords))
+		for _, p := range u.passwords {
+			reply.BulkString(p)
+		}
+		reply.BulkString("commands").BulkString(u.commandRules())
+		reply.BulkString("keys").BulkString(u.keyRules())
+		reply.BulkString("channels").BulkString(u.channelRules())
+		return reply.Bytes(), nil
+	case "DELUSER":
+		if len(args) < 1 {
+			return nil, types.ErrInvalidNumberOfArgs
+		}
+		var names []string
+		for _, name := range args {
+			names = append(names, string(name))
+		}
+		deleted, err := db.acl.DelUser(names)
+		if err != nil {
+			return nil, err
+		}
+		return util.MessageInt(int64(deleted)), nil
+	case "CAT":
+		if len(args) == 0 {
+			categories := []string{"all"}
+			for name := range aclCategories {
+				categories = append(categories, name)
+			}
+			sort.Strings(categories)
+			reply.Array(len(categories))
+			for _, name := range categories {
+				reply.BulkString(name)
+			}
+			return reply.Bytes(), nil
+		}
+		cmds, ok := aclCategory(strings.ToLower(string(args[0])))
+		if !ok {
+			return nil, types.ReplyError(fmt.Sprintf("ERR Unknown category '%s'", args[0]))
+		}
+		reply.Array(len(cmds))
+		for _, cmd := range cmds {
+			reply.BulkString(strings.ToLower(cmd))
+		}
+		return reply.Bytes(), nil
+	case "LOG":
+		count := 10
+		if len(args) > 0 {
+			if strings.ToUpper(string(args[0])) == "RESET" {
+				db.acl.ResetLog()
+				return util.MessageOK(), nil
+			}
+			n, err := strconv.Atoi(string(args[0]))
+			if err != nil {
+				return nil, types.ErrNotInteger
+			}
+			count = n
+		}
+		entries := db.acl.logEntries(count)
+		reply.Array(len(entries))
+		now := time.Now()
+		for _, e := range entries {
+			reply.Map(10).
+				BulkString("count").Int(e.count).
+				BulkString("reason").BulkString(e.reason).
+				BulkString("context").BulkString(e.context).
+				BulkString("object").BulkString(e.object).
+				BulkString("username").BulkString(e.username).
+				BulkString("age-seconds").Double(now.Sub(e.created).Seconds()).
+				BulkString("client-info").BulkString(e.client).
+				BulkString("entry-id").Int(e.id).
+				BulkString("timestamp-created").Int(e.created.UnixNano() / int64(time.Millisecond)).
+				BulkString("timestamp-last-updated").Int(e.updated.UnixNano() / int64(time.Millisecond))
+		}
+		return reply.Bytes(), nil
+	case "SAVE":
+		if err := db.acl.Save(); err != nil {
+			return nil, types.ReplyError(fmt.Sprintf("ERR There was an error trying to save the ACLs: %v", err))
+		}
+		return util.MessageOK(), nil
+	case "LOAD":
+		if err := db.acl.Load(); err != nil {
+			return nil, types.ReplyError(fmt.Sprintf("ERR Error loading ACLs: %v", err))
+		}
+		return util.MessageOK(), nil
+	default:
+		return nil, types.ReplyError(fmt.Sprintf("ERR unknown subcommand '%s'. Try ACL HELP.", sub))
+	}
+}
+
+func aclRuleError(rule, reason string) error {
+	return types.ReplyError(fmt.Sprintf("ERR Error in ACL SETUSER modifier '%s': %s", rule, reason))
+}
+
+func passwordHash(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+func isPasswordHash(hash string) bool {
+	if len(hash) != sha256.Size*2 {
+		return false
+	}
+	for _, c := range hash {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func removeString(list []string, s string) []string {
+	var output []string
+	for _, item := range list {
+		if item != s {
+			output = append(output, item)
+		}
+	}
+	return output
+}
@@ -4,11 +4,17 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"github.com/joway/pidis/executor"
 	"github.com/joway/pidis/types"
 	"github.com/tidwall/redcon"
 	"io"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -21,62 +27,267 @@ type AOFBus struct {
 
 	file   *os.File
 	buffer *bufio.Writer
+	//keyring seals the buffer into segments when it's flushed, nil for plaintext
+	keyring *Keyring
+
+	lastFlush    time.Time
+	lastFlushErr error
+
+	//counters since startup
+	entries int64
+	written int64
+}
+
+const aofSegmentSize = 64 << 10
+
+type AOFStat struct {
+	Size         int64
+	Buffered     int
+	LastFlush    time.Time
+	LastFlushErr error
 }
 
-func EncodeAOF(uid []byte, args [][]byte) []byte {
+// AOFEntry is a write command and the database it has been run in
+type AOFEntry struct {
+	DB   int
+	Args [][]byte
+}
+
+// EncodeAOF writes an entry as an array of its uid, database index and command arguments
+func EncodeAOF(uid []byte, index int, args [][]byte) []byte {
 	var encoded []byte
-	encoded = redcon.AppendArray(encoded, len(args)+1)
+	encoded = redcon.AppendArray(encoded, len(args)+2)
 	encoded = redcon.AppendBulk(encoded, uid)
+	encoded = redcon.AppendBulkString(encoded, strconv.Itoa(index))
 	for _, arg := range args {
 		encoded = redcon.AppendBulk(encoded, arg)
 	}
 	return encoded
 }
 
-func DecodeAOF(content []byte) (uid []byte, args [][]byte, leftover []byte, err error) {
+// DecodeAOF reads the next entry, entries written before databases were recorded belong to the first one
+func DecodeAOF(content []byte) (uid []byte, index int, args [][]byte, leftover []byte, err error) {
 	isCompleted, args, _, leftover, err := redcon.ReadNextCommand(content, nil)
 	if err != nil {
-		return nil, nil, content, types.ErrInvalidAOFFormat
+		return nil, 0, nil, content, types.ErrInvalidAOFFormat
 	}
 	if !isCompleted {
-		return nil, nil, content, nil
+		return nil, 0, nil, content, nil
 	}
-	return args[0], args[1:], leftover, nil
-}
-
-func NewAOFBus(path string, offsetSize int) (*AOFBus, error) {
-	file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, os.ModePerm)
-	if err != nil {
-		return nil, err
+	//a command name is never a number
+	if len(args) > 2 {
+		if n, err := strconv.Atoi(string(args[1])); err == nil && n >= 0 {
+			return args[0], n, args[2:], leftover, nil
+		}
 	}
-	buffer := bufio.NewWriter(file)
+	return args[0], 0, args[1:], leftover, nil
+}
 
-	return &AOFBus{
+func NewAOFBus(path string, offsetSize int, keyring *Keyring) (*AOFBus, error) {
+	b := &AOFBus{
 		path:       path,
 		offsetSize: offsetSize,
-
-		file:   file,
-		buffer: buffer,
+		keyring:    keyring,
 
 		lock: &sync.Mutex{},
-	}, nil
+	}
+	if err := b.dropUnfinishedArchive(); err != nil {
+		return nil, err
+	}
+	if err := b.open(); err != nil {
+		return nil, err
+	}
+	return b, nil
 }
 
-func (b *AOFBus) Append(args [][]byte) error {
-	uid := NewUID()
-	line := EncodeAOF(uid.Bytes(), args)
+// open opens the file entries are appended to
+func (b *AOFBus) open() error {
+	file, err := os.OpenFile(b.path, os.O_RDWR|os.O_APPEND|os.O_CREATE, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	b.file = file
+	b.buffer = bufio.NewWriter(file)
+	if b.keyring.Enabled() {
+		//larger segments make the overhead of sealing negligible
+		b.buffer = bufio.NewWriterSize(b.keyring.SealWriter(file), aofSegmentSize)
+	}
+	return nil
+}
+
+func (b *AOFBus) Append(index int, args [][]byte) error {
 	b.lock.Lock()
 	defer b.lock.Unlock()
+	//uids are taken under the lock so they are ordered like the entries
+	line := EncodeAOF(NewUID().Bytes(), index, args)
 	if _, err := b.buffer.Write(line); err != nil {
 		return err
 	}
+	b.appended(1, len(line))
 	return nil
 }
 
+func (b *AOFBus) AppendMulti(entries []AOFEntry) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	var lines []byte
+	lines = append(lines, EncodeAOF(NewUID().Bytes(), entries[0].DB, [][]byte{[]byte(executor.MULTI)})...)
+	for _, e := range entries {
+		lines = append(lines, EncodeAOF(NewUID().Bytes(), e.DB, e.Args)...)
+	}
+	lines = append(lines, EncodeAOF(NewUID().Bytes(), entries[len(entries)-1].DB, [][]byte{[]byte(executor.EXEC)})...)
+	if _, err := b.buffer.Write(lines); err != nil {
+		return err
+	}
+	b.appended(len(entries)+2, len(lines))
+	return nil
+}
+
+func (b *AOFBus) appended(entries, size int) {
+	atomic.AddInt64(&b.entries, int64(entries))
+	atomic.AddInt64(&b.written, int64(size))
+}
+
+// Entries returns the number of entries appended since startup
+func (b *AOFBus) Entries() int64 {
+	return atomic.LoadInt64(&b.entries)
+}
+
+// Written returns the number of bytes appended since startup
+func (b *AOFBus) Written() int64 {
+	return atomic.LoadInt64(&b.written)
+}
+
+// Mark returns a uid and the number of entries appended so far,
+// entries appended later have greater uids
+func (b *AOFBus) Mark() ([]byte, int64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return NewUID().Bytes(), b.entries
+}
+
 func (b *AOFBus) Flush() error {
 	b.lock.Lock()
 	defer b.lock.Unlock()
-	return b.buffer.Flush()
+	return b.flushed(b.buffer.Flush())
+}
+
+func (b *AOFBus) flushed(err error) error {
+	b.lastFlush = time.Now()
+	b.lastFlushErr = err
+	return err
+}
+
+func (b *AOFBus) Stat() (AOFStat, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	info, err := b.file.Stat()
+	if err != nil {
+		return AOFStat{}, err
+	}
+	return AOFStat{
+		Size:         info.Size(),
+		Buffered:     b.buffer.Buffered(),
+		LastFlush:    b.lastFlush,
+		LastFlushErr: b.lastFlushErr,
+	}, nil
+}
+
+// Fsync flushes the buffer and commits the file to disk
+func (b *AOFBus) Fsync() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if err := b.flushed(b.buffer.Flush()); err != nil {
+		return err
+	}
+	return b.file.Sync()
+}
+
+// Rotate archives the entries of the file into a segment named after a uid greater than all of theirs,
+// then appends to a new file. The file is replaced by a rename so it always holds the entries not archived
+func (b *AOFBus) Rotate() (string, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if err := b.flushed(b.buffer.Flush()); err != nil {
+		return "", err
+	}
+	if err := b.file.Sync(); err != nil {
+		return "", err
+	}
+	archive := b.archivePath(NewUID())
+	//the archive is linked first, a crash before the rename leaves a duplicate dropped when reopening
+	if err := os.Link(b.path, archive); err != nil {
+		return "", err
+	}
+	tmp := b.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, os.ModePerm)
+	if err != nil {
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, b.path); err != nil {
+		return "", err
+	}
+	if err := b.file.Close(); err != nil {
+		logger.Error("failed to close the archived aof: %v", err)
+	}
+	return archive, b.open()
+}
+
+// Archives returns the segments archived by rotations from the oldest
+func (b *AOFBus) Archives() ([]string, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return aofArchives(b.path)
+}
+
+func (b *AOFBus) archivePath(uid UID) string {
+	ext := filepath.Ext(b.path)
+	return strings.TrimSuffix(b.path, ext) + "-" + uid.String() + ext
+}
+
+// aofArchives lists the segments archived from the aof file, their uids sort like their names
+func aofArchives(file string) ([]string, error) {
+	ext := filepath.Ext(file)
+	archives, err := filepath.Glob(strings.TrimSuffix(file, ext) + "-*" + ext)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(archives)
+	return archives, nil
+}
+
+// aofArchiveUID returns the uid an archived segment is named after, its entries have lower ones
+func aofArchiveUID(archive string) (UID, error) {
+	name := strings.TrimSuffix(filepath.Base(archive), filepath.Ext(archive))
+	return UIDFromString(name[strings.LastIndexByte(name, '-')+1:])
+}
+
+// dropUnfinishedArchive removes the link of an archive whose rotation has been interrupted
+func (b *AOFBus) dropUnfinishedArchive() error {
+	archives, err := aofArchives(b.path)
+	if err != nil || len(archives) == 0 {
+		return err
+	}
+	last := archives[len(archives)-1]
+	current, err := os.Stat(b.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	archived, err := os.Stat(last)
+	if err != nil {
+		return err
+	}
+	if !os.SameFile(current, archived) {
+		return nil
+	}
+	logger.Warn("removed %s left by an interrupted aof rotation", last)
+	return os.Remove(last)
 }
 
 func (b *AOFBus) Close() error {
@@ -84,20 +295,20 @@ func (b *AOFBus) Close() error {
 }
 
 func (b *AOFBus) Sync(ctx context.Context, writer io.Writer, offset []byte) error {
-	aofFile, err := os.OpenFile(b.path, os.O_RDONLY, os.ModePerm)
+	tail, err := b.tail(offset)
 	if err != nil {
 		return err
 	}
 	defer func() {
-		if err := aofFile.Close(); err != nil {
+		if err := tail.Close(); err != nil {
 			logger.Error("%v", err)
 		}
 	}()
 
-	rd := bufio.NewReader(aofFile)
+	rd := bufio.NewReader(tail)
 
 	//1. Find the position by offset
-	var buffer []byte
+	var raw, buffer []byte
 	//TODO: tuning
 	buf := make([]byte, 1024)
 	var packet []byte
@@ -116,10 +327,17 @@ func (b *AOFBus) Sync(ctx context.Context, writer io.Writer, offset []byte) erro
 				return err
 			}
 
-			buffer = append(buffer, buf[:size]...)
+			//sealed segments are sent decrypted, followers encrypt with keys of their own
+			raw = append(raw, buf[:size]...)
+			plain, leftover, err := b.keyring.Unseal(raw)
+			if err != nil {
+				return err
+			}
+			raw = leftover
+			buffer = append(buffer, plain...)
 			//parser sections
 			for {
-				uid, args, leftover, err := DecodeAOF(buffer)
+				uid, _, args, leftover, err := DecodeAOF(buffer)
 				if err != nil {
 					return err
 				}
@@ -145,3 +363,149 @@ func (b *AOFBus) Sync(ctx context.Context, writer io.Writer, offset []byte) erro
 		}
 	}
 }
+
+// aofTail reads the archived segments holding entries from an offset, then follows the file across rotations
+type aofTail struct {
+	bus *AOFBus
+	//pending are the archives left to read before live
+	pending []*os.File
+	live    *os.File
+	file    *os.File
+	rotated bool
+}
+
+func (b *AOFBus) tail(offset []byte) (*aofTail, error) {
+	//the file is opened along with listing the archives so no rotation can happen in between
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	archives, err := aofArchives(b.path)
+	if err != nil {
+		return nil, err
+	}
+	t := &aofTail{bus: b}
+	for _, archive := range archives {
+		uid, err := aofArchiveUID(archive)
+		if err != nil {
+			_ = t.Close()
+			return nil, err
+		}
+		if bytes.Compare(uid.Bytes(), offset) <= 0 {
+			continue
+		}
+		f, err := os.Open(archive)
+		if err != nil {
+			_ = t.Close()
+			return nil, err
+		}
+		t.pending = append(t.pending, f)
+	}
+	if t.live, err = os.Open(b.path); err != nil {
+		_ = t.Close()
+		return nil, err
+	}
+	t.next()
+	return t, nil
+}
+
+// next moves to the next archive or to the live file
+func (t *aofTail) next() {
+	if len(t.pending) == 0 {
+		t.file = t.live
+		return
+	}
+	t.file, t.pending = t.pending[0], t.pending[1:]
+}
+
+// Read returns io.EOF once every entry appended so far has been read
+func (t *aofTail) Read(p []byte) (int, error) {
+	for {
+		n, err := t.file.Read(p)
+		if n > 0 || err != io.EOF {
+			return n, err
+		}
+		if t.file != t.live {
+			_ = t.file.Close()
+			t.next()
+			continue
+		}
+		if !t.rotated {
+			current, err := os.Stat(t.bus.path)
+			if err != nil {
+				return 0, err
+			}
+			info, err := t.live.Stat()
+			if err != nil {
+				return 0, err
+			}
+			if os.SameFile(current, info) {
+				return 0, io.EOF
+			}
+			//rotations flush the file before replacing it, what's left of it is read first
+			t.rotated = true
+			continue
+		}
+		files, err := t.bus.follow(t.live)
+		if err != nil {
+			return 0, err
+		}
+		_ = t.live.Close()
+		t.pending, t.live, t.rotated = files[:len(files)-1], files[len(files)-1], false
+		t.next()
+	}
+}
+
+func (t *aofTail) Close() error {
+	var err error
+	for _, f := range append(t.pending, t.live) {
+		if f == nil {
+			continue
+		}
+		if closeErr := f.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	if t.file != nil && t.file != t.live {
+		_ = t.file.Close()
+	}
+	return err
+}
+
+// follow opens the files following a rotated one: the archives of the rotations since then and the live file
+func (b *AOFBus) follow(rotated *os.File) ([]*os.File, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	info, err := rotated.Stat()
+	if err != nil {
+		return nil, err
+	}
+	archives, err := aofArchives(b.path)
+	if err != nil {
+		return nil, err
+	}
+	var files []*os.File
+	closeAll := func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}
+	found := false
+	for _, archive := range archives {
+		if !found {
+			archived, err := os.Stat(archive)
+			found = err == nil && os.SameFile(archived, info)
+			continue
+		}
+		f, err := os.Open(archive)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	live, err := os.Open(b.path)
+	if err != nil {
+		closeAll()
+		return nil, err
+	}
+	return append(files, live), nil
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"github.com/joway/pidis/util"
 	"github.com/stretchr/testify/suite"
+	"io/ioutil"
 	"os"
 	"path"
 	"testing"
@@ -31,22 +32,33 @@ func (suite *AOFTestSuite) SetupTest() {
 func (suite *AOFTestSuite) TestDecode() {
 	text := []byte("*4\r\n$12\r\n000000000000\r\n$3\r\nset\r\n$1\r\nk\r\n$1\r\nv\r\n" +
 		"*3\r\n$12\r\n000000000000\r\n$3\r\nget\r\n$1\r\nk\r\n")
-	uid, args, leftover, err := DecodeAOF(text)
+	uid, index, args, leftover, err := DecodeAOF(text)
 	suite.NoError(err)
 	suite.Equal("000000000000", string(uid))
+	suite.Equal(0, index)
 	suite.Equal("*3\r\n$12\r\n000000000000\r\n$3\r\nget\r\n$1\r\nk\r\n", string(leftover))
 	suite.Equal("set k v", string(bytes.Join(args, []byte(" "))))
+
+	//records carry the database index since databases exist
+	uid, index, args, _, err = DecodeAOF(EncodeAOF([]byte("000000000000"), 3, util.CommandToArgs("del k")))
+	suite.NoError(err)
+	suite.Equal("000000000000", string(uid))
+	suite.Equal(3, index)
+	suite.Equal("del k", string(bytes.Join(args, []byte(" "))))
 }
 
 func (suite *AOFTestSuite) TestEncode() {
 	uid := NewUID().Bytes()
 	args := [][]byte{[]byte("set"), []byte("k"), []byte("v")}
-	encoded := EncodeAOF(uid, args)
-	suite.Equal(fmt.Sprintf("*4\r\n$12\r\n%s\r\n$3\r\nset\r\n$1\r\nk\r\n$1\r\nv\r\n", uid), string(encoded))
+	encoded := EncodeAOF(uid, 1, args)
+	suite.Equal(
+		fmt.Sprintf("*5\r\n$12\r\n%s\r\n$1\r\n1\r\n$3\r\nset\r\n$1\r\nk\r\n$1\r\nv\r\n", uid),
+		string(encoded),
+	)
 }
 
 func (suite *AOFTestSuite) TestSync() {
-	bus, err := NewAOFBus(path.Join(suite.dir, "test.aof"), UIDSize)
+	bus, err := NewAOFBus(path.Join(suite.dir, "test.aof"), UIDSize, nil)
 	suite.NoError(err)
 	var offset []byte
 	for i := 0; i < 100; i++ {
@@ -54,14 +66,15 @@ func (suite *AOFTestSuite) TestSync() {
 			offset = NewUID().Bytes()
 		}
 		args := util.CommandToArgs(fmt.Sprintf("set k%d xxx", i))
-		err := bus.Append(args)
+		err := bus.Append(0, args)
 		suite.NoError(err)
 	}
 
 	suite.NoError(bus.Flush())
 
 	stream := util.NewStreamBus(1024)
-	ctx, _ := context.WithTimeout(context.Background(), time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
 	go func() {
 		select {
 		case <-ctx.Done():
@@ -81,7 +94,7 @@ func (suite *AOFTestSuite) TestSync() {
 			return
 		case content := <-stream.Read():
 			for {
-				ts, args, leftover, err := DecodeAOF(content)
+				ts, _, args, leftover, err := DecodeAOF(content)
 				suite.NoError(err)
 				if ts == nil && args == nil {
 					break
@@ -94,3 +107,91 @@ func (suite *AOFTestSuite) TestSync() {
 		}
 	}
 }
+
+func (suite *AOFTestSuite) TestAppendMulti() {
+	bus, err := NewAOFBus(path.Join(suite.dir, "multi.aof"), UIDSize, nil)
+	suite.NoError(err)
+	err = bus.AppendMulti([]AOFEntry{
+		{DB: 0, Args: util.CommandToArgs("set k1 v")},
+		{DB: 2, Args: util.CommandToArgs("del k2")},
+	})
+	suite.NoError(err)
+	suite.NoError(bus.Flush())
+
+	content, err := ioutil.ReadFile(path.Join(suite.dir, "multi.aof"))
+	suite.NoError(err)
+	var cmds []string
+	var indexes []int
+	for len(content) > 0 {
+		_, index, args, leftover, err := DecodeAOF(content)
+		suite.NoError(err)
+		cmds = append(cmds, string(bytes.Join(args, []byte(" "))))
+		indexes = append(indexes, index)
+		content = leftover
+	}
+	suite.Equal([]string{"MULTI", "set k1 v", "del k2", "EXEC"}, cmds)
+	suite.Equal([]int{0, 0, 2, 2}, indexes)
+}
+
+func (suite *AOFTestSuite) TestRotate() {
+	file := path.Join(suite.dir, "rotate.aof")
+	bus, err := NewAOFBus(file, UIDSize, nil)
+	suite.NoError(err)
+	suite.NoError(bus.Append(0, util.CommandToArgs("set k0 v")))
+
+	stream := util.NewStreamBus(1024)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	synced := make(chan error, 1)
+	go func() {
+		synced <- bus.Sync(ctx, stream, UIDFromTime(time.Unix(0, 0)).Bytes())
+	}()
+
+	//the tail follows the file across rotations, archived entries are streamed once
+	for i := 1; i < 6; i++ {
+		if i%2 == 0 {
+			_, err := bus.Rotate()
+			suite.NoError(err)
+		}
+		suite.NoError(bus.Append(0, util.CommandToArgs(fmt.Sprintf("set k%d v", i))))
+		suite.NoError(bus.Flush())
+	}
+	var keys []string
+	for len(keys) < 6 {
+		select {
+		case <-ctx.Done():
+			suite.FailNow("aof not streamed", "%v", keys)
+		case content := <-stream.Read():
+			for len(content) > 0 {
+				_, _, args, leftover, err := DecodeAOF(content)
+				suite.Require().NoError(err)
+				keys = append(keys, string(args[1]))
+				content = leftover
+			}
+		}
+	}
+	suite.Equal([]string{"k0", "k1", "k2", "k3", "k4", "k5"}, keys)
+	cancel()
+	suite.NoError(<-synced)
+
+	archives, err := bus.Archives()
+	suite.NoError(err)
+	suite.Len(archives, 2)
+	//a sync from the rotation only reads the newer archives
+	uid, err := aofArchiveUID(archives[0])
+	suite.NoError(err)
+	tail, err := bus.tail(uid.Bytes())
+	suite.NoError(err)
+	suite.Equal(archives[1], tail.file.Name())
+	suite.Empty(tail.pending)
+	suite.NoError(tail.Close())
+
+	//the archive linked by an interrupted rotation is dropped
+	suite.NoError(bus.Close())
+	suite.NoError(os.Link(file, path.Join(suite.dir, "rotate-"+NewUID().String()+".aof")))
+	bus, err = NewAOFBus(file, UIDSize, nil)
+	suite.NoError(err)
+	defer func() { _ = bus.Close() }()
+	archives, err = bus.Archives()
+	suite.NoError(err)
+	suite.Len(archives, 2)
+}
@@ -0,0 +1,551 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/joway/pidis/executor"
+	"github.com/joway/pidis/storage"
+	"github.com/joway/pidis/types"
+	"github.com/joway/pidis/util"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	manifestExt  = ".manifest"
+	keysExt      = ".keys"
+	functionsExt = ".functions"
+)
+
+const DefaultBackupRetention = 7
+
+// BackupManifest describes a backup, its snapshot and files are named after its id
+type BackupManifest struct {
+	//ID is the uid watermark of the aof, the snapshot holds every entry recorded before it and none after
+	ID string `json:"id"`
+	//Time is when the watermark was taken, uids of different processes aren't ordered within a second
+	Time time.Time `json:"time"`
+	//Base is the backup an incremental one is loaded over
+	Base string `json:"base,omitempty"`
+	//Since and Version bound the storage versions of the writes held by the snapshot,
+	//Version is the one of the storage at the watermark
+	Since   uint64 `json:"since"`
+	Version uint64 `json:"version"`
+	Size    int64  `json:"size"`
+	//Functions backups hold the dump of the function libraries along their snapshot
+	Functions bool `json:"functions,omitempty"`
+	//Encrypted snapshots are sealed with the keyring saved along
+	Encrypted bool `json:"encrypted"`
+}
+
+type BackupOptions struct {
+	//Incremental backups only hold the writes made since the last backup, when the storage supports it
+	Incremental bool
+	//Retention is the number of full backups kept along with their incremental ones, 0 keeps all of them
+	Retention int
+	//RetentionAge removes the backups whose chain hasn't grown since, 0 keeps them
+	RetentionAge time.Duration
+}
+
+// Backups tracks the backups of a database
+type Backups struct {
+	inProgress int32
+
+	lock         sync.Mutex
+	lastSave     time.Time
+	lastErr      error
+	lastDuration time.Duration
+	last         *BackupManifest
+	//oldest is cached until backups are saved or removed, generation tells loads started before
+	oldest     *oldestBackup
+	generation int
+}
+
+// oldestBackup is the watermark of the oldest backup of a target
+type oldestBackup struct {
+	target    string
+	watermark UID
+	ok        bool
+}
+
+type BackupState struct {
+	InProgress   bool
+	LastSave     time.Time
+	LastErr      error
+	LastDuration time.Duration
+	Last         *BackupManifest
+}
+
+// NewBackups starts with the last save at startup, like redis does once it has loaded its data
+func NewBackups() *Backups {
+	return &Backups{lastSave: time.Now(), lastDuration: -1}
+}
+
+func (b *Backups) begin() bool {
+	return atomic.CompareAndSwapInt32(&b.inProgress, 0, 1)
+}
+
+func (b *Backups) end(manifest BackupManifest, err error, duration time.Duration) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.lastErr = err
+	b.lastDuration = duration
+	if err == nil {
+		b.lastSave = time.Now()
+		b.last = &manifest
+	}
+	atomic.StoreInt32(&b.inProgress, 0)
+}
+
+// oldestWatermark returns the watermark of the oldest backup of target, the manifests are only listed
+// the first time and after backups ran
+func (b *Backups) oldestWatermark(target BackupTarget) (UID, bool, error) {
+	b.lock.Lock()
+	cached, generation := b.oldest, b.generation
+	b.lock.Unlock()
+	if cached != nil && cached.target == target.String() {
+		return cached.watermark, cached.ok, nil
+	}
+	manifests, err := LoadBackupManifests(target)
+	if err != nil {
+		return UID{}, false, err
+	}
+	oldest := &oldestBackup{target: target.String()}
+	for _, manifest := range manifests {
+		uid, err := UIDFromString(manifest.ID)
+		if err != nil {
+			return UID{}, false, err
+		}
+		if !oldest.ok || bytes.Compare(uid.Bytes(), oldest.watermark.Bytes()) < 0 {
+			oldest.watermark, oldest.ok = uid, true
+		}
+	}
+	b.lock.Lock()
+	if b.generation == generation {
+		b.oldest = oldest
+	}
+	b.lock.Unlock()
+	return oldest.watermark, oldest.ok, nil
+}
+
+// forgetOldest drops the cached oldest backup once backups may have been saved or removed
+func (b *Backups) forgetOldest() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.oldest = nil
+	b.generation++
+}
+
+func (b *Backups) State() BackupState {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return BackupState{
+		InProgress:   atomic.LoadInt32(&b.inProgress) == 1,
+		LastSave:     b.lastSave,
+		LastErr:      b.lastErr,
+		LastDuration: b.lastDuration,
+		Last:         b.last,
+	}
+}
+
+// Backup writes a consistent backup of the database to target, then removes the backups out of retention
+func (db *Database) Backup(ctx context.Context, target BackupTarget, options BackupOptions) (BackupManifest, error) {
+	if !db.backups.begin() {
+		return BackupManifest{}, types.ErrBackupInProgress
+	}
+	return db.runBackup(ctx, target, options)
+}
+
+// BackgroundSave runs a backup to the target of the config in the background
+func (db *Database) BackgroundSave(incremental bool) error {
+	target, err := db.BackupTarget()
+	if err != nil {
+		return types.ReplyError("ERR " + err.Error())
+	}
+	if !db.backups.begin() {
+		return types.ErrBackupInProgress
+	}
+	options := db.BackupOptions()
+	options.Incremental = incremental
+	go func() {
+		if _, err := db.runBackup(context.Background(), target, options); err != nil {
+			logger.Error("background saving failed: %v", err)
+		}
+	}()
+	return nil
+}
+
+func (db *Database) LastSave() time.Time {
+	return db.backups.State().LastSave
+}
+
+// BackupTarget returns the object store of the config if any, the backup dir otherwise
+func (db *Database) BackupTarget() (BackupTarget, error) {
+	if endpoint := db.config.Get("backup-s3-endpoint"); endpoint != "" {
+		return NewS3Target(S3Options{
+			Endpoint:  endpoint,
+			Region:    db.config.Get("backup-s3-region"),
+			Bucket:    db.config.Get("backup-s3-bucket"),
+			Prefix:    db.config.Get("backup-s3-prefix"),
+			AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		})
+	}
+	dir := db.config.Get("backup-dir")
+	if dir == "" {
+		dir = path.Join(db.dir, "backups")
+	}
+	return NewDirTarget(dir)
+}
+
+// BackupOptions returns the retention of the config
+func (db *Database) BackupOptions() BackupOptions {
+	retention, _ := strconv.Atoi(db.config.Get("backup-retention"))
+	age, _ := strconv.Atoi(db.config.Get("backup-retention-age"))
+	return BackupOptions{Retention: retention, RetentionAge: time.Duration(age) * time.Second}
+}
+
+func (db *Database) runBackup(ctx context.Context, target BackupTarget, options BackupOptions) (BackupManifest, error) {
+	start := time.Now()
+	defer db.backups.forgetOldest()
+	manifest, err := db.backup(ctx, target, options.Incremental)
+	db.backups.end(manifest, err, time.Since(start))
+	if err != nil {
+		return manifest, err
+	}
+	logger.Info("backup %s saved to %s in %v", manifest.ID, target, time.Since(start))
+	removed, err := ApplyBackupRetention(target, options, time.Now())
+	if err != nil {
+		logger.Error("failed to apply backup retention: %v", err)
+	}
+	if len(removed) > 0 {
+		logger.Info("backups out of retention removed: %s", strings.Join(removed, ", "))
+	}
+	return manifest, nil
+}
+
+// pinnedSnapshot is the state of the database at a watermark of the aof, its storage is held
+// at the version holding every entry recorded before the watermark and none recorded after
+type pinnedSnapshot struct {
+	watermark UID
+	time      time.Time
+	functions []byte
+	//version is 0 for storages without versions, which are snapshotted into spool instead
+	version  uint64
+	backuper storage.Backuper
+	spool    *os.File
+	release  func()
+}
+
+// pinSnapshot takes a watermark of the aof, commands are applied under the read lock they are recorded with
+// so none is applied while it's taken. The snapshot has to be released once written
+func (db *Database) pinSnapshot() (*pinnedSnapshot, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	mark, _ := db.aofBus.Mark()
+	watermark, err := UIDFromBytes(mark)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &pinnedSnapshot{
+		watermark: watermark,
+		time:      time.Now(),
+		functions: db.functions.Dump(),
+	}
+	if backuper, ok := db.storage.(storage.Backuper); ok {
+		snapshot.backuper = backuper
+		snapshot.version, snapshot.release = backuper.Pin()
+		return snapshot, nil
+	}
+	//storages without versions are snapshotted aside, so that the lock isn't held while it's sent
+	spool, err := ioutil.TempFile(db.dir, "snapshot-*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	snapshot.spool = spool
+	snapshot.release = func() {
+		_ = spool.Close()
+		_ = os.Remove(spool.Name())
+	}
+	buffered := bufio.NewWriterSize(spool, aofSegmentSize)
+	err = db.storage.Snapshot(context.Background(), buffered)
+	if err == nil {
+		err = buffered.Flush()
+	}
+	if err != nil {
+		snapshot.release()
+		return nil, errors.Wrap(err, "snapshot storage failed")
+	}
+	return snapshot, nil
+}
+
+// write writes the storage at the watermark, only the writes made after since when the storage has versions
+func (s *pinnedSnapshot) write(ctx context.Context, writer io.Writer, since uint64) error {
+	if s.backuper != nil {
+		return s.backuper.Backup(ctx, writer, since, s.version)
+	}
+	if _, err := s.spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := io.Copy(writer, s.spool)
+	return err
+}
+
+// backup writes the snapshot, the keyring and then the manifest, so a listed manifest is a complete backup
+func (db *Database) backup(ctx context.Context, target BackupTarget, incremental bool) (BackupManifest, error) {
+	manifests, err := LoadBackupManifests(target)
+	if err != nil {
+		return BackupManifest{}, errors.Wrap(err, "list backups failed")
+	}
+	pinned, err := db.pinSnapshot()
+	if err != nil {
+		return BackupManifest{}, err
+	}
+	manifest := BackupManifest{
+		ID:        pinned.watermark.String(),
+		Time:      pinned.time,
+		Version:   pinned.version,
+		Functions: true,
+		Encrypted: db.keyring.Enabled(),
+	}
+	if incremental && pinned.backuper != nil && len(manifests) > 0 {
+		base := manifests[len(manifests)-1]
+		manifest.Base = base.ID
+		manifest.Since = base.Version
+	}
+
+	reader, writer := io.Pipe()
+	go func() {
+		defer pinned.release()
+		buffered := bufio.NewWriterSize(db.keyring.SealWriter(writer), aofSegmentSize)
+		err := pinned.write(ctx, buffered, manifest.Since)
+		if err == nil {
+			err = buffered.Flush()
+		}
+		_ = writer.CloseWithError(err)
+	}()
+	snapshot := &countingReader{r: reader}
+	err = target.Put(manifest.ID+snapshotExt, snapshot)
+	_ = reader.CloseWithError(err)
+	if err != nil {
+		return manifest, errors.Wrap(err, "save snapshot failed")
+	}
+	manifest.Size = snapshot.n
+
+	if manifest.Encrypted {
+		keys, err := os.Open(path.Join(db.dir, "pidis.keys"))
+		if err != nil {
+			return manifest, err
+		}
+		err = target.Put(manifest.ID+keysExt, keys)
+		_ = keys.Close()
+		if err != nil {
+			return manifest, errors.Wrap(err, "save keyring failed")
+		}
+	}
+	functions, err := db.sealFunctions(pinned.functions)
+	if err != nil {
+		return manifest, err
+	}
+	if err := target.Put(manifest.ID+functionsExt, bytes.NewReader(functions)); err != nil {
+		return manifest, errors.Wrap(err, "save functions failed")
+	}
+	content, err := json.Marshal(manifest)
+	if err != nil {
+		return manifest, err
+	}
+	if err := target.Put(manifest.ID+manifestExt, strings.NewReader(string(content))); err != nil {
+		return manifest, errors.Wrap(err, "save manifest failed")
+	}
+	return manifest, nil
+}
+
+// sealFunctions seals a dump of the function libraries like the snapshot it's saved along
+func (db *Database) sealFunctions(functions []byte) ([]byte, error) {
+	var sealed bytes.Buffer
+	if _, err := db.keyring.SealWriter(&sealed).Write(functions); err != nil {
+		return nil, err
+	}
+	return sealed.Bytes(), nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// LoadBackupManifests returns the manifests of the backups of target from the oldest
+func LoadBackupManifests(target BackupTarget) ([]BackupManifest, error) {
+	names, err := target.List()
+	if err != nil {
+		return nil, err
+	}
+	var manifests []BackupManifest
+	for _, name := range names {
+		if !strings.HasSuffix(name, manifestExt) {
+			continue
+		}
+		reader, err := target.Get(name)
+		if err != nil {
+			return nil, err
+		}
+		var manifest BackupManifest
+		err = json.NewDecoder(reader).Decode(&manifest)
+		_ = reader.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid manifest %s", name)
+		}
+		manifests = append(manifests, manifest)
+	}
+	sort.SliceStable(manifests, func(i, j int) bool {
+		return manifests[i].Time.Before(manifests[j].Time)
+	})
+	return manifests, nil
+}
+
+// BackupChain returns the backups to load in order to restore the backup id, from its full backup
+func BackupChain(manifests []BackupManifest, id string) ([]BackupManifest, error) {
+	byID := make(map[string]BackupManifest, len(manifests))
+	for _, manifest := range manifests {
+		byID[manifest.ID] = manifest
+	}
+	var chain []BackupManifest
+	for id != "" {
+		manifest, ok := byID[id]
+		if !ok {
+			return nil, errors.Errorf("backup %s is missing", id)
+		}
+		chain = append([]BackupManifest{manifest}, chain...)
+		id = manifest.Base
+	}
+	return chain, nil
+}
+
+// ApplyBackupRetention removes the full backups out of retention along with their incremental ones,
+// the newest full backup is always kept
+func ApplyBackupRetention(target BackupTarget, options BackupOptions, now time.Time) ([]string, error) {
+	manifests, err := LoadBackupManifests(target)
+	if err != nil {
+		return nil, err
+	}
+	//chains are listed from the oldest full backup, each one with its newest backup time
+	var roots []string
+	chains := make(map[string][]BackupManifest)
+	rootOf := make(map[string]string)
+	for _, manifest := range manifests {
+		root := manifest.ID
+		if manifest.Base != "" {
+			if root = rootOf[manifest.Base]; root == "" {
+				//the base has been removed, the backup can't be restored anymore
+				root = manifest.ID
+			}
+		}
+		if _, ok := chains[root]; !ok {
+			roots = append(roots, root)
+		}
+		rootOf[manifest.ID] = root
+		chains[root] = append(chains[root], manifest)
+	}
+
+	var removed []string
+	for i, root := range roots {
+		if i == len(roots)-1 {
+			break
+		}
+		chain := chains[root]
+		expired := options.RetentionAge > 0 && now.Sub(chain[len(chain)-1].Time) > options.RetentionAge
+		exceeded := options.Retention > 0 && len(roots)-i > options.Retention
+		if !expired && !exceeded {
+			continue
+		}
+		for _, manifest := range chain {
+			if err := removeBackup(target, manifest); err != nil {
+				return removed, err
+			}
+			removed = append(removed, manifest.ID)
+		}
+	}
+	return removed, nil
+}
+
+// removeBackup removes the manifest first, so a partly removed backup isn't listed anymore
+func removeBackup(target BackupTarget, manifest BackupManifest) error {
+	files := []string{manifest.ID + manifestExt, manifest.ID + snapshotExt}
+	if manifest.Encrypted {
+		files = append(files, manifest.ID+keysExt)
+	}
+	if manifest.Functions {
+		files = append(files, manifest.ID+functionsExt)
+	}
+	for _, file := range files {
+		if err := target.Delete(file); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func execBackup(database *Database, client *Client, name string, args [][]byte) ([]byte, bool, error) {
+	switch name {
+	case executor.BGSAVE:
+		incremental := false
+		if len(args) == 2 {
+			switch strings.ToUpper(string(args[1])) {
+			case "INCREMENTAL":
+				incremental = true
+			case "SCHEDULE":
+			default:
+				return nil, true, types.ErrSyntaxError
+			}
+		}
+		if err := database.BackgroundSave(incremental); err != nil {
+			return nil, true, err
+		}
+		return util.MessageString("Background saving started"), true, nil
+	case executor.LASTSAVE:
+		return util.MessageInt(database.LastSave().Unix()), true, nil
+	}
+	return nil, false, nil
+}
+
+func (db *Database) infoBackup(w *infoWriter) {
+	state := db.backups.State()
+	inProgress := 0
+	if state.InProgress {
+		inProgress = 1
+	}
+	w.field("rdb_bgsave_in_progress", inProgress)
+	w.field("rdb_last_save_time", state.LastSave.Unix())
+	status := "ok"
+	if state.LastErr != nil {
+		status = "err"
+	}
+	w.field("rdb_last_bgsave_status", status)
+	var duration int64 = -1
+	if state.LastDuration >= 0 {
+		duration = int64(state.LastDuration / time.Second)
+	}
+	w.field("rdb_last_bgsave_time_sec", duration)
+	if state.Last != nil {
+		w.field("backup_last_id", state.Last.ID)
+		w.field("backup_last_incremental", boolInt(state.Last.Base != ""))
+		w.field("backup_last_size", state.Last.Size)
+	}
+}
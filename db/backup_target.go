@@ -0,0 +1,328 @@
+package db
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// BackupTarget stores the files of backups
+type BackupTarget interface {
+	Put(name string, reader io.Reader) error
+	Get(name string) (io.ReadCloser, error)
+	//List returns the names of the stored files
+	List() ([]string, error)
+	Delete(name string) error
+	String() string
+}
+
+// DirTarget stores backups in a local directory
+type DirTarget struct {
+	dir string
+}
+
+func NewDirTarget(dir string) (*DirTarget, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	return &DirTarget{dir: dir}, nil
+}
+
+// Put writes a temporary file renamed once complete, so a listed file is never partial
+func (t *DirTarget) Put(name string, reader io.Reader) error {
+	tmp := path.Join(t.dir, name+".tmp")
+	file, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, reader)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path.Join(t.dir, name))
+}
+
+func (t *DirTarget) Get(name string) (io.ReadCloser, error) {
+	return os.Open(path.Join(t.dir, name))
+}
+
+func (t *DirTarget) List() ([]string, error) {
+	entries, err := ioutil.ReadDir(t.dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() && !strings.HasSuffix(entry.Name(), ".tmp") {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+func (t *DirTarget) Delete(name string) error {
+	return os.Remove(path.Join(t.dir, name))
+}
+
+func (t *DirTarget) String() string {
+	return t.dir
+}
+
+// S3Options locate a bucket of a S3 compatible object store, objects are addressed path-style
+type S3Options struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+}
+
+// S3Target stores backups in a S3 compatible object store, requests are signed with AWS signature v4
+type S3Target struct {
+	options S3Options
+	client  *http.Client
+}
+
+const (
+	s3Service = "s3"
+	//s3ResponseTimeout bounds the wait for the response of a request once sent, uploads take as long as they need
+	s3ResponseTimeout = 30 * time.Second
+)
+
+func NewS3Target(options S3Options) (*S3Target, error) {
+	if options.Endpoint == "" || options.Bucket == "" {
+		return nil, errors.New("a s3 endpoint and bucket are required")
+	}
+	if _, err := url.Parse(options.Endpoint); err != nil {
+		return nil, errors.Wrap(err, "invalid s3 endpoint")
+	}
+	if options.Region == "" {
+		options.Region = "us-east-1"
+	}
+	options.Endpoint = strings.TrimSuffix(options.Endpoint, "/")
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = s3ResponseTimeout
+	return &S3Target{options: options, client: &http.Client{Transport: transport}}, nil
+}
+
+// Put spools the content into a temporary file, objects are uploaded with their length and checksum
+func (t *S3Target) Put(name string, reader io.Reader) error {
+	tmp, err := ioutil.TempFile("", "pidis-s3-")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+	}()
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), reader)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPut, t.url(t.options.Prefix+name, nil), tmp)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	resp, err := t.do(req, hex.EncodeToString(hash.Sum(nil)))
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (t *S3Target) Get(name string) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, t.url(t.options.Prefix+name, nil), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.do(req, emptySHA256)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (t *S3Target) List() ([]string, error) {
+	var names []string
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {t.options.Prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		req, err := http.NewRequest(http.MethodGet, t.url("", query), nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := t.do(req, emptySHA256)
+		if err != nil {
+			return nil, err
+		}
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		_ = resp.Body.Close()
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid s3 list response")
+		}
+		for _, object := range result.Contents {
+			name := strings.TrimPrefix(object.Key, t.options.Prefix)
+			//objects of sub prefixes aren't backups
+			if name != "" && !strings.Contains(name, "/") {
+				names = append(names, name)
+			}
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return names, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (t *S3Target) Delete(name string) error {
+	req, err := http.NewRequest(http.MethodDelete, t.url(t.options.Prefix+name, nil), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := t.do(req, emptySHA256)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (t *S3Target) String() string {
+	return fmt.Sprintf("s3://%s/%s", t.options.Bucket, t.options.Prefix)
+}
+
+func (t *S3Target) url(key string, query url.Values) string {
+	u := t.options.Endpoint + "/" + awsEscape(t.options.Bucket, false)
+	if key != "" {
+		u += "/" + awsEscape(key, false)
+	}
+	if len(query) > 0 {
+		u += "?" + canonicalQuery(query)
+	}
+	return u
+}
+
+// do signs and sends a request, responses other than 2xx are returned as errors
+func (t *S3Target) do(req *http.Request, payloadHash string) (*http.Response, error) {
+	t.sign(req, payloadHash, time.Now().UTC())
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		_ = resp.Body.Close()
+		return nil, errors.Errorf("s3 %s %s: %s %s", req.Method, req.URL.Path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+var emptySHA256 = hex.EncodeToString(sha256.New().Sum(nil))
+
+// sign adds the authorization of AWS signature v4 to a request
+func (t *S3Target) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		"host:" + req.URL.Host + "\n" +
+			"x-amz-content-sha256:" + payloadHash + "\n" +
+			"x-amz-date:" + amzDate + "\n",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := strings.Join([]string{date, t.options.Region, s3Service, "aws4_request"}, "/")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	key := []byte("AWS4" + t.options.SecretKey)
+	for _, part := range []string{date, t.options.Region, s3Service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		t.options.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, key := range keys {
+		for _, value := range query[key] {
+			pairs = append(pairs, awsEscape(key, true)+"="+awsEscape(value, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// awsEscape percent-encodes every byte but the unreserved characters, and slashes of paths
+func awsEscape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,590 @@
+package db
+
+import (
+	"fmt"
+	"github.com/joway/pidis"
+	"github.com/joway/pidis/executor"
+	"github.com/joway/pidis/types"
+	"github.com/joway/pidis/util"
+	"github.com/tidwall/redcon"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var lastClientID int64
+
+type Client struct {
+	id    int64
+	conn  redcon.Conn
+	proto int32
+
+	//introspection, guarded by lock since CLIENT LIST reads it from other connections
+	lock            sync.Mutex
+	name            string
+	createdAt       time.Time
+	lastInteraction time.Time
+	lastCmd         string
+	dbIndex         int
+	noEvict         bool
+	state           clientState
+
+	//CLIENT REPLY, skipping mutes the command following CLIENT REPLY SKIP
+	replyOff bool
+	skipNext bool
+	skipping bool
+
+	//acl
+	user          string
+	authenticated bool
+
+	//transaction
+	multi    bool
+	multiErr bool
+	queue    [][][]byte
+	watching []string
+	dirty    bool
+
+	//pubsub
+	push     *Outbox
+	detached redcon.DetachedConn
+	channels map[string]struct{}
+	patterns map[string]struct{}
+	shards   map[string]struct{}
+
+	//tracking
+	tracking trackingOptions
+	caching  int
+
+	monitor bool
+}
+
+// clientState is the part of the state of a client read by other connections, the fields
+// below are only touched by the goroutine serving the client, which publishes them after every command
+type clientState struct {
+	conn     redcon.Conn
+	push     *Outbox
+	user     string
+	multi    int
+	watch    int
+	sub      int
+	psub     int
+	ssub     int
+	tracking bool
+	bcast    bool
+	redirect int64
+	monitor  bool
+}
+
+func NewClient(conn redcon.Conn) *Client {
+	now := time.Now()
+	return &Client{
+		id:    atomic.AddInt64(&lastClientID, 1),
+		conn:  conn,
+		proto: int32(util.RESP2),
+
+		createdAt:       now,
+		lastInteraction: now,
+		state:           clientState{conn: conn, multi: -1},
+
+		channels: make(map[string]struct{}),
+		patterns: make(map[string]struct{}),
+		shards:   make(map[string]struct{}),
+	}
+}
+
+func (c *Client) ID() int64 {
+	return c.id
+}
+
+func (c *Client) Proto() int {
+	return int(atomic.LoadInt32(&c.proto))
+}
+
+func (c *Client) Addr() string {
+	return c.snapshot().conn.RemoteAddr()
+}
+
+func (c *Client) Name() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.name
+}
+
+func (c *Client) SetName(name string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.name = name
+}
+
+// DB returns the database selected by the client
+func (c *Client) DB() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.dbIndex
+}
+
+func (c *Client) SetDB(index int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.dbIndex = index
+}
+
+// touch records the command being processed
+func (c *Client) touch(cmd string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.lastInteraction = time.Now()
+	if knownCommand(cmd) {
+		c.lastCmd = strings.ToLower(cmd)
+	}
+}
+
+// publish shares the state of the client with other connections,
+// it must be called by the goroutine serving the client
+func (c *Client) publish() {
+	state := clientState{
+		conn:     c.conn,
+		push:     c.push,
+		user:     c.user,
+		multi:    -1,
+		watch:    len(c.watching),
+		sub:      len(c.channels),
+		psub:     len(c.patterns),
+		ssub:     len(c.shards),
+		tracking: c.tracking.on,
+		bcast:    c.tracking.bcast,
+		redirect: c.tracking.redirect,
+		monitor:  c.monitor,
+	}
+	if c.multi {
+		state.multi = len(c.queue)
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.state = state
+}
+
+// snapshot returns the state last published by the client
+func (c *Client) snapshot() clientState {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.state
+}
+
+// Info describes the client the way CLIENT LIST does
+func (c *Client) Info() string {
+	c.lock.Lock()
+	name, createdAt, lastInteraction, lastCmd := c.name, c.createdAt, c.lastInteraction, c.lastCmd
+	dbIndex, noEvict, state := c.dbIndex, c.noEvict, c.state
+	c.lock.Unlock()
+
+	omem := 0
+	if state.push != nil {
+		omem = state.push.Size()
+	}
+	redir := int64(-1)
+	if state.tracking {
+		redir = state.redirect
+	}
+	now := time.Now()
+	return fmt.Sprintf(
+		"id=%d addr=%s name=%s age=%d idle=%d flags=%s db=%d sub=%d psub=%d ssub=%d multi=%d watch=%d "+
+			"omem=%d cmd=%s user=%s redir=%d resp=%d",
+		c.id, state.conn.RemoteAddr(), name, int64(now.Sub(createdAt)/time.Second), int64(now.Sub(lastInteraction)/time.Second),
+		state.flags(noEvict), dbIndex, state.sub, state.psub, state.ssub, state.multi, state.watch,
+		omem, lastCmd, state.user, redir, c.Proto(),
+	)
+}
+
+func (s clientState) flags(noEvict bool) string {
+	var flags []byte
+	if s.monitor {
+		flags = append(flags, 'O')
+	}
+	if s.sub+s.psub+s.ssub > 0 {
+		flags = append(flags, 'P')
+	}
+	if s.multi >= 0 {
+		flags = append(flags, 'x')
+	}
+	if s.tracking {
+		flags = append(flags, 't')
+		if s.bcast {
+			flags = append(flags, 'B')
+		}
+	}
+	if noEvict {
+		flags = append(flags, 'e')
+	}
+	if len(flags) == 0 {
+		return "N"
+	}
+	return string(flags)
+}
+
+// Reply writes the reply of a command, RESP2 nulls are upgraded for RESP3 clients
+func (c *Client) Reply(output []byte) {
+	if c.replyOff || c.skipping {
+		return
+	}
+	if c.Proto() == util.RESP3 {
+		output = util.UpgradeRESP3(output)
+	}
+	c.conn.WriteRaw(output)
+}
+
+func (c *Client) Push(msg []byte) {
+	if c.push != nil {
+		c.push.Write(msg)
+	}
+}
+
+func (c *Client) Subscriptions() int {
+	return len(c.channels) + len(c.patterns)
+}
+
+func (c *Client) Channels() []string {
+	return sortedKeys(c.channels)
+}
+
+func (c *Client) Patterns() []string {
+	return sortedKeys(c.patterns)
+}
+
+func (c *Client) ShardChannels() []string {
+	return sortedKeys(c.shards)
+}
+
+func (db *Database) clientOf(conn redcon.Conn) *Client {
+	if c, ok := conn.Context().(*Client); ok {
+		return c
+	}
+	c := NewClient(conn)
+	conn.SetContext(c)
+	db.register(c)
+	return c
+}
+
+func (db *Database) register(c *Client) {
+	c.user = DefaultUser
+	if u := db.acl.Get(DefaultUser); u != nil && u.enabled && u.nopass {
+		c.authenticated = true
+	}
+	c.publish()
+
+	db.stats.incr(&db.stats.Connections)
+	db.clientsLock.Lock()
+	defer db.clientsLock.Unlock()
+	db.clients[c.id] = c
+}
+
+func (db *Database) clientByID(id int64) *Client {
+	db.clientsLock.RLock()
+	defer db.clientsLock.RUnlock()
+	return db.clients[id]
+}
+
+func (db *Database) closeClient(c *Client) {
+	db.clientsLock.Lock()
+	delete(db.clients, c.id)
+	db.clientsLock.Unlock()
+
+	db.unwatch(c)
+	db.pubsub.UnsubscribeAll(c)
+	db.tracking.Disable(c)
+	db.monitors.Remove(c)
+	if c.push != nil {
+		c.push.Close()
+	}
+}
+
+func sortedKeys(m map[string]struct{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func execClient(database *Database, client *Client, name string, args [][]byte) ([]byte, bool, error) {
+	switch name {
+	case executor.HELLO:
+		output, err := hello(database, client, args[1:])
+		return output, true, err
+	case executor.CLIENT:
+	default:
+		return nil, false, nil
+	}
+	if len(args) < 2 {
+		return nil, true, types.ErrInvalidNumberOfArgs
+	}
+	switch strings.ToUpper(string(args[1])) {
+	case "ID":
+		return util.MessageInt(client.id), true, nil
+	case "LIST":
+		output, err := clientList(database, client, args[2:])
+		return output, true, err
+	case "INFO":
+		if len(args) != 2 {
+			return nil, true, types.ErrInvalidNumberOfArgs
+		}
+		return util.NewReply(client.Proto()).Verbatim("txt", client.Info()+"\n").Bytes(), true, nil
+	case "SETNAME":
+		if len(args) != 3 {
+			return nil, true, types.ErrInvalidNumberOfArgs
+		}
+		if err := checkClientName(string(args[2])); err != nil {
+			return nil, true, err
+		}
+		client.SetName(string(args[2]))
+		return util.MessageOK(), true, nil
+	case "GETNAME":
+		if len(args) != 2 {
+			return nil, true, types.ErrInvalidNumberOfArgs
+		}
+		name := client.Name()
+		if name == "" {
+			return util.NewReply(client.Proto()).Null().Bytes(), true, nil
+		}
+		return util.NewReply(client.Proto()).BulkString(name).Bytes(), true, nil
+	case "KILL":
+		output, err := clientKill(database, client, args[2:])
+		return output, true, err
+	case "PAUSE":
+		output, err := clientPause(database, args[2:])
+		return output, true, err
+	case "UNPAUSE":
+		if len(args) != 2 {
+			return nil, true, types.ErrInvalidNumberOfArgs
+		}
+		database.pause.Unpause()
+		return util.MessageOK(), true, nil
+	case "NO-EVICT":
+		if len(args) != 3 {
+			return nil, true, types.ErrInvalidNumberOfArgs
+		}
+		on, err := parseOnOff(args[2])
+		if err != nil {
+			return nil, true, err
+		}
+		client.lock.Lock()
+		client.noEvict = on
+		client.lock.Unlock()
+		return util.MessageOK(), true, nil
+	case "REPLY":
+		if len(args) != 3 {
+			return nil, true, types.ErrInvalidNumberOfArgs
+		}
+		output, err := clientReply(client, args[2])
+		return output, true, err
+	case "TRACKING":
+		output, err := clientTracking(database, client, args[2:])
+		return output, true, err
+	case "CACHING":
+		if len(args) != 3 {
+			return nil, true, types.ErrInvalidNumberOfArgs
+		}
+		output, err := clientCaching(client, args[2])
+		return output, true, err
+	case "GETREDIR":
+		if !client.tracking.on {
+			return util.MessageInt(-1), true, nil
+		}
+		return util.MessageInt(client.tracking.redirect), true, nil
+	case "TRACKINGINFO":
+		return trackingInfo(client), true, nil
+	default:
+		return nil, true, types.ReplyError(fmt.Sprintf(
+			"ERR unknown subcommand '%s'. Try CLIENT HELP.",
+			args[1],
+		))
+	}
+}
+
+func clientTracking(database *Database, client *Client, args [][]byte) ([]byte, error) {
+	if len(args) == 0 {
+		return nil, types.ErrInvalidNumberOfArgs
+	}
+	switch strings.ToUpper(string(args[0])) {
+	case "ON":
+	case "OFF":
+		database.tracking.Disable(client)
+		return util.MessageOK(), nil
+	default:
+		return nil, types.ErrSyntaxError
+	}
+
+	opts := trackingOptions{on: true}
+	for i := 1; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "REDIRECT":
+			if i+1 >= len(args) {
+				return nil, types.ErrSyntaxError
+			}
+			i++
+			id, err := strconv.ParseInt(string(args[i]), 10, 64)
+			if err != nil {
+				return nil, types.ErrNotInteger
+			}
+			if id != client.id && database.clientByID(id) == nil {
+				return nil, types.ErrTrackingRedirect
+			}
+			opts.redirect = id
+		case "BCAST":
+			opts.bcast = true
+		case "PREFIX":
+			if i+1 >= len(args) {
+				return nil, types.ErrSyntaxError
+			}
+			i++
+			opts.prefixes = append(opts.prefixes, string(args[i]))
+		case "OPTIN":
+			opts.optIn = true
+		case "OPTOUT":
+			opts.optOut = true
+		default:
+			return nil, types.ErrSyntaxError
+		}
+	}
+	if len(opts.prefixes) > 0 && !opts.bcast {
+		return nil, types.ErrTrackingPrefix
+	}
+	if opts.optIn && opts.optOut {
+		return nil, types.ErrTrackingOptInOut
+	}
+	if opts.bcast && (opts.optIn || opts.optOut) {
+		return nil, types.ErrTrackingBcastOpt
+	}
+	//invalidations are pushed to RESP3 clients on their own connection,
+	//which is set up before any invalidation can be sent
+	if opts.redirect == 0 && client.Proto() == util.RESP3 {
+		database.detach(client)
+	}
+	database.tracking.Enable(client, opts)
+	return util.MessageOK(), nil
+}
+
+func trackingInfo(client *Client) []byte {
+	opts := client.tracking
+	var flags []string
+	switch {
+	case !opts.on:
+		flags = append(flags, "off")
+	case opts.bcast:
+		flags = append(flags, "on", "bcast")
+	case opts.optIn:
+		flags = append(flags, "on", "optin")
+		if client.caching == cachingYes {
+			flags = append(flags, "caching-yes")
+		}
+	case opts.optOut:
+		flags = append(flags, "on", "optout")
+		if client.caching == cachingNo {
+			flags = append(flags, "caching-no")
+		}
+	default:
+		flags = append(flags, "on")
+	}
+	redirect := opts.redirect
+	if !opts.on {
+		redirect = -1
+	}
+
+	reply := util.NewReply(client.Proto()).Map(3)
+	reply.BulkString("flags").Set(len(flags))
+	for _, flag := range flags {
+		reply.BulkString(flag)
+	}
+	reply.BulkString("redirect").Int(redirect)
+	reply.BulkString("prefixes").Array(len(opts.prefixes))
+	for _, prefix := range opts.prefixes {
+		reply.BulkString(prefix)
+	}
+	return reply.Bytes()
+}
+
+// hello switches the protocol version of client and replies the server properties
+func hello(database *Database, client *Client, args [][]byte) ([]byte, error) {
+	proto := client.Proto()
+	if len(args) > 0 {
+		v, err := strconv.Atoi(string(args[0]))
+		if err != nil {
+			return nil, types.ErrProtocolVersion
+		}
+		if v != util.RESP2 && v != util.RESP3 {
+			return nil, types.ErrNoProto
+		}
+		proto = v
+	}
+	name, hasName := "", false
+	for i := 1; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "AUTH":
+			if i+2 >= len(args) {
+				return nil, types.ErrSyntaxError
+			}
+			if err := database.auth(client, string(args[i+1]), string(args[i+2])); err != nil {
+				return nil, err
+			}
+			i += 2
+		case "SETNAME":
+			if i+1 >= len(args) {
+				return nil, types.ErrSyntaxError
+			}
+			i++
+			name, hasName = string(args[i]), true
+			if err := checkClientName(name); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, types.ErrSyntaxError
+		}
+	}
+	if !client.authenticated {
+		return nil, types.ErrHelloNoAuth
+	}
+	atomic.StoreInt32(&client.proto, int32(proto))
+	if hasName {
+		client.SetName(name)
+	}
+
+	role := "master"
+	if !database.IsWritable() {
+		role = "replica"
+	}
+	return util.NewReply(proto).Map(7).
+		BulkString("server").BulkString("pidis").
+		BulkString("version").BulkString(pidis.VERSION).
+		BulkString("proto").Int(int64(proto)).
+		BulkString("id").Int(client.id).
+		BulkString("mode").BulkString("standalone").
+		BulkString("role").BulkString(role).
+		BulkString("modules").Array(0).
+		Bytes(), nil
+}
+
+func clientCaching(client *Client, arg []byte) ([]byte, error) {
+	if !client.tracking.on || !(client.tracking.optIn || client.tracking.optOut) {
+		return nil, types.ErrTrackingCaching
+	}
+	switch strings.ToUpper(string(arg)) {
+	case "YES":
+		if !client.tracking.optIn {
+			return nil, types.ErrTrackingCaching
+		}
+		client.caching = cachingYes
+	case "NO":
+		if !client.tracking.optOut {
+			return nil, types.ErrTrackingCaching
+		}
+		client.caching = cachingNo
+	default:
+		return nil, types.ErrSyntaxError
+	}
+	return util.MessageOK(), nil
+}
@@ -0,0 +1,379 @@
+package db
+
+import (
+	"fmt"
+	"github.com/joway/pidis/executor"
+	"github.com/joway/pidis/types"
+	"github.com/joway/pidis/util"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ClientTypeNormal  = "normal"
+	ClientTypePubSub  = "pubsub"
+	ClientTypeMaster  = "master"
+	ClientTypeReplica = "replica"
+)
+
+func checkClientName(name string) error {
+	for _, c := range name {
+		if c <= ' ' || c > '~' {
+			return types.ReplyError("ERR Client names cannot contain spaces, newlines or special characters.")
+		}
+	}
+	return nil
+}
+
+func parseOnOff(arg []byte) (bool, error) {
+	switch strings.ToUpper(string(arg)) {
+	case "ON":
+		return true, nil
+	case "OFF":
+		return false, nil
+	}
+	return false, types.ErrSyntaxError
+}
+
+// Type returns the type matched by CLIENT LIST TYPE and CLIENT KILL TYPE,
+// followers replicate over rpc so redis clients are never masters or replicas
+func (c *Client) Type() string {
+	if state := c.snapshot(); state.sub+state.psub+state.ssub > 0 {
+		return ClientTypePubSub
+	}
+	return ClientTypeNormal
+}
+
+func parseClientType(arg []byte) (string, error) {
+	switch t := strings.ToLower(string(arg)); t {
+	case ClientTypeNormal, ClientTypePubSub, ClientTypeMaster, ClientTypeReplica:
+		return t, nil
+	case "slave":
+		return ClientTypeReplica, nil
+	}
+	return "", types.ReplyError(fmt.Sprintf("ERR Unknown client type '%s'", arg))
+}
+
+func parseClientID(arg []byte) (int64, error) {
+	id, err := strconv.ParseInt(string(arg), 10, 64)
+	if err != nil || id <= 0 {
+		return 0, types.ReplyError("ERR client-id should be greater than 0")
+	}
+	return id, nil
+}
+
+// Clients returns the connected clients ordered by id
+func (db *Database) Clients() []*Client {
+	db.clientsLock.RLock()
+	clients := make([]*Client, 0, len(db.clients))
+	for _, c := range db.clients {
+		clients = append(clients, c)
+	}
+	db.clientsLock.RUnlock()
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].id < clients[j].id
+	})
+	return clients
+}
+
+// CLIENT LIST [TYPE type] [ID id [id ...]]
+func clientList(database *Database, client *Client, args [][]byte) ([]byte, error) {
+	var (
+		clientType string
+		ids        map[int64]bool
+	)
+	for i := 0; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "TYPE":
+			if i+1 >= len(args) {
+				return nil, types.ErrSyntaxError
+			}
+			i++
+			t, err := parseClientType(args[i])
+			if err != nil {
+				return nil, err
+			}
+			clientType = t
+		case "ID":
+			if i+1 >= len(args) {
+				return nil, types.ErrSyntaxError
+			}
+			ids = make(map[int64]bool)
+			for i++; i < len(args); i++ {
+				id, err := parseClientID(args[i])
+				if err != nil {
+					return nil, err
+				}
+				ids[id] = true
+			}
+		default:
+			return nil, types.ErrSyntaxError
+		}
+	}
+	var list strings.Builder
+	for _, c := range database.Clients() {
+		if clientType != "" && c.Type() != clientType {
+			continue
+		}
+		if ids != nil && !ids[c.id] {
+			continue
+		}
+		list.WriteString(c.Info())
+		list.WriteString("\n")
+	}
+	return util.NewReply(client.Proto()).Verbatim("txt", list.String()).Bytes(), nil
+}
+
+type clientFilter struct {
+	id         int64
+	addr       string
+	user       string
+	clientType string
+	skipMe     bool
+}
+
+func (f clientFilter) match(self, c *Client) bool {
+	switch {
+	case f.skipMe && c == self:
+		return false
+	case f.id != 0 && c.id != f.id:
+		return false
+	case f.addr != "" && c.Addr() != f.addr:
+		return false
+	case f.user != "" && c.snapshot().user != f.user:
+		return false
+	case f.clientType != "" && c.Type() != f.clientType:
+		return false
+	}
+	return true
+}
+
+// CLIENT KILL addr or CLIENT KILL [ID id] [ADDR addr] [USER username] [TYPE type] [SKIPME yes|no]
+func clientKill(database *Database, client *Client, args [][]byte) ([]byte, error) {
+	if len(args) == 0 {
+		return nil, types.ErrInvalidNumberOfArgs
+	}
+	//the old form replies OK and kills the client with the given address only
+	if len(args) == 1 {
+		for _, c := range database.Clients() {
+			if c.Addr() == string(args[0]) {
+				database.killClient(client, c, util.MessageOK())
+				return nil, nil
+			}
+		}
+		return nil, types.ReplyError("ERR No such client")
+	}
+	if len(args)%2 != 0 {
+		return nil, types.ErrSyntaxError
+	}
+	filter := clientFilter{skipMe: true}
+	for i := 0; i < len(args); i += 2 {
+		value := args[i+1]
+		switch strings.ToUpper(string(args[i])) {
+		case "ID":
+			id, err := parseClientID(value)
+			if err != nil {
+				return nil, err
+			}
+			filter.id = id
+		case "ADDR":
+			filter.addr = string(value)
+		case "USER":
+			if database.acl.Get(string(value)) == nil {
+				return nil, types.ReplyError(fmt.Sprintf("ERR No such user '%s'", value))
+			}
+			filter.user = string(value)
+		case "TYPE":
+			t, err := parseClientType(value)
+			if err != nil {
+				return nil, err
+			}
+			filter.clientType = t
+		case "SKIPME":
+			switch strings.ToLower(string(value)) {
+			case "yes":
+				filter.skipMe = true
+			case "no":
+				filter.skipMe = false
+			default:
+				return nil, types.ErrSyntaxError
+			}
+		default:
+			return nil, types.ErrSyntaxError
+		}
+	}
+	var (
+		killed int64
+		self   bool
+	)
+	for _, c := range database.Clients() {
+		if !filter.match(client, c) {
+			continue
+		}
+		killed++
+		if c == client {
+			self = true
+			continue
+		}
+		database.killClient(client, c, nil)
+	}
+	output := util.MessageInt(killed)
+	if self {
+		database.killClient(client, client, output)
+		return nil, nil
+	}
+	return output, nil
+}
+
+// killClient closes the connection of c, a client killing itself gets its reply first
+func (db *Database) killClient(self, c *Client, reply []byte) {
+	if c == self {
+		self.Reply(reply)
+		_ = c.conn.Close()
+		return
+	}
+	if reply != nil {
+		self.Reply(reply)
+	}
+	state := c.snapshot()
+	//detached clients flush their outbox before closing
+	if state.push != nil {
+		_ = state.conn.Close()
+		return
+	}
+	//only the serving goroutine may write to the connection,
+	//closing the socket makes it stop reading and release the client
+	if nc, ok := state.conn.(interface{ NetConn() net.Conn }); ok {
+		_ = nc.NetConn().Close()
+	}
+}
+
+// CLIENT PAUSE timeout [WRITE|ALL]
+func clientPause(database *Database, args [][]byte) ([]byte, error) {
+	if len(args) != 1 && len(args) != 2 {
+		return nil, types.ErrInvalidNumberOfArgs
+	}
+	ms, err := strconv.ParseInt(string(args[0]), 10, 64)
+	if err != nil || ms < 0 {
+		return nil, types.ReplyError("ERR timeout is not an integer or out of range")
+	}
+	all := true
+	if len(args) == 2 {
+		switch strings.ToUpper(string(args[1])) {
+		case "ALL":
+		case "WRITE":
+			all = false
+		default:
+			return nil, types.ErrSyntaxError
+		}
+	}
+	database.pause.Pause(time.Duration(ms)*time.Millisecond, all)
+	return util.MessageOK(), nil
+}
+
+// CLIENT REPLY ON|OFF|SKIP, only ON is replied
+func clientReply(client *Client, arg []byte) ([]byte, error) {
+	switch strings.ToUpper(string(arg)) {
+	case "ON":
+		client.replyOff = false
+		return util.MessageOK(), nil
+	case "OFF":
+		client.replyOff = true
+	case "SKIP":
+		client.skipNext = true
+	default:
+		return nil, types.ErrSyntaxError
+	}
+	return nil, nil
+}
+
+// ClientPause holds the commands of clients until a deadline or CLIENT UNPAUSE
+type ClientPause struct {
+	lock  sync.Mutex
+	until time.Time
+	//all pauses every command, otherwise only writes
+	all bool
+	//done is closed when the pause is lifted early
+	done chan struct{}
+}
+
+func NewClientPause() *ClientPause {
+	return &ClientPause{}
+}
+
+// Pause extends the current pause, ALL takes precedence over WRITE
+func (p *ClientPause) Pause(timeout time.Duration, all bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	until := time.Now().Add(timeout)
+	if !p.active() {
+		p.all = all
+		p.until = until
+		p.done = make(chan struct{})
+		return
+	}
+	p.all = p.all || all
+	if until.After(p.until) {
+		p.until = until
+	}
+}
+
+func (p *ClientPause) Unpause() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.done != nil {
+		close(p.done)
+		p.done = nil
+	}
+	p.until = time.Time{}
+}
+
+func (p *ClientPause) active() bool {
+	return p.done != nil && time.Now().Before(p.until)
+}
+
+// wait blocks the command of client while it is paused,
+// CLIENT commands always go through so a pause can be lifted
+func (p *ClientPause) wait(client *Client, name string) {
+	if name == executor.CLIENT || (client.multi && name != executor.EXEC) {
+		return
+	}
+	for {
+		p.lock.Lock()
+		if !p.active() || !(p.all || isPausedWrite(client, name)) {
+			p.lock.Unlock()
+			return
+		}
+		done, remaining := p.done, time.Until(p.until)
+		p.lock.Unlock()
+
+		timer := time.NewTimer(remaining)
+		select {
+		case <-done:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+func isPausedWrite(client *Client, name string) bool {
+	if name != executor.EXEC {
+		return mayWrite(name)
+	}
+	for _, args := range client.queue {
+		if mayWrite(string(args[0])) {
+			return true
+		}
+	}
+	return false
+}
+
+// mayWrite tells whether a command may write, scripts included
+func mayWrite(name string) bool {
+	cmd := executor.Lookup(name)
+	return cmd.IsWrite() || cmd.HasFlag(executor.FlagMayReplicate)
+}
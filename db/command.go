@@ -0,0 +1,173 @@
+package db
+
+import (
+	"fmt"
+	"github.com/joway/pidis/executor"
+	"github.com/joway/pidis/types"
+	"github.com/joway/pidis/util"
+	"strings"
+)
+
+// checkCommand refuses unknown commands and wrong numbers of arguments
+func checkCommand(name string, args [][]byte) error {
+	cmd := executor.Lookup(name)
+	if cmd == nil {
+		return types.ErrUnknownCommand
+	}
+	if !cmd.CheckArity(len(args)) {
+		return types.ErrInvalidNumberOfArgs
+	}
+	return nil
+}
+
+func execCommand(database *Database, client *Client, name string, args [][]byte) ([]byte, bool, error) {
+	if name != executor.COMMAND {
+		return nil, false, nil
+	}
+	if len(args) == 1 {
+		return commandInfo(client, executor.Commands()), true, nil
+	}
+	output, err := database.Command(client, strings.ToUpper(string(args[1])), args[2:])
+	return output, true, err
+}
+
+// Command serves the COMMAND subcommands
+func (db *Database) Command(client *Client, sub string, args [][]byte) ([]byte, error) {
+	switch sub {
+	case "COUNT":
+		if len(args) != 0 {
+			return nil, types.ErrInvalidNumberOfArgs
+		}
+		return util.MessageInt(int64(len(executor.Commands()))), nil
+	case "INFO":
+		return commandInfo(client, lookupCommands(args)), nil
+	case "DOCS":
+		return commandDocs(client, lookupCommands(args)), nil
+	case "GETKEYS":
+		if len(args) == 0 {
+			return nil, types.ErrInvalidNumberOfArgs
+		}
+		cmd := executor.Lookup(string(args[0]))
+		if cmd == nil {
+			return nil, types.ReplyError("ERR Invalid command specified")
+		}
+		if !cmd.CheckArity(len(args)) {
+			return nil, types.ReplyError("ERR Invalid number of arguments specified for command")
+		}
+		keys := cmd.Keys(args)
+		if len(keys) == 0 {
+			return nil, types.ReplyError("ERR The command has no key arguments")
+		}
+		reply := util.NewReply(client.Proto()).Array(len(keys))
+		for _, key := range keys {
+			reply.Bulk(key)
+		}
+		return reply.Bytes(), nil
+	}
+	return nil, types.ReplyError(fmt.Sprintf("ERR unknown subcommand '%s'. Try COMMAND HELP.", strings.ToLower(sub)))
+}
+
+// lookupCommands returns the named commands, nil for unknown ones, or every command without names
+func lookupCommands(names [][]byte) []*executor.Command {
+	if len(names) == 0 {
+		return executor.Commands()
+	}
+	cmds := make([]*executor.Command, len(names))
+	for i, name := range names {
+		cmds[i] = executor.Lookup(string(name))
+	}
+	return cmds
+}
+
+// commandInfo replies the redis 7 layout: name, arity, flags, first key, last key, step,
+// acl categories, tips, key specs and subcommands
+func commandInfo(client *Client, cmds []*executor.Command) []byte {
+	reply := util.NewReply(client.Proto()).Array(len(cmds))
+	for _, cmd := range cmds {
+		if cmd == nil {
+			reply.NullArray()
+			continue
+		}
+		flags := cmd.Flags
+		//keys of EVAL like commands can only be found by parsing their arguments
+		if cmd.NumKeys > 0 {
+			flags = append(append([]string(nil), flags...), "movablekeys")
+		}
+		reply.Array(10).
+			BulkString(strings.ToLower(cmd.Name)).
+			Int(int64(cmd.Arity)).
+			Set(len(flags))
+		for _, flag := range flags {
+			reply.String(flag)
+		}
+		reply.Int(int64(cmd.FirstKey)).Int(int64(cmd.LastKey)).Int(int64(cmd.KeyStep))
+		categories := cmd.AllCategories()
+		reply.Set(len(categories))
+		for _, category := range categories {
+			reply.String("@" + category)
+		}
+		reply.Set(0)
+		keySpecs(reply, cmd)
+		reply.Array(0)
+	}
+	return reply.Bytes()
+}
+
+func keySpecs(reply *util.Reply, cmd *executor.Command) {
+	if cmd.FirstKey == 0 && cmd.NumKeys == 0 {
+		reply.Array(0)
+		return
+	}
+	access := "RO"
+	if cmd.IsWrite() || cmd.NumKeys > 0 {
+		access = "RW"
+	}
+	reply.Array(1).Map(3).
+		BulkString("flags").Set(1).String(access).
+		BulkString("begin_search").Map(2).
+		BulkString("type").BulkString("index").
+		BulkString("spec").Map(1)
+	if cmd.NumKeys > 0 {
+		reply.BulkString("index").Int(int64(cmd.NumKeys)).
+			BulkString("find_keys").Map(2).
+			BulkString("type").BulkString("keynum").
+			BulkString("spec").Map(3).
+			BulkString("keynumidx").Int(0).
+			BulkString("firstkey").Int(1).
+			BulkString("keystep").Int(1)
+		return
+	}
+	//the last key is relative to the first one, or to the end when negative
+	lastKey := cmd.LastKey
+	if lastKey >= 0 {
+		lastKey -= cmd.FirstKey
+	}
+	reply.BulkString("index").Int(int64(cmd.FirstKey)).
+		BulkString("find_keys").Map(2).
+		BulkString("type").BulkString("range").
+		BulkString("spec").Map(3).
+		BulkString("lastkey").Int(int64(lastKey)).
+		BulkString("keystep").Int(int64(cmd.KeyStep)).
+		BulkString("limit").Int(0)
+}
+
+func commandDocs(client *Client, cmds []*executor.Command) []byte {
+	n := 0
+	for _, cmd := range cmds {
+		if cmd != nil {
+			n++
+		}
+	}
+	//unknown commands are left out
+	reply := util.NewReply(client.Proto()).Map(n)
+	for _, cmd := range cmds {
+		if cmd == nil {
+			continue
+		}
+		reply.BulkString(strings.ToLower(cmd.Name)).Map(3).
+			BulkString("summary").BulkString(cmd.Summary).
+			BulkString("since").BulkString(cmd.Since).
+			BulkString("group").BulkString(cmd.Group)
+	}
+	return reply.Bytes()
+}
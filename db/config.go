@@ -0,0 +1,823 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/gobwas/glob"
+	"github.com/joway/pidis/executor"
+	"github.com/joway/pidis/storage"
+	"github.com/joway/pidis/types"
+	"github.com/joway/pidis/util"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	AppendFsyncAlways   = "always"
+	AppendFsyncEverySec = "everysec"
+)
+
+type configParam struct {
+	name string
+	//default value
+	value string
+	//values made of several arguments are written without quoting
+	list bool
+	//check validates and normalizes a value
+	check func(value string) (string, error)
+	//apply changes a running database, params without apply are only read at startup
+	apply func(db *Database, value string) error
+}
+
+var configParams = []configParam{
+	{name: "port", value: "6380", check: checkPort},
+	{name: "rpc-port", value: "6381", check: checkPort},
+	//prometheus metrics are served over http when set
+	{name: "metrics-port", check: checkOptionalPort},
+	{name: "dir", value: "/tmp/pidis"},
+	{name: "storage", value: storage.TypeBadger, check: checkOneOf(storage.TypeBadger, storage.TypeMemory)},
+	{
+		name:  "block-compression",
+		value: storage.CompressionNone,
+		check: checkOneOf(storage.CompressionNone, storage.CompressionSnappy, storage.CompressionZSTD),
+	},
+	{
+		name:  "value-compression",
+		value: storage.CompressionNone,
+		check: checkOneOf(storage.CompressionNone, storage.CompressionSnappy, storage.CompressionZSTD),
+		apply: func(db *Database, value string) error {
+			return db.compressor.SetCodec(value)
+		},
+	},
+	{
+		//bytes, shorter values aren't compressed
+		name:  "value-compression-threshold",
+		value: strconv.Itoa(storage.DefaultCompressionThreshold),
+		check: checkMemory,
+		apply: func(db *Database, value string) error {
+			threshold, _ := strconv.ParseInt(value, 10, 64)
+			db.compressor.SetThreshold(threshold)
+			return nil
+		},
+	},
+	//backups are written to the dir, <dir>/backups by default, or to the object store when an endpoint is set.
+	//Its credentials are read from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY
+	{name: "backup-dir", apply: applyNothing},
+	{name: "backup-s3-endpoint", apply: applyNothing},
+	{name: "backup-s3-region", value: "us-east-1", apply: applyNothing},
+	{name: "backup-s3-bucket", apply: applyNothing},
+	{name: "backup-s3-prefix", apply: applyNothing},
+	{
+		//full backups kept with their incremental ones, 0 keeps all of them
+		name:  "backup-retention",
+		value: strconv.Itoa(DefaultBackupRetention),
+		check: checkInt(0),
+		apply: applyNothing,
+	},
+	{
+		//seconds, backups not followed by an incremental one for longer are removed, 0 keeps them
+		name:  "backup-retention-age",
+		value: "0",
+		check: checkInt(0),
+		apply: applyNothing,
+	},
+	{name: "aclfile"},
+	{name: "databases", value: strconv.Itoa(DefaultDatabases), check: checkInt(1)},
+	{
+		name: "requirepass",
+		apply: func(db *Database, value string) error {
+			if value == "" {
+				return db.acl.SetUser(DefaultUser, []string{"nopass"})
+			}
+			return db.acl.SetUser(DefaultUser, []string{"resetpass", ">" + value})
+		},
+	},
+	{
+		name: "notify-keyspace-events",
+		check: func(value string) (string, error) {
+			flags, err := ParseNotifyKeyspaceEvents(value)
+			if err != nil {
+				return "", err
+			}
+			return FormatNotifyKeyspaceEvents(flags), nil
+		},
+		apply: func(db *Database, value string) error {
+			return db.SetNotifyKeyspaceEvents(value)
+		},
+	},
+	{
+		name:  "appendfsync",
+		value: AppendFsyncEverySec,
+		check: checkOneOf(AppendFsyncAlways, AppendFsyncEverySec),
+		apply: func(db *Database, value string) error {
+			db.SetAppendFsync(value)
+			return nil
+		},
+	},
+	{
+		name:  "client-output-buffer-limit",
+		value: formatBufferLimit(DefaultPubSubBufferLimit),
+		list:  true,
+		check: func(value string) (string, error) {
+			limit, err := parseBufferLimit(value)
+			if err != nil {
+				return "", err
+			}
+			return formatBufferLimit(limit), nil
+		},
+		apply: func(db *Database, value string) error {
+			limit, err := parseBufferLimit(value)
+			if err != nil {
+				return err
+			}
+			db.pubsubLimit.Store(limit)
+			return nil
+		},
+	},
+	{name: "tls-cert-file"},
+	{name: "tls-key-file"},
+	{name: "tls-ca-cert-file"},
+	{name: "tls-auth-clients", value: "no", check: checkBool},
+	{name: "tls-replication", value: "no", check: checkBool},
+	{name: "replicaof", list: true, check: checkReplicaOf},
+	{
+		name: "masterauth",
+		apply: func(db *Database, value string) error {
+			db.SetMasterAuth(value)
+			return nil
+		},
+	},
+	//hex encoded master key, PIDIS_ENCRYPTION_KEY is read when empty
+	{name: "encryption-key-file"},
+	{
+		//seconds, lifetime of the data keys
+		name:  "encryption-key-rotation",
+		value: strconv.Itoa(int(DefaultEncryptionKeyRotation / time.Second)),
+		check: checkInt(1),
+	},
+	{
+		//microseconds, negative disables the slow log
+		name:  "slowlog-log-slower-than",
+		value: strconv.Itoa(DefaultSlowLogSlowerThan),
+		check: checkInt(math.MinInt64),
+		apply: func(db *Database, value string) error {
+			usec, _ := strconv.ParseInt(value, 10, 64)
+			db.slowLog.SetSlowerThan(usec)
+			return nil
+		},
+	},
+	{
+		name:  "slowlog-max-len",
+		value: strconv.Itoa(DefaultSlowLogMaxLen),
+		check: checkInt(0),
+		apply: func(db *Database, value string) error {
+			maxLen, _ := strconv.Atoi(value)
+			db.slowLog.SetMaxLen(maxLen)
+			return nil
+		},
+	},
+	{
+		name:  "maxmemory",
+		value: "0",
+		check: checkMemory,
+		apply: func(db *Database, value string) error {
+			limit, _ := strconv.ParseInt(value, 10, 64)
+			return db.memory.SetLimit(limit)
+		},
+	},
+	{
+		name:  "maxmemory-policy",
+		value: PolicyNoEviction,
+		check: checkOneOf(
+			PolicyNoEviction, PolicyAllKeysLRU, PolicyAllKeysLFU, PolicyVolatileLRU, PolicyVolatileTTL, PolicyAllKeysRandom,
+		),
+		apply: func(db *Database, value string) error {
+			db.memory.SetPolicy(value)
+			return nil
+		},
+	},
+	{
+		name:  "maxmemory-samples",
+		value: strconv.Itoa(DefaultMaxMemorySamples),
+		check: checkInt(1),
+		apply: func(db *Database, value string) error {
+			samples, _ := strconv.Atoi(value)
+			db.memory.SetSamples(samples)
+			return nil
+		},
+	},
+	{
+		//bytes of the data dir and the aof, 0 disables the quota
+		name:  "disk-quota",
+		value: "0",
+		check: checkMemory,
+		apply: func(db *Database, value string) error {
+			limit, _ := strconv.ParseInt(value, 10, 64)
+			db.diskQuota.SetLimit(limit)
+			return nil
+		},
+	},
+	{
+		//percent of disk-quota under which writes are accepted again
+		name:  "disk-quota-low-watermark",
+		value: strconv.Itoa(DefaultDiskQuotaLowWatermark),
+		check: checkPercent,
+		apply: func(db *Database, value string) error {
+			percent, _ := strconv.Atoi(value)
+			db.diskQuota.SetLowWatermark(percent)
+			return nil
+		},
+	},
+	//reclaiming is configured by these two, read once the quota is exceeded
+	{name: "disk-quota-gc", value: "yes", check: checkBool, apply: applyNothing},
+	{name: "disk-quota-aof-rewrite", value: "no", check: checkBool, apply: applyNothing},
+	{
+		//1 to 10, higher efforts sample more keys per expire cycle and tolerate less expired keys
+		name:  "active-expire-effort",
+		value: strconv.Itoa(DefaultActiveExpireEffort),
+		check: checkRange(1, 10),
+		apply: applyNothing,
+	},
+	{
+		//milliseconds, 0 disables the latency monitor
+		name:  "latency-monitor-threshold",
+		value: "0",
+		check: checkInt(0),
+		apply: func(db *Database, value string) error {
+			ms, _ := strconv.ParseInt(value, 10, 64)
+			db.latency.SetThreshold(ms)
+			return nil
+		},
+	},
+}
+
+var configAliases = map[string]string{
+	"slaveof": "replicaof",
+}
+
+func findConfigParam(name string) (configParam, bool) {
+	name = strings.ToLower(name)
+	if alias, ok := configAliases[name]; ok {
+		name = alias
+	}
+	for _, p := range configParams {
+		if p.name == name {
+			return p, true
+		}
+	}
+	return configParam{}, false
+}
+
+func checkPort(value string) (string, error) {
+	port, err := strconv.Atoi(value)
+	if err != nil || port < 0 || port > 65535 {
+		return "", errors.New("argument must be a valid port")
+	}
+	return value, nil
+}
+
+func checkOptionalPort(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	return checkPort(value)
+}
+
+func checkInt(min int64) func(string) (string, error) {
+	return func(value string) (string, error) {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return "", errors.New("argument couldn't be parsed into an integer")
+		}
+		if n < min {
+			return "", errors.Errorf("argument must be greater than or equal to %d", min)
+		}
+		return strconv.FormatInt(n, 10), nil
+	}
+}
+
+func checkRange(min, max int) func(string) (string, error) {
+	return func(value string) (string, error) {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < min || n > max {
+			return "", errors.Errorf("argument must be between %d and %d", min, max)
+		}
+		return strconv.Itoa(n), nil
+	}
+}
+
+func checkPercent(value string) (string, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 || n > 100 {
+		return "", errors.New("argument must be a percentage between 1 and 100")
+	}
+	return strconv.Itoa(n), nil
+}
+
+// applyNothing makes params read on demand settable at runtime
+func applyNothing(*Database, string) error {
+	return nil
+}
+
+func checkBool(value string) (string, error) {
+	switch strings.ToLower(value) {
+	case "yes":
+		return "yes", nil
+	case "no":
+		return "no", nil
+	}
+	return "", errors.New("argument must be 'yes' or 'no'")
+}
+
+func checkOneOf(values ...string) func(string) (string, error) {
+	return func(value string) (string, error) {
+		for _, v := range values {
+			if strings.EqualFold(v, value) {
+				return v, nil
+			}
+		}
+		return "", errors.Errorf("argument must be one of %s", strings.Join(values, ", "))
+	}
+}
+
+func checkReplicaOf(value string) (string, error) {
+	fields := strings.Fields(value)
+	if len(fields) == 0 || (len(fields) == 2 && strings.EqualFold(fields[0], "no") && strings.EqualFold(fields[1], "one")) {
+		return "", nil
+	}
+	if len(fields) != 2 {
+		return "", errors.New("argument must be '<host> <port>'")
+	}
+	if _, err := checkPort(fields[1]); err != nil {
+		return "", err
+	}
+	return fields[0] + " " + fields[1], nil
+}
+
+// checkMemory normalizes a memory value to bytes
+func checkMemory(value string) (string, error) {
+	n, err := parseMemory(value)
+	if err != nil {
+		return "", err
+	}
+	return strconv.Itoa(n), nil
+}
+
+// parseMemory parses sizes like 1024, 64kb or 1gb
+func parseMemory(s string) (int, error) {
+	s = strings.ToLower(s)
+	units := []struct {
+		suffix string
+		size   int
+	}{
+		{"gb", 1 << 30}, {"mb", 1 << 20}, {"kb", 1 << 10},
+		{"g", 1000 * 1000 * 1000}, {"m", 1000 * 1000}, {"k", 1000}, {"b", 1},
+	}
+	size := 1
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			s = strings.TrimSuffix(s, u.suffix)
+			size = u.size
+			break
+		}
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, errors.New("argument must be a memory value")
+	}
+	return n * size, nil
+}
+
+// parseBufferLimit parses "pubsub <hard> <soft> <soft seconds>", the only class of output buffers
+func parseBufferLimit(value string) (OutputBufferLimit, error) {
+	fields := strings.Fields(value)
+	if len(fields) != 4 || strings.ToLower(fields[0]) != "pubsub" {
+		return OutputBufferLimit{}, errors.New("argument must be 'pubsub <hard> <soft> <soft seconds>'")
+	}
+	hard, err := parseMemory(fields[1])
+	if err != nil {
+		return OutputBufferLimit{}, err
+	}
+	soft, err := parseMemory(fields[2])
+	if err != nil {
+		return OutputBufferLimit{}, err
+	}
+	seconds, err := strconv.Atoi(fields[3])
+	if err != nil || seconds < 0 {
+		return OutputBufferLimit{}, errors.New("soft seconds must be a positive integer")
+	}
+	return OutputBufferLimit{
+		Hard:        hard,
+		Soft:        soft,
+		SoftSeconds: time.Duration(seconds) * time.Second,
+	}, nil
+}
+
+func formatBufferLimit(limit OutputBufferLimit) string {
+	return fmt.Sprintf("pubsub %d %d %d", limit.Hard, limit.Soft, int(limit.SoftSeconds/time.Second))
+}
+
+// splitConfigLine splits a config line into arguments,
+// arguments are separated by spaces and may be "quoted" or 'quoted'
+func splitConfigLine(line string) ([]string, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return nil, nil
+	}
+	var args []string
+	for len(line) > 0 {
+		var arg string
+		switch line[0] {
+		case '"':
+			end := 1
+			for ; end < len(line) && line[end] != '"'; end++ {
+				if line[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(line) {
+				return nil, errors.New("unbalanced quotes")
+			}
+			unquoted, err := strconv.Unquote(line[:end+1])
+			if err != nil {
+				return nil, errors.New("invalid quoted argument")
+			}
+			arg, line = unquoted, line[end+1:]
+		case '\'':
+			end := strings.IndexByte(line[1:], '\'')
+			if end < 0 {
+				return nil, errors.New("unbalanced quotes")
+			}
+			arg, line = line[1:end+1], line[end+2:]
+		default:
+			end := strings.IndexAny(line, " \t")
+			if end < 0 {
+				end = len(line)
+			}
+			arg, line = line[:end], line[end:]
+		}
+		if line != "" && line[0] != ' ' && line[0] != '\t' {
+			return nil, errors.New("closing quote must be followed by a space")
+		}
+		args = append(args, arg)
+		line = strings.TrimLeft(line, " \t")
+	}
+	return args, nil
+}
+
+func formatConfigLine(p configParam, value string) string {
+	if !(p.list && value != "") && (value == "" || strings.ContainsAny(value, " \t\"'\\#")) {
+		value = strconv.Quote(value)
+	}
+	return p.name + " " + value
+}
+
+// Config is the registry of server settings, loaded from a redis.conf like file
+type Config struct {
+	lock   sync.RWMutex
+	file   string
+	values map[string]string
+}
+
+func NewConfig() *Config {
+	values := make(map[string]string, len(configParams))
+	for _, p := range configParams {
+		values[p.name] = p.value
+	}
+	return &Config{values: values}
+}
+
+func LoadConfig(file string) (*Config, error) {
+	c := NewConfig()
+	c.file = file
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "read config file failed")
+	}
+	for i, line := range strings.Split(string(content), "\n") {
+		args, err := splitConfigLine(line)
+		if err == nil && len(args) == 1 {
+			err = errors.New("wrong number of arguments")
+		}
+		if err == nil && len(args) > 0 {
+			p, ok := findConfigParam(args[0])
+			if !ok {
+				err = errors.Errorf("unknown config '%s'", args[0])
+			} else if !p.list && len(args) != 2 {
+				err = errors.New("wrong number of arguments")
+			} else {
+				err = c.Set(p.name, strings.Join(args[1:], " "))
+			}
+		}
+		if err != nil {
+			return nil, errors.Errorf("config file %s line %d: %v", file, i+1, err)
+		}
+	}
+	return c, nil
+}
+
+func (c *Config) File() string {
+	return c.file
+}
+
+func (c *Config) Get(name string) string {
+	p, ok := findConfigParam(name)
+	if !ok {
+		return ""
+	}
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.values[p.name]
+}
+
+// Set validates and stores a value without applying it to a running database
+func (c *Config) Set(name, value string) error {
+	p, ok := findConfigParam(name)
+	if !ok {
+		return errors.Errorf("unknown config '%s'", name)
+	}
+	if p.check != nil {
+		var err error
+		if value, err = p.check(value); err != nil {
+			return errors.New(strings.TrimPrefix(err.Error(), "ERR "))
+		}
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.values[p.name] = value
+	return nil
+}
+
+func (c *Config) TLS() TLSOptions {
+	return TLSOptions{
+		CertFile:    c.Get("tls-cert-file"),
+		KeyFile:     c.Get("tls-key-file"),
+		CAFile:      c.Get("tls-ca-cert-file"),
+		AuthClients: c.Get("tls-auth-clients") == "yes",
+	}
+}
+
+// ReplicaOf returns the master to follow at startup, host is empty for a master
+func (c *Config) ReplicaOf() (host, port string) {
+	fields := strings.Fields(c.Get("replicaof"))
+	if len(fields) != 2 {
+		return "", ""
+	}
+	return fields[0], fields[1]
+}
+
+func (c *Config) Options() (Options, error) {
+	limit, err := parseBufferLimit(c.Get("client-output-buffer-limit"))
+	if err != nil {
+		return Options{}, err
+	}
+	options := Options{
+		DBDir:   c.Get("dir"),
+		Storage: c.Get("storage"),
+
+		PubSubBufferLimit: limit,
+
+		NotifyKeyspaceEvents: c.Get("notify-keyspace-events"),
+		ACLFile:              c.Get("aclfile"),
+
+		MasterAuth: c.Get("masterauth"),
+
+		EncryptionKeyFile: c.Get("encryption-key-file"),
+
+		BlockCompression: c.Get("block-compression"),
+
+		Config: c,
+	}
+	options.Databases, _ = strconv.Atoi(c.Get("databases"))
+	rotation, _ := strconv.ParseInt(c.Get("encryption-key-rotation"), 10, 64)
+	options.EncryptionKeyRotation = time.Duration(rotation) * time.Second
+	if c.Get("tls-replication") == "yes" {
+		options.ReplicationTLS = c.TLS()
+	}
+	return options, nil
+}
+
+// record keeps the registry in line with options of a database created without a config
+func (c *Config) record(options Options) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.values["dir"] = options.DBDir
+	if options.Storage != "" {
+		c.values["storage"] = options.Storage
+	}
+	c.values["aclfile"] = options.ACLFile
+	if options.Databases > 0 {
+		c.values["databases"] = strconv.Itoa(options.Databases)
+	}
+	if flags, err := ParseNotifyKeyspaceEvents(options.NotifyKeyspaceEvents); err == nil {
+		c.values["notify-keyspace-events"] = FormatNotifyKeyspaceEvents(flags)
+	}
+	if options.PubSubBufferLimit != (OutputBufferLimit{}) {
+		c.values["client-output-buffer-limit"] = formatBufferLimit(options.PubSubBufferLimit)
+	}
+	if options.ReplicationTLS.Enabled() {
+		c.values["tls-cert-file"] = options.ReplicationTLS.CertFile
+		c.values["tls-key-file"] = options.ReplicationTLS.KeyFile
+		c.values["tls-ca-cert-file"] = options.ReplicationTLS.CAFile
+		if options.ReplicationTLS.AuthClients {
+			c.values["tls-auth-clients"] = "yes"
+		}
+		c.values["tls-replication"] = "yes"
+	}
+	c.values["masterauth"] = options.MasterAuth
+	c.values["encryption-key-file"] = options.EncryptionKeyFile
+	if options.BlockCompression != "" {
+		c.values["block-compression"] = options.BlockCompression
+	}
+	if options.EncryptionKeyRotation > 0 {
+		c.values["encryption-key-rotation"] = strconv.FormatInt(int64(options.EncryptionKeyRotation/time.Second), 10)
+	}
+}
+
+func (c *Config) match(patterns []string) ([][2]string, error) {
+	var globs []glob.Glob
+	for _, pattern := range patterns {
+		g, err := glob.Compile(strings.ToLower(pattern))
+		if err != nil {
+			return nil, types.ErrSyntaxError
+		}
+		globs = append(globs, g)
+	}
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	var pairs [][2]string
+	for _, p := range configParams {
+		for _, g := range globs {
+			if g.Match(p.name) {
+				pairs = append(pairs, [2]string{p.name, c.values[p.name]})
+				break
+			}
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		return pairs[i][0] < pairs[j][0]
+	})
+	return pairs, nil
+}
+
+// Rewrite persists current values into the config file,
+// comments and the order of the existing lines are kept and unset defaults are not written
+func (c *Config) Rewrite() error {
+	if c.file == "" {
+		return types.ErrNoConfigFile
+	}
+	content, err := ioutil.ReadFile(c.file)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	var lines []string
+	written := make(map[string]bool)
+	if len(content) > 0 {
+		for _, line := range strings.Split(strings.TrimRight(string(content), "\n"), "\n") {
+			args, err := splitConfigLine(line)
+			if err != nil || len(args) == 0 {
+				lines = append(lines, line)
+				continue
+			}
+			p, ok := findConfigParam(args[0])
+			if !ok {
+				lines = append(lines, line)
+				continue
+			}
+			if written[p.name] {
+				continue
+			}
+			written[p.name] = true
+			lines = append(lines, formatConfigLine(p, c.values[p.name]))
+		}
+	}
+	for _, p := range configParams {
+		if !written[p.name] && c.values[p.name] != p.value {
+			lines = append(lines, formatConfigLine(p, c.values[p.name]))
+		}
+	}
+	var buf bytes.Buffer
+	for _, line := range lines {
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
+	tmp := c.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.file)
+}
+
+// bindConfig applies the runtime params which differ from their defaults
+func (db *Database) bindConfig(config *Config) error {
+	db.config = config
+	for _, p := range configParams {
+		if p.apply == nil {
+			continue
+		}
+		if value := config.Get(p.name); value != p.value {
+			if err := p.apply(db, value); err != nil {
+				return errors.Wrapf(err, "apply config %s failed", p.name)
+			}
+		}
+	}
+	return nil
+}
+
+func (db *Database) setConfig(args [][]byte) error {
+	if len(args) == 0 || len(args)%2 != 0 {
+		return types.ErrInvalidNumberOfArgs
+	}
+	type change struct {
+		param configParam
+		value string
+	}
+	var changes []change
+	for i := 0; i < len(args); i += 2 {
+		p, ok := findConfigParam(string(args[i]))
+		if !ok {
+			return types.ReplyError(fmt.Sprintf("ERR Unknown option or number of arguments for CONFIG SET - '%s'", args[i]))
+		}
+		if p.apply == nil {
+			return types.ReplyError(fmt.Sprintf("ERR CONFIG SET failed (possibly related to argument '%s') - can't set immutable config", p.name))
+		}
+		value := string(args[i+1])
+		if p.check != nil {
+			var err error
+			if value, err = p.check(value); err != nil {
+				return types.ReplyError(fmt.Sprintf("ERR CONFIG SET failed (possibly related to argument '%s') - %s", p.name, strings.TrimPrefix(err.Error(), "ERR ")))
+			}
+		}
+		changes = append(changes, change{p, value})
+	}
+	for _, ch := range changes {
+		if err := ch.param.apply(db, ch.value); err != nil {
+			return types.ReplyError(fmt.Sprintf("ERR CONFIG SET failed (possibly related to argument '%s') - %s", ch.param.name, strings.TrimPrefix(err.Error(), "ERR ")))
+		}
+		if err := db.config.Set(ch.param.name, ch.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func execConfig(database *Database, client *Client, name string, args [][]byte) ([]byte, bool, error) {
+	if name != executor.CONFIG {
+		return nil, false, nil
+	}
+	if len(args) < 2 {
+		return nil, true, types.ErrInvalidNumberOfArgs
+	}
+	output, err := database.Config(client, strings.ToUpper(string(args[1])), args[2:])
+	return output, true, err
+}
+
+func (db *Database) Config(client *Client, sub string, args [][]byte) ([]byte, error) {
+	switch sub {
+	case "GET":
+		if len(args) < 1 {
+			return nil, types.ErrInvalidNumberOfArgs
+		}
+		var patterns []string
+		for _, arg := range args {
+			patterns = append(patterns, string(arg))
+		}
+		pairs, err := db.config.match(patterns)
+		if err != nil {
+			return nil, err
+		}
+		reply := util.NewReply(client.Proto()).Map(len(pairs))
+		for _, pair := range pairs {
+			reply.BulkString(pair[0]).BulkString(pair[1])
+		}
+		return reply.Bytes(), nil
+	case "SET":
+		if err := db.setConfig(args); err != nil {
+			return nil, err
+		}
+		return util.MessageOK(), nil
+	case "REWRITE":
+		if err := db.config.Rewrite(); err != nil {
+			if err == types.ErrNoConfigFile {
+				return nil, err
+			}
+			return nil, types.ReplyError(fmt.Sprintf("ERR Rewriting config file: %v", err))
+		}
+		return util.MessageOK(), nil
+	case "RESETSTAT":
+		db.stats.Reset()
+		db.commandStats.Reset()
+		return util.MessageOK(), nil
+	default:
+		return nil, types.ReplyError(fmt.Sprintf("ERR unknown subcommand '%s'. Try CONFIG HELP.", strings.ToLower(sub)))
+	}
+}
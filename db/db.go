@@ -2,6 +2,7 @@ package db
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"github.com/joway/loki"
 	"github.com/joway/pidis/executor"
@@ -10,22 +11,59 @@ import (
 	"github.com/joway/pidis/types"
 	"github.com/pkg/errors"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"io"
+	"io/ioutil"
 	"os"
 	"path"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var logger = loki.New("pidis:db")
 
+const storageGCInterval = time.Minute * 10
+
 type Options struct {
 	DBDir string
+	//Storage is the storage engine, badger by default
+	Storage string
+
+	PubSubBufferLimit OutputBufferLimit
+
+	NotifyKeyspaceEvents string
+
+	//ACLFile defaults to users.acl in DBDir
+	ACLFile string
+
+	//ReplicationTLS secures the Pidis service and the connection of followers to it
+	ReplicationTLS TLSOptions
+
+	//MasterAuth is the shared secret required from followers and presented when following a master
+	MasterAuth string
+
+	//Databases is the number of databases clients can SELECT, 16 by default
+	Databases int
+
+	//EncryptionKeyFile holds the hex encoded master key encrypting the data files, the aof and snapshots,
+	//PIDIS_ENCRYPTION_KEY is read when it's empty and the data is plaintext without both
+	EncryptionKeyFile string
+	//EncryptionKeyRotation is the lifetime of the data keys, 10 days by default
+	EncryptionKeyRotation time.Duration
+
+	//BlockCompression is the codec of badger blocks, values are compressed according to value-compression
+	BlockCompression string
+
+	//Config backs CONFIG commands, a default registry reflecting options is used if nil
+	Config *Config
 }
 
 type Database struct {
-	dir     string
-	storage storage.Storage
+	dir        string
+	storage    storage.Storage
+	compressor *storage.Compressor
 
 	//signals
 	sigFollowing chan bool
@@ -34,6 +72,61 @@ type Database struct {
 	followingConn *grpc.ClientConn
 
 	aofBus *AOFBus
+
+	//encryption at rest, nil for plaintext
+	keyring           *Keyring
+	encryptionKeyFile string
+
+	//transaction
+	lock      sync.RWMutex
+	watchLock sync.Mutex
+	watches   map[string]map[*Client]struct{}
+
+	scripts   *ScriptCache
+	functions *FunctionRegistry
+
+	pubsub      *PubSub
+	pubsubLimit atomic.Value
+
+	//keyspace notification
+	notifyFlags int32
+	expires     *Expires
+
+	//databases
+	keyspaces *Keyspaces
+
+	//maxmemory
+	memory *Memory
+	//disk usage of data and aof
+	diskQuota *DiskQuota
+	backups   *Backups
+
+	//clients
+	clientsLock sync.RWMutex
+	clients     map[int64]*Client
+	tracking    *Tracking
+	monitors    *Monitors
+	pause       *ClientPause
+
+	acl *ACL
+
+	//replication tls, nil for plaintext
+	rpcTLS  *tls.Config
+	dialTLS *tls.Config
+	//replication secret
+	masterAuth atomic.Value
+
+	config       *Config
+	stats        Stats
+	commandStats *CommandStats
+	fsyncAlways  int32
+
+	replication *Replication
+	metrics     *Metrics
+	slowLog     *SlowLog
+	latency     *LatencyMonitor
+	startTime   time.Time
+	runID       string
 }
 
 func New(options Options) (*Database, error) {
@@ -42,9 +135,17 @@ func New(options Options) (*Database, error) {
 	if err := os.MkdirAll(dataDir, os.ModePerm); err != nil {
 		return nil, err
 	}
+	compressor := storage.NewCompressor()
 	storageOpts := storage.Options{
-		Storage: storage.TypeBadger,
+		Storage: options.Storage,
 		Dir:     dataDir,
+
+		Compressor:       compressor,
+		BlockCompression: options.BlockCompression,
+	}
+	keyring, err := openEncryption(options.DBDir, options.EncryptionKeyFile, options.EncryptionKeyRotation, &storageOpts)
+	if err != nil {
+		return nil, errors.Wrap(err, "open encryption failed")
 	}
 	store, err := storage.NewStorage(storageOpts)
 	if err != nil {
@@ -52,18 +153,110 @@ func New(options Options) (*Database, error) {
 	}
 
 	//create aofBus stream
-	aofBuf, err := NewAOFBus(aofFilePath, UIDSize)
+	aofBuf, err := NewAOFBus(aofFilePath, UIDSize, keyring)
 	if err != nil {
 		return nil, err
 	}
 
+	functions, err := NewFunctionRegistry(path.Join(options.DBDir, "pidis.functions"))
+	if err != nil {
+		return nil, err
+	}
+
+	aclFile := options.ACLFile
+	if aclFile == "" {
+		aclFile = path.Join(options.DBDir, "users.acl")
+	}
+	acl, err := NewACL(aclFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var rpcTLS, dialTLS *tls.Config
+	if options.ReplicationTLS.Enabled() || options.ReplicationTLS.CAFile != "" {
+		if options.ReplicationTLS.Enabled() {
+			if rpcTLS, err = options.ReplicationTLS.ServerConfig(); err != nil {
+				return nil, err
+			}
+		}
+		if dialTLS, err = options.ReplicationTLS.ClientConfig(); err != nil {
+			return nil, err
+		}
+	}
+
+	databases := options.Databases
+	if databases <= 0 {
+		databases = DefaultDatabases
+	}
 	database := &Database{
-		dir:     options.DBDir,
-		storage: store,
+		dir:        options.DBDir,
+		storage:    store,
+		compressor: compressor,
 
 		sigFollowing: make(chan bool),
 
 		aofBus: aofBuf,
+
+		keyring:           keyring,
+		encryptionKeyFile: options.EncryptionKeyFile,
+
+		watches: make(map[string]map[*Client]struct{}),
+
+		scripts:   NewScriptCache(),
+		functions: functions,
+
+		pubsub: NewPubSub(),
+
+		expires: NewExpires(),
+
+		keyspaces: NewKeyspaces(databases),
+
+		memory:    NewMemory(options.Storage == storage.TypeMemory),
+		diskQuota: NewDiskQuota(),
+		backups:   NewBackups(),
+
+		clients:  make(map[int64]*Client),
+		tracking: NewTracking(),
+		monitors: NewMonitors(),
+		pause:    NewClientPause(),
+
+		acl: acl,
+
+		rpcTLS:  rpcTLS,
+		dialTLS: dialTLS,
+
+		commandStats: NewCommandStats(),
+		replication:  NewReplication(),
+		slowLog:      NewSlowLog(DefaultSlowLogSlowerThan, DefaultSlowLogMaxLen),
+		latency:      NewLatencyMonitor(0),
+		startTime:    time.Now(),
+		runID:        newRunID(),
+	}
+	database.metrics = newMetrics(database)
+	if options.PubSubBufferLimit == (OutputBufferLimit{}) {
+		options.PubSubBufferLimit = DefaultPubSubBufferLimit
+	}
+	database.pubsubLimit.Store(options.PubSubBufferLimit)
+	database.SetMasterAuth(options.MasterAuth)
+	if err := database.SetNotifyKeyspaceEvents(options.NotifyKeyspaceEvents); err != nil {
+		return nil, err
+	}
+	if err := database.loadKeyspaces(); err != nil {
+		return nil, err
+	}
+	if err := database.loadExpires(); err != nil {
+		return nil, err
+	}
+	if err := database.loadMemory(); err != nil {
+		return nil, err
+	}
+	config := options.Config
+	if config == nil {
+		config = NewConfig()
+		config.record(options)
+	}
+	if err := database.bindConfig(config); err != nil {
+		return nil, err
 	}
 
 	return database, nil
@@ -81,8 +274,38 @@ func (db *Database) IsWritable() bool {
 	return db.following == nil
 }
 
-func (db *Database) Record(cmd [][]byte) error {
-	return db.aofBus.Append(cmd)
+// Record appends a command run in the database index to the aof
+func (db *Database) Record(index int, cmd [][]byte) error {
+	if err := db.aofBus.Append(index, cmd); err != nil {
+		return err
+	}
+	return db.fsyncAOF()
+}
+
+func (db *Database) SetAppendFsync(policy string) {
+	var always int32
+	if policy == AppendFsyncAlways {
+		always = 1
+	}
+	atomic.StoreInt32(&db.fsyncAlways, always)
+}
+
+// fsyncAOF commits appended commands to disk when appendfsync is always,
+// otherwise the daemon flushes them periodically
+func (db *Database) fsyncAOF() error {
+	if atomic.LoadInt32(&db.fsyncAlways) == 0 {
+		return nil
+	}
+	defer db.latency.Since(LatencyAOFFsyncAlways, time.Now())
+	return db.aofBus.Fsync()
+}
+
+func (db *Database) PubSubBufferLimit() OutputBufferLimit {
+	return db.pubsubLimit.Load().(OutputBufferLimit)
+}
+
+func (db *Database) Stats() Stats {
+	return db.stats.Snapshot()
 }
 
 func (db *Database) Close() error {
@@ -105,30 +328,83 @@ func (db *Database) Close() error {
 	return errors.Errorf("%v", errs)
 }
 
-func (db *Database) exec(args [][]byte, isInternal bool) (result *executor.Result, err error) {
+// exec runs a command in the database index, client is the connection issuing it, nil for internal callers,
+// whose acl user is checked against the commands called by scripts
+func (db *Database) exec(client *Client, index int, args [][]byte, isInternal bool) (result *executor.Result, err error) {
 	if len(args) == 0 {
 		return nil, types.ErrInvalidNumberOfArgs
 	}
 	cmd := strings.ToUpper(string(args[0]))
+	if !isInternal {
+		if mayWrite(cmd) {
+			db.freeMemory()
+		}
+		db.expireKeys(index, executor.Lookup(cmd).Keys(args))
+	}
+	switch cmd {
+	case executor.EVAL, executor.EVALSHA, executor.FCALL, executor.FCALL_RO,
+		executor.MOVE, executor.SWAPDB, executor.FLUSHDB, executor.FLUSHALL:
+		return db.execExclusive(client, index, args, isInternal)
+	case executor.SCRIPT:
+		return db.Script(args)
+	case executor.FUNCTION:
+		return db.Function(args, isInternal)
+	}
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
 	exec := executor.New(cmd)
+	if exec == nil {
+		return nil, types.ErrUnknownCommand
+	}
 	if exec.IsWrite() {
 		if !isInternal && !db.IsWritable() {
 			return nil, types.ErrNodeReadOnly
 		}
-		if err := db.Record(args); err != nil {
+		if err := db.checkOOM(cmd, isInternal); err != nil {
+			return nil, err
+		}
+		if err := db.Record(index, args); err != nil {
 			return nil, errors.Wrap(err, "record cmd failed")
 		}
 	}
 
-	return exec.Exec(db.storage, args)
+	result, err = db.execute(db.keyspace(db.storage, index), index, exec, cmd, args)
+	if err == nil && exec.IsWrite() {
+		db.touch(index, exec.KeyArgs(args))
+	}
+	return result, err
 }
 
+// execExclusive runs a command in a transaction of its own, with the database locked
+func (db *Database) execExclusive(client *Client, index int, args [][]byte, isInternal bool) (*executor.Result, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	outputs, errs, err := db.execMulti(client, []AOFEntry{{DB: index, Args: args}}, isInternal)
+	if err != nil {
+		return nil, err
+	}
+	if errs[0] != nil {
+		return nil, errs[0]
+	}
+	return executor.NewResult(outputs[0]), nil
+}
+
+// Exec runs a command in the first database
 func (db *Database) Exec(args [][]byte) (result *executor.Result, err error) {
-	return db.exec(args, false)
+	return db.exec(nil, 0, args, false)
+}
+
+// ExecIn runs a command in the database index
+func (db *Database) ExecIn(index int, args [][]byte) (result *executor.Result, err error) {
+	return db.exec(nil, index, args, false)
 }
 
-func (db *Database) IExec(args [][]byte) (result *executor.Result, err error) {
-	return db.exec(args, true)
+// IExec runs a replicated command in the database index, even on a follower
+func (db *Database) IExec(index int, args [][]byte) (result *executor.Result, err error) {
+	return db.exec(nil, index, args, true)
 }
 
 func (db *Database) Daemon() error {
@@ -138,13 +414,31 @@ func (db *Database) Daemon() error {
 		fCancel context.CancelFunc
 	)
 
+	flushTicker := time.NewTicker(time.Millisecond * 500)
+	defer flushTicker.Stop()
+	expireTicker := time.NewTicker(expireCycleInterval)
+	defer expireTicker.Stop()
+	gcTicker := time.NewTicker(storageGCInterval)
+	defer gcTicker.Stop()
+	quotaTicker := time.NewTicker(diskQuotaInterval)
+	defer quotaTicker.Stop()
+
 	for {
 		select {
 		//flush aof
-		case <-time.After(time.Millisecond * 500):
-			if err := db.aofBus.Flush(); err != nil {
+		case <-flushTicker.C:
+			if err := db.flushAOF(); err != nil {
 				logger.Error("failed to flush aof file: %v", err)
 			}
+		//active expiration
+		case <-expireTicker.C:
+			db.expireCycle()
+		//reclaim disk space
+		case <-gcTicker.C:
+			db.storageGC()
+		//refuse writes before the disk is full
+		case <-quotaTicker.C:
+			db.checkDiskQuota()
 		case sig := <-db.sigFollowing:
 			if sig {
 				go func() {
@@ -166,14 +460,31 @@ func (db *Database) Daemon() error {
 	}
 }
 
+func (db *Database) storageGC() {
+	gc, ok := db.storage.(storage.GarbageCollector)
+	if !ok {
+		return
+	}
+	defer db.latency.Since(LatencyBadgerGC, time.Now())
+	if err := gc.RunGC(); err != nil {
+		logger.Error("failed to run storage gc: %v", err)
+	}
+}
+
 func (db *Database) SlaveOf(host, port string) error {
 	address := fmt.Sprintf("%s:%s", host, port)
 	var err error
-	ctx, _ := context.WithTimeout(context.Background(), time.Second*1)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*1)
+	defer cancel()
+	creds := grpc.WithInsecure()
+	if db.dialTLS != nil {
+		creds = grpc.WithTransportCredentials(credentials.NewTLS(db.dialTLS))
+	}
 	db.followingConn, err = grpc.DialContext(
 		ctx,
 		address,
-		grpc.WithInsecure(),
+		creds,
+		grpc.WithPerRPCCredentials(masterAuthCredentials{db: db}),
 		grpc.WithBlock(),
 	)
 	if err != nil {
@@ -194,18 +505,34 @@ func (db *Database) Following(ctx context.Context) error {
 		return types.ErrNodeIsMaster
 	}
 
+	db.replication.setLink(true, false)
+	defer db.replication.setLink(false, false)
+
 	client := proto.NewPidisClient(db.followingConn)
-	offsetId := NewUID()
-	//fetch snapshot
-	snapPath := path.Join(db.dir, fmt.Sprintf("%s.snapshot", offsetId.Timestamp()))
+	//fetch snapshot, the oplog is requested from its watermark
 	snapStream, err := client.Snapshot(ctx, &proto.SnapshotReq{})
 	if err != nil {
 		return errors.Wrap(err, "create snapshot stream failed")
 	}
+	header, err := snapStream.Header()
+	if err != nil {
+		return errors.Wrap(err, "recv snapshot header failed")
+	}
+	watermarks, functions := header.Get(snapshotWatermarkKey), header.Get(snapshotFunctionsKey)
+	if len(watermarks) != 1 || len(functions) != 1 {
+		return errors.New("snapshot without watermark")
+	}
+	offsetId, err := UIDFromString(watermarks[0])
+	if err != nil {
+		return errors.Wrap(err, "invalid snapshot watermark")
+	}
+	snapPath := path.Join(db.dir, "pidis"+snapshotExt+".tmp")
 	snapFile, err := os.OpenFile(snapPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, os.ModePerm)
 	if err != nil {
 		return errors.Wrap(err, "cannot open snapshot file")
 	}
+	defer func() { _ = snapFile.Close() }()
+	snapWriter := db.keyring.SealWriter(snapFile)
 	//save snapshot
 	for {
 		select {
@@ -221,17 +548,24 @@ func (db *Database) Following(ctx context.Context) error {
 			}
 
 			content := resp.GetPayload()
-			if _, err := snapFile.Write(content); err != nil {
+			if _, err := snapWriter.Write(content); err != nil {
 				return errors.Wrap(err, "append snapshot file failed")
 			}
+			db.replication.received(len(content))
 		}
 	}
 restore:
 	{
 		//restore snapshot
 		_, _ = snapFile.Seek(0, io.SeekStart)
-		if err := db.storage.LoadSnapshot(ctx, snapFile); err != nil {
-			return errors.Wrap(err, "load snapshot failed")
+		if err := db.loadSnapshot(ctx, db.keyring.UnsealReader(snapFile)); err != nil {
+			return err
+		}
+		if err := db.functions.Restore([]byte(functions[0]), "FLUSH"); err != nil {
+			return errors.Wrap(err, "restore functions failed")
+		}
+		if err := db.keepSnapshot(snapPath, []byte(functions[0])); err != nil {
+			return err
 		}
 	}
 
@@ -242,6 +576,8 @@ restore:
 	if err != nil {
 		return errors.Wrap(err, "fetch oplog failed")
 	}
+	db.replication.setLink(false, true)
+	replay := newReplayer(db)
 	for {
 		select {
 		case <-ctx.Done():
@@ -259,14 +595,14 @@ restore:
 			//TODO: concurrent
 			//replay oplog
 			for {
-				_, args, leftover, err := DecodeAOF(line)
+				uid, index, args, leftover, err := DecodeAOF(line)
 				if err != nil {
 					return errors.Wrap(err, "parse oplog failed")
 				}
-				_, err = db.IExec(args)
-				if err != nil {
+				if err := replay.Apply(index, args); err != nil {
 					return errors.Wrap(err, "replay oplog failed")
 				}
+				db.replication.apply(uid)
 				if len(leftover) == 0 {
 					break
 				}
@@ -276,6 +612,42 @@ restore:
 	}
 }
 
+// keepSnapshot names a snapshot loaded from the master after the watermark of the aof, which is replayed
+// from it on restore, and saves the function libraries along
+func (db *Database) keepSnapshot(file string, functions []byte) error {
+	mark, _ := db.aofBus.Mark()
+	watermark, err := UIDFromBytes(mark)
+	if err != nil {
+		return err
+	}
+	sealed, err := db.sealFunctions(functions)
+	if err != nil {
+		return err
+	}
+	name := path.Join(db.dir, followerSnapshotPrefix+watermark.String())
+	if err := ioutil.WriteFile(name+functionsExt, sealed, 0600); err != nil {
+		return errors.Wrap(err, "save functions failed")
+	}
+	return os.Rename(file, name+snapshotExt)
+}
+
+// loadSnapshot loads a storage snapshot and rebuilds the in-memory state from it
+func (db *Database) loadSnapshot(ctx context.Context, reader io.Reader) error {
+	if err := db.storage.LoadSnapshot(ctx, reader); err != nil {
+		return errors.Wrap(err, "load snapshot failed")
+	}
+	if err := db.loadKeyspaces(); err != nil {
+		return errors.Wrap(err, "load keyspaces failed")
+	}
+	if err := db.loadExpires(); err != nil {
+		return errors.Wrap(err, "load expires failed")
+	}
+	if err := db.loadMemory(); err != nil {
+		return errors.Wrap(err, "load memory failed")
+	}
+	return nil
+}
+
 func (db *Database) Sync(ctx context.Context, writer io.Writer, offset []byte) error {
 	return db.aofBus.Sync(ctx, writer, offset)
 }
@@ -2,17 +2,39 @@ package db
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"fmt"
+	"github.com/joway/pidis/proto"
+	"github.com/joway/pidis/storage"
+	"github.com/joway/pidis/types"
 	"github.com/joway/pidis/util"
 	"github.com/stretchr/testify/suite"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"io"
+	"io/ioutil"
 	"net"
 	"os"
 	"path"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
+const testLibrary = `#!lua name=testlib
+redis.register_function('test_set', function(keys, args)
+	return redis.call('SET', keys[1], args[1])
+end)
+redis.register_function{
+	function_name = 'test_get',
+	callback = function(keys, args) return redis.call('GET', keys[1]) end,
+	flags = {'no-writes'},
+}
+`
+
 type DBTestSuite struct {
 	suite.Suite
 
@@ -51,6 +73,8 @@ func (suite *DBTestSuite) TestSlaveOf() {
 
 	_, err = leader.Exec(util.CommandToArgs("set k x"))
 	suite.NoError(err)
+	_, err = leader.Exec([][]byte{[]byte("function"), []byte("load"), []byte(testLibrary)})
+	suite.NoError(err)
 	result, err := leader.Exec(util.CommandToArgs("get k"))
 	suite.NoError(err)
 	suite.Equal(result.Output()[4], byte('x'))
@@ -60,6 +84,11 @@ func (suite *DBTestSuite) TestSlaveOf() {
 
 	time.Sleep(time.Second)
 
+	//replayed writes invalidate keys tracked on follower
+	tracked := NewClient(nil)
+	follower.tracking.Enable(tracked, trackingOptions{on: true})
+	follower.tracking.Track(tracked, util.CommandToArgs("k2 k4"), cachingDefault)
+
 	_, err = leader.Exec(util.CommandToArgs("set k1 xxx"))
 	suite.NoError(err)
 	_, err = leader.Exec(util.CommandToArgs("set k2 xxx"))
@@ -67,6 +96,27 @@ func (suite *DBTestSuite) TestSlaveOf() {
 	time.Sleep(time.Millisecond * 100)
 	_, err = leader.Exec(util.CommandToArgs("set k3 xxx"))
 	suite.NoError(err)
+	client := NewClient(nil)
+	_, err = leader.Multi(client)
+	suite.NoError(err)
+	_, err = leader.Queue(client, util.CommandToArgs("set k4 xxx"))
+	suite.NoError(err)
+	_, err = leader.ExecMulti(client)
+	suite.NoError(err)
+	_, err = leader.Exec(util.CommandToArgs("eval return(redis.call('set',KEYS[1],'xxx')) 1 k5"))
+	suite.NoError(err)
+	//writes are applied to the database they were run in
+	_, err = leader.ExecIn(3, util.CommandToArgs("set k6 xxx"))
+	suite.NoError(err)
+	client.SetDB(1)
+	_, err = leader.Multi(client)
+	suite.NoError(err)
+	_, err = leader.Queue(client, util.CommandToArgs("select 2"))
+	suite.NoError(err)
+	_, err = leader.Queue(client, util.CommandToArgs("set k7 xxx"))
+	suite.NoError(err)
+	_, err = leader.ExecMulti(client)
+	suite.NoError(err)
 
 	time.Sleep(time.Millisecond * 1000)
 
@@ -82,6 +132,231 @@ func (suite *DBTestSuite) TestSlaveOf() {
 	result, err = follower.Exec(util.CommandToArgs("get k3"))
 	suite.NoError(err)
 	suite.Equal("xxx", string(result.Output()[4:7]))
+	result, err = follower.Exec(util.CommandToArgs("get k4"))
+	suite.NoError(err)
+	suite.Equal("xxx", string(result.Output()[4:7]))
+	result, err = follower.Exec(util.CommandToArgs("get k5"))
+	suite.NoError(err)
+	suite.Equal("xxx", string(result.Output()[4:7]))
+	result, err = follower.Exec(util.CommandToArgs("get k6"))
+	suite.NoError(err)
+	suite.Equal(util.MessageNull(), result.Output())
+	result, err = follower.ExecIn(3, util.CommandToArgs("get k6"))
+	suite.NoError(err)
+	suite.Equal("xxx", string(result.Output()[4:7]))
+	result, err = follower.ExecIn(2, util.CommandToArgs("get k7"))
+	suite.NoError(err)
+	suite.Equal("xxx", string(result.Output()[4:7]))
+
+	suite.Empty(follower.tracking.Invalidate(util.CommandToArgs("k2 k4")))
+
+	info := follower.Info([]string{"replication"})
+	suite.Contains(info, "role:slave\r\n")
+	suite.Contains(info, "master_port:10001\r\n")
+	suite.Contains(info, "master_link_status:up\r\n")
+	suite.Regexp("master_last_applied_uid:[0-9a-v]{20}\r\n", info)
+	info = leader.Info([]string{"replication"})
+	suite.Contains(info, "role:master\r\n")
+	suite.Contains(info, "connected_slaves:1\r\n")
+	state := leader.replication.State()
+	suite.Require().Len(state.Followers, 1)
+	suite.Equal(int64(0), state.Followers[0].Lag(leader.aofBus))
+	suite.True(state.Followers[0].Sent > 0)
+	suite.True(follower.replication.State().Applied > 0)
+	suite.True(follower.replication.State().SnapshotBytes > 0)
+	//the loaded snapshot is kept along with the functions, named after the watermark of the follower aof
+	snapshots, err := listSnapshots(path.Join(suite.dir, "follower"), false)
+	suite.NoError(err)
+	suite.Require().Len(snapshots, 1)
+	_, err = os.Stat(snapshots[0].functions)
+	suite.NoError(err)
+
+	//read only functions are allowed on follower
+	result, err = follower.Exec(util.CommandToArgs("fcall_ro test_get 1 k5"))
+	suite.NoError(err)
+	suite.Equal("xxx", string(result.Output()[4:7]))
+	_, err = follower.Exec(util.CommandToArgs("fcall test_set 1 k5 yyy"))
+	suite.Equal(types.ErrNodeReadOnly, err)
+}
+
+func (suite *DBTestSuite) TestFunctionPersist() {
+	dir := path.Join(suite.dir, "functions")
+	db, err := New(Options{DBDir: dir})
+	suite.NoError(err)
+	_, err = db.Exec([][]byte{[]byte("function"), []byte("load"), []byte(testLibrary)})
+	suite.NoError(err)
+	_ = db.Close()
+
+	db, err = New(Options{DBDir: dir})
+	suite.NoError(err)
+	defer func() { _ = db.Close() }()
+	_, err = db.Exec(util.CommandToArgs("fcall test_set 1 k xxx"))
+	suite.NoError(err)
+	result, err := db.Exec(util.CommandToArgs("fcall_ro test_get 1 k"))
+	suite.NoError(err)
+	suite.Equal("xxx", string(result.Output()[4:7]))
+}
+
+func (suite *DBTestSuite) TestFailedFunctionLoad() {
+	db, err := New(Options{DBDir: path.Join(suite.dir, "functions")})
+	suite.Require().NoError(err)
+	defer func() { _ = db.Close() }()
+
+	//the library is unloaded once it can't be recorded
+	atomic.StoreInt32(&db.fsyncAlways, 1)
+	suite.NoError(db.aofBus.file.Close())
+	_, err = db.Exec([][]byte{[]byte("function"), []byte("load"), []byte(testLibrary)})
+	suite.Error(err)
+	suite.Nil(db.functions.Get("test_set"))
+	payload, err := ioutil.ReadFile(path.Join(suite.dir, "functions", "pidis.functions"))
+	suite.NoError(err)
+	suite.Equal("*0\r\n", string(payload))
+}
+
+func (suite *DBTestSuite) TestKeyspacesPersist() {
+	dir := path.Join(suite.dir, "keyspaces")
+	db, err := New(Options{DBDir: dir})
+	suite.NoError(err)
+	_, err = db.Exec(util.CommandToArgs("set k 0"))
+	suite.NoError(err)
+	_, err = db.ExecIn(1, util.CommandToArgs("set k 1"))
+	suite.NoError(err)
+	_, err = db.Exec(util.CommandToArgs("swapdb 0 1"))
+	suite.NoError(err)
+	_, err = db.ExecIn(1, util.CommandToArgs("flushdb"))
+	suite.NoError(err)
+	suite.Equal([]int{1, 16}, db.keyspaces.Save()[:2])
+	_ = db.Close()
+
+	db, err = New(Options{DBDir: dir})
+	suite.NoError(err)
+	defer func() { _ = db.Close() }()
+	result, err := db.Exec(util.CommandToArgs("get k"))
+	suite.NoError(err)
+	suite.Equal("1", string(result.Output()[4:5]))
+	result, err = db.ExecIn(1, util.CommandToArgs("get k"))
+	suite.NoError(err)
+	suite.Equal(util.MessageNull(), result.Output())
+	//the flushed slot has been dropped
+	pairs, err := db.storage.Scan(storage.ScanOptions{Pattern: "k"})
+	suite.NoError(err)
+	suite.Empty(pairs)
+}
+
+func (suite *DBTestSuite) TestKeyspaceIsolation() {
+	dir := path.Join(suite.dir, "isolation")
+	db, err := New(Options{DBDir: dir})
+	suite.Require().NoError(err)
+	_, err = db.ExecIn(1, util.CommandToArgs("set foo 1"))
+	suite.NoError(err)
+	//keys of the first database looking like the stored keys of the others or the internal ones are escaped
+	_, err = db.Exec(util.CommandToArgs("set \x01ks1:foo leaked"))
+	suite.NoError(err)
+	_, err = db.Exec(util.CommandToArgs("set \x01ks:slots garbage"))
+	suite.NoError(err)
+	result, err := db.ExecIn(1, util.CommandToArgs("get foo"))
+	suite.NoError(err)
+	suite.Equal("$1\r\n1\r\n", string(result.Output()))
+	result, err = db.Exec(util.CommandToArgs("get \x01ks1:foo"))
+	suite.NoError(err)
+	suite.Equal("$6\r\nleaked\r\n", string(result.Output()))
+	pairs, err := db.keyspace(db.storage, 0).Scan(storage.ScanOptions{Pattern: "\x01ks*"})
+	suite.NoError(err)
+	suite.Len(pairs, 2)
+	pairs, err = db.keyspace(db.storage, 1).Scan(storage.ScanOptions{Pattern: "*"})
+	suite.NoError(err)
+	suite.Len(pairs, 1)
+	_ = db.Close()
+
+	db, err = New(Options{DBDir: dir})
+	suite.Require().NoError(err)
+	defer func() { _ = db.Close() }()
+	result, err = db.Exec(util.CommandToArgs("get \x01ks:slots"))
+	suite.NoError(err)
+	suite.Equal("$7\r\ngarbage\r\n", string(result.Output()))
+	result, err = db.ExecIn(1, util.CommandToArgs("get foo"))
+	suite.NoError(err)
+	suite.Equal("$1\r\n1\r\n", string(result.Output()))
+}
+
+func (suite *DBTestSuite) TestFailedFlush() {
+	db, err := New(Options{DBDir: path.Join(suite.dir, "flush")})
+	suite.Require().NoError(err)
+	defer func() { _ = db.Close() }()
+	_, err = db.Exec(util.CommandToArgs("set k v ex 100"))
+	suite.NoError(err)
+	suite.Equal(1, db.expires.Len())
+
+	//the flush is rolled back once it can't be recorded, its keys stay indexed
+	atomic.StoreInt32(&db.fsyncAlways, 1)
+	suite.NoError(db.aofBus.file.Close())
+	_, err = db.Exec(util.CommandToArgs("flushdb"))
+	suite.Error(err)
+	suite.Equal(1, db.expires.Len())
+	suite.Equal([]int{0, 1}, db.keyspaces.Save()[:2])
+	result, err := db.IExec(0, util.CommandToArgs("get k"))
+	suite.NoError(err)
+	suite.Equal("$1\r\nv\r\n", string(result.Output()))
+}
+
+func (suite *DBTestSuite) TestDiskQuota() {
+	quota := NewDiskQuota()
+	quota.SetLimit(100)
+	exceeded, changed := quota.Update(100)
+	suite.True(exceeded)
+	suite.True(changed)
+	//writes resume under the low watermark only
+	exceeded, changed = quota.Update(95)
+	suite.True(exceeded)
+	suite.False(changed)
+	exceeded, changed = quota.Update(89)
+	suite.False(exceeded)
+	suite.True(changed)
+
+	db, err := New(Options{DBDir: path.Join(suite.dir, "quota")})
+	suite.NoError(err)
+	defer func() { _ = db.Close() }()
+	client := NewClient(nil)
+	_, err = db.Exec(util.CommandToArgs("set k v"))
+	suite.NoError(err)
+	_, err = db.Config(client, "SET", util.CommandToArgs("disk-quota 1 disk-quota-aof-rewrite yes"))
+	suite.NoError(err)
+	db.checkDiskQuota()
+	suite.True(db.diskQuota.Usage() > 0)
+	suite.Contains(db.Info([]string{"persistence"}), "disk_quota_exceeded:1\r\n")
+	_, err = db.Exec(util.CommandToArgs("set k2 v"))
+	suite.Equal(types.ErrDiskQuota, err)
+	_, err = db.Exec(util.CommandToArgs("del k"))
+	suite.NoError(err)
+	//without snapshots the aof isn't rewritten, archiving it wouldn't free anything
+	archives, err := db.aofBus.Archives()
+	suite.NoError(err)
+	suite.Empty(archives)
+	stat, err := db.aofBus.Stat()
+	suite.NoError(err)
+	suite.NotZero(stat.Size + int64(stat.Buffered))
+	//the rewritten entries are archived until a snapshot holds them
+	snapshot := path.Join(suite.dir, "quota", followerSnapshotPrefix+UIDFromTime(time.Now().Add(-time.Hour)).String()+snapshotExt)
+	suite.NoError(ioutil.WriteFile(snapshot, nil, os.ModePerm))
+	db.checkDiskQuota()
+	archives, err = db.aofBus.Archives()
+	suite.NoError(err)
+	suite.Len(archives, 1)
+	stat, err = db.aofBus.Stat()
+	suite.NoError(err)
+	suite.Zero(stat.Size + int64(stat.Buffered))
+	//space is reclaimed on every check while the quota is exceeded
+	suite.NoError(os.Rename(snapshot, path.Join(suite.dir, "quota", followerSnapshotPrefix+UIDFromTime(time.Now().Add(2*time.Second)).String()+snapshotExt)))
+	db.checkDiskQuota()
+	archives, err = db.aofBus.Archives()
+	suite.NoError(err)
+	suite.Empty(archives)
+
+	_, err = db.Config(client, "SET", util.CommandToArgs("disk-quota 1gb"))
+	suite.NoError(err)
+	db.checkDiskQuota()
+	_, err = db.Exec(util.CommandToArgs("set k2 v"))
+	suite.NoError(err)
 }
 
 func (suite *DBTestSuite) TestSnapshot() {
@@ -116,3 +391,276 @@ func (suite *DBTestSuite) TestSnapshot() {
 	suite.NoError(err)
 	suite.Equal(result.Output()[4], byte('x'))
 }
+
+func (suite *DBTestSuite) TestNotifyKeyspaceEventsFlags() {
+	flags, err := ParseNotifyKeyspaceEvents("KEA")
+	suite.NoError(err)
+	suite.Equal(NotifyKeyspace|NotifyKeyevent|NotifyAll, flags)
+	suite.Equal("AKE", FormatNotifyKeyspaceEvents(flags))
+
+	flags, err = ParseNotifyKeyspaceEvents("Kx$")
+	suite.NoError(err)
+	suite.Equal(NotifyKeyspace|NotifyExpired|NotifyString, flags)
+	suite.Equal("$xK", FormatNotifyKeyspaceEvents(flags))
+
+	_, err = ParseNotifyKeyspaceEvents("KEy")
+	suite.Equal(types.ErrInvalidNotifyFlags, err)
+}
+
+func (suite *DBTestSuite) TestExpireCycle() {
+	db, err := New(Options{DBDir: suite.dir})
+	suite.NoError(err)
+	defer func() { _ = db.Close() }()
+
+	_, err = db.Exec(util.CommandToArgs("set k1 v px 100"))
+	suite.NoError(err)
+	_, err = db.Exec(util.CommandToArgs("set k2 v ex 100"))
+	suite.NoError(err)
+	_, err = db.Exec(util.CommandToArgs("set k3 v px 100"))
+	suite.NoError(err)
+	_, err = db.Exec(util.CommandToArgs("set k3 v"))
+	suite.NoError(err)
+	suite.Equal(2, db.expires.Len())
+
+	time.Sleep(time.Millisecond * 1100)
+	db.expireCycle()
+	suite.Equal(1, db.expires.Len())
+	suite.EqualValues(1, db.Stats().ExpiredKeys)
+	suite.Equal([]string{"DEL k1"}, suite.recordedSinceDel(db))
+}
+
+func (suite *DBTestSuite) TestExpireOnAccess() {
+	db, err := New(Options{DBDir: suite.dir})
+	suite.NoError(err)
+	defer func() { _ = db.Close() }()
+
+	_, err = db.ExecIn(2, util.CommandToArgs("set k v px 100"))
+	suite.NoError(err)
+	time.Sleep(time.Millisecond * 1100)
+	//the expiration is recorded before the command which sees the key missing
+	_, err = db.ExecIn(2, util.CommandToArgs("set k w nx"))
+	suite.NoError(err)
+	suite.Zero(db.expires.Len())
+	suite.Equal([]string{"DEL k", "set k w nx"}, suite.recordedSinceDel(db))
+}
+
+func (suite *DBTestSuite) TestCompression() {
+	db, err := New(Options{DBDir: suite.dir, BlockCompression: storage.CompressionZSTD})
+	suite.Require().NoError(err)
+	defer func() { _ = db.Close() }()
+
+	client := NewClient(nil)
+	_, err = db.Config(client, "SET", util.CommandToArgs("value-compression snappy value-compression-threshold 64"))
+	suite.NoError(err)
+	_, err = db.Config(client, "SET", util.CommandToArgs("value-compression lz4"))
+	suite.Error(err)
+	value := strings.Repeat(`{"name":"pidis"}`, 64)
+	_, err = db.Exec([][]byte{[]byte("set"), []byte("k"), []byte(value)})
+	suite.NoError(err)
+	result, err := db.Exec(util.CommandToArgs("get k"))
+	suite.NoError(err)
+	suite.Equal(fmt.Sprintf("$%d\r\n%s\r\n", len(value), value), string(result.Output()))
+
+	info := db.Info([]string{"persistence"})
+	suite.Contains(info, "value_compression:snappy")
+	suite.Contains(info, "storage_block_compression:zstd")
+	suite.NotContains(info, "value_compression_ratio:1.00")
+}
+
+// recordedSinceDel returns the commands recorded in the aof of db from the first DEL on
+func (suite *DBTestSuite) recordedSinceDel(db *Database) []string {
+	suite.NoError(db.aofBus.Flush())
+	content, err := ioutil.ReadFile(path.Join(suite.dir, "pidis.aof"))
+	suite.NoError(err)
+	var cmds []string
+	for len(content) > 0 {
+		_, _, args, leftover, err := DecodeAOF(content)
+		suite.Require().NoError(err)
+		if string(args[0]) == "DEL" || len(cmds) > 0 {
+			cmds = append(cmds, string(bytes.Join(args, []byte(" "))))
+		}
+		content = leftover
+	}
+	return cmds
+}
+
+func (suite *DBTestSuite) TestTracking() {
+	tracking := NewTracking()
+	c1, c2, c3 := NewClient(nil), NewClient(nil), NewClient(nil)
+	tracking.Enable(c1, trackingOptions{on: true})
+	tracking.Enable(c2, trackingOptions{on: true, bcast: true, prefixes: []string{"a:"}})
+	tracking.Enable(c3, trackingOptions{on: true, optIn: true})
+
+	tracking.Track(c1, util.CommandToArgs("k1 a:1"), cachingDefault)
+	tracking.Track(c3, util.CommandToArgs("k2"), cachingDefault)
+	tracking.Track(c3, util.CommandToArgs("k3"), cachingYes)
+
+	suite.Len(tracking.Invalidate(util.CommandToArgs("k1")), 1)
+	suite.Len(tracking.Invalidate(util.CommandToArgs("k1")), 0)
+	suite.Len(tracking.Invalidate(util.CommandToArgs("a:1")), 2)
+	suite.Len(tracking.Invalidate(util.CommandToArgs("a:2")), 1)
+	suite.Len(tracking.Invalidate(util.CommandToArgs("k2")), 0)
+	suite.Len(tracking.Invalidate(util.CommandToArgs("k3")), 1)
+
+	tracking.Disable(c2)
+	suite.Len(tracking.Invalidate(util.CommandToArgs("a:2")), 0)
+
+	//keys of a disabled client are forgotten with it
+	tracking.Track(c1, util.CommandToArgs("k1 k2"), cachingDefault)
+	tracking.Track(c3, util.CommandToArgs("k2"), cachingYes)
+	tracking.Disable(c1)
+	suite.Len(tracking.keys, 1)
+	suite.Len(tracking.tracked, 1)
+	suite.Len(tracking.Invalidate(util.CommandToArgs("k1 k2")), 1)
+	suite.Empty(tracking.keys)
+	suite.Empty(tracking.tracked)
+}
+
+func (suite *DBTestSuite) TestACL() {
+	file := path.Join(suite.dir, "users.acl")
+	acl, err := NewACL(file)
+	suite.NoError(err)
+	suite.NoError(acl.SetUser("alice", []string{"on", ">secret", "~cache:*", "&news.*", "+@all", "-@dangerous", "+keys"}))
+
+	alice := acl.Get("alice")
+	suite.True(alice.CanRun("GET"))
+	suite.True(alice.CanRun("KEYS"))
+	suite.False(alice.CanRun("SHUTDOWN"))
+	suite.True(alice.CanAccessKey([]byte("cache:1")))
+	suite.False(alice.CanAccessKey([]byte("other")))
+	suite.True(alice.CanAccessChannel([]byte("news.tech"), false))
+	suite.True(alice.CanAccessChannel([]byte("news.*"), true))
+	suite.False(alice.CanAccessChannel([]byte("news.t*"), true))
+	_, ok := acl.Authenticate("alice", "secret")
+	suite.True(ok)
+	_, ok = acl.Authenticate("alice", "wrong")
+	suite.False(ok)
+
+	//a failed rule leaves the user untouched
+	suite.Error(acl.SetUser("alice", []string{"off", "+nosuchcommand"}))
+	suite.True(acl.Get("alice").enabled)
+
+	reloaded, err := NewACL(file)
+	suite.NoError(err)
+	suite.Equal(alice.Describe(), reloaded.Get("alice").Describe())
+	suite.Equal("user default on nopass ~* &* +@all", reloaded.Get(DefaultUser).Describe())
+
+	deleted, err := reloaded.DelUser([]string{"alice", "bob"})
+	suite.NoError(err)
+	suite.Equal(1, deleted)
+	_, err = reloaded.DelUser([]string{DefaultUser})
+	suite.Equal(types.ErrDeleteDefaultUser, err)
+}
+
+func (suite *DBTestSuite) TestMasterAuth() {
+	leader, err := New(Options{
+		DBDir:      path.Join(suite.dir, "leader"),
+		MasterAuth: "secret",
+	})
+	suite.NoError(err)
+	follower, err := New(Options{
+		DBDir:      path.Join(suite.dir, "follower"),
+		MasterAuth: "secret",
+	})
+	suite.NoError(err)
+	intruder, err := New(Options{
+		DBDir:      path.Join(suite.dir, "intruder"),
+		MasterAuth: "guess",
+	})
+	suite.NoError(err)
+	leader.Run()
+	follower.Run()
+	intruder.Run()
+
+	leaderListen, err := net.Listen("tcp", ":10003")
+	suite.NoError(err)
+	server := NewRpcServer(leader)
+	defer server.Stop()
+	go func() {
+		_ = server.Serve(leaderListen)
+	}()
+
+	_, err = leader.Exec(util.CommandToArgs("set k x"))
+	suite.NoError(err)
+
+	//callers without the secret can't stream the dataset
+	conn, err := grpc.Dial("127.0.0.1:10003", grpc.WithInsecure())
+	suite.NoError(err)
+	defer conn.Close()
+	stream, err := proto.NewPidisClient(conn).Snapshot(context.Background(), &proto.SnapshotReq{})
+	suite.NoError(err)
+	_, err = stream.Recv()
+	suite.Equal(codes.Unauthenticated, status.Code(err))
+
+	suite.NoError(follower.SlaveOf("127.0.0.1", "10003"))
+	suite.NoError(intruder.SlaveOf("127.0.0.1", "10003"))
+	time.Sleep(time.Second)
+
+	result, err := follower.Exec(util.CommandToArgs("get k"))
+	suite.NoError(err)
+	suite.Equal(byte('x'), result.Output()[4])
+	result, err = intruder.Exec(util.CommandToArgs("get k"))
+	suite.NoError(err)
+	suite.Equal(util.MessageNull(), result.Output())
+
+	//secret rotation applies to new rpcs
+	leader.SetMasterAuth("guess")
+	stream, err = proto.NewPidisClient(intruder.followingConn).Snapshot(context.Background(), &proto.SnapshotReq{})
+	suite.NoError(err)
+	_, err = stream.Recv()
+	suite.NotEqual(codes.Unauthenticated, status.Code(err))
+}
+
+func (suite *DBTestSuite) TestConfig() {
+	file := path.Join(suite.dir, "pidis.conf")
+	content := "# pidis\nport 7000\ndir " + path.Join(suite.dir, "config") + "\n" +
+		"notify-keyspace-events \"Ex\"\nslaveof 127.0.0.1 7001\nrequirepass 'p w'\n"
+	suite.NoError(ioutil.WriteFile(file, []byte(content), 0600))
+
+	config, err := LoadConfig(file)
+	suite.NoError(err)
+	suite.Equal("7000", config.Get("port"))
+	suite.Equal("xE", config.Get("notify-keyspace-events"))
+	host, port := config.ReplicaOf()
+	suite.Equal("127.0.0.1", host)
+	suite.Equal("7001", port)
+	suite.Error(config.Set("port", "http"))
+	suite.Error(config.Set("tls-replication", "maybe"))
+
+	options, err := config.Options()
+	suite.NoError(err)
+	database, err := New(options)
+	suite.NoError(err)
+	suite.Equal("xE", database.NotifyKeyspaceEvents())
+	_, ok := database.acl.Authenticate(DefaultUser, "p w")
+	suite.True(ok)
+
+	client := NewClient(nil)
+	_, err = database.Config(client, "SET", util.CommandToArgs("appendfsync always masterauth secret"))
+	suite.NoError(err)
+	suite.Equal(int32(1), database.fsyncAlways)
+	suite.Equal("secret", database.MasterAuth())
+	_, err = database.Config(client, "SET", util.CommandToArgs("masterauth other dir /tmp"))
+	suite.Error(err)
+	suite.Equal("secret", database.MasterAuth())
+
+	_, err = database.Exec(util.CommandToArgs("get missing"))
+	suite.NoError(err)
+	suite.Equal(int64(1), database.Stats().KeyspaceMisses)
+	_, err = database.Config(client, "RESETSTAT", nil)
+	suite.NoError(err)
+	suite.Equal(Stats{}, database.Stats())
+
+	//comments and positions are kept, changed defaults are appended
+	_, err = database.Config(client, "REWRITE", nil)
+	suite.NoError(err)
+	rewritten, err := ioutil.ReadFile(file)
+	suite.NoError(err)
+	suite.Equal("# pidis\nport 7000\ndir "+path.Join(suite.dir, "config")+"\n"+
+		"notify-keyspace-events xE\nreplicaof 127.0.0.1 7001\nrequirepass \"p w\"\n"+
+		"appendfsync always\nmasterauth secret\n", string(rewritten))
+	reloaded, err := LoadConfig(file)
+	suite.NoError(err)
+	suite.Equal("p w", reloaded.Get("requirepass"))
+	suite.Equal("always", reloaded.Get("appendfsync"))
+}
@@ -0,0 +1,459 @@
+package db
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/joway/pidis/executor"
+	"github.com/joway/pidis/storage"
+	"github.com/joway/pidis/types"
+	"github.com/joway/pidis/util"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	//EncryptionKeyEnv holds the master key when no key file is configured
+	EncryptionKeyEnv = "PIDIS_ENCRYPTION_KEY"
+
+	DefaultEncryptionKeyRotation = 10 * 24 * time.Hour
+
+	dataKeySize = 32
+	nonceSize   = 12
+
+	//segmentMarker starts a sealed segment, plaintext aof entries start with '*'
+	segmentMarker = 0
+	//a segment is the marker, the length of its body, and the body made of a data key id, a nonce and the ciphertext
+	segmentHeaderSize = 5
+	segmentBodyHeader = 4 + nonceSize
+	//a keyring record is a data key id, its creation time, a nonce and the data key sealed by the master key
+	keyringRecordSize = 4 + 8 + nonceSize + dataKeySize + 16
+)
+
+// LoadMasterKey reads the hex encoded master key from file, or from PIDIS_ENCRYPTION_KEY when file is empty.
+// It returns a nil key when encryption isn't configured
+func LoadMasterKey(file string) ([]byte, error) {
+	encoded := os.Getenv(EncryptionKeyEnv)
+	if file != "" {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		encoded = string(content)
+	}
+	encoded = strings.TrimSpace(encoded)
+	if encoded == "" {
+		return nil, nil
+	}
+	key, err := hex.DecodeString(encoded)
+	if err != nil {
+		return nil, errors.New("encryption key must be hex encoded")
+	}
+	if len(key) != 16 && len(key) != 24 && len(key) != 32 {
+		return nil, errors.New("encryption key must be 16, 24 or 32 bytes for AES-128, AES-192 or AES-256")
+	}
+	return key, nil
+}
+
+type dataKey struct {
+	key     []byte
+	created time.Time
+	aead    cipher.AEAD
+}
+
+// Keyring holds the data keys sealing the aof and snapshots with AES-GCM, the data keys are stored
+// encrypted by the master key so rotating it only rewrites the keyring. A nil keyring disables encryption
+type Keyring struct {
+	lock     sync.RWMutex
+	path     string
+	master   []byte
+	rotation time.Duration
+
+	keys    map[uint32]*dataKey
+	current uint32
+}
+
+// OpenKeyring loads the data keys of path with master, a first data key is created for a new keyring
+func OpenKeyring(path string, master []byte, rotation time.Duration) (*Keyring, error) {
+	if rotation <= 0 {
+		rotation = DefaultEncryptionKeyRotation
+	}
+	k := &Keyring{path: path, master: master, rotation: rotation, keys: make(map[uint32]*dataKey)}
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return k, k.rotate()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(content)%keyringRecordSize != 0 {
+		return nil, errors.New("keyring is corrupted")
+	}
+	aead, err := newAEAD(master)
+	if err != nil {
+		return nil, err
+	}
+	for ; len(content) > 0; content = content[keyringRecordSize:] {
+		id := binary.BigEndian.Uint32(content)
+		created := time.Unix(0, int64(binary.BigEndian.Uint64(content[4:])))
+		nonce := content[12 : 12+nonceSize]
+		key, err := aead.Open(nil, nonce, content[12+nonceSize:keyringRecordSize], content[:12])
+		if err != nil {
+			return nil, errors.New("encryption key doesn't match the keyring")
+		}
+		if err := k.add(id, key, created); err != nil {
+			return nil, err
+		}
+		if id >= k.current {
+			k.current = id
+		}
+	}
+	return k, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (k *Keyring) add(id uint32, key []byte, created time.Time) error {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+	k.keys[id] = &dataKey{key: key, created: created, aead: aead}
+	return nil
+}
+
+func (k *Keyring) Enabled() bool {
+	return k != nil
+}
+
+// Current returns the id and the creation time of the data key sealing new segments
+func (k *Keyring) Current() (uint32, time.Time) {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	return k.current, k.keys[k.current].created
+}
+
+// Master returns the master key the data keys are stored with
+func (k *Keyring) Master() []byte {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	return k.master
+}
+
+// Rotate seals the following segments with a new data key, older keys are kept to open the existing ones
+func (k *Keyring) Rotate() error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	return k.rotate()
+}
+
+func (k *Keyring) rotate() error {
+	key := make([]byte, dataKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	id := k.current + 1
+	if err := k.add(id, key, time.Now()); err != nil {
+		return err
+	}
+	if err := k.save(k.master); err != nil {
+		delete(k.keys, id)
+		return err
+	}
+	k.current = id
+	return nil
+}
+
+// Rekey stores the data keys encrypted by a new master key
+func (k *Keyring) Rekey(master []byte) error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if err := k.save(master); err != nil {
+		return err
+	}
+	k.master = master
+	return nil
+}
+
+// save rewrites the keyring with master, the file is replaced atomically
+func (k *Keyring) save(master []byte) error {
+	aead, err := newAEAD(master)
+	if err != nil {
+		return err
+	}
+	var content []byte
+	for id, dk := range k.keys {
+		header := make([]byte, 12)
+		binary.BigEndian.PutUint32(header, id)
+		binary.BigEndian.PutUint64(header[4:], uint64(dk.created.UnixNano()))
+		nonce := make([]byte, nonceSize)
+		if _, err := rand.Read(nonce); err != nil {
+			return err
+		}
+		record := append(append(make([]byte, 0, keyringRecordSize), header...), nonce...)
+		content = append(content, aead.Seal(record, nonce, dk.key, header)...)
+	}
+	tmp := k.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, k.path)
+}
+
+// Seal encrypts plain into a segment with the current data key, which is rotated once expired
+func (k *Keyring) Seal(plain []byte) ([]byte, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if time.Since(k.keys[k.current].created) > k.rotation {
+		if err := k.rotate(); err != nil {
+			return nil, err
+		}
+	}
+	segment := make([]byte, segmentHeaderSize+segmentBodyHeader, segmentHeaderSize+segmentBodyHeader+len(plain)+16)
+	segment[0] = segmentMarker
+	binary.BigEndian.PutUint32(segment[1:], uint32(segmentBodyHeader+len(plain)+16))
+	binary.BigEndian.PutUint32(segment[segmentHeaderSize:], k.current)
+	nonce := segment[segmentHeaderSize+4:]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return k.keys[k.current].aead.Seal(segment, nonce, plain, nil), nil
+}
+
+// open decrypts the body of a segment
+func (k *Keyring) open(body []byte) ([]byte, error) {
+	if k == nil {
+		return nil, errors.New("encrypted segment found without an encryption key")
+	}
+	if len(body) < segmentBodyHeader {
+		return nil, types.ErrInvalidAOFFormat
+	}
+	k.lock.RLock()
+	dk, ok := k.keys[binary.BigEndian.Uint32(body)]
+	k.lock.RUnlock()
+	if !ok {
+		return nil, errors.Errorf("data key %d of segment not found", binary.BigEndian.Uint32(body))
+	}
+	return dk.aead.Open(nil, body[4:segmentBodyHeader], body[segmentBodyHeader:], nil)
+}
+
+// Unseal decrypts the complete segments at the start of content and passes plaintext aof entries through,
+// so an aof written before encryption was enabled stays readable
+func (k *Keyring) Unseal(content []byte) (plain, leftover []byte, err error) {
+	for len(content) > 0 {
+		if content[0] != segmentMarker {
+			uid, _, args, left, err := DecodeAOF(content)
+			if err != nil {
+				return nil, content, err
+			}
+			if uid == nil && args == nil {
+				break
+			}
+			plain = append(plain, content[:len(content)-len(left)]...)
+			content = left
+			continue
+		}
+		if len(content) < segmentHeaderSize {
+			break
+		}
+		size := int(binary.BigEndian.Uint32(content[1:]))
+		if len(content) < segmentHeaderSize+size {
+			break
+		}
+		opened, err := k.open(content[segmentHeaderSize : segmentHeaderSize+size])
+		if err != nil {
+			return nil, content, err
+		}
+		plain = append(plain, opened...)
+		content = content[segmentHeaderSize+size:]
+	}
+	return plain, content, nil
+}
+
+// sealWriter seals every write into a segment of its own
+type sealWriter struct {
+	keyring *Keyring
+	w       io.Writer
+}
+
+// SealWriter returns a writer encrypting into w, or w itself when encryption is disabled
+func (k *Keyring) SealWriter(w io.Writer) io.Writer {
+	if k == nil {
+		return w
+	}
+	return &sealWriter{keyring: k, w: w}
+}
+
+func (w *sealWriter) Write(p []byte) (int, error) {
+	segment, err := w.keyring.Seal(p)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := w.w.Write(segment); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// unsealReader decrypts the segments written by a sealWriter
+type unsealReader struct {
+	keyring *Keyring
+	r       io.Reader
+	plain   []byte
+}
+
+// UnsealReader returns a reader decrypting r, or r itself when encryption is disabled
+func (k *Keyring) UnsealReader(r io.Reader) io.Reader {
+	if k == nil {
+		return r
+	}
+	return &unsealReader{keyring: k, r: r}
+}
+
+func (r *unsealReader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		header := make([]byte, segmentHeaderSize)
+		if _, err := io.ReadFull(r.r, header); err != nil {
+			return 0, err
+		}
+		if header[0] != segmentMarker {
+			return 0, errors.New("invalid encrypted segment")
+		}
+		body := make([]byte, binary.BigEndian.Uint32(header[1:]))
+		if _, err := io.ReadFull(r.r, body); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		plain, err := r.keyring.open(body)
+		if err != nil {
+			return 0, err
+		}
+		r.plain = plain
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+// openEncryption loads the master key and the keyring of a database, a data dir written in plaintext
+// has its data keys encrypted when encryption is first enabled
+func openEncryption(dir, keyFile string, rotation time.Duration, options *storage.Options) (*Keyring, error) {
+	master, err := LoadMasterKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	keyringPath := path.Join(dir, "pidis.keys")
+	_, statErr := os.Stat(keyringPath)
+	if master == nil {
+		if statErr == nil {
+			return nil, errors.New("the data is encrypted, an encryption key is required")
+		}
+		return nil, nil
+	}
+	if os.IsNotExist(statErr) && options.Storage != storage.TypeMemory {
+		if _, err := os.Stat(path.Join(options.Dir, "KEYREGISTRY")); err == nil {
+			if err := storage.RekeyBadger(options.Dir, nil, master); err != nil {
+				return nil, errors.Wrap(err, "encrypt data keys failed")
+			}
+		}
+	}
+	options.EncryptionKey = master
+	options.EncryptionKeyRotation = rotation
+	return OpenKeyring(keyringPath, master, rotation)
+}
+
+// RotateEncryption seals the following aof segments and snapshots with a new data key.
+// The master key is read again, when it has changed every data key is encrypted with the new one
+func (db *Database) RotateEncryption() error {
+	if !db.keyring.Enabled() {
+		return types.ErrEncryptionDisabled
+	}
+	master, err := LoadMasterKey(db.encryptionKeyFile)
+	if err != nil {
+		return types.ReplyError("ERR " + err.Error())
+	}
+	if master == nil {
+		return types.ReplyError("ERR the encryption key is missing")
+	}
+	if old := db.keyring.Master(); !bytes.Equal(master, old) {
+		if err := db.rekey(old, master); err != nil {
+			return err
+		}
+		logger.Info("encryption master key rotated")
+	}
+	if err := db.keyring.Rotate(); err != nil {
+		return errors.Wrap(err, "rotate data key failed")
+	}
+	id, _ := db.keyring.Current()
+	logger.Info("encryption data key rotated to %d", id)
+	return nil
+}
+
+// rekey encrypts the data keys of the storage and of the keyring with master
+func (db *Database) rekey(old, master []byte) error {
+	if db.replication.State().SnapshotsServing > 0 {
+		return types.ReplyError("ERR the master key can't be rotated while a snapshot is being served")
+	}
+	//the storage is reopened, commands wait meanwhile
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	rekeyer, ok := db.storage.(storage.Rekeyer)
+	if ok {
+		if err := rekeyer.Rekey(master); err != nil {
+			return errors.Wrap(err, "rekey storage failed")
+		}
+	}
+	if err := db.keyring.Rekey(master); err != nil {
+		if ok {
+			if err := rekeyer.Rekey(old); err != nil {
+				logger.Error("failed to restore the storage master key: %v", err)
+			}
+		}
+		return errors.Wrap(err, "rekey keyring failed")
+	}
+	return nil
+}
+
+func execEncryption(database *Database, client *Client, name string, args [][]byte) ([]byte, bool, error) {
+	if name != executor.ENCRYPTION {
+		return nil, false, nil
+	}
+	if len(args) < 2 {
+		return nil, true, types.ErrInvalidNumberOfArgs
+	}
+	output, err := database.Encryption(client, strings.ToUpper(string(args[1])), args[2:])
+	return output, true, err
+}
+
+func (db *Database) Encryption(client *Client, sub string, args [][]byte) ([]byte, error) {
+	switch sub {
+	case "ROTATE":
+		if len(args) != 0 {
+			return nil, types.ErrInvalidNumberOfArgs
+		}
+		if err := db.RotateEncryption(); err != nil {
+			return nil, err
+		}
+		return util.MessageOK(), nil
+	default:
+		return nil, types.ReplyError(fmt.Sprintf("ERR unknown subcommand '%s'. Try ENCRYPTION HELP.", strings.ToLower(sub)))
+	}
+}
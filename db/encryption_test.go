@@ -0,0 +1,230 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"github.com/joway/pidis/types"
+	"github.com/joway/pidis/util"
+	"github.com/stretchr/testify/suite"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testMasterKey    = "000102030405060708090a0b0c0d0e0f000102030405060708090a0b0c0d0e0f"
+	testNewMasterKey = "f0f1f2f3f4f5f6f7f8f9fafbfcfdfeff"
+)
+
+type EncryptionTestSuite struct {
+	suite.Suite
+
+	dir     string
+	keyFile string
+}
+
+func TestEncryption(t *testing.T) {
+	suite.Run(t, new(EncryptionTestSuite))
+}
+
+func (suite *EncryptionTestSuite) SetupTest() {
+	suite.dir = "/tmp/pidis/encryption"
+	_ = os.RemoveAll(suite.dir)
+	_ = os.MkdirAll(suite.dir, os.ModePerm)
+	suite.keyFile = path.Join(suite.dir, "master.key")
+	suite.writeKey(testMasterKey)
+}
+
+func (suite *EncryptionTestSuite) writeKey(key string) {
+	suite.Require().NoError(ioutil.WriteFile(suite.keyFile, []byte(key+"\n"), 0600))
+}
+
+func (suite *EncryptionTestSuite) open() (*Database, error) {
+	return New(Options{DBDir: path.Join(suite.dir, "db"), EncryptionKeyFile: suite.keyFile})
+}
+
+// plaintext tells whether any file of the database contains s in clear
+func (suite *EncryptionTestSuite) plaintext(s string) bool {
+	found := false
+	err := filepath.Walk(path.Join(suite.dir, "db"), func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		content, err := ioutil.ReadFile(p)
+		if bytes.Contains(content, []byte(s)) {
+			found = true
+		}
+		return err
+	})
+	suite.NoError(err)
+	return found
+}
+
+func (suite *EncryptionTestSuite) TestMasterKey() {
+	key, err := LoadMasterKey(suite.keyFile)
+	suite.NoError(err)
+	suite.Len(key, 32)
+
+	suite.NoError(os.Setenv(EncryptionKeyEnv, testNewMasterKey))
+	defer func() { _ = os.Unsetenv(EncryptionKeyEnv) }()
+	key, err = LoadMasterKey("")
+	suite.NoError(err)
+	suite.Len(key, 16)
+
+	suite.writeKey("0011")
+	_, err = LoadMasterKey(suite.keyFile)
+	suite.Error(err)
+	suite.writeKey("not hex")
+	_, err = LoadMasterKey(suite.keyFile)
+	suite.Error(err)
+}
+
+func (suite *EncryptionTestSuite) TestKeyring() {
+	master, _ := LoadMasterKey(suite.keyFile)
+	keyringPath := path.Join(suite.dir, "pidis.keys")
+	keyring, err := OpenKeyring(keyringPath, master, 0)
+	suite.NoError(err)
+
+	first, err := keyring.Seal(EncodeAOF(NewUID().Bytes(), 0, util.CommandToArgs("set k secret1")))
+	suite.NoError(err)
+	suite.NotContains(string(first), "secret1")
+	suite.NoError(keyring.Rotate())
+	id, _ := keyring.Current()
+	suite.EqualValues(2, id)
+	second, err := keyring.Seal(EncodeAOF(NewUID().Bytes(), 0, util.CommandToArgs("set k secret2")))
+	suite.NoError(err)
+
+	//plaintext entries written before encryption and incomplete segments are handled
+	content := append(EncodeAOF(NewUID().Bytes(), 0, util.CommandToArgs("set k plain")), first...)
+	content = append(content, second[:10]...)
+	plain, leftover, err := keyring.Unseal(content)
+	suite.NoError(err)
+	suite.Equal(second[:10], leftover)
+	plain, leftover, err = keyring.Unseal(append(plain, second...))
+	suite.NoError(err)
+	suite.Empty(leftover)
+	var values []string
+	for len(plain) > 0 {
+		_, _, args, left, err := DecodeAOF(plain)
+		suite.Require().NoError(err)
+		values = append(values, string(args[2]))
+		plain = left
+	}
+	suite.Equal([]string{"plain", "secret1", "secret2"}, values)
+
+	//the data keys survive a master key rotation
+	newMaster, _ := hex.DecodeString(testNewMasterKey)
+	suite.NoError(keyring.Rekey(newMaster))
+	_, err = OpenKeyring(keyringPath, master, 0)
+	suite.Error(err)
+	reopened, err := OpenKeyring(keyringPath, newMaster, 0)
+	suite.NoError(err)
+	_, _, err = reopened.Unseal(first)
+	suite.NoError(err)
+	id, _ = reopened.Current()
+	suite.EqualValues(2, id)
+
+	_, _, err = (*Keyring)(nil).Unseal(first)
+	suite.Error(err)
+}
+
+func (suite *EncryptionTestSuite) TestSnapshotStream() {
+	master, _ := LoadMasterKey(suite.keyFile)
+	keyring, err := OpenKeyring(path.Join(suite.dir, "pidis.keys"), master, 0)
+	suite.NoError(err)
+	var sealed bytes.Buffer
+	w := keyring.SealWriter(&sealed)
+	var expected []byte
+	for i := 0; i < 10; i++ {
+		chunk := []byte(strings.Repeat(fmt.Sprintf("chunk%d", i), 100))
+		expected = append(expected, chunk...)
+		_, err := w.Write(chunk)
+		suite.NoError(err)
+	}
+	suite.NotContains(sealed.String(), "chunk")
+	plain, err := ioutil.ReadAll(keyring.UnsealReader(&sealed))
+	suite.NoError(err)
+	suite.Equal(expected, plain)
+}
+
+func (suite *EncryptionTestSuite) TestDatabase() {
+	db, err := suite.open()
+	suite.Require().NoError(err)
+	_, err = db.Exec(util.CommandToArgs("set k topsecretvalue"))
+	suite.NoError(err)
+	suite.NoError(db.aofBus.Flush())
+
+	//the oplog is sent decrypted to followers
+	stream := util.NewStreamBus(1024)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	go func() {
+		_ = db.Sync(ctx, stream, nil)
+	}()
+	select {
+	case content := <-stream.Read():
+		_, _, args, _, err := DecodeAOF(content)
+		suite.NoError(err)
+		suite.Equal("set k topsecretvalue", string(bytes.Join(args, []byte(" "))))
+	case <-ctx.Done():
+		suite.Fail("oplog not synced")
+	}
+	suite.Contains(db.Info([]string{"persistence"}), "encryption_enabled:1")
+	_ = db.Close()
+	suite.False(suite.plaintext("topsecretvalue"))
+
+	//the key is required once the data is encrypted
+	suite.writeKey("")
+	_, err = suite.open()
+	suite.Error(err)
+
+	suite.writeKey(testMasterKey)
+	db, err = suite.open()
+	suite.Require().NoError(err)
+	suite.writeKey(testNewMasterKey)
+	suite.NoError(db.RotateEncryption())
+	_, err = db.Exec(util.CommandToArgs("set k2 v2"))
+	suite.NoError(err)
+	_ = db.Close()
+
+	suite.writeKey(testMasterKey)
+	_, err = suite.open()
+	suite.Error(err)
+	suite.writeKey(testNewMasterKey)
+	db, err = suite.open()
+	suite.Require().NoError(err)
+	defer func() { _ = db.Close() }()
+	result, err := db.Exec(util.CommandToArgs("get k"))
+	suite.NoError(err)
+	suite.Equal("$14\r\ntopsecretvalue\r\n", string(result.Output()))
+	result, err = db.Exec(util.CommandToArgs("get k2"))
+	suite.NoError(err)
+	suite.Equal("$2\r\nv2\r\n", string(result.Output()))
+}
+
+func (suite *EncryptionTestSuite) TestEnable() {
+	db, err := New(Options{DBDir: path.Join(suite.dir, "db")})
+	suite.Require().NoError(err)
+	suite.Equal(types.ErrEncryptionDisabled, db.RotateEncryption())
+	_, err = db.Exec(util.CommandToArgs("set k plainvalue"))
+	suite.NoError(err)
+	_ = db.Close()
+
+	//data written in plaintext stays readable once encryption is enabled
+	db, err = suite.open()
+	suite.Require().NoError(err)
+	defer func() { _ = db.Close() }()
+	result, err := db.Exec(util.CommandToArgs("get k"))
+	suite.NoError(err)
+	suite.Equal("$10\r\nplainvalue\r\n", string(result.Output()))
+	_, err = db.Exec(util.CommandToArgs("set k2 newsecret"))
+	suite.NoError(err)
+	suite.NoError(db.aofBus.Flush())
+	suite.False(suite.plaintext("newsecret"))
+}
@@ -0,0 +1,280 @@
+package db
+
+import (
+	"github.com/joway/pidis/executor"
+	"github.com/joway/pidis/storage"
+	"github.com/joway/pidis/types"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	expireCycleInterval = time.Millisecond * 100
+	expireCycleSamples  = 20
+	//percent of the interval a cycle may run for
+	expireCycleBudget = 25
+	//percent of expired samples a cycle tolerates before stopping
+	expireCycleStale = 10
+
+	DefaultActiveExpireEffort = 1
+)
+
+// Expires is a secondary index of the deadline of every stored key with a ttl.
+// Storage only hides expired keys, so it's the only way to find the keys to delete
+type Expires struct {
+	lock sync.Mutex
+	keys map[string]int64
+}
+
+func NewExpires() *Expires {
+	return &Expires{
+		keys: make(map[string]int64),
+	}
+}
+
+func (e *Expires) Set(key string, deadline time.Time) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.keys[key] = deadline.UnixNano()
+}
+
+func (e *Expires) Remove(key string) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	delete(e.keys, key)
+}
+
+func (e *Expires) Len() int {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return len(e.keys)
+}
+
+// SlotStats returns the number of keys of slot with a ttl and their average remaining time to live in milliseconds
+func (e *Expires) SlotStats(slot int, now time.Time) (count int, avgTTL int64) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	var total int64
+	for key, deadline := range e.keys {
+		if s, _, _ := storage.SplitKeyspace([]byte(key)); s != slot {
+			continue
+		}
+		count++
+		if ttl := deadline - now.UnixNano(); ttl > 0 {
+			total += ttl
+		}
+	}
+	if count == 0 {
+		return 0, 0
+	}
+	return count, total / int64(count) / int64(time.Millisecond)
+}
+
+// RemoveSlot forgets the keys of a dropped slot
+func (e *Expires) RemoveSlot(slot int) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	for key := range e.keys {
+		if s, _, _ := storage.SplitKeyspace([]byte(key)); s == slot {
+			delete(e.keys, key)
+		}
+	}
+}
+
+// Random returns the deadlines of at most limit random keys
+func (e *Expires) Random(limit int) map[string]int64 {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	keys := make(map[string]int64, limit)
+	for key, deadline := range e.keys {
+		if len(keys) >= limit {
+			break
+		}
+		keys[key] = deadline
+	}
+	return keys
+}
+
+// Pop removes key from the index if it's past its deadline
+func (e *Expires) Pop(key string, now time.Time) bool {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	deadline, ok := e.keys[key]
+	if !ok || deadline > now.UnixNano() {
+		return false
+	}
+	delete(e.keys, key)
+	return true
+}
+
+// Sample checks at most limit random keys and pops those past their deadline
+func (e *Expires) Sample(now time.Time, limit int) (expired []string, checked int) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	for key, deadline := range e.keys {
+		if checked >= limit {
+			break
+		}
+		checked++
+		if deadline <= now.UnixNano() {
+			expired = append(expired, key)
+			delete(e.keys, key)
+		}
+	}
+	return expired, checked
+}
+
+// expireCycle samples the index for keys past their deadline and deletes them as redis does:
+// it keeps going while too many samples were expired, within a time budget so commands aren't stalled.
+// Followers leave expired keys to the DELs of their master
+func (db *Database) expireCycle() {
+	if db.expires.Len() == 0 || !db.IsWritable() {
+		return
+	}
+	effort, _ := strconv.Atoi(db.config.Get("active-expire-effort"))
+	if effort < 1 {
+		effort = DefaultActiveExpireEffort
+	}
+	var (
+		samples = expireCycleSamples + expireCycleSamples/4*(effort-1)
+		budget  = expireCycleInterval * time.Duration(expireCycleBudget+2*(effort-1)) / 100
+		stale   = expireCycleStale - (effort - 1)
+		start   = time.Now()
+	)
+	defer func() {
+		db.stats.add(&db.stats.ExpireCycleUsec, time.Since(start).Nanoseconds()/1000)
+		db.latency.Since(LatencyExpireCycle, start)
+	}()
+	for {
+		keys, checked := db.expires.Sample(time.Now(), samples)
+		if len(keys) > 0 {
+			db.lock.Lock()
+			for _, key := range keys {
+				db.expireKey([]byte(key))
+			}
+			db.lock.Unlock()
+		}
+		if checked == 0 || len(keys)*100 <= checked*stale {
+			return
+		}
+		if time.Since(start) > budget {
+			db.stats.incr(&db.stats.ExpiredTimeCapReached)
+			return
+		}
+	}
+}
+
+// expireKeys expires the keys a command is about to access once past their deadline,
+// so their DEL is recorded before the command and followers replay both in the same order
+func (db *Database) expireKeys(index int, keys [][]byte) {
+	if len(keys) == 0 || db.expires.Len() == 0 || !db.IsWritable() {
+		return
+	}
+	ks := db.keyspace(db.storage, index)
+	now := time.Now()
+	var expired [][]byte
+	for _, key := range keys {
+		if stored := ks.Key(key); db.expires.Pop(string(stored), now) {
+			expired = append(expired, stored)
+		}
+	}
+	if len(expired) == 0 {
+		return
+	}
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	for _, stored := range expired {
+		db.expireKey(stored)
+	}
+}
+
+// expireKey deletes a key popped from the index and records it as a DEL, so followers
+// expire it at the same point of the oplog. The database must be locked
+func (db *Database) expireKey(stored []byte) {
+	ttl, err := db.storage.TTL(stored)
+	if err == nil {
+		//storage has a coarser clock or the key has been rewritten
+		if ttl > 0 {
+			db.expires.Set(string(stored), time.Now().Add(time.Duration(ttl)*time.Millisecond))
+		}
+		return
+	}
+	if err != types.ErrKeyNotFound {
+		logger.Error("failed to check ttl of %s: %v", stored, err)
+		return
+	}
+	db.memory.Remove(string(stored))
+	slot, key, _ := storage.SplitKeyspace(stored)
+	index := db.keyspaces.Index(slot)
+	//the database has been flushed meanwhile
+	if index < 0 {
+		return
+	}
+	//storage hides the expired key but keeps it on disk until deleted
+	if err := db.Record(index, [][]byte{[]byte(executor.DEL), key}); err != nil {
+		logger.Error("failed to record expiration of %s: %v", stored, err)
+		return
+	}
+	if err := db.storage.Del([][]byte{stored}); err != nil {
+		logger.Error("failed to delete expired %s: %v", stored, err)
+		return
+	}
+	db.stats.incr(&db.stats.ExpiredKeys)
+	db.touch(index, [][]byte{key})
+	db.invalidate([][]byte{key})
+	db.notify(index, NotifyExpired, "expired", key)
+}
+
+// loadExpires rebuilds the index from the keys already in storage
+func (db *Database) loadExpires() error {
+	pairs, err := db.storage.Scan(storage.ScanOptions{Pattern: "*"})
+	if err != nil {
+		return err
+	}
+	for _, p := range pairs {
+		ttl, err := db.storage.TTL(p.Key)
+		if err != nil || ttl == 0 {
+			continue
+		}
+		db.expires.Set(string(p.Key), time.Now().Add(time.Duration(ttl)*time.Millisecond))
+	}
+	return nil
+}
+
+func (db *Database) updateExpires(ks *storage.Keyspace, cmd string, args [][]byte) {
+	switch cmd {
+	case executor.SET, executor.SETNX:
+		if ttl := setTTL(args); ttl > 0 {
+			db.expires.Set(string(ks.Key(args[1])), time.Now().Add(time.Duration(ttl)*time.Millisecond))
+			return
+		}
+		db.expires.Remove(string(ks.Key(args[1])))
+	case executor.INCR:
+		db.expires.Remove(string(ks.Key(args[1])))
+	case executor.DEL:
+		for _, key := range args[1:] {
+			db.expires.Remove(string(ks.Key(key)))
+		}
+	}
+}
+
+// setTTL returns the ttl in milliseconds of a SET command
+func setTTL(args [][]byte) uint64 {
+	if len(args) < 5 {
+		return 0
+	}
+	ttl, err := strconv.ParseUint(string(args[4]), 10, 64)
+	if err != nil {
+		return 0
+	}
+	switch strings.ToUpper(string(args[3])) {
+	case "EX":
+		return ttl * 1000
+	case "PX":
+		return ttl
+	default:
+		return 0
+	}
+}
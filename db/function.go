@@ -0,0 +1,516 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/gobwas/glob"
+	"github.com/joway/pidis/executor"
+	"github.com/joway/pidis/storage"
+	"github.com/joway/pidis/types"
+	"github.com/joway/pidis/util"
+	"github.com/pkg/errors"
+	"github.com/tidwall/redcon"
+	lua "github.com/yuin/gopher-lua"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var reFunctionName = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
+
+type Library struct {
+	name      string
+	code      []byte
+	vm        *lua.LState
+	functions map[string]*Function
+}
+
+type Function struct {
+	name     string
+	fn       *lua.LFunction
+	flags    []string
+	noWrites bool
+	library  *Library
+}
+
+type FunctionRegistry struct {
+	lock sync.Mutex
+	path string
+
+	libraries map[string]*Library
+	functions map[string]*Function
+}
+
+func NewFunctionRegistry(path string) (*FunctionRegistry, error) {
+	r := &FunctionRegistry{
+		path:      path,
+		libraries: make(map[string]*Library),
+		functions: make(map[string]*Function),
+	}
+	payload, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := r.Restore(payload, "APPEND"); err != nil {
+		return nil, errors.Wrap(err, "restore functions failed")
+	}
+	return r, nil
+}
+
+func (r *FunctionRegistry) Load(code []byte, replace bool) (string, error) {
+	lib, err := compileLibrary(code)
+	if err != nil {
+		return "", err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if err := r.add(lib, replace); err != nil {
+		lib.vm.Close()
+		return "", err
+	}
+	return lib.name, r.save()
+}
+
+func (r *FunctionRegistry) Delete(name string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, ok := r.libraries[name]; !ok {
+		return types.ErrLibraryNotFound
+	}
+	r.remove(name)
+	return r.save()
+}
+
+func (r *FunctionRegistry) Flush() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for name := range r.libraries {
+		r.remove(name)
+	}
+	return r.save()
+}
+
+func (r *FunctionRegistry) Get(name string) *Function {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.functions[name]
+}
+
+func (r *FunctionRegistry) Dump() []byte {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.dump()
+}
+
+func (r *FunctionRegistry) Restore(payload []byte, policy string) error {
+	var libs []*Library
+	codes, err := decodeFunctionDump(payload)
+	if err != nil {
+		return err
+	}
+	for _, code := range codes {
+		lib, err := compileLibrary(code)
+		if err != nil {
+			return err
+		}
+		libs = append(libs, lib)
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	switch policy {
+	case "FLUSH":
+		for name := range r.libraries {
+			r.remove(name)
+		}
+	case "APPEND":
+		for _, lib := range libs {
+			if _, ok := r.libraries[lib.name]; ok {
+				return types.ReplyError(fmt.Sprintf("ERR Library %s already exists", lib.name))
+			}
+		}
+	case "REPLACE":
+	default:
+		return types.ErrSyntaxError
+	}
+	for _, lib := range libs {
+		if err := r.add(lib, true); err != nil {
+			return err
+		}
+	}
+	return r.save()
+}
+
+func (r *FunctionRegistry) List(pattern string, withCode bool) ([]byte, error) {
+	var matcher glob.Glob
+	if pattern != "" {
+		g, err := glob.Compile(pattern)
+		if err != nil {
+			return nil, types.ErrSyntaxError
+		}
+		matcher = g
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var names []string
+	for name := range r.libraries {
+		if matcher == nil || matcher.Match(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	output := redcon.AppendArray(nil, len(names))
+	for _, name := range names {
+		lib := r.libraries[name]
+		fields := 6
+		if withCode {
+			fields += 2
+		}
+		output = redcon.AppendArray(output, fields)
+		output = redcon.AppendBulkString(output, "library_name")
+		output = redcon.AppendBulkString(output, lib.name)
+		output = redcon.AppendBulkString(output, "engine")
+		output = redcon.AppendBulkString(output, "LUA")
+		output = redcon.AppendBulkString(output, "functions")
+
+		var fnames []string
+		for fname := range lib.functions {
+			fnames = append(fnames, fname)
+		}
+		sort.Strings(fnames)
+		output = redcon.AppendArray(output, len(fnames))
+		for _, fname := range fnames {
+			fn := lib.functions[fname]
+			output = redcon.AppendArray(output, 6)
+			output = redcon.AppendBulkString(output, "name")
+			output = redcon.AppendBulkString(output, fn.name)
+			output = redcon.AppendBulkString(output, "description")
+			output = redcon.AppendNull(output)
+			output = redcon.AppendBulkString(output, "flags")
+			output = redcon.AppendArray(output, len(fn.flags))
+			for _, flag := range fn.flags {
+				output = redcon.AppendBulkString(output, flag)
+			}
+		}
+		if withCode {
+			output = redcon.AppendBulkString(output, "library_code")
+			output = redcon.AppendBulk(output, lib.code)
+		}
+	}
+	return output, nil
+}
+
+func (r *FunctionRegistry) add(lib *Library, replace bool) error {
+	if _, ok := r.libraries[lib.name]; ok && !replace {
+		return types.ReplyError(fmt.Sprintf("ERR Library '%s' already exists", lib.name))
+	}
+	for fname := range lib.functions {
+		if fn, ok := r.functions[fname]; ok && fn.library.name != lib.name {
+			return types.ReplyError(fmt.Sprintf("ERR Function %s already exists", fname))
+		}
+	}
+	r.remove(lib.name)
+	r.libraries[lib.name] = lib
+	for fname, fn := range lib.functions {
+		r.functions[fname] = fn
+	}
+	return nil
+}
+
+func (r *FunctionRegistry) remove(name string) {
+	lib, ok := r.libraries[name]
+	if !ok {
+		return
+	}
+	for fname := range lib.functions {
+		delete(r.functions, fname)
+	}
+	delete(r.libraries, name)
+	lib.vm.Close()
+}
+
+func (r *FunctionRegistry) dump() []byte {
+	var names []string
+	for name := range r.libraries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	output := redcon.AppendArray(nil, len(names))
+	for _, name := range names {
+		output = redcon.AppendBulk(output, r.libraries[name].code)
+	}
+	return output
+}
+
+func (r *FunctionRegistry) save() error {
+	if r.path == "" {
+		return nil
+	}
+	tmp := r.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, r.dump(), os.ModePerm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.path)
+}
+
+func decodeFunctionDump(payload []byte) ([][]byte, error) {
+	if bytes.Equal(payload, redcon.AppendArray(nil, 0)) {
+		return nil, nil
+	}
+	completed, codes, _, leftover, err := redcon.ReadNextCommand(payload, nil)
+	if err != nil || !completed || len(leftover) > 0 {
+		return nil, types.ErrInvalidFunctionPayload
+	}
+	return codes, nil
+}
+
+// compileLibrary runs the library code in its own vm to collect the registered functions
+func compileLibrary(code []byte) (*Library, error) {
+	name, err := parseLibraryName(code)
+	if err != nil {
+		return nil, err
+	}
+	proto, err := compileScript(code, "@user_function")
+	if err != nil {
+		return nil, types.ReplyError(fmt.Sprintf("ERR Error compiling function: %v", err))
+	}
+
+	lib := &Library{
+		name:      name,
+		code:      code,
+		vm:        newLuaState(),
+		functions: make(map[string]*Function),
+	}
+	register := func(L *lua.LState) int {
+		fn := &Function{library: lib}
+		if tbl, ok := L.Get(1).(*lua.LTable); ok {
+			name, ok := tbl.RawGetString("function_name").(lua.LString)
+			if !ok {
+				L.RaiseError("function_name argument given to register_function must be a string")
+				return 0
+			}
+			fn.name = string(name)
+			fn.fn, _ = tbl.RawGetString("callback").(*lua.LFunction)
+			if flags, ok := tbl.RawGetString("flags").(*lua.LTable); ok {
+				flags.ForEach(func(_ lua.LValue, flag lua.LValue) {
+					fn.flags = append(fn.flags, flag.String())
+				})
+			}
+		} else {
+			fn.name = L.CheckString(1)
+			fn.fn = L.CheckFunction(2)
+		}
+		if !reFunctionName.MatchString(fn.name) {
+			L.RaiseError("Function names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+			return 0
+		}
+		if fn.fn == nil {
+			L.RaiseError("Missing function callback")
+			return 0
+		}
+		for _, flag := range fn.flags {
+			switch flag {
+			case "no-writes":
+				fn.noWrites = true
+			case "allow-oom", "allow-stale", "no-cluster", "allow-cross-slot-keys":
+			default:
+				L.RaiseError("Unknown flag given")
+				return 0
+			}
+		}
+		if _, ok := lib.functions[fn.name]; ok {
+			L.RaiseError("Function already exists in the library")
+			return 0
+		}
+		lib.functions[fn.name] = fn
+		return 0
+	}
+	L := lib.vm
+	L.SetField(L.GetGlobal("redis"), "register_function", L.NewFunction(register))
+	L.Push(L.NewFunctionFromProto(proto))
+	if err := L.PCall(0, 0, nil); err != nil {
+		L.Close()
+		return nil, types.ReplyError(fmt.Sprintf("ERR Error registering functions: %v", err))
+	}
+	if len(lib.functions) == 0 {
+		L.Close()
+		return nil, types.ReplyError("ERR No functions registered")
+	}
+	L.SetField(L.GetGlobal("redis"), "register_function", lua.LNil)
+	return lib, nil
+}
+
+func parseLibraryName(code []byte) (string, error) {
+	line := code
+	if i := bytes.IndexByte(code, '\n'); i >= 0 {
+		line = code[:i]
+	}
+	fields := strings.Fields(strings.TrimPrefix(string(line), "#!"))
+	if !bytes.HasPrefix(code, []byte("#!")) || len(fields) == 0 {
+		return "", types.ReplyError("ERR Missing library metadata")
+	}
+	if fields[0] != "lua" {
+		return "", types.ReplyError(fmt.Sprintf("ERR Engine '%s' not found", fields[0]))
+	}
+	name := ""
+	for _, field := range fields[1:] {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 || kv[0] != "name" {
+			return "", types.ReplyError(fmt.Sprintf("ERR Invalid metadata value given: %s", field))
+		}
+		name = kv[1]
+	}
+	if name == "" {
+		return "", types.ReplyError("ERR Library name was not given")
+	}
+	if !reFunctionName.MatchString(name) {
+		return "", types.ReplyError("ERR Library names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+	}
+	return name, nil
+}
+
+func (db *Database) Function(args [][]byte, isInternal bool) (*executor.Result, error) {
+	if len(args) < 2 {
+		return nil, types.ErrInvalidNumberOfArgs
+	}
+	sub := strings.ToUpper(string(args[1]))
+	var previous []byte
+	switch sub {
+	case "LOAD", "DELETE", "FLUSH", "RESTORE":
+		if !isInternal && !db.IsWritable() {
+			return nil, types.ErrNodeReadOnly
+		}
+		//block FCALL while libraries are changing
+		db.lock.Lock()
+		defer db.lock.Unlock()
+		//libraries are changed before being recorded, they're restored when the record fails
+		previous = db.functions.Dump()
+	}
+
+	var output []byte
+	switch sub {
+	case "LOAD":
+		if len(args) < 3 || len(args) > 4 {
+			return nil, types.ErrInvalidNumberOfArgs
+		}
+		replace := len(args) == 4
+		if replace && strings.ToUpper(string(args[2])) != "REPLACE" {
+			return nil, types.ErrSyntaxError
+		}
+		name, err := db.functions.Load(args[len(args)-1], replace)
+		if err != nil {
+			return nil, err
+		}
+		output = util.Message([]byte(name))
+	case "DELETE":
+		if len(args) != 3 {
+			return nil, types.ErrInvalidNumberOfArgs
+		}
+		if err := db.functions.Delete(string(args[2])); err != nil {
+			return nil, err
+		}
+		output = util.MessageOK()
+	case "FLUSH":
+		if err := db.functions.Flush(); err != nil {
+			return nil, err
+		}
+		output = util.MessageOK()
+	case "RESTORE":
+		if len(args) < 3 || len(args) > 4 {
+			return nil, types.ErrInvalidNumberOfArgs
+		}
+		policy := "APPEND"
+		if len(args) == 4 {
+			policy = strings.ToUpper(string(args[3]))
+		}
+		if err := db.functions.Restore(args[2], policy); err != nil {
+			return nil, err
+		}
+		output = util.MessageOK()
+	case "DUMP":
+		return executor.NewResult(util.Message(db.functions.Dump())), nil
+	case "LIST":
+		pattern, withCode := "", false
+		for i := 2; i < len(args); i++ {
+			switch strings.ToUpper(string(args[i])) {
+			case "WITHCODE":
+				withCode = true
+			case "LIBRARYNAME":
+				if i+1 >= len(args) {
+					return nil, types.ErrSyntaxError
+				}
+				i++
+				pattern = string(args[i])
+			default:
+				return nil, types.ErrSyntaxError
+			}
+		}
+		output, err := db.functions.List(pattern, withCode)
+		if err != nil {
+			return nil, err
+		}
+		return executor.NewResult(output), nil
+	case "KILL":
+		if err := db.scripts.Kill(); err != nil {
+			return nil, err
+		}
+		return executor.NewResult(util.MessageOK()), nil
+	default:
+		return nil, types.ErrSyntaxError
+	}
+
+	//replicate library changes
+	if err := db.Record(0, args); err != nil {
+		if undoErr := db.functions.Restore(previous, "FLUSH"); undoErr != nil {
+			logger.Error("restore functions failed: %v", undoErr)
+		}
+		return nil, errors.Wrap(err, "record cmd failed")
+	}
+	return executor.NewResult(output), nil
+}
+
+func (db *Database) fcallTxn(client *Client, txn storage.Storage, index int, args [][]byte, isInternal bool) ([]byte, []AOFEntry, error) {
+	if len(args) < 3 {
+		return nil, nil, types.ErrInvalidNumberOfArgs
+	}
+	fn := db.functions.Get(string(args[1]))
+	if fn == nil {
+		return nil, nil, types.ErrFunctionNotFound
+	}
+	numKeys, err := strconv.Atoi(string(args[2]))
+	if err != nil {
+		return nil, nil, types.ErrNotInteger
+	}
+	if numKeys < 0 {
+		return nil, nil, types.ErrNegativeNumKeys
+	}
+	if numKeys > len(args)-3 {
+		return nil, nil, types.ErrTooManyNumKeys
+	}
+	readOnly := strings.ToUpper(string(args[0])) == executor.FCALL_RO
+	if readOnly && !fn.noWrites {
+		return nil, nil, types.ReplyError("ERR Can not execute a script with write flag using *_ro command.")
+	}
+	if !isInternal && !db.IsWritable() && !fn.noWrites {
+		return nil, nil, types.ErrNodeReadOnly
+	}
+
+	L := fn.library.vm
+	keys := luaArray(L, args[3:3+numKeys])
+	argv := luaArray(L, args[3+numKeys:])
+	output, writes, err := db.runScript(client, L, txn, index, fn.fn, []lua.LValue{keys, argv}, fn.noWrites, isInternal)
+	if err != nil {
+		return nil, writes, types.ReplyError(fmt.Sprintf("ERR Error running script (call to %s): %v", fn.name, err))
+	}
+	return output, writes, nil
+}
@@ -6,54 +6,239 @@ import (
 	"github.com/joway/pidis/types"
 	"github.com/joway/pidis/util"
 	"github.com/tidwall/redcon"
+	"strings"
+	"time"
 )
 
 func GetRedisCmdHandler(database *Database) func(conn redcon.Conn, cmd redcon.Command) {
 	return func(conn redcon.Conn, cmd redcon.Command) {
-		defer func() {
-			if err := recover(); err != nil {
-				conn.WriteError(fmt.Sprintf("fatal error: %s", (err.(error)).Error()))
+		handle(database, conn, cmd)
+	}
+}
+
+func handle(database *Database, conn redcon.Conn, cmd redcon.Command) {
+	defer func() {
+		if err := recover(); err != nil {
+			conn.WriteError(fmt.Sprintf("fatal error: %s", (err.(error)).Error()))
+		}
+	}()
+	client := database.clientOf(conn)
+	//other connections see the state left by the command
+	defer func() {
+		client.publish()
+		database.handOver(client)
+	}()
+	name := strings.ToUpper(string(cmd.Args[0]))
+	client.touch(name)
+	//CLIENT REPLY SKIP mutes the next command only
+	client.skipping, client.skipNext = client.skipNext, false
+	database.stats.incr(&database.stats.Commands)
+	var (
+		start    = time.Now()
+		rejected bool
+		errReply []byte
+		replyErr error
+	)
+	defer func() {
+		database.recordCommand(name, time.Since(start), rejected, errReply, replyErr)
+	}()
+
+	//unknown commands and wrong arities are refused before anything else, aborting a transaction
+	if err := checkCommand(name, cmd.Args); err != nil {
+		if client.multi {
+			client.multiErr = true
+		}
+		rejected = true
+		errReply = errorOutput(cmd.Args, err)
+		replyErr = err
+		client.Reply(errReply)
+		return
+	}
+
+	//RESP3 clients receive messages as push, so they can still issue any command
+	if client.Proto() == util.RESP2 && client.Subscriptions() > 0 && !subscribedCommands[name] {
+		rejected = true
+		errReply = util.MessageError(fmt.Sprintf(
+			"ERR Can't execute '%s': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT are allowed in this context",
+			strings.ToLower(name),
+		))
+		client.Reply(errReply)
+		return
+	}
+
+	//acl
+	if err := database.checkACL(client, name, cmd.Args); err != nil {
+		if client.multi {
+			client.multiErr = true
+		}
+		rejected = true
+		errReply = errorOutput(cmd.Args, err)
+		replyErr = err
+		client.Reply(errReply)
+		return
+	}
+
+	database.monitors.Feed(client, cmd.Args)
+	database.pause.wait(client, name)
+
+	//the whole dispatch is timed, commands queued in a transaction are accounted by their EXEC
+	queued := client.multi && !transactionCommands[name]
+	execStart := time.Now()
+	defer func() {
+		if queued {
+			return
+		}
+		elapsed := time.Since(execStart)
+		database.slowLog.Record(cmd.Args, elapsed, client.Addr(), client.Name())
+		database.latency.Observe(LatencyCommand, elapsed)
+	}()
+
+	//CLIENT CACHING only affects the next command
+	caching := client.caching
+	if !(name == executor.CLIENT && len(cmd.Args) > 1 && strings.ToUpper(string(cmd.Args[1])) == "CACHING") {
+		client.caching = cachingDefault
+	}
+	//keys are tracked before being read so no write in between can be missed
+	if client.tracking.on && (!client.multi || name == executor.EXEC) {
+		database.tracking.Track(client, readKeys(name, cmd.Args, client.queue), caching)
+	}
+
+	//handle commands depending on the connection state,
+	//transaction comes first so that commands are queued inside MULTI
+	connHandlers := [...]func(*Database, *Client, string, [][]byte) ([]byte, bool, error){
+		execTransaction,
+		execSelect,
+		execPubSub,
+		execClient,
+		execACL,
+		execConfig,
+		execInfo,
+		execSlowLog,
+		execLatency,
+		execEncryption,
+		execBackup,
+		execMonitor,
+		execCommand,
+	}
+	for _, exec := range connHandlers {
+		output, ok, err := exec(database, client, name, cmd.Args)
+		if !ok {
+			continue
+		}
+		if err != nil {
+			errReply = errorOutput(cmd.Args, err)
+			replyErr = err
+			client.Reply(errReply)
+			return
+		}
+		//pushed replies have been written already
+		if output != nil {
+			if errorCode(output) != "" {
+				errReply = output
+			}
+			client.Reply(output)
+		}
+		return
+	}
+
+	result, err := database.exec(client, client.DB(), cmd.Args, false)
+	//handle action
+	if result != nil {
+		switch result.Action() {
+		case executor.ActionSlaveOf:
+			host := cmd.Args[1]
+			port := cmd.Args[2]
+			if err := database.SlaveOf(string(host), string(port)); err != nil {
+				logger.Error("ERR slaveof: %v", err)
+				errReply = util.MessageError(err.Error())
+				client.Reply(errReply)
+				return
 			}
-		}()
-		result, err := database.Exec(cmd.Args)
-		//handle action
-		if result != nil {
-			switch result.Action() {
-			case executor.ActionSlaveOf:
-				host := cmd.Args[1]
-				port := cmd.Args[2]
-				if err := database.SlaveOf(string(host), string(port)); err != nil {
-					logger.Error("ERR slaveof: %v", err)
-					conn.WriteRaw(util.MessageError(err.Error()))
-					return
-				}
-			case executor.ActionConnClose:
-				if err := conn.Close(); err != nil {
-					logger.Error("connection close Failed:\n%v", err)
-				}
-			case executor.ActionShutdown:
-				logger.Fatal("shutting server down, bye bye")
+		case executor.ActionConnClose:
+			if err := conn.Close(); err != nil {
+				logger.Error("connection close Failed:\n%v", err)
 			}
+		case executor.ActionShutdown:
+			logger.Fatal("shutting server down, bye bye")
 		}
-		//handle err
-		switch err {
-		case nil:
-			conn.WriteRaw(result.Output())
-		case types.ErrUnknownCommand:
-			conn.WriteRaw(util.MessageError(fmt.Sprintf(
-				"ERR unknown command '%s'",
-				cmd.Args[0],
-			)))
-		case types.ErrRuntimeError:
-			conn.WriteRaw(util.MessageError(types.ErrRuntimeError.Error()))
-		case types.ErrInvalidNumberOfArgs:
-			conn.WriteRaw(util.MessageError(types.ErrInvalidNumberOfArgs.Error()))
-		case types.ErrSyntaxError:
-			conn.WriteRaw(util.MessageError(types.ErrSyntaxError.Error()))
-		default:
-			logger.Error("Unhandled error : %v", err)
-			conn.WriteRaw(util.MessageError(err.Error()))
+	}
+	//handle err
+	if err != nil {
+		errReply = errorOutput(cmd.Args, err)
+		replyErr = err
+		client.Reply(errReply)
+		return
+	}
+	output := result.Output()
+	//some executors reply errors as their output
+	if errorCode(output) != "" {
+		errReply = output
+	}
+	client.Reply(output)
+}
+
+// transactionCommands are run rather than queued inside MULTI
+var transactionCommands = map[string]bool{
+	executor.MULTI:   true,
+	executor.EXEC:    true,
+	executor.DISCARD: true,
+	executor.WATCH:   true,
+	executor.UNWATCH: true,
+}
+
+func execTransaction(database *Database, client *Client, name string, args [][]byte) ([]byte, bool, error) {
+	var (
+		output []byte
+		err    error
+	)
+	switch {
+	case name == executor.MULTI:
+		output, err = database.Multi(client)
+	case name == executor.EXEC:
+		output, err = database.ExecMulti(client)
+	case name == executor.DISCARD:
+		output, err = database.Discard(client)
+	case name == executor.WATCH:
+		output, err = database.Watch(client, args[1:])
+	case name == executor.UNWATCH:
+		output, err = database.Unwatch(client)
+	case client.multi:
+		output, err = database.Queue(client, args)
+	default:
+		return nil, false, nil
+	}
+	return output, true, err
+}
+
+func GetRedisAcceptHandler(database *Database) func(conn redcon.Conn) bool {
+	return func(conn redcon.Conn) bool {
+		c := NewClient(conn)
+		conn.SetContext(c)
+		database.register(c)
+		return true
+	}
+}
+
+func GetRedisClosedHandler(database *Database) func(conn redcon.Conn, err error) {
+	return func(conn redcon.Conn, err error) {
+		c, ok := conn.Context().(*Client)
+		//detached clients are closed by their own serving goroutine
+		if !ok || c.push != nil {
+			return
 		}
+		database.closeClient(c)
 	}
+}
 
+func errorOutput(args [][]byte, err error) []byte {
+	if err == types.ErrUnknownCommand {
+		return util.MessageError(fmt.Sprintf(
+			"ERR unknown command '%s'",
+			args[0],
+		))
+	}
+	if !types.Known(err) {
+		logger.Error("Unhandled error : %v", err)
+	}
+	return util.MessageError(err.Error())
 }
@@ -0,0 +1,291 @@
+package db
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/joway/pidis"
+	"github.com/joway/pidis/executor"
+	"github.com/joway/pidis/storage"
+	"github.com/joway/pidis/util"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+)
+
+var infoSections = []struct {
+	name string
+	//default sections are replied by INFO without arguments
+	isDefault bool
+	build     func(db *Database, w *infoWriter)
+}{
+	{"server", true, (*Database).infoServer},
+	{"clients", true, (*Database).infoClients},
+	{"memory", true, (*Database).infoMemory},
+	{"persistence", true, (*Database).infoPersistence},
+	{"stats", true, (*Database).infoStats},
+	{"replication", true, (*Database).infoReplication},
+	{"commandstats", false, (*Database).infoCommandStats},
+	{"keyspace", true, (*Database).infoKeyspace},
+}
+
+func newRunID() string {
+	id := make([]byte, 20)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+type infoWriter struct {
+	strings.Builder
+}
+
+func (w *infoWriter) field(name string, value interface{}) {
+	_, _ = fmt.Fprintf(w, "%s:%v\r\n", name, value)
+}
+
+func humanBytes(n int64) string {
+	units := []string{"B", "K", "M", "G", "T"}
+	size := float64(n)
+	i := 0
+	for size >= 1024 && i < len(units)-1 {
+		size /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%dB", n)
+	}
+	return fmt.Sprintf("%.2f%s", size, units[i])
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Info renders the given sections, all default sections if none is given
+func (db *Database) Info(sections []string) string {
+	wanted := make(map[string]bool)
+	for _, s := range sections {
+		wanted[strings.ToLower(s)] = true
+	}
+	all := wanted["all"] || wanted["everything"]
+	if len(wanted) == 0 || wanted["default"] {
+		for _, s := range infoSections {
+			wanted[s.name] = wanted[s.name] || s.isDefault
+		}
+	}
+	var w infoWriter
+	for _, s := range infoSections {
+		if !all && !wanted[s.name] {
+			continue
+		}
+		if w.Len() > 0 {
+			w.WriteString("\r\n")
+		}
+		w.WriteString("# " + strings.ToUpper(s.name[:1]) + s.name[1:] + "\r\n")
+		s.build(db, &w)
+	}
+	return w.String()
+}
+
+func (db *Database) infoServer(w *infoWriter) {
+	uptime := time.Since(db.startTime)
+	executable, _ := os.Executable()
+	w.field("pidis_version", pidis.VERSION)
+	w.field("redis_mode", "standalone")
+	w.field("os", runtime.GOOS)
+	w.field("arch_bits", 32<<(^uint(0)>>63))
+	w.field("go_version", runtime.Version())
+	w.field("process_id", os.Getpid())
+	w.field("run_id", db.runID)
+	w.field("tcp_port", db.config.Get("port"))
+	w.field("rpc_port", db.config.Get("rpc-port"))
+	w.field("uptime_in_seconds", int64(uptime/time.Second))
+	w.field("uptime_in_days", int64(uptime/(24*time.Hour)))
+	w.field("executable", executable)
+	w.field("config_file", db.config.File())
+}
+
+func (db *Database) infoClients(w *infoWriter) {
+	db.clientsLock.RLock()
+	connected := len(db.clients)
+	db.clientsLock.RUnlock()
+	w.field("connected_clients", connected)
+	w.field("pubsub_clients", db.pubsub.Clients())
+}
+
+func (db *Database) infoMemory(w *infoWriter) {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	w.field("used_memory", m.HeapAlloc)
+	w.field("used_memory_human", humanBytes(int64(m.HeapAlloc)))
+	w.field("used_memory_sys", m.Sys)
+	w.field("used_memory_sys_human", humanBytes(int64(m.Sys)))
+	w.field("used_memory_dataset", db.memory.Used())
+	w.field("used_memory_dataset_human", humanBytes(db.memory.Used()))
+	w.field("maxmemory", db.memory.Limit())
+	w.field("maxmemory_human", humanBytes(db.memory.Limit()))
+	w.field("maxmemory_policy", db.memory.Policy())
+	w.field("gc_count", m.NumGC)
+}
+
+func (db *Database) infoPersistence(w *infoWriter) {
+	w.field("loading", boolInt(db.replication.State().Syncing))
+	w.field("storage_engine", db.config.Get("storage"))
+	if sizer, ok := db.storage.(storage.Sizer); ok {
+		lsm, vlog := sizer.Size()
+		w.field("storage_lsm_size", lsm)
+		w.field("storage_lsm_size_human", humanBytes(lsm))
+		w.field("storage_vlog_size", vlog)
+		w.field("storage_vlog_size_human", humanBytes(vlog))
+	}
+	w.field("storage_block_compression", db.config.Get("block-compression"))
+	raw, stored := db.compressor.Stats()
+	ratio := 1.0
+	if stored > 0 {
+		ratio = float64(raw) / float64(stored)
+	}
+	w.field("value_compression", db.compressor.Codec())
+	w.field("value_compression_threshold", db.compressor.Threshold())
+	w.field("value_compression_raw_bytes", raw)
+	w.field("value_compression_stored_bytes", stored)
+	w.field("value_compression_ratio", fmt.Sprintf("%.2f", ratio))
+	w.field("disk_usage", db.diskQuota.Usage())
+	w.field("disk_usage_human", humanBytes(db.diskQuota.Usage()))
+	w.field("disk_quota", db.diskQuota.Limit())
+	w.field("disk_quota_human", humanBytes(db.diskQuota.Limit()))
+	w.field("disk_quota_exceeded", boolInt(db.diskQuota.Exceeded()))
+	w.field("encryption_enabled", boolInt(db.keyring.Enabled()))
+	if db.keyring.Enabled() {
+		id, created := db.keyring.Current()
+		w.field("encryption_data_key_id", id)
+		w.field("encryption_data_key_created", created.Unix())
+	}
+	db.infoBackup(w)
+	w.field("aof_enabled", 1)
+	w.field("appendfsync", db.config.Get("appendfsync"))
+	stat, err := db.aofBus.Stat()
+	if err != nil {
+		logger.Error("failed to stat aof: %v", err)
+		return
+	}
+	w.field("aof_current_size", stat.Size)
+	w.field("aof_buffer_length", stat.Buffered)
+	var lastFlush int64 = -1
+	if !stat.LastFlush.IsZero() {
+		lastFlush = stat.LastFlush.Unix()
+	}
+	w.field("aof_last_flush_time", lastFlush)
+	status := "ok"
+	if stat.LastFlushErr != nil {
+		status = "err"
+	}
+	w.field("aof_last_write_status", status)
+}
+
+func (db *Database) infoStats(w *infoWriter) {
+	stats := db.Stats()
+	w.field("total_connections_received", stats.Connections)
+	w.field("total_commands_processed", stats.Commands)
+	w.field("keyspace_hits", stats.KeyspaceHits)
+	w.field("keyspace_misses", stats.KeyspaceMisses)
+	w.field("expired_keys", stats.ExpiredKeys)
+	w.field("expired_time_cap_reached_count", stats.ExpiredTimeCapReached)
+	w.field("expire_cycle_cpu_milliseconds", stats.ExpireCycleUsec/1000)
+	w.field("evicted_keys", stats.EvictedKeys)
+	channels, _ := db.pubsub.Channels("", false)
+	shardChannels, _ := db.pubsub.Channels("", true)
+	w.field("pubsub_channels", len(channels))
+	w.field("pubsub_patterns", db.pubsub.NumPat())
+	w.field("pubsub_shardchannels", len(shardChannels))
+}
+
+func (db *Database) infoReplication(w *infoWriter) {
+	state := db.replication.State()
+	if following := db.following; following != nil {
+		w.field("role", "slave")
+		w.field("master_host", following.host)
+		w.field("master_port", following.port)
+		link := "down"
+		if state.LinkUp {
+			link = "up"
+		}
+		w.field("master_link_status", link)
+		var lastIO int64 = -1
+		if !state.LastIO.IsZero() {
+			lastIO = int64(time.Since(state.LastIO) / time.Second)
+		}
+		w.field("master_last_io_seconds_ago", lastIO)
+		w.field("master_sync_in_progress", boolInt(state.Syncing))
+		lastApplied := ""
+		if uid, err := UIDFromBytes(state.LastApplied); err == nil {
+			lastApplied = uid.String()
+		}
+		w.field("master_last_applied_uid", lastApplied)
+	} else {
+		w.field("role", "master")
+	}
+	w.field("connected_slaves", len(state.Followers))
+	for i, f := range state.Followers {
+		host, port, err := net.SplitHostPort(f.Addr)
+		if err != nil {
+			host = f.Addr
+		}
+		w.field(fmt.Sprintf("slave%d", i), fmt.Sprintf(
+			"ip=%s,port=%s,state=online,since=%d", host, port, f.Since.Unix(),
+		))
+	}
+}
+
+func (db *Database) infoCommandStats(w *infoWriter) {
+	for _, stat := range db.commandStats.List() {
+		perCall := 0.0
+		if stat.Calls > 0 {
+			perCall = float64(stat.Usec) / float64(stat.Calls)
+		}
+		w.field("cmdstat_"+stat.Name, fmt.Sprintf(
+			"calls=%d,usec=%d,usec_per_call=%.2f,rejected_calls=%d,failed_calls=%d",
+			stat.Calls, stat.Usec, perCall, stat.Rejected, stat.Failed,
+		))
+	}
+}
+
+func (db *Database) infoKeyspace(w *infoWriter) {
+	pairs, err := db.storage.Scan(storage.ScanOptions{Pattern: "*"})
+	if err != nil {
+		logger.Error("failed to count keys: %v", err)
+		return
+	}
+	keys := make(map[int]int)
+	for _, p := range pairs {
+		if slot, _, ok := storage.SplitKeyspace(p.Key); ok {
+			keys[slot]++
+		}
+	}
+	now := time.Now()
+	for i := 0; i < db.keyspaces.Len(); i++ {
+		slot := db.keyspaces.Slot(i)
+		if keys[slot] == 0 {
+			continue
+		}
+		expires, avgTTL := db.expires.SlotStats(slot, now)
+		w.field(fmt.Sprintf("db%d", i), fmt.Sprintf(
+			"keys=%d,expires=%d,avg_ttl=%d", keys[slot], expires, avgTTL,
+		))
+	}
+}
+
+func execInfo(database *Database, client *Client, name string, args [][]byte) ([]byte, bool, error) {
+	if name != executor.INFO {
+		return nil, false, nil
+	}
+	var sections []string
+	for _, arg := range args[1:] {
+		sections = append(sections, string(arg))
+	}
+	return util.NewReply(client.Proto()).Verbatim("txt", database.Info(sections)).Bytes(), true, nil
+}
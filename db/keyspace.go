@@ -0,0 +1,405 @@
+package db
+
+import (
+	"github.com/joway/pidis/executor"
+	"github.com/joway/pidis/storage"
+	"github.com/joway/pidis/types"
+	"github.com/joway/pidis/util"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultDatabases = 16
+
+// keyspacesKey stores the slots of the databases once they differ from their indexes
+var keyspacesKey = []byte(storage.KeyspaceMarker + ":slots")
+
+// Keyspaces maps the databases selected by clients to the storage slots holding their keys,
+// so SWAPDB and FLUSHDB only have to remap them, flushed slots are then dropped in the background
+type Keyspaces struct {
+	lock      sync.RWMutex
+	databases int
+	//slots may outlive databases removed from the config, their data shows up again once added back
+	slots []int
+	//released slots are dropped once the remapping transaction commits, in the background when true
+	released map[int]bool
+	//dropping slots can't be reused until all their keys are deleted
+	dropping map[int]bool
+}
+
+// NewKeyspaces maps every database to the slot of the same index
+func NewKeyspaces(databases int) *Keyspaces {
+	return &Keyspaces{
+		databases: databases,
+		slots:     identitySlots(databases),
+		released:  make(map[int]bool),
+		dropping:  make(map[int]bool),
+	}
+}
+
+func identitySlots(n int) []int {
+	slots := make([]int, n)
+	for i := range slots {
+		slots[i] = i
+	}
+	return slots
+}
+
+// Len returns the number of databases
+func (k *Keyspaces) Len() int {
+	return k.databases
+}
+
+// Slot returns the slot of the database index
+func (k *Keyspaces) Slot(index int) int {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	return k.slots[index]
+}
+
+// Index returns the database of slot, -1 if no database maps to it
+func (k *Keyspaces) Index(slot int) int {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	for i, s := range k.slots[:k.databases] {
+		if s == slot {
+			return i
+		}
+	}
+	return -1
+}
+
+// Mapped tells whether slot belongs to a database, removed ones included
+func (k *Keyspaces) Mapped(slot int) bool {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	for _, s := range k.slots {
+		if s == slot {
+			return true
+		}
+	}
+	return false
+}
+
+func (k *Keyspaces) Swap(a, b int) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.slots[a], k.slots[b] = k.slots[b], k.slots[a]
+}
+
+// Renew maps index to an unused slot and releases its previous one, which is returned
+func (k *Keyspaces) Renew(index int, async bool) int {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	next := 0
+	for _, s := range k.slots {
+		if s >= next {
+			next = s + 1
+		}
+	}
+	for _, used := range []map[int]bool{k.released, k.dropping} {
+		for s := range used {
+			if s >= next {
+				next = s + 1
+			}
+		}
+	}
+	old := k.slots[index]
+	k.released[old] = async
+	k.slots[index] = next
+	return old
+}
+
+// Drop returns the slots released since the last call, to be passed to Dropped once deleted
+func (k *Keyspaces) Drop() map[int]bool {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	released := k.released
+	k.released = make(map[int]bool)
+	for s := range released {
+		k.dropping[s] = true
+	}
+	return released
+}
+
+func (k *Keyspaces) Dropped(slot int) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	delete(k.dropping, slot)
+}
+
+// Save returns the mapping, to be restored when a remapping transaction fails
+func (k *Keyspaces) Save() []int {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	return append([]int(nil), k.slots...)
+}
+
+func (k *Keyspaces) Restore(slots []int) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.slots = slots
+	k.released = make(map[int]bool)
+}
+
+func (k *Keyspaces) encode() []byte {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	fields := make([]string, len(k.slots))
+	for i, s := range k.slots {
+		fields[i] = strconv.Itoa(s)
+	}
+	return []byte(strings.Join(fields, " "))
+}
+
+// decode loads saved slots, databases added since then get unused slots
+func (k *Keyspaces) decode(encoded []byte) error {
+	fields := strings.Fields(string(encoded))
+	slots := make([]int, 0, len(fields))
+	next := 0
+	for _, f := range fields {
+		s, err := strconv.Atoi(f)
+		if err != nil || s < 0 {
+			return types.ErrInvalidKeyspaces
+		}
+		slots = append(slots, s)
+		if s >= next {
+			next = s + 1
+		}
+	}
+	for len(slots) < k.databases {
+		slots = append(slots, next)
+		next++
+	}
+	k.Restore(slots)
+	return nil
+}
+
+// keyspace returns the keys of the database index
+func (db *Database) keyspace(store storage.Storage, index int) *storage.Keyspace {
+	return storage.NewKeyspace(store, db.keyspaces.Slot(index))
+}
+
+// checkDB validates a database index argument
+func (db *Database) checkDB(arg []byte) (int, error) {
+	index, err := strconv.Atoi(string(arg))
+	if err != nil {
+		return 0, types.ErrInvalidDBIndex
+	}
+	if index < 0 || index >= db.keyspaces.Len() {
+		return 0, types.ErrDBIndexOutOfRange
+	}
+	return index, nil
+}
+
+// loadKeyspaces reads the saved mapping and drops the slots released before a restart
+func (db *Database) loadKeyspaces() error {
+	encoded, err := db.storage.Get(keyspacesKey)
+	if err == types.ErrKeyNotFound {
+		db.keyspaces.Restore(identitySlots(db.keyspaces.Len()))
+	} else if err != nil {
+		return err
+	} else if err := db.keyspaces.decode(encoded); err != nil {
+		return err
+	}
+	pairs, err := db.storage.Scan(storage.ScanOptions{Prefix: []byte(storage.KeyspaceMarker)})
+	if err != nil {
+		return err
+	}
+	stored := make(map[int]bool)
+	for _, p := range pairs {
+		if slot, _, ok := storage.SplitKeyspace(p.Key); ok {
+			stored[slot] = true
+		}
+	}
+	//plain keys are only dropped once the first database has been flushed
+	stored[0] = true
+	for slot := range stored {
+		if db.keyspaces.Mapped(slot) {
+			continue
+		}
+		if err := db.dropKeyspace(slot); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveKeyspaces writes the mapping within txn, so it's committed along with the remapping
+func (db *Database) saveKeyspaces(txn storage.Storage) error {
+	return txn.Set(keyspacesKey, db.keyspaces.encode(), 0)
+}
+
+// dropKeyspace deletes the keys of a released slot
+func (db *Database) dropKeyspace(slot int) error {
+	const batch = 1024
+	ks := storage.NewKeyspace(db.storage, slot)
+	pairs, err := ks.Scan(storage.ScanOptions{Pattern: "*"})
+	if err != nil {
+		return err
+	}
+	keys := make([][]byte, 0, batch)
+	for i, p := range pairs {
+		keys = append(keys, p.Key)
+		if len(keys) == batch || i == len(pairs)-1 {
+			if err := ks.Del(keys); err != nil {
+				return err
+			}
+			keys = keys[:0]
+		}
+	}
+	return nil
+}
+
+// forgetSlot drops the indexed keys of a released slot
+func (db *Database) forgetSlot(slot int) {
+	db.expires.RemoveSlot(slot)
+	db.memory.RemoveSlot(slot)
+}
+
+// dropReleased deletes the slots released by a committed transaction, their keys are forgotten at once
+// since a failed transaction leaves them in place
+func (db *Database) dropReleased() {
+	released := db.keyspaces.Drop()
+	for slot := range released {
+		db.forgetSlot(slot)
+	}
+	for slot, async := range released {
+		drop := func(slot int) {
+			defer db.keyspaces.Dropped(slot)
+			if err := db.dropKeyspace(slot); err != nil {
+				logger.Error("failed to drop keyspace %d: %v", slot, err)
+			}
+		}
+		if async {
+			go drop(slot)
+		} else {
+			drop(slot)
+		}
+	}
+}
+
+func execSelect(database *Database, client *Client, name string, args [][]byte) ([]byte, bool, error) {
+	if name != executor.SELECT {
+		return nil, false, nil
+	}
+	index, err := database.checkDB(args[1])
+	if err != nil {
+		return nil, true, err
+	}
+	client.SetDB(index)
+	return util.MessageOK(), true, nil
+}
+
+// execKeyspace runs the commands moving keys between databases or flushing them within txn,
+// the database must be locked
+func (db *Database) execKeyspace(txn storage.Storage, index int, cmd string, args [][]byte) ([]byte, error) {
+	switch cmd {
+	case executor.MOVE:
+		return db.move(txn, index, args[1], args[2])
+	case executor.SWAPDB:
+		a, err := db.checkDB(args[1])
+		if err != nil {
+			return nil, err
+		}
+		b, err := db.checkDB(args[2])
+		if err != nil {
+			return nil, err
+		}
+		db.keyspaces.Swap(a, b)
+		if err := db.saveKeyspaces(txn); err != nil {
+			return nil, err
+		}
+		//clients see other keys after the swap
+		db.touchDB(a)
+		db.touchDB(b)
+		db.invalidateAll()
+		return util.MessageOK(), nil
+	case executor.FLUSHDB, executor.FLUSHALL:
+		async, err := parseFlushMode(args[1:])
+		if err != nil {
+			return nil, err
+		}
+		indexes := []int{index}
+		if cmd == executor.FLUSHALL {
+			indexes = indexes[:0]
+			for i := 0; i < db.keyspaces.Len(); i++ {
+				indexes = append(indexes, i)
+			}
+		}
+		for _, i := range indexes {
+			db.keyspaces.Renew(i, async)
+			db.touchDB(i)
+		}
+		if err := db.saveKeyspaces(txn); err != nil {
+			return nil, err
+		}
+		db.invalidateAll()
+		return util.MessageOK(), nil
+	}
+	return nil, types.ErrUnknownCommand
+}
+
+// FLUSHDB [ASYNC|SYNC], keys are gone at once either way but ASYNC deletes them in the background
+func parseFlushMode(args [][]byte) (async bool, err error) {
+	if len(args) == 0 {
+		return false, nil
+	}
+	if len(args) > 1 {
+		return false, types.ErrSyntaxError
+	}
+	switch strings.ToUpper(string(args[0])) {
+	case "ASYNC":
+		return true, nil
+	case "SYNC":
+		return false, nil
+	}
+	return false, types.ErrSyntaxError
+}
+
+// move moves key from the database index to the database of arg along with its ttl
+func (db *Database) move(txn storage.Storage, index int, key, arg []byte) ([]byte, error) {
+	dst, err := db.checkDB(arg)
+	if err != nil {
+		return nil, err
+	}
+	if dst == index {
+		return nil, types.ErrSameObject
+	}
+	from, to := db.keyspace(txn, index), db.keyspace(txn, dst)
+	val, err := from.Get(key)
+	if err == types.ErrKeyNotFound {
+		return util.MessageInt(0), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if exists(to, key) {
+		return util.MessageInt(0), nil
+	}
+	ttl, err := from.TTL(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := to.Set(key, val, ttl); err != nil {
+		return nil, err
+	}
+	if err := from.Del([][]byte{key}); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	db.expires.Remove(string(from.Key(key)))
+	if ttl > 0 {
+		db.expires.Set(string(to.Key(key)), now.Add(time.Duration(ttl)*time.Millisecond))
+	}
+	db.memory.Remove(string(from.Key(key)))
+	db.memory.Set(string(to.Key(key)), int64(len(to.Key(key))+len(val)), now)
+	db.touch(index, [][]byte{key})
+	db.touch(dst, [][]byte{key})
+	db.invalidate([][]byte{key})
+	db.notify(index, NotifyGeneric, "move_from", key)
+	db.notify(dst, NotifyGeneric, "move_to", key)
+	return util.MessageInt(1), nil
+}
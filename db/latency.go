@@ -0,0 +1,272 @@
+package db
+
+import (
+	"fmt"
+	"github.com/joway/pidis/executor"
+	"github.com/joway/pidis/types"
+	"github.com/joway/pidis/util"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latency events
+const (
+	LatencyCommand        = "command"
+	LatencyAOFFlush       = "aof-flush"
+	LatencyAOFFsyncAlways = "aof-fsync-always"
+	LatencyExpireCycle    = "expire-cycle"
+	LatencyEvictionCycle  = "eviction-cycle"
+	LatencyBadgerGC       = "badger-gc"
+	LatencySnapshot       = "snapshot"
+)
+
+// samples kept by event, one per second at most
+const latencyHistoryLen = 160
+
+var latencyAdvices = map[string]string{
+	LatencyCommand:        "Check SLOWLOG GET for the slow commands, avoid O(N) commands like KEYS on large keyspaces.",
+	LatencyAOFFlush:       "The disk is slow to absorb aof writes, check the disk load or move the aof to a faster disk.",
+	LatencyAOFFsyncAlways: "appendfsync always syncs every write, consider 'CONFIG SET appendfsync everysec'.",
+	LatencyExpireCycle:    "Many keys expire at the same time, consider adding random jitter to the ttls.",
+	LatencyEvictionCycle:  "Writes keep exceeding maxmemory, raise maxmemory or lower maxmemory-samples.",
+	LatencyBadgerGC:       "Value log garbage collection rewrites data files, it is slow when many values were overwritten or deleted.",
+	LatencySnapshot:       "Snapshots are created when followers sync, avoid resyncing followers during peak load.",
+}
+
+type LatencySample struct {
+	Time time.Time
+	//Latency is in milliseconds
+	Latency int64
+}
+
+type latencyEvent struct {
+	samples []LatencySample
+	//head is the index of the oldest sample once the history is full
+	head int
+	max  int64
+}
+
+func (e *latencyEvent) lastIndex() int {
+	if e.head == 0 {
+		return len(e.samples) - 1
+	}
+	return e.head - 1
+}
+
+func (e *latencyEvent) latest() LatencySample {
+	return e.samples[e.lastIndex()]
+}
+
+func (e *latencyEvent) history() []LatencySample {
+	samples := make([]LatencySample, 0, len(e.samples))
+	samples = append(samples, e.samples[e.head:]...)
+	return append(samples, e.samples[:e.head]...)
+}
+
+func (e *latencyEvent) add(sample LatencySample) {
+	if sample.Latency > e.max {
+		e.max = sample.Latency
+	}
+	if len(e.samples) > 0 {
+		//samples of the same second are merged
+		last := &e.samples[e.lastIndex()]
+		if last.Time.Unix() == sample.Time.Unix() {
+			if sample.Latency > last.Latency {
+				last.Latency = sample.Latency
+			}
+			return
+		}
+	}
+	if len(e.samples) < latencyHistoryLen {
+		e.samples = append(e.samples, sample)
+		return
+	}
+	e.samples[e.head] = sample
+	e.head = (e.head + 1) % len(e.samples)
+}
+
+// LatencyMonitor samples the events taking longer than a threshold
+type LatencyMonitor struct {
+	//threshold is in milliseconds, 0 disables the monitor
+	threshold int64
+
+	lock   sync.Mutex
+	events map[string]*latencyEvent
+}
+
+func NewLatencyMonitor(threshold int64) *LatencyMonitor {
+	return &LatencyMonitor{threshold: threshold, events: make(map[string]*latencyEvent)}
+}
+
+func (m *LatencyMonitor) SetThreshold(ms int64) {
+	atomic.StoreInt64(&m.threshold, ms)
+}
+
+func (m *LatencyMonitor) Threshold() int64 {
+	return atomic.LoadInt64(&m.threshold)
+}
+
+// Observe samples an event if it took at least the threshold
+func (m *LatencyMonitor) Observe(event string, elapsed time.Duration) {
+	threshold := m.Threshold()
+	latency := int64(elapsed / time.Millisecond)
+	if threshold <= 0 || latency < threshold {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	e, ok := m.events[event]
+	if !ok {
+		e = &latencyEvent{}
+		m.events[event] = e
+	}
+	e.add(LatencySample{Time: time.Now(), Latency: latency})
+}
+
+// Since samples an event started at start
+func (m *LatencyMonitor) Since(event string, start time.Time) {
+	m.Observe(event, time.Since(start))
+}
+
+type LatencyLatest struct {
+	Event  string
+	Latest LatencySample
+	Max    int64
+}
+
+// Latest returns the latest sample of every event, sorted by name
+func (m *LatencyMonitor) Latest() []LatencyLatest {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	latest := make([]LatencyLatest, 0, len(m.events))
+	for name, e := range m.events {
+		latest = append(latest, LatencyLatest{Event: name, Latest: e.latest(), Max: e.max})
+	}
+	sort.Slice(latest, func(i, j int) bool {
+		return latest[i].Event < latest[j].Event
+	})
+	return latest
+}
+
+func (m *LatencyMonitor) History(event string) []LatencySample {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	e, ok := m.events[event]
+	if !ok {
+		return nil
+	}
+	return e.history()
+}
+
+// Reset drops the samples of the given events, all events if none is given,
+// and returns the number of events reset
+func (m *LatencyMonitor) Reset(events ...string) int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if len(events) == 0 {
+		n := len(m.events)
+		m.events = make(map[string]*latencyEvent)
+		return n
+	}
+	n := 0
+	for _, event := range events {
+		if _, ok := m.events[event]; ok {
+			delete(m.events, event)
+			n++
+		}
+	}
+	return n
+}
+
+// Doctor renders a human readable report of the sampled events
+func (m *LatencyMonitor) Doctor() string {
+	var report strings.Builder
+	if m.Threshold() <= 0 {
+		report.WriteString("Latency monitoring is disabled. " +
+			"Enable it with 'CONFIG SET latency-monitor-threshold <milliseconds>'.\n")
+		return report.String()
+	}
+	latest := m.Latest()
+	if len(latest) == 0 {
+		fmt.Fprintf(&report, "No latency spike above %dms was observed.\n", m.Threshold())
+		return report.String()
+	}
+	fmt.Fprintf(&report, "Latency spikes above %dms were observed for %d events:\n\n", m.Threshold(), len(latest))
+	for i, l := range latest {
+		history := m.History(l.Event)
+		var sum int64
+		for _, s := range history {
+			sum += s.Latency
+		}
+		fmt.Fprintf(&report,
+			"%d. %s: %d latency spikes (average %dms, max %dms), latest %dms at %s.\n",
+			i+1, l.Event, len(history), sum/int64(len(history)), l.Max, l.Latest.Latency,
+			l.Latest.Time.Format(time.RFC3339),
+		)
+	}
+	report.WriteString("\nAdvices:\n\n")
+	for _, l := range latest {
+		if advice, ok := latencyAdvices[l.Event]; ok {
+			fmt.Fprintf(&report, "- %s: %s\n", l.Event, advice)
+		}
+	}
+	return report.String()
+}
+
+func execLatency(database *Database, client *Client, name string, args [][]byte) ([]byte, bool, error) {
+	if name != executor.LATENCY {
+		return nil, false, nil
+	}
+	if len(args) < 2 {
+		return nil, true, types.ErrInvalidNumberOfArgs
+	}
+	output, err := database.Latency(client, strings.ToUpper(string(args[1])), args[2:])
+	return output, true, err
+}
+
+// LatencyMonitor returns the monitor sampling the latency events of the database
+func (db *Database) LatencyMonitor() *LatencyMonitor {
+	return db.latency
+}
+
+func (db *Database) Latency(client *Client, sub string, args [][]byte) ([]byte, error) {
+	reply := util.NewReply(client.Proto())
+	switch sub {
+	case "LATEST":
+		if len(args) != 0 {
+			return nil, types.ErrInvalidNumberOfArgs
+		}
+		latest := db.latency.Latest()
+		reply.Array(len(latest))
+		for _, l := range latest {
+			reply.Array(4).BulkString(l.Event).Int(l.Latest.Time.Unix()).Int(l.Latest.Latency).Int(l.Max)
+		}
+		return reply.Bytes(), nil
+	case "HISTORY":
+		if len(args) != 1 {
+			return nil, types.ErrInvalidNumberOfArgs
+		}
+		history := db.latency.History(string(args[0]))
+		reply.Array(len(history))
+		for _, s := range history {
+			reply.Array(2).Int(s.Time.Unix()).Int(s.Latency)
+		}
+		return reply.Bytes(), nil
+	case "RESET":
+		var events []string
+		for _, arg := range args {
+			events = append(events, string(arg))
+		}
+		return reply.Int(int64(db.latency.Reset(events...))).Bytes(), nil
+	case "DOCTOR":
+		if len(args) != 0 {
+			return nil, types.ErrInvalidNumberOfArgs
+		}
+		return reply.Verbatim("txt", db.latency.Doctor()).Bytes(), nil
+	default:
+		return nil, types.ReplyError(fmt.Sprintf("ERR unknown subcommand '%s'. Try LATENCY HELP.", strings.ToLower(sub)))
+	}
+}
@@ -0,0 +1,365 @@
+package db
+
+import (
+	"github.com/joway/pidis/executor"
+	"github.com/joway/pidis/storage"
+	"github.com/joway/pidis/types"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// maxmemory policies, same as redis
+const (
+	PolicyNoEviction    = "noeviction"
+	PolicyAllKeysLRU    = "allkeys-lru"
+	PolicyAllKeysLFU    = "allkeys-lfu"
+	PolicyVolatileLRU   = "volatile-lru"
+	PolicyVolatileTTL   = "volatile-ttl"
+	PolicyAllKeysRandom = "allkeys-random"
+)
+
+const (
+	DefaultMaxMemorySamples = 5
+
+	//estimated bookkeeping of a key on top of its key and value bytes
+	keyOverhead = 48
+
+	//new keys start with some frequency so they aren't evicted before being read again
+	lfuInitVal   = 5
+	lfuLogFactor = 10
+	lfuDecayTime = time.Minute
+)
+
+type keyUsage struct {
+	size int64
+	//access is the unix nano time of the last read or write
+	access int64
+	//counter grows logarithmically with accesses and decays over time
+	counter uint8
+	decayed int64
+}
+
+// Memory accounts the bytes of the stored keys along with their accesses,
+// so the keys to evict once maxmemory is reached can be picked by sampling.
+// Only the memory storage is accounted, persistent storages are bounded by their disk
+type Memory struct {
+	lock    sync.Mutex
+	enabled bool
+	used    int64
+	keys    map[string]*keyUsage
+
+	limit   int64
+	policy  string
+	samples int
+}
+
+func NewMemory(enabled bool) *Memory {
+	return &Memory{
+		enabled: enabled,
+		keys:    make(map[string]*keyUsage),
+		policy:  PolicyNoEviction,
+		samples: DefaultMaxMemorySamples,
+	}
+}
+
+func (m *Memory) Enabled() bool {
+	return m.enabled
+}
+
+// SetLimit sets maxmemory in bytes, 0 disables it
+func (m *Memory) SetLimit(limit int64) error {
+	if limit > 0 && !m.enabled {
+		return types.ReplyError("ERR maxmemory requires the memory storage")
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.limit = limit
+	return nil
+}
+
+func (m *Memory) Limit() int64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.limit
+}
+
+func (m *Memory) SetPolicy(policy string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.policy = policy
+}
+
+func (m *Memory) Policy() string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.policy
+}
+
+func (m *Memory) SetSamples(samples int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.samples = samples
+}
+
+func (m *Memory) Samples() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.samples
+}
+
+// Used returns the accounted bytes of the stored keys
+func (m *Memory) Used() int64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.used
+}
+
+func (m *Memory) OverLimit() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.limit > 0 && m.used > m.limit
+}
+
+// Set records a write of key, size is the bytes of its stored key and value
+func (m *Memory) Set(key string, size int64, now time.Time) {
+	if !m.enabled {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	size += keyOverhead
+	u, ok := m.keys[key]
+	if !ok {
+		u = &keyUsage{counter: lfuInitVal, decayed: now.UnixNano()}
+		m.keys[key] = u
+	}
+	m.used += size - u.size
+	u.size = size
+	m.touch(u, now)
+}
+
+// Access records a read of key
+func (m *Memory) Access(key string, now time.Time) {
+	if !m.enabled {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if u, ok := m.keys[key]; ok {
+		m.touch(u, now)
+	}
+}
+
+func (m *Memory) touch(u *keyUsage, now time.Time) {
+	u.access = now.UnixNano()
+	m.decay(u, now)
+	if u.counter == 255 {
+		return
+	}
+	//the more a key has been accessed the less likely its counter grows, as redis does
+	base := float64(u.counter) - lfuInitVal
+	if base < 0 {
+		base = 0
+	}
+	if rand.Float64() < 1/(base*lfuLogFactor+1) {
+		u.counter++
+	}
+}
+
+// decay decrements the counter once per period elapsed since the last decay
+func (m *Memory) decay(u *keyUsage, now time.Time) uint8 {
+	periods := (now.UnixNano() - u.decayed) / int64(lfuDecayTime)
+	if periods <= 0 {
+		return u.counter
+	}
+	u.decayed += periods * int64(lfuDecayTime)
+	if periods >= int64(u.counter) {
+		u.counter = 0
+	} else {
+		u.counter -= uint8(periods)
+	}
+	return u.counter
+}
+
+func (m *Memory) Remove(key string) {
+	if !m.enabled {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if u, ok := m.keys[key]; ok {
+		m.used -= u.size
+		delete(m.keys, key)
+	}
+}
+
+// RemoveSlot forgets the keys of a dropped slot
+func (m *Memory) RemoveSlot(slot int) {
+	if !m.enabled {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for key, u := range m.keys {
+		if s, _, _ := storage.SplitKeyspace([]byte(key)); s == slot {
+			m.used -= u.size
+			delete(m.keys, key)
+		}
+	}
+}
+
+// Candidate picks the best key to evict among a few sampled ones, volatile are the deadlines of sampled keys
+// with a ttl for the volatile policies. It returns an empty key when nothing can be evicted
+func (m *Memory) Candidate(policy string, volatile map[string]int64, now time.Time) string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	best, bestScore := "", int64(0)
+	consider := func(key string, score int64) {
+		if best == "" || score < bestScore {
+			best, bestScore = key, score
+		}
+	}
+	switch policy {
+	case PolicyNoEviction:
+	case PolicyVolatileTTL:
+		for key, deadline := range volatile {
+			consider(key, deadline)
+		}
+	case PolicyVolatileLRU:
+		for key := range volatile {
+			if u, ok := m.keys[key]; ok {
+				consider(key, u.access)
+			}
+		}
+	default:
+		//map iteration starts at a random key, which is good enough a sample
+		sampled := 0
+		for key, u := range m.keys {
+			if sampled >= m.samples {
+				break
+			}
+			sampled++
+			switch policy {
+			case PolicyAllKeysLRU:
+				consider(key, u.access)
+			case PolicyAllKeysLFU:
+				consider(key, int64(m.decay(u, now)))
+			default:
+				consider(key, 0)
+			}
+		}
+	}
+	return best
+}
+
+func isVolatilePolicy(policy string) bool {
+	return policy == PolicyVolatileLRU || policy == PolicyVolatileTTL
+}
+
+// loadMemory accounts the keys already in storage
+func (db *Database) loadMemory() error {
+	if !db.memory.Enabled() {
+		return nil
+	}
+	pairs, err := db.storage.Scan(storage.ScanOptions{Pattern: "*", IncludeValue: true})
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, p := range pairs {
+		if _, _, ok := storage.SplitKeyspace(p.Key); ok {
+			db.memory.Set(string(p.Key), int64(len(p.Key)+len(p.Val)), now)
+		}
+	}
+	return nil
+}
+
+// updateMemory accounts the keys of a command, writes resize them and reads refresh their access
+func (db *Database) updateMemory(ks *storage.Keyspace, keys [][]byte, write bool) {
+	if !db.memory.Enabled() {
+		return
+	}
+	now := time.Now()
+	for _, key := range keys {
+		stored := ks.Key(key)
+		if !write {
+			db.memory.Access(string(stored), now)
+			continue
+		}
+		val, err := ks.Get(key)
+		if err != nil {
+			db.memory.Remove(string(stored))
+			continue
+		}
+		db.memory.Set(string(stored), int64(len(stored)+len(val)), now)
+	}
+}
+
+// checkOOM refuses the commands which may grow the dataset while maxmemory or the disk quota is exceeded
+func (db *Database) checkOOM(cmd string, isInternal bool) error {
+	if isInternal || !executor.Lookup(cmd).HasFlag(executor.FlagDenyOOM) {
+		return nil
+	}
+	if db.memory.OverLimit() {
+		return types.ErrOOM
+	}
+	if db.diskQuota.Exceeded() {
+		return types.ErrDiskQuota
+	}
+	return nil
+}
+
+// freeMemory evicts keys according to maxmemory-policy until the used memory fits maxmemory,
+// it's run before writes on a master only, followers delete the keys evicted by their master
+func (db *Database) freeMemory() {
+	if !db.memory.OverLimit() || !db.IsWritable() {
+		return
+	}
+	policy := db.memory.Policy()
+	if policy == PolicyNoEviction {
+		return
+	}
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	defer db.latency.Since(LatencyEvictionCycle, time.Now())
+	for db.memory.OverLimit() {
+		var volatile map[string]int64
+		if isVolatilePolicy(policy) {
+			volatile = db.expires.Random(db.memory.Samples())
+		}
+		key := db.memory.Candidate(policy, volatile, time.Now())
+		if key == "" {
+			return
+		}
+		if err := db.evictKey([]byte(key)); err != nil {
+			logger.Error("failed to evict %s: %v", key, err)
+			return
+		}
+	}
+}
+
+// evictKey deletes a stored key and records it as a DEL, so followers evict it too
+func (db *Database) evictKey(stored []byte) error {
+	slot, key, _ := storage.SplitKeyspace(stored)
+	index := db.keyspaces.Index(slot)
+	if index >= 0 {
+		if err := db.Record(index, [][]byte{[]byte(executor.DEL), key}); err != nil {
+			return err
+		}
+	}
+	if err := db.storage.Del([][]byte{stored}); err != nil {
+		return err
+	}
+	db.memory.Remove(string(stored))
+	db.expires.Remove(string(stored))
+	//the database has been flushed meanwhile
+	if index < 0 {
+		return nil
+	}
+	db.stats.incr(&db.stats.EvictedKeys)
+	db.touch(index, [][]byte{key})
+	db.invalidate([][]byte{key})
+	db.notify(index, NotifyEvicted, "evicted", key)
+	return nil
+}
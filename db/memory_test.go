@@ -0,0 +1,155 @@
+package db
+
+import (
+	"fmt"
+	"github.com/joway/pidis/storage"
+	"github.com/joway/pidis/types"
+	"github.com/joway/pidis/util"
+	"github.com/stretchr/testify/suite"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+type MemoryTestSuite struct {
+	suite.Suite
+
+	dir string
+	db  *Database
+}
+
+func TestMemory(t *testing.T) {
+	suite.Run(t, new(MemoryTestSuite))
+}
+
+func (suite *MemoryTestSuite) SetupTest() {
+	suite.dir = "/tmp/pidis/memory"
+	_ = os.RemoveAll(suite.dir)
+	db, err := New(Options{DBDir: suite.dir, Storage: storage.TypeMemory, NotifyKeyspaceEvents: "KEA"})
+	suite.Require().NoError(err)
+	suite.db = db
+}
+
+func (suite *MemoryTestSuite) TearDownTest() {
+	_ = suite.db.Close()
+}
+
+func (suite *MemoryTestSuite) config(args string) {
+	_, err := suite.db.Config(NewClient(nil), "SET", util.CommandToArgs(args))
+	suite.Require().NoError(err)
+}
+
+func (suite *MemoryTestSuite) TestAccounting() {
+	_, err := suite.db.Exec(util.CommandToArgs("set k 12345"))
+	suite.NoError(err)
+	suite.EqualValues(len("k")+len("12345")+keyOverhead, suite.db.memory.Used())
+	_, err = suite.db.ExecIn(1, util.CommandToArgs("set k 1"))
+	suite.NoError(err)
+	_, err = suite.db.Exec(util.CommandToArgs("del k"))
+	suite.NoError(err)
+	suite.EqualValues(len(storage.KeyspacePrefix(1))+len("k1")+keyOverhead, suite.db.memory.Used())
+	_, err = suite.db.ExecIn(1, util.CommandToArgs("flushdb"))
+	suite.NoError(err)
+	suite.EqualValues(0, suite.db.memory.Used())
+}
+
+func (suite *MemoryTestSuite) TestNoEviction() {
+	suite.config("maxmemory 1kb")
+	var err error
+	for i := 0; i < 100 && err == nil; i++ {
+		_, err = suite.db.Exec(util.CommandToArgs(fmt.Sprintf("set k%d %s", i, strings.Repeat("v", 64))))
+	}
+	suite.Equal(types.ErrOOM, err)
+	//commands which don't grow the dataset are still allowed
+	_, err = suite.db.Exec(util.CommandToArgs("get k0"))
+	suite.NoError(err)
+	_, err = suite.db.Exec(util.CommandToArgs("del k0 k1"))
+	suite.NoError(err)
+	_, err = suite.db.Exec(util.CommandToArgs("set k0 v"))
+	suite.NoError(err)
+	suite.Zero(suite.db.Stats().EvictedKeys)
+}
+
+func (suite *MemoryTestSuite) TestAllKeysLRU() {
+	//sampling every key makes the approximation exact
+	suite.config("maxmemory 1kb maxmemory-policy allkeys-lru maxmemory-samples 100")
+	_, err := suite.db.Exec(util.CommandToArgs("set hot v"))
+	suite.NoError(err)
+	for i := 0; i < 100; i++ {
+		_, err := suite.db.Exec(util.CommandToArgs(fmt.Sprintf("set k%d %s", i, strings.Repeat("v", 64))))
+		suite.NoError(err)
+		_, err = suite.db.Exec(util.CommandToArgs("get hot"))
+		suite.NoError(err)
+	}
+	suite.True(suite.db.memory.Used() <= 1024+2*(64+keyOverhead))
+	suite.True(suite.db.Stats().EvictedKeys > 80)
+	result, err := suite.db.Exec(util.CommandToArgs("get hot"))
+	suite.NoError(err)
+	suite.Equal("$1\r\nv\r\n", string(result.Output()))
+	result, err = suite.db.Exec(util.CommandToArgs("get k0"))
+	suite.NoError(err)
+	suite.Equal(util.MessageNull(), result.Output())
+
+	//evictions are recorded as DEL so followers replay them
+	suite.NoError(suite.db.aofBus.Flush())
+	content, err := ioutil.ReadFile(path.Join(suite.dir, "pidis.aof"))
+	suite.NoError(err)
+	var dels []string
+	for len(content) > 0 {
+		_, _, args, leftover, err := DecodeAOF(content)
+		suite.Require().NoError(err)
+		if string(args[0]) == "DEL" {
+			dels = append(dels, string(args[1]))
+		}
+		content = leftover
+	}
+	suite.EqualValues(suite.db.Stats().EvictedKeys, len(dels))
+	suite.Equal("k0", dels[0])
+}
+
+func (suite *MemoryTestSuite) TestAllKeysLFU() {
+	suite.config("maxmemory 1kb maxmemory-policy allkeys-lfu maxmemory-samples 100")
+	_, err := suite.db.Exec(util.CommandToArgs("set hot v"))
+	suite.NoError(err)
+	for i := 0; i < 100; i++ {
+		_, err = suite.db.Exec(util.CommandToArgs("get hot"))
+		suite.NoError(err)
+	}
+	for i := 0; i < 100; i++ {
+		_, err := suite.db.Exec(util.CommandToArgs(fmt.Sprintf("set k%d %s", i, strings.Repeat("v", 64))))
+		suite.NoError(err)
+	}
+	result, err := suite.db.Exec(util.CommandToArgs("get hot"))
+	suite.NoError(err)
+	suite.Equal("$1\r\nv\r\n", string(result.Output()))
+}
+
+func (suite *MemoryTestSuite) TestVolatile() {
+	suite.config("maxmemory 1kb maxmemory-policy volatile-ttl maxmemory-samples 100")
+	_, err := suite.db.Exec(util.CommandToArgs("set soon v ex 10"))
+	suite.NoError(err)
+	_, err = suite.db.Exec(util.CommandToArgs("set later v ex 1000"))
+	suite.NoError(err)
+	for i := 0; err == nil; i++ {
+		_, err = suite.db.Exec(util.CommandToArgs(fmt.Sprintf("set k%d %s", i, strings.Repeat("v", 64))))
+	}
+	//keys without ttl are never evicted
+	suite.Equal(types.ErrOOM, err)
+	suite.EqualValues(2, suite.db.Stats().EvictedKeys)
+	result, err := suite.db.Exec(util.CommandToArgs("get k0"))
+	suite.NoError(err)
+	suite.Equal("$64\r\n"+strings.Repeat("v", 64)+"\r\n", string(result.Output()))
+	suite.Zero(suite.db.expires.Len())
+}
+
+func (suite *MemoryTestSuite) TestBadger() {
+	db, err := New(Options{DBDir: path.Join(suite.dir, "badger")})
+	suite.NoError(err)
+	defer func() { _ = db.Close() }()
+	_, err = db.Config(NewClient(nil), "SET", util.CommandToArgs("maxmemory 1mb"))
+	suite.Error(err)
+	_, err = db.Config(NewClient(nil), "SET", util.CommandToArgs("maxmemory-policy allkeys-lru"))
+	suite.NoError(err)
+}
@@ -0,0 +1,247 @@
+package db
+
+import (
+	"github.com/joway/pidis/types"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const metricsNamespace = "pidis"
+
+// Metrics exposes the counters of a database to prometheus
+type Metrics struct {
+	registry *prometheus.Registry
+
+	commands         *prometheus.CounterVec
+	commandDuration  *prometheus.HistogramVec
+	commandErrors    *prometheus.CounterVec
+	aofFlushDuration prometheus.Histogram
+
+	snapshotSentBytes prometheus.Counter
+}
+
+func newMetrics(db *Database) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		commands: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "commands_total",
+			Help:      "Commands processed by name.",
+		}, []string{"command"}),
+		commandDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "command_duration_seconds",
+			Help:      "Latency of the commands by name.",
+			Buckets:   prometheus.ExponentialBuckets(0.00001, 4, 10),
+		}, []string{"command"}),
+		commandErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "command_errors_total",
+			Help:      "Error replies by command and error name, such as not_integer or no_perm_key.",
+		}, []string{"command", "error"}),
+		aofFlushDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "aof_flush_duration_seconds",
+			Help:      "Latency of flushing the aof buffer to the file.",
+			Buckets:   prometheus.ExponentialBuckets(0.00001, 4, 10),
+		}),
+		snapshotSentBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "snapshot_sent_bytes_total",
+			Help:      "Bytes of snapshots sent to followers.",
+		}),
+	}
+	m.registry.MustRegister(
+		m.commands,
+		m.commandDuration,
+		m.commandErrors,
+		m.aofFlushDuration,
+		m.snapshotSentBytes,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "connected_clients",
+			Help:      "Clients connected to the redis listener.",
+		}, func() float64 {
+			db.clientsLock.RLock()
+			defer db.clientsLock.RUnlock()
+			return float64(len(db.clients))
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "aof_written_bytes_total",
+			Help:      "Bytes appended to the aof since startup.",
+		}, func() float64 {
+			return float64(db.aofBus.Written())
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "aof_entries_total",
+			Help:      "Entries appended to the aof since startup.",
+		}, func() float64 {
+			return float64(db.aofBus.Entries())
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "disk_usage_bytes",
+			Help:      "Bytes of the data dir and the aof, measured while a disk quota is set.",
+		}, func() float64 {
+			return float64(db.diskQuota.Usage())
+		}),
+		&replicationCollector{db: db},
+		badgerCollector(),
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// observeCommand counts errors by their registered name, err is nil when the error was replied as output
+func (m *Metrics) observeCommand(name string, elapsed time.Duration, errReply []byte, err error) {
+	m.commands.WithLabelValues(name).Inc()
+	m.commandDuration.WithLabelValues(name).Observe(elapsed.Seconds())
+	if errReply != nil {
+		m.commandErrors.WithLabelValues(name, types.Name(err)).Inc()
+	}
+}
+
+// errorCode returns the first word of an error reply,
+// replies not starting with an uppercase code are counted as ERR
+func errorCode(reply []byte) string {
+	if len(reply) < 2 || reply[0] != '-' {
+		return ""
+	}
+	code := string(reply[1:])
+	if i := strings.IndexAny(code, " \r"); i >= 0 {
+		code = code[:i]
+	}
+	if code == "" || strings.IndexFunc(code, func(r rune) bool {
+		return r < 'A' || r > 'Z'
+	}) >= 0 {
+		return "ERR"
+	}
+	return code
+}
+
+func (db *Database) recordCommand(name string, elapsed time.Duration, rejected bool, errReply []byte, err error) {
+	if !knownCommand(name) {
+		return
+	}
+	name = strings.ToLower(name)
+	db.commandStats.Record(name, elapsed, rejected, errReply != nil)
+	db.metrics.observeCommand(name, elapsed, errReply, err)
+}
+
+// flushAOF flushes the aof buffer and observes its latency
+func (db *Database) flushAOF() error {
+	start := time.Now()
+	err := db.aofBus.Flush()
+	elapsed := time.Since(start)
+	db.metrics.aofFlushDuration.Observe(elapsed.Seconds())
+	db.latency.Observe(LatencyAOFFlush, elapsed)
+	return err
+}
+
+// MetricsHandler serves the metrics in the prometheus text format
+func (db *Database) MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(db.metrics.registry, promhttp.HandlerOpts{})
+}
+
+var (
+	replicationLagEntriesDesc = prometheus.NewDesc(
+		metricsNamespace+"_replication_follower_lag_entries",
+		"Aof entries not sent to a follower yet.",
+		[]string{"follower"}, nil,
+	)
+	replicationFollowersDesc = prometheus.NewDesc(
+		metricsNamespace+"_replication_connected_followers",
+		"Followers streaming the oplog.",
+		nil, nil,
+	)
+	replicationLinkDesc = prometheus.NewDesc(
+		metricsNamespace+"_replication_master_link_up",
+		"Whether a follower is streaming the oplog of its master.",
+		nil, nil,
+	)
+	replicationLagSecondsDesc = prometheus.NewDesc(
+		metricsNamespace+"_replication_lag_seconds",
+		"Seconds since the last applied entry was written on the master.",
+		nil, nil,
+	)
+	replicationAppliedDesc = prometheus.NewDesc(
+		metricsNamespace+"_replication_applied_entries_total",
+		"Oplog entries applied by a follower.",
+		nil, nil,
+	)
+	snapshotSyncingDesc = prometheus.NewDesc(
+		metricsNamespace+"_snapshot_transfer_in_progress",
+		"Whether a follower is receiving a snapshot.",
+		nil, nil,
+	)
+	snapshotReceivedDesc = prometheus.NewDesc(
+		metricsNamespace+"_snapshot_received_bytes",
+		"Bytes received of the current or last snapshot.",
+		nil, nil,
+	)
+)
+
+// replicationCollector reports the replication state when scraped
+type replicationCollector struct {
+	db *Database
+}
+
+func (c *replicationCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- replicationLagEntriesDesc
+	ch <- replicationFollowersDesc
+	ch <- replicationLinkDesc
+	ch <- replicationLagSecondsDesc
+	ch <- replicationAppliedDesc
+	ch <- snapshotSyncingDesc
+	ch <- snapshotReceivedDesc
+}
+
+func (c *replicationCollector) Collect(ch chan<- prometheus.Metric) {
+	state := c.db.replication.State()
+	ch <- prometheus.MustNewConstMetric(replicationFollowersDesc, prometheus.GaugeValue, float64(len(state.Followers)))
+	for _, f := range state.Followers {
+		ch <- prometheus.MustNewConstMetric(
+			replicationLagEntriesDesc, prometheus.GaugeValue, float64(f.Lag(c.db.aofBus)), f.Addr,
+		)
+	}
+	if c.db.following == nil {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(replicationLinkDesc, prometheus.GaugeValue, float64(boolInt(state.LinkUp)))
+	ch <- prometheus.MustNewConstMetric(replicationAppliedDesc, prometheus.CounterValue, float64(state.Applied))
+	if uid, err := UIDFromBytes(state.LastApplied); err == nil {
+		ch <- prometheus.MustNewConstMetric(
+			replicationLagSecondsDesc, prometheus.GaugeValue, time.Since(uid.Time()).Seconds(),
+		)
+	}
+	ch <- prometheus.MustNewConstMetric(snapshotSyncingDesc, prometheus.GaugeValue, float64(boolInt(state.Syncing)))
+	ch <- prometheus.MustNewConstMetric(snapshotReceivedDesc, prometheus.GaugeValue, float64(state.SnapshotBytes))
+}
+
+// badgerCollector exports the expvar metrics published by badger, under their v1 names
+func badgerCollector() prometheus.Collector {
+	desc := func(name, help string, labels ...string) *prometheus.Desc {
+		return prometheus.NewDesc(metricsNamespace+"_"+name, help, labels, nil)
+	}
+	return prometheus.NewExpvarCollector(map[string]*prometheus.Desc{
+		"badger_v2_disk_reads_total":     desc("badger_disk_reads_total", "Badger disk reads."),
+		"badger_v2_disk_writes_total":    desc("badger_disk_writes_total", "Badger disk writes."),
+		"badger_v2_read_bytes":           desc("badger_read_bytes_total", "Bytes read by badger."),
+		"badger_v2_written_bytes":        desc("badger_written_bytes_total", "Bytes written by badger."),
+		"badger_v2_gets_total":           desc("badger_gets_total", "Badger gets."),
+		"badger_v2_puts_total":           desc("badger_puts_total", "Badger puts."),
+		"badger_v2_blocked_puts_total":   desc("badger_blocked_puts_total", "Badger puts blocked by a full memtable."),
+		"badger_v2_memtable_gets_total":  desc("badger_memtable_gets_total", "Badger gets served by memtables."),
+		"badger_v2_lsm_level_gets_total": desc("badger_lsm_level_gets_total", "Badger gets by lsm level.", "level"),
+		"badger_v2_lsm_bloom_hits_total": desc("badger_lsm_bloom_hits_total", "Badger bloom filter hits by lsm level.", "level"),
+		"badger_v2_lsm_size_bytes":       desc("badger_lsm_size_bytes", "Badger lsm size by directory.", "dir"),
+		"badger_v2_vlog_size_bytes":      desc("badger_vlog_size_bytes", "Badger value log size by directory.", "dir"),
+		"badger_v2_pending_writes_total": desc("badger_pending_writes", "Badger pending writes by directory.", "dir"),
+	})
+}
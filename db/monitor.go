@@ -0,0 +1,160 @@
+package db
+
+import (
+	"fmt"
+	"github.com/joway/pidis/executor"
+	"github.com/joway/pidis/types"
+	"github.com/joway/pidis/util"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const redacted = "(redacted)"
+
+// Monitors are the clients streaming every processed command
+type Monitors struct {
+	//count is checked before building a feed, so commands cost nothing without monitors
+	count int32
+
+	lock    sync.RWMutex
+	clients map[int64]*Client
+}
+
+func NewMonitors() *Monitors {
+	return &Monitors{clients: make(map[int64]*Client)}
+}
+
+func (m *Monitors) Len() int {
+	return int(atomic.LoadInt32(&m.count))
+}
+
+func (m *Monitors) Add(c *Client) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.clients[c.id] = c
+	atomic.StoreInt32(&m.count, int32(len(m.clients)))
+}
+
+func (m *Monitors) Remove(c *Client) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.clients, c.id)
+	atomic.StoreInt32(&m.count, int32(len(m.clients)))
+}
+
+// Feed sends a command run by client to every monitor
+func (m *Monitors) Feed(client *Client, args [][]byte) {
+	if m.Len() == 0 {
+		return
+	}
+	line := monitorLine(time.Now(), client.DB(), client.Addr(), redactArgs(args))
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	for _, c := range m.clients {
+		c.Push(line)
+	}
+}
+
+func monitorLine(now time.Time, index int, addr string, args [][]byte) []byte {
+	var line strings.Builder
+	fmt.Fprintf(&line, "+%d.%06d [%d %s]", now.Unix(), now.Nanosecond()/1000, index, addr)
+	for _, arg := range args {
+		line.WriteByte(' ')
+		line.WriteString(quoteArg(arg))
+	}
+	line.WriteString("\r\n")
+	return []byte(line.String())
+}
+
+// quoteArg escapes an argument the way redis-cli prints it
+func quoteArg(arg []byte) string {
+	var quoted strings.Builder
+	quoted.WriteByte('"')
+	for _, c := range arg {
+		switch c {
+		case '\\', '"':
+			quoted.WriteByte('\\')
+			quoted.WriteByte(c)
+		case '\n':
+			quoted.WriteString(`\n`)
+		case '\r':
+			quoted.WriteString(`\r`)
+		case '\t':
+			quoted.WriteString(`\t`)
+		case '\a':
+			quoted.WriteString(`\a`)
+		case '\b':
+			quoted.WriteString(`\b`)
+		default:
+			if c < 0x20 || c > 0x7e {
+				fmt.Fprintf(&quoted, `\x%02x`, c)
+			} else {
+				quoted.WriteByte(c)
+			}
+		}
+	}
+	quoted.WriteByte('"')
+	return quoted.String()
+}
+
+// redactArgs hides the passwords of a command from monitors
+func redactArgs(args [][]byte) [][]byte {
+	name := strings.ToUpper(string(args[0]))
+	redact := func(from int, keep func(i int) bool) [][]byte {
+		out := make([][]byte, len(args))
+		copy(out, args)
+		for i := from; i < len(out); i++ {
+			if keep == nil || !keep(i) {
+				out[i] = []byte(redacted)
+			}
+		}
+		return out
+	}
+	switch name {
+	case executor.AUTH:
+		return redact(1, nil)
+	case executor.HELLO:
+		//HELLO protover AUTH username password
+		for i := 1; i < len(args)-2; i++ {
+			if strings.EqualFold(string(args[i]), "AUTH") {
+				return redact(i+1, func(j int) bool { return j > i+2 })
+			}
+		}
+	case executor.CONFIG:
+		if len(args) > 1 && strings.EqualFold(string(args[1]), "SET") {
+			return redact(2, func(j int) bool {
+				//values of secret params
+				if (j-2)%2 == 0 {
+					return true
+				}
+				param := strings.ToLower(string(args[j-1]))
+				return param != "requirepass" && param != "masterauth"
+			})
+		}
+	case executor.ACL:
+		if len(args) > 1 && strings.EqualFold(string(args[1]), "SETUSER") {
+			return redact(3, func(j int) bool {
+				rule := args[j]
+				return len(rule) == 0 || !strings.ContainsRune("><#!", rune(rule[0]))
+			})
+		}
+	}
+	return args
+}
+
+func execMonitor(database *Database, client *Client, name string, args [][]byte) ([]byte, bool, error) {
+	if name != executor.MONITOR {
+		return nil, false, nil
+	}
+	if len(args) != 1 {
+		return nil, true, types.ErrInvalidNumberOfArgs
+	}
+	database.detach(client)
+	//OK is queued before the first fed command
+	client.Reply(util.MessageOK())
+	client.monitor = true
+	database.monitors.Add(client)
+	return nil, true, nil
+}
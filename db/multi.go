@@ -0,0 +1,318 @@
+package db
+
+import (
+	"github.com/joway/pidis/executor"
+	"github.com/joway/pidis/storage"
+	"github.com/joway/pidis/types"
+	"github.com/joway/pidis/util"
+	"github.com/pkg/errors"
+	"github.com/tidwall/redcon"
+	"strconv"
+	"strings"
+)
+
+func (db *Database) Multi(c *Client) ([]byte, error) {
+	if c.multi {
+		return nil, types.ErrNestedMulti
+	}
+	c.multi = true
+	c.multiErr = false
+	c.queue = nil
+	return util.MessageOK(), nil
+}
+
+func (db *Database) Queue(c *Client, args [][]byte) ([]byte, error) {
+	if len(args) == 0 {
+		c.multiErr = true
+		return nil, types.ErrInvalidNumberOfArgs
+	}
+	//the database switched by SELECT is checked now, so EXEC knows the database of every command
+	if strings.EqualFold(string(args[0]), executor.SELECT) {
+		if _, err := db.checkDB(args[1]); err != nil {
+			c.multiErr = true
+			return nil, err
+		}
+	}
+	c.queue = append(c.queue, args)
+	return util.MessageString("QUEUED"), nil
+}
+
+func (db *Database) Discard(c *Client) ([]byte, error) {
+	if !c.multi {
+		return nil, types.ErrDiscardWithoutMulti
+	}
+	db.resetMulti(c)
+	return util.MessageOK(), nil
+}
+
+func (db *Database) ExecMulti(c *Client) ([]byte, error) {
+	if !c.multi {
+		return nil, types.ErrExecWithoutMulti
+	}
+	queue, multiErr := c.queue, c.multiErr
+	defer db.resetMulti(c)
+	if multiErr {
+		return nil, types.ErrExecAbort
+	}
+
+	entries := make([]AOFEntry, len(queue))
+	index := c.DB()
+	for i, args := range queue {
+		if strings.EqualFold(string(args[0]), executor.SELECT) {
+			index, _ = db.checkDB(args[1])
+		}
+		entries[i] = AOFEntry{DB: index, Args: args}
+	}
+
+	//room is made and expired keys are deleted before the database gets locked by the transaction
+	for _, args := range queue {
+		if mayWrite(strings.ToUpper(string(args[0]))) {
+			db.freeMemory()
+			break
+		}
+	}
+	for _, e := range entries {
+		db.expireKeys(e.DB, executor.Lookup(string(e.Args[0])).Keys(e.Args))
+	}
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	//watched keys have been modified
+	if db.isDirty(c) {
+		return util.MessageNullArray(), nil
+	}
+	outputs, errs, err := db.execMulti(c, entries, false)
+	if err != nil {
+		return nil, err
+	}
+	c.SetDB(index)
+
+	output := redcon.AppendArray(nil, len(outputs))
+	for i := range outputs {
+		if errs[i] != nil {
+			output = append(output, errorOutput(queue[i], errs[i])...)
+			continue
+		}
+		output = append(output, outputs[i]...)
+	}
+	return output, nil
+}
+
+func (db *Database) Watch(c *Client, keys [][]byte) ([]byte, error) {
+	if c.multi {
+		return nil, types.ErrWatchInsideMulti
+	}
+	if len(keys) == 0 {
+		return nil, types.ErrInvalidNumberOfArgs
+	}
+
+	db.watchLock.Lock()
+	defer db.watchLock.Unlock()
+	index := c.DB()
+	for _, key := range keys {
+		k := watchKey(index, key)
+		clients, ok := db.watches[k]
+		if !ok {
+			clients = make(map[*Client]struct{})
+			db.watches[k] = clients
+		}
+		if _, ok := clients[c]; ok {
+			continue
+		}
+		clients[c] = struct{}{}
+		c.watching = append(c.watching, k)
+	}
+	return util.MessageOK(), nil
+}
+
+func (db *Database) Unwatch(c *Client) ([]byte, error) {
+	db.unwatch(c)
+	return util.MessageOK(), nil
+}
+
+// execMulti runs commands in a single transaction, the database must be locked.
+// Like single commands, the writes are recorded before being committed
+func (db *Database) execMulti(client *Client, entries []AOFEntry, isInternal bool) ([][]byte, []error, error) {
+	var (
+		outputs = make([][]byte, len(entries))
+		errs    = make([]error, len(entries))
+	)
+	//databases remapped by the transaction are restored if it fails
+	slots := db.keyspaces.Save()
+	err := db.storage.Transaction(func(txn storage.Storage) error {
+		var writes []AOFEntry
+		for i, e := range entries {
+			output, w, err := db.execTxn(client, txn, e.DB, e.Args, isInternal)
+			outputs[i], errs[i] = output, err
+			writes = append(writes, w...)
+		}
+		if len(writes) == 0 {
+			return nil
+		}
+		//a failed record rolls the transaction back
+		if err := db.aofBus.AppendMulti(writes); err != nil {
+			return errors.Wrap(err, "record transaction failed")
+		}
+		return errors.Wrap(db.fsyncAOF(), "record transaction failed")
+	})
+	if err != nil {
+		db.keyspaces.Restore(slots)
+		return nil, nil, errors.Wrap(err, "commit transaction failed")
+	}
+	db.dropReleased()
+	return outputs, errs, nil
+}
+
+// execTxn runs a command of client in the database index within txn and returns the entries to record
+func (db *Database) execTxn(client *Client, txn storage.Storage, index int, args [][]byte, isInternal bool) ([]byte, []AOFEntry, error) {
+	if len(args) == 0 {
+		return nil, nil, types.ErrInvalidNumberOfArgs
+	}
+	cmd := strings.ToUpper(string(args[0]))
+	switch cmd {
+	case executor.EVAL, executor.EVALSHA:
+		return db.evalTxn(client, txn, index, args, isInternal)
+	case executor.FCALL, executor.FCALL_RO:
+		return db.fcallTxn(client, txn, index, args, isInternal)
+	case executor.PUBLISH, executor.SPUBLISH:
+		//messages published by scripts are delivered at once and aren't recorded
+		output, err := db.publish(cmd, args)
+		return output, nil, err
+	case executor.SELECT:
+		//the following commands have been given the selected database by EXEC
+		return util.MessageOK(), nil, nil
+	case executor.MOVE, executor.SWAPDB, executor.FLUSHDB, executor.FLUSHALL:
+		if !isInternal && !db.IsWritable() {
+			return nil, nil, types.ErrNodeReadOnly
+		}
+		output, err := db.execKeyspace(txn, index, cmd, args)
+		if err != nil || output == nil {
+			return output, nil, err
+		}
+		return output, []AOFEntry{{DB: index, Args: args}}, nil
+	}
+
+	exec := executor.New(cmd)
+	if exec == nil {
+		return nil, nil, types.ErrUnknownCommand
+	}
+	if !executor.Lookup(cmd).CheckArity(len(args)) {
+		return nil, nil, types.ErrInvalidNumberOfArgs
+	}
+	if exec.IsWrite() && !isInternal && !db.IsWritable() {
+		return nil, nil, types.ErrNodeReadOnly
+	}
+	if err := db.checkOOM(cmd, isInternal); err != nil {
+		return nil, nil, err
+	}
+	result, err := db.execute(db.keyspace(txn, index), index, exec, cmd, args)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !exec.IsWrite() {
+		return result.Output(), nil, nil
+	}
+	db.touch(index, exec.KeyArgs(args))
+	return result.Output(), []AOFEntry{{DB: index, Args: args}}, nil
+}
+
+func (db *Database) resetMulti(c *Client) {
+	c.multi = false
+	c.multiErr = false
+	c.queue = nil
+	db.unwatch(c)
+}
+
+func (db *Database) unwatch(c *Client) {
+	db.watchLock.Lock()
+	defer db.watchLock.Unlock()
+	for _, k := range c.watching {
+		delete(db.watches[k], c)
+		if len(db.watches[k]) == 0 {
+			delete(db.watches, k)
+		}
+	}
+	c.watching = nil
+	c.dirty = false
+}
+
+func (db *Database) isDirty(c *Client) bool {
+	db.watchLock.Lock()
+	defer db.watchLock.Unlock()
+	return c.dirty
+}
+
+// watchKey identifies a key of the database index among watched keys
+func watchKey(index int, key []byte) string {
+	return strconv.Itoa(index) + ":" + string(key)
+}
+
+// touch marks the clients watching keys of the database index as dirty
+func (db *Database) touch(index int, keys [][]byte) {
+	db.watchLock.Lock()
+	defer db.watchLock.Unlock()
+	if len(db.watches) == 0 {
+		return
+	}
+	for _, key := range keys {
+		for c := range db.watches[watchKey(index, key)] {
+			c.dirty = true
+		}
+	}
+}
+
+// touchDB marks the clients watching any key of the database index as dirty
+func (db *Database) touchDB(index int) {
+	db.watchLock.Lock()
+	defer db.watchLock.Unlock()
+	prefix := watchKey(index, nil)
+	for k, clients := range db.watches {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		for c := range clients {
+			c.dirty = true
+		}
+	}
+}
+
+// replayer applies oplog commands, a MULTI/EXEC block is buffered
+// until it has been fully received and then applied as one transaction
+type replayer struct {
+	db *Database
+
+	multi bool
+	queue []AOFEntry
+}
+
+func newReplayer(db *Database) *replayer {
+	return &replayer{db: db}
+}
+
+// Apply runs a command recorded in the database index
+func (r *replayer) Apply(index int, args [][]byte) error {
+	if len(args) == 0 {
+		return types.ErrInvalidNumberOfArgs
+	}
+	switch strings.ToUpper(string(args[0])) {
+	case executor.MULTI:
+		r.multi = true
+		r.queue = nil
+		return nil
+	case executor.EXEC:
+		queue := r.queue
+		r.multi = false
+		r.queue = nil
+		r.db.lock.Lock()
+		defer r.db.lock.Unlock()
+		_, _, err := r.db.execMulti(nil, queue, true)
+		return err
+	}
+	if r.multi {
+		r.queue = append(r.queue, AOFEntry{DB: index, Args: args})
+		return nil
+	}
+	_, err := r.db.IExec(index, args)
+	return err
+}
@@ -0,0 +1,202 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/joway/pidis/executor"
+	"github.com/joway/pidis/storage"
+	"github.com/joway/pidis/types"
+	"github.com/joway/pidis/util"
+	"strings"
+	"sync/atomic"
+)
+
+// keyspace event classes, same as the notify-keyspace-events flags of redis
+const (
+	NotifyKeyspace = 1 << iota // K
+	NotifyKeyevent             // E
+	NotifyGeneric              // g
+	NotifyString               // $
+	NotifyList                 // l
+	NotifySet                  // s
+	NotifyHash                 // h
+	NotifyZSet                 // z
+	NotifyExpired              // x
+	NotifyEvicted              // e
+	NotifyStream               // t
+	NotifyKeyMiss              // m
+	NotifyModule               // d
+	NotifyNew                  // n
+
+	NotifyAll = NotifyGeneric | NotifyString | NotifyList | NotifySet | NotifyHash |
+		NotifyZSet | NotifyExpired | NotifyEvicted | NotifyStream | NotifyModule // A
+)
+
+var notifyClasses = []struct {
+	flag  byte
+	class int
+}{
+	{'g', NotifyGeneric},
+	{'$', NotifyString},
+	{'l', NotifyList},
+	{'s', NotifySet},
+	{'h', NotifyHash},
+	{'z', NotifyZSet},
+	{'x', NotifyExpired},
+	{'e', NotifyEvicted},
+	{'t', NotifyStream},
+	{'m', NotifyKeyMiss},
+	{'d', NotifyModule},
+	{'n', NotifyNew},
+	{'K', NotifyKeyspace},
+	{'E', NotifyKeyevent},
+}
+
+func ParseNotifyKeyspaceEvents(s string) (int, error) {
+	flags := 0
+	for i := 0; i < len(s); i++ {
+		if s[i] == 'A' {
+			flags |= NotifyAll
+			continue
+		}
+		found := false
+		for _, c := range notifyClasses {
+			if c.flag == s[i] {
+				flags |= c.class
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, types.ErrInvalidNotifyFlags
+		}
+	}
+	return flags, nil
+}
+
+func FormatNotifyKeyspaceEvents(flags int) string {
+	var sb strings.Builder
+	if flags&NotifyAll == NotifyAll {
+		sb.WriteByte('A')
+	}
+	for _, c := range notifyClasses {
+		if flags&NotifyAll == NotifyAll && c.class&NotifyAll != 0 {
+			continue
+		}
+		if flags&c.class != 0 {
+			sb.WriteByte(c.flag)
+		}
+	}
+	return sb.String()
+}
+
+func (db *Database) SetNotifyKeyspaceEvents(s string) error {
+	flags, err := ParseNotifyKeyspaceEvents(s)
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt32(&db.notifyFlags, int32(flags))
+	return nil
+}
+
+func (db *Database) NotifyKeyspaceEvents() string {
+	return FormatNotifyKeyspaceEvents(int(atomic.LoadInt32(&db.notifyFlags)))
+}
+
+func (db *Database) notifying(class int) bool {
+	flags := int(atomic.LoadInt32(&db.notifyFlags))
+	return flags&class != 0 && flags&(NotifyKeyspace|NotifyKeyevent) != 0
+}
+
+// notify fires the event of a key of the database index
+func (db *Database) notify(index int, class int, event string, key []byte) {
+	if !db.notifying(class) {
+		return
+	}
+	flags := int(atomic.LoadInt32(&db.notifyFlags))
+	if flags&NotifyKeyspace != 0 {
+		db.pubsub.Publish(fmt.Sprintf("__keyspace@%d__:%s", index, key), []byte(event))
+	}
+	if flags&NotifyKeyevent != 0 {
+		db.pubsub.Publish(fmt.Sprintf("__keyevent@%d__:%s", index, event), key)
+	}
+}
+
+type keyEvent struct {
+	class int
+	event string
+	key   []byte
+}
+
+// keyEvents collects the events a write command is going to fire,
+// it has to run before the command since some events depend on the previous state
+func (db *Database) keyEvents(store storage.Storage, cmd string, args [][]byte) []keyEvent {
+	if atomic.LoadInt32(&db.notifyFlags) == 0 || len(args) < 2 {
+		return nil
+	}
+	var events []keyEvent
+	key := args[1]
+	switch cmd {
+	case executor.SET, executor.SETNX, executor.INCR:
+		if db.notifying(NotifyNew) && !exists(store, key) {
+			events = append(events, keyEvent{NotifyNew, "new", key})
+		}
+		if cmd == executor.INCR {
+			events = append(events, keyEvent{NotifyString, "incrby", key})
+			break
+		}
+		events = append(events, keyEvent{NotifyString, "set", key})
+		if setTTL(args) > 0 {
+			events = append(events, keyEvent{NotifyGeneric, "expire", key})
+		}
+	case executor.DEL:
+		if !db.notifying(NotifyGeneric) {
+			break
+		}
+		for _, k := range args[1:] {
+			if exists(store, k) {
+				events = append(events, keyEvent{NotifyGeneric, "del", k})
+			}
+		}
+	}
+	return events
+}
+
+// execute runs exec against the keyspace of the database index,
+// keeps the expires index up to date and fires keyspace events
+func (db *Database) execute(ks *storage.Keyspace, index int, exec executor.Executor, cmd string, args [][]byte) (*executor.Result, error) {
+	var events []keyEvent
+	if exec.IsWrite() {
+		events = db.keyEvents(ks, cmd, args)
+	}
+	result, err := exec.Exec(ks, args)
+	if err != nil {
+		return result, err
+	}
+	if bytes.Equal(result.Output(), util.MessageNull()) {
+		//nothing has been read or written
+		if cmd == executor.GET {
+			db.stats.incr(&db.stats.KeyspaceMisses)
+			db.notify(index, NotifyKeyMiss, "keymiss", args[1])
+		}
+		return result, nil
+	}
+	if cmd == executor.GET {
+		db.stats.incr(&db.stats.KeyspaceHits)
+	}
+	keys := exec.KeyArgs(args)
+	db.updateMemory(ks, keys, exec.IsWrite())
+	if exec.IsWrite() {
+		db.updateExpires(ks, cmd, args)
+		db.invalidate(keys)
+	}
+	for _, e := range events {
+		db.notify(index, e.class, e.event, e.key)
+	}
+	return result, nil
+}
+
+func exists(store storage.Storage, key []byte) bool {
+	_, err := store.Get(key)
+	return err == nil
+}
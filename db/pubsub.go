@@ -0,0 +1,423 @@
+package db
+
+import (
+	"github.com/gobwas/glob"
+	"github.com/joway/pidis/executor"
+	"github.com/joway/pidis/types"
+	"github.com/joway/pidis/util"
+	"github.com/tidwall/redcon"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// commands allowed when a RESP2 client is subscribed
+var subscribedCommands = map[string]bool{
+	executor.SUBSCRIBE:    true,
+	executor.UNSUBSCRIBE:  true,
+	executor.PSUBSCRIBE:   true,
+	executor.PUNSUBSCRIBE: true,
+	executor.SSUBSCRIBE:   true,
+	executor.SUNSUBSCRIBE: true,
+	executor.PING:         true,
+	executor.QUIT:         true,
+}
+
+type pattern struct {
+	glob    glob.Glob
+	clients map[*Client]struct{}
+}
+
+type PubSub struct {
+	lock sync.RWMutex
+
+	channels map[string]map[*Client]struct{}
+	patterns map[string]*pattern
+	shards   map[string]map[*Client]struct{}
+}
+
+func NewPubSub() *PubSub {
+	return &PubSub{
+		channels: make(map[string]map[*Client]struct{}),
+		patterns: make(map[string]*pattern),
+		shards:   make(map[string]map[*Client]struct{}),
+	}
+}
+
+func (ps *PubSub) Subscribe(c *Client, channel string) bool {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	return subscribe(ps.channels, c.channels, c, channel)
+}
+
+func (ps *PubSub) Unsubscribe(c *Client, channel string) bool {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	return unsubscribe(ps.channels, c.channels, c, channel)
+}
+
+func (ps *PubSub) SSubscribe(c *Client, channel string) bool {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	return subscribe(ps.shards, c.shards, c, channel)
+}
+
+func (ps *PubSub) SUnsubscribe(c *Client, channel string) bool {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	return unsubscribe(ps.shards, c.shards, c, channel)
+}
+
+func (ps *PubSub) PSubscribe(c *Client, p string) (bool, error) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	if _, ok := c.patterns[p]; ok {
+		return false, nil
+	}
+	sub, ok := ps.patterns[p]
+	if !ok {
+		g, err := glob.Compile(p)
+		if err != nil {
+			return false, err
+		}
+		sub = &pattern{glob: g, clients: make(map[*Client]struct{})}
+		ps.patterns[p] = sub
+	}
+	sub.clients[c] = struct{}{}
+	c.patterns[p] = struct{}{}
+	return true, nil
+}
+
+func (ps *PubSub) PUnsubscribe(c *Client, p string) bool {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	if _, ok := c.patterns[p]; !ok {
+		return false
+	}
+	delete(c.patterns, p)
+	if sub, ok := ps.patterns[p]; ok {
+		delete(sub.clients, c)
+		if len(sub.clients) == 0 {
+			delete(ps.patterns, p)
+		}
+	}
+	return true
+}
+
+func (ps *PubSub) UnsubscribeAll(c *Client) {
+	for _, channel := range c.Channels() {
+		ps.Unsubscribe(c, channel)
+	}
+	for _, p := range c.Patterns() {
+		ps.PUnsubscribe(c, p)
+	}
+	for _, channel := range c.ShardChannels() {
+		ps.SUnsubscribe(c, channel)
+	}
+}
+
+func (ps *PubSub) Publish(channel string, message []byte) int {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+	receivers := 0
+	if clients, ok := ps.channels[channel]; ok {
+		msg := cachedMessage(func(proto int) []byte {
+			return pushMessage(proto, "message", []byte(channel), message)
+		})
+		for c := range clients {
+			c.Push(msg(c.Proto()))
+			receivers++
+		}
+	}
+	for p, sub := range ps.patterns {
+		if !sub.glob.Match(channel) {
+			continue
+		}
+		p := p
+		msg := cachedMessage(func(proto int) []byte {
+			return pushMessage(proto, "pmessage", []byte(p), []byte(channel), message)
+		})
+		for c := range sub.clients {
+			c.Push(msg(c.Proto()))
+			receivers++
+		}
+	}
+	return receivers
+}
+
+func (ps *PubSub) SPublish(channel string, message []byte) int {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+	clients := ps.shards[channel]
+	msg := cachedMessage(func(proto int) []byte {
+		return pushMessage(proto, "smessage", []byte(channel), message)
+	})
+	for c := range clients {
+		c.Push(msg(c.Proto()))
+	}
+	return len(clients)
+}
+
+// Deliver sends message to c only, if it has subscribed channel
+func (ps *PubSub) Deliver(c *Client, channel string, message []byte) bool {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+	if _, ok := ps.channels[channel][c]; !ok {
+		return false
+	}
+	c.Push(message)
+	return true
+}
+
+func (ps *PubSub) Channels(p string, sharded bool) ([][]byte, error) {
+	var matcher glob.Glob
+	if p != "" {
+		g, err := glob.Compile(p)
+		if err != nil {
+			return nil, err
+		}
+		matcher = g
+	}
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+	channels := ps.channels
+	if sharded {
+		channels = ps.shards
+	}
+	var names []string
+	for channel := range channels {
+		if matcher == nil || matcher.Match(channel) {
+			names = append(names, channel)
+		}
+	}
+	sort.Strings(names)
+	var output [][]byte
+	for _, name := range names {
+		output = append(output, []byte(name))
+	}
+	return output, nil
+}
+
+func (ps *PubSub) NumSub(channel string, sharded bool) int {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+	if sharded {
+		return len(ps.shards[channel])
+	}
+	return len(ps.channels[channel])
+}
+
+// Clients counts the clients subscribed to at least one channel or pattern
+func (ps *PubSub) Clients() int {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+	clients := make(map[*Client]struct{})
+	for _, registry := range []map[string]map[*Client]struct{}{ps.channels, ps.shards} {
+		for _, subscribers := range registry {
+			for c := range subscribers {
+				clients[c] = struct{}{}
+			}
+		}
+	}
+	for _, p := range ps.patterns {
+		for c := range p.clients {
+			clients[c] = struct{}{}
+		}
+	}
+	return len(clients)
+}
+
+func (ps *PubSub) NumPat() int {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+	return len(ps.patterns)
+}
+
+func subscribe(registry map[string]map[*Client]struct{}, own map[string]struct{}, c *Client, channel string) bool {
+	if _, ok := own[channel]; ok {
+		return false
+	}
+	clients, ok := registry[channel]
+	if !ok {
+		clients = make(map[*Client]struct{})
+		registry[channel] = clients
+	}
+	clients[c] = struct{}{}
+	own[channel] = struct{}{}
+	return true
+}
+
+func unsubscribe(registry map[string]map[*Client]struct{}, own map[string]struct{}, c *Client, channel string) bool {
+	if _, ok := own[channel]; !ok {
+		return false
+	}
+	delete(own, channel)
+	delete(registry[channel], c)
+	if len(registry[channel]) == 0 {
+		delete(registry, channel)
+	}
+	return true
+}
+
+func pushMessage(proto int, kind string, args ...[]byte) []byte {
+	reply := util.NewReply(proto).Push(len(args) + 1).BulkString(kind)
+	for _, arg := range args {
+		reply.Bulk(arg)
+	}
+	return reply.Bytes()
+}
+
+// cachedMessage builds a message once per protocol version
+func cachedMessage(build func(proto int) []byte) func(proto int) []byte {
+	var cache [util.RESP3 + 1][]byte
+	return func(proto int) []byte {
+		if cache[proto] == nil {
+			cache[proto] = build(proto)
+		}
+		return cache[proto]
+	}
+}
+
+func subscriptionMessage(proto int, kind string, channel []byte, count int) []byte {
+	reply := util.NewReply(proto).Push(3).BulkString(kind)
+	if channel == nil {
+		reply.Null()
+	} else {
+		reply.Bulk(channel)
+	}
+	return reply.Int(int64(count)).Bytes()
+}
+
+// execPubSub handles pub/sub commands, subscribing switches the client into push mode
+func execPubSub(database *Database, client *Client, name string, args [][]byte) ([]byte, bool, error) {
+	switch name {
+	case executor.SUBSCRIBE, executor.PSUBSCRIBE, executor.SSUBSCRIBE:
+		if len(args) < 2 {
+			return nil, true, types.ErrInvalidNumberOfArgs
+		}
+		if client.multi {
+			return nil, true, types.ReplyError("ERR Command not allowed inside a transaction")
+		}
+		database.detach(client)
+		for _, channel := range args[1:] {
+			switch name {
+			case executor.SUBSCRIBE:
+				database.pubsub.Subscribe(client, string(channel))
+			case executor.SSUBSCRIBE:
+				database.pubsub.SSubscribe(client, string(channel))
+			case executor.PSUBSCRIBE:
+				if _, err := database.pubsub.PSubscribe(client, string(channel)); err != nil {
+					client.Push(errorOutput(args, types.ErrSyntaxError))
+					continue
+				}
+			}
+			count := client.Subscriptions()
+			if name == executor.SSUBSCRIBE {
+				count = len(client.ShardChannels())
+			}
+			client.Push(subscriptionMessage(client.Proto(), strings.ToLower(name), channel, count))
+		}
+		return nil, true, nil
+	case executor.UNSUBSCRIBE, executor.PUNSUBSCRIBE, executor.SUNSUBSCRIBE:
+		channels := args[1:]
+		if len(channels) == 0 {
+			var all []string
+			switch name {
+			case executor.UNSUBSCRIBE:
+				all = client.Channels()
+			case executor.PUNSUBSCRIBE:
+				all = client.Patterns()
+			case executor.SUNSUBSCRIBE:
+				all = client.ShardChannels()
+			}
+			for _, channel := range all {
+				channels = append(channels, []byte(channel))
+			}
+		}
+		kind := strings.ToLower(name)
+		if len(channels) == 0 {
+			count := client.Subscriptions()
+			if name == executor.SUNSUBSCRIBE {
+				count = 0
+			}
+			return subscriptionMessage(client.Proto(), kind, nil, count), true, nil
+		}
+		var output []byte
+		for _, channel := range channels {
+			count := 0
+			switch name {
+			case executor.UNSUBSCRIBE:
+				database.pubsub.Unsubscribe(client, string(channel))
+				count = client.Subscriptions()
+			case executor.PUNSUBSCRIBE:
+				database.pubsub.PUnsubscribe(client, string(channel))
+				count = client.Subscriptions()
+			case executor.SUNSUBSCRIBE:
+				database.pubsub.SUnsubscribe(client, string(channel))
+				count = len(client.ShardChannels())
+			}
+			output = append(output, subscriptionMessage(client.Proto(), kind, channel, count)...)
+		}
+		return output, true, nil
+	case executor.PUBLISH, executor.SPUBLISH:
+		output, err := database.publish(name, args)
+		return output, true, err
+	case executor.PUBSUB:
+		output, err := execPubSubIntrospection(database, args)
+		return output, true, err
+	case executor.PING:
+		if client.Proto() == util.RESP3 || client.Subscriptions() == 0 {
+			return nil, false, nil
+		}
+		msg := []byte("")
+		if len(args) > 1 {
+			msg = args[1]
+		}
+		return util.MessageArray([][]byte{[]byte("pong"), msg}), true, nil
+	default:
+		return nil, false, nil
+	}
+}
+
+// publish runs PUBLISH or SPUBLISH, which scripts can call as well
+func (db *Database) publish(name string, args [][]byte) ([]byte, error) {
+	if len(args) != 3 {
+		return nil, types.ErrInvalidNumberOfArgs
+	}
+	var receivers int
+	if name == executor.PUBLISH {
+		receivers = db.pubsub.Publish(string(args[1]), args[2])
+	} else {
+		receivers = db.pubsub.SPublish(string(args[1]), args[2])
+	}
+	return util.MessageInt(int64(receivers)), nil
+}
+
+func execPubSubIntrospection(database *Database, args [][]byte) ([]byte, error) {
+	if len(args) < 2 {
+		return nil, types.ErrInvalidNumberOfArgs
+	}
+	switch sub := strings.ToUpper(string(args[1])); sub {
+	case "CHANNELS", "SHARDCHANNELS":
+		p := ""
+		if len(args) > 2 {
+			p = string(args[2])
+		}
+		channels, err := database.pubsub.Channels(p, sub == "SHARDCHANNELS")
+		if err != nil {
+			return nil, types.ErrSyntaxError
+		}
+		return util.MessageArray(channels), nil
+	case "NUMSUB", "SHARDNUMSUB":
+		output := redcon.AppendArray(nil, (len(args)-2)*2)
+		for _, channel := range args[2:] {
+			output = redcon.AppendBulk(output, channel)
+			output = redcon.AppendInt(output, int64(database.pubsub.NumSub(string(channel), sub == "SHARDNUMSUB")))
+		}
+		return output, nil
+	case "NUMPAT":
+		return util.MessageInt(int64(database.pubsub.NumPat())), nil
+	default:
+		return nil, types.ErrSyntaxError
+	}
+}
@@ -0,0 +1,224 @@
+package db
+
+import (
+	"github.com/tidwall/redcon"
+	"net"
+	"sync"
+	"time"
+)
+
+type OutputBufferLimit struct {
+	Hard        int
+	Soft        int
+	SoftSeconds time.Duration
+}
+
+var DefaultPubSubBufferLimit = OutputBufferLimit{
+	Hard:        32 * 1024 * 1024,
+	Soft:        8 * 1024 * 1024,
+	SoftSeconds: time.Second * 60,
+}
+
+// Outbox queues replies of a detached connection and writes them in background,
+// so a slow consumer never blocks the publisher
+type Outbox struct {
+	lock  sync.Mutex
+	cond  *sync.Cond
+	conn  redcon.DetachedConn
+	limit OutputBufferLimit
+
+	queue     [][]byte
+	size      int
+	softSince time.Time
+	closed    bool
+	killed    bool
+}
+
+func NewOutbox(conn redcon.DetachedConn, limit OutputBufferLimit) *Outbox {
+	o := &Outbox{
+		conn:  conn,
+		limit: limit,
+	}
+	o.cond = sync.NewCond(&o.lock)
+	go o.run()
+	return o
+}
+
+func (o *Outbox) Write(b []byte) bool {
+	o.lock.Lock()
+	if o.closed {
+		o.lock.Unlock()
+		return false
+	}
+	o.queue = append(o.queue, b)
+	o.size += len(b)
+	if o.exceeded() {
+		o.closed = true
+		o.killed = true
+		o.queue = nil
+		o.cond.Signal()
+		o.lock.Unlock()
+		logger.Warn("client %s closed for overcoming of output buffer limits", o.conn.RemoteAddr())
+		//unblock the pending network write
+		o.closeConn()
+		return false
+	}
+	o.cond.Signal()
+	o.lock.Unlock()
+	return true
+}
+
+func (o *Outbox) Size() int {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return o.size
+}
+
+// Close flushes all queued replies and then closes the connection
+func (o *Outbox) Close() {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.closed = true
+	o.cond.Signal()
+}
+
+// closeConn closes the socket, which is safe while the serving goroutine reads the connection
+// unlike closing the redcon connection itself
+func (o *Outbox) closeConn() {
+	if nc, ok := o.conn.(interface{ NetConn() net.Conn }); ok {
+		_ = nc.NetConn().Close()
+		return
+	}
+	_ = o.conn.Close()
+}
+
+func (o *Outbox) exceeded() bool {
+	if o.limit.Hard > 0 && o.size > o.limit.Hard {
+		return true
+	}
+	if o.limit.Soft <= 0 || o.size <= o.limit.Soft {
+		o.softSince = time.Time{}
+		return false
+	}
+	if o.softSince.IsZero() {
+		o.softSince = time.Now()
+		return false
+	}
+	return time.Since(o.softSince) > o.limit.SoftSeconds
+}
+
+func (o *Outbox) run() {
+	defer o.closeConn()
+	for {
+		o.lock.Lock()
+		for len(o.queue) == 0 && !o.closed {
+			o.cond.Wait()
+		}
+		queue, closed, killed := o.queue, o.closed, o.killed
+		o.queue = nil
+		o.lock.Unlock()
+		if killed {
+			return
+		}
+
+		size := 0
+		for _, b := range queue {
+			o.conn.WriteRaw(b)
+			size += len(b)
+		}
+		if err := o.conn.Flush(); err != nil {
+			o.lock.Lock()
+			o.closed = true
+			o.lock.Unlock()
+			return
+		}
+		o.lock.Lock()
+		o.size -= size
+		o.lock.Unlock()
+		if closed {
+			return
+		}
+	}
+}
+
+// pushConn is a detached connection whose replies go through an Outbox
+type pushConn struct {
+	redcon.DetachedConn
+
+	out *Outbox
+}
+
+func (c *pushConn) WriteRaw(data []byte) {
+	c.out.Write(data)
+}
+
+func (c *pushConn) WriteError(msg string) {
+	c.out.Write(redcon.AppendError(nil, msg))
+}
+
+func (c *pushConn) WriteString(str string) {
+	c.out.Write(redcon.AppendString(nil, str))
+}
+
+func (c *pushConn) WriteBulk(bulk []byte) {
+	c.out.Write(redcon.AppendBulk(nil, bulk))
+}
+
+func (c *pushConn) WriteBulkString(bulk string) {
+	c.out.Write(redcon.AppendBulkString(nil, bulk))
+}
+
+func (c *pushConn) WriteInt(num int) {
+	c.out.Write(redcon.AppendInt(nil, int64(num)))
+}
+
+func (c *pushConn) WriteInt64(num int64) {
+	c.out.Write(redcon.AppendInt(nil, num))
+}
+
+func (c *pushConn) WriteArray(count int) {
+	c.out.Write(redcon.AppendArray(nil, count))
+}
+
+func (c *pushConn) WriteNull() {
+	c.out.Write(redcon.AppendNull(nil))
+}
+
+func (c *pushConn) Close() error {
+	c.out.Close()
+	return nil
+}
+
+// detach switches client into push mode, the connection is then served by
+// its own goroutine and every reply is written through an Outbox
+func (db *Database) detach(c *Client) {
+	if c.push != nil {
+		return
+	}
+	dc := c.conn.Detach()
+	c.push = NewOutbox(dc, db.PubSubBufferLimit())
+	c.conn = &pushConn{DetachedConn: dc, out: c.push}
+	c.detached = dc
+}
+
+// handOver starts serving a client detached by its last command, which must have returned
+// so that only one goroutine ever serves the client
+func (db *Database) handOver(c *Client) {
+	if c.detached == nil {
+		return
+	}
+	dc := c.detached
+	c.detached = nil
+	go db.servePush(c, dc)
+}
+
+func (db *Database) servePush(c *Client, dc redcon.DetachedConn) {
+	defer db.closeClient(c)
+	for {
+		cmd, err := dc.ReadCommand()
+		if err != nil {
+			return
+		}
+		handle(db, c.conn, cmd)
+	}
+}
@@ -0,0 +1,251 @@
+package db
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	diskQuotaInterval = time.Second
+
+	DefaultDiskQuotaLowWatermark = 90
+
+	//followers request the oplog once their snapshot is loaded, the aof is kept meanwhile
+	aofRewriteGrace = time.Minute
+)
+
+// DiskQuota bounds the disk used by the data dir and the aof, writes are refused
+// once the quota is exceeded until the usage drops below the low watermark
+type DiskQuota struct {
+	lock  sync.Mutex
+	limit int64
+	//lowWatermark is a percentage of limit
+	lowWatermark int
+	usage        int64
+	exceeded     bool
+}
+
+func NewDiskQuota() *DiskQuota {
+	return &DiskQuota{lowWatermark: DefaultDiskQuotaLowWatermark}
+}
+
+// SetLimit sets the quota in bytes, 0 disables it
+func (q *DiskQuota) SetLimit(limit int64) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.limit = limit
+	if limit == 0 {
+		q.exceeded = false
+	}
+}
+
+func (q *DiskQuota) Limit() int64 {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.limit
+}
+
+func (q *DiskQuota) SetLowWatermark(percent int) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.lowWatermark = percent
+}
+
+// Usage returns the disk usage measured by the last check
+func (q *DiskQuota) Usage() int64 {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.usage
+}
+
+func (q *DiskQuota) Exceeded() bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.exceeded
+}
+
+// Update records the disk usage and tells whether the quota has been exceeded or recovered since the last update
+func (q *DiskQuota) Update(usage int64) (exceeded, changed bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.usage = usage
+	was := q.exceeded
+	switch {
+	case q.limit == 0:
+		q.exceeded = false
+	case usage >= q.limit:
+		q.exceeded = true
+	case usage < q.limit*int64(q.lowWatermark)/100:
+		q.exceeded = false
+	}
+	return q.exceeded, q.exceeded != was
+}
+
+// diskUsage returns the bytes of the data dir, the aof and its archives
+func (db *Database) diskUsage() (int64, error) {
+	var usage int64
+	err := filepath.Walk(path.Join(db.dir, "data"), func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			//badger removes files while compacting
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() {
+			usage += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	stat, err := db.aofBus.Stat()
+	if err != nil {
+		return 0, err
+	}
+	archives, err := db.aofBus.Archives()
+	if err != nil {
+		return 0, err
+	}
+	for _, archive := range archives {
+		if info, err := os.Stat(archive); err == nil {
+			usage += info.Size()
+		}
+	}
+	return usage + stat.Size + int64(stat.Buffered), nil
+}
+
+// checkDiskQuota measures the disk usage and reclaims space on every check while the quota is exceeded
+func (db *Database) checkDiskQuota() {
+	if db.diskQuota.Limit() == 0 {
+		return
+	}
+	usage, err := db.diskUsage()
+	if err != nil {
+		logger.Error("failed to measure disk usage: %v", err)
+		return
+	}
+	exceeded, changed := db.diskQuota.Update(usage)
+	switch {
+	case changed && exceeded:
+		logger.Error("disk usage %s exceeds the quota of %s, writes are refused",
+			humanBytes(usage), humanBytes(db.diskQuota.Limit()))
+	case changed:
+		logger.Info("disk usage %s is back under the low watermark, writes are accepted", humanBytes(usage))
+	}
+	if !exceeded {
+		return
+	}
+	if db.config.Get("disk-quota-gc") == "yes" {
+		db.storageGC()
+	}
+	if db.config.Get("disk-quota-aof-rewrite") == "yes" {
+		db.rewriteAOF()
+	}
+}
+
+// rewriteAOF archives the entries of the aof and removes the archives no restore needs anymore,
+// the ones recorded before every snapshot and backup. It's skipped while followers may still need them
+func (db *Database) rewriteAOF() {
+	state := db.replication.State()
+	if len(state.Followers) > 0 || state.SnapshotsServing > 0 || time.Since(state.LastSnapshotServed) < aofRewriteGrace {
+		logger.Info("aof rewrite skipped while followers are syncing")
+		return
+	}
+	//archives are kept until a snapshot or backup holds their entries, there's nothing to free without any
+	_, ok, err := db.oldestWatermark()
+	if err != nil {
+		logger.Error("failed to rewrite aof: %v", err)
+		return
+	}
+	if !ok {
+		logger.Info("aof rewrite skipped, no snapshot or backup holds its entries")
+		return
+	}
+	stat, err := db.aofBus.Stat()
+	if err != nil {
+		logger.Error("failed to rewrite aof: %v", err)
+		return
+	}
+	if stat.Size+int64(stat.Buffered) > 0 {
+		archive, err := db.aofBus.Rotate()
+		if err != nil {
+			logger.Error("failed to rewrite aof: %v", err)
+			return
+		}
+		logger.Info("aof archived to %s", archive)
+	}
+	if err := db.pruneAOFArchives(); err != nil {
+		logger.Error("failed to remove aof archives: %v", err)
+	}
+}
+
+// pruneAOFArchives removes the archived aof segments whose entries were all recorded before the oldest snapshot
+// or backup, uids of different processes are only ordered by their seconds
+func (db *Database) pruneAOFArchives() error {
+	archives, err := db.aofBus.Archives()
+	if err != nil || len(archives) == 0 {
+		return err
+	}
+	oldest, ok, err := db.oldestWatermark()
+	if err != nil {
+		return err
+	}
+	//without snapshots restores replay every archive
+	if !ok {
+		return nil
+	}
+	for _, archive := range archives {
+		uid, err := aofArchiveUID(archive)
+		if err != nil {
+			return err
+		}
+		if !uid.Time().Before(oldest.Time()) {
+			break
+		}
+		if err := os.Remove(archive); err != nil {
+			return err
+		}
+		logger.Info("removed aof archive %s, every snapshot is more recent", archive)
+	}
+	return nil
+}
+
+// oldestWatermark returns the watermark of the oldest snapshot or backup aof entries are replayed from
+func (db *Database) oldestWatermark() (UID, bool, error) {
+	var watermarks []UID
+	//archives are kept for legacy snapshots, restores don't load them by default
+	snapshots, err := listSnapshots(db.dir, false)
+	if err != nil {
+		return UID{}, false, err
+	}
+	for _, snapshot := range snapshots {
+		watermarks = append(watermarks, snapshot.watermark)
+	}
+	target, err := db.BackupTarget()
+	if err != nil {
+		return UID{}, false, err
+	}
+	backup, ok, err := db.backups.oldestWatermark(target)
+	if err != nil {
+		return UID{}, false, err
+	}
+	if ok {
+		watermarks = append(watermarks, backup)
+	}
+	if len(watermarks) == 0 {
+		return UID{}, false, nil
+	}
+	oldest := watermarks[0]
+	for _, uid := range watermarks[1:] {
+		if bytes.Compare(uid.Bytes(), oldest.Bytes()) < 0 {
+			oldest = uid
+		}
+	}
+	return oldest, true, nil
+}
@@ -0,0 +1,167 @@
+package db
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type ReplicaInfo struct {
+	ID    int64
+	Addr  string
+	Since time.Time
+
+	//entries appended to the aof after mark, base is the number of entries at mark
+	mark []byte
+	base int64
+	//Sent counts the entries after mark sent to the follower
+	Sent int64
+}
+
+// Lag returns the number of entries appended since mark which haven't been sent yet
+func (f ReplicaInfo) Lag(aof *AOFBus) int64 {
+	return aof.Entries() - f.base - f.Sent
+}
+
+// sentEntries counts the entries of an oplog payload appended after mark
+func (f *ReplicaInfo) sentEntries(payload []byte) {
+	var sent int64
+	for len(payload) > 0 {
+		uid, _, _, leftover, err := DecodeAOF(payload)
+		if err != nil || uid == nil {
+			break
+		}
+		if bytes.Compare(uid, f.mark) > 0 {
+			sent++
+		}
+		payload = leftover
+	}
+	atomic.AddInt64(&f.Sent, sent)
+}
+
+// Replication tracks the followers streaming the oplog of a master,
+// and the state of the link to its master on a follower
+type Replication struct {
+	lock sync.RWMutex
+
+	nextID    int64
+	followers map[int64]*ReplicaInfo
+
+	syncing       bool
+	linkUp        bool
+	lastIO        time.Time
+	lastApplied   []byte
+	applied       int64
+	snapshotBytes int64
+
+	//snapshots served to followers
+	snapshotsServing   int
+	lastSnapshotServed time.Time
+}
+
+type ReplicationState struct {
+	Followers []ReplicaInfo
+
+	Syncing     bool
+	LinkUp      bool
+	LastIO      time.Time
+	LastApplied []byte
+	//Applied counts the oplog entries applied on a follower
+	Applied int64
+	//SnapshotBytes is the size of the snapshot received so far
+	SnapshotBytes int64
+
+	SnapshotsServing   int
+	LastSnapshotServed time.Time
+}
+
+func NewReplication() *Replication {
+	return &Replication{followers: make(map[int64]*ReplicaInfo)}
+}
+
+func (r *Replication) AddFollower(addr string, mark []byte, base int64) *ReplicaInfo {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.nextID++
+	f := &ReplicaInfo{ID: r.nextID, Addr: addr, Since: time.Now(), mark: mark, base: base}
+	r.followers[r.nextID] = f
+	return f
+}
+
+func (r *Replication) RemoveFollower(id int64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.followers, id)
+}
+
+func (r *Replication) setLink(syncing, up bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.syncing = syncing
+	r.linkUp = up
+	r.lastIO = time.Now()
+	if syncing {
+		r.snapshotBytes = 0
+	}
+}
+
+func (r *Replication) received(snapshotBytes int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.snapshotBytes += int64(snapshotBytes)
+	r.lastIO = time.Now()
+}
+
+// serving counts the snapshots being sent to followers, done is called once one has been sent
+func (r *Replication) serving() (done func()) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.snapshotsServing++
+	return func() {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		r.snapshotsServing--
+		r.lastSnapshotServed = time.Now()
+	}
+}
+
+func (r *Replication) apply(uid []byte) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.lastApplied = append(r.lastApplied[:0], uid...)
+	r.applied++
+	r.lastIO = time.Now()
+}
+
+func (r *Replication) State() ReplicationState {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	state := ReplicationState{
+		Syncing:     r.syncing,
+		LinkUp:      r.linkUp,
+		LastIO:      r.lastIO,
+		LastApplied: append([]byte(nil), r.lastApplied...),
+
+		Applied:       r.applied,
+		SnapshotBytes: r.snapshotBytes,
+
+		SnapshotsServing:   r.snapshotsServing,
+		LastSnapshotServed: r.lastSnapshotServed,
+	}
+	for _, f := range r.followers {
+		state.Followers = append(state.Followers, ReplicaInfo{
+			ID:    f.ID,
+			Addr:  f.Addr,
+			Since: f.Since,
+			mark:  f.mark,
+			base:  f.base,
+			Sent:  atomic.LoadInt64(&f.Sent),
+		})
+	}
+	sort.Slice(state.Followers, func(i, j int) bool {
+		return state.Followers[i].ID < state.Followers[j].ID
+	})
+	return state
+}
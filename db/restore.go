@@ -0,0 +1,368 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"github.com/joway/pidis/executor"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	snapshotExt = ".snapshot"
+	//followerSnapshotPrefix names the snapshots loaded by followers after the watermark of their aof
+	followerSnapshotPrefix = "pidis-"
+)
+
+// RestoreOptions tells a point in time recovery where to read the data from and where to restore it
+type RestoreOptions struct {
+	//Source is the data dir whose aof is replayed
+	Source string
+	//Snapshots is the dir of the snapshots or of the backups, the source dir by default
+	Snapshots string
+	//EncryptionKeyFile holds the master key the source has been encrypted with
+	EncryptionKeyFile string
+	//LegacySnapshots restores from the <unix time>.snapshot files of older data dirs as well,
+	//the commands of their second are skipped although the snapshot may not hold all of them
+	LegacySnapshots bool
+
+	//ToTime is the last second whose commands are replayed
+	ToTime time.Time
+	//DryRun only counts the commands which would be applied
+	DryRun bool
+
+	//Target are the options of the fresh database restored into
+	Target Options
+}
+
+type RestoreReport struct {
+	//Snapshot is the loaded snapshot, empty when the aof is replayed from scratch
+	Snapshot string
+	//Skipped are the commands recorded before the snapshot
+	Skipped int64
+	//Overlap are the skipped commands of the second of a legacy snapshot, which it may not hold
+	Overlap int64
+	Applied int64
+	//LastApplied is the time of the last applied command
+	LastApplied time.Time
+}
+
+// snapshotFile is a snapshot to restore from, a backup is loaded over the ones it's incremental to
+type snapshotFile struct {
+	//paths are loaded in order, with the keyring saved along when it isn't the one of the source
+	paths []string
+	keys  []string
+	time  time.Time
+	//watermark is the uid from which the aof is replayed
+	watermark UID
+	//functions is the dump of the function libraries at the watermark, sealed with the last keyring
+	functions string
+	//legacy snapshots are named by their unix time, whose commands they may or may not hold
+	legacy bool
+}
+
+// Restore loads the newest snapshot or backup taken before the target time into a fresh database,
+// then replays the commands of the aof recorded from the snapshot up to the target time.
+// Uids only hold seconds, so every command of the target second is replayed
+func Restore(ctx context.Context, options RestoreOptions) (RestoreReport, error) {
+	var report RestoreReport
+	keyring, err := openSourceKeyring(options.Source, options.EncryptionKeyFile)
+	if err != nil {
+		return report, err
+	}
+	snapshotsDir := options.Snapshots
+	if snapshotsDir == "" {
+		snapshotsDir = options.Source
+	}
+	snapshots, err := listSnapshots(snapshotsDir, options.LegacySnapshots)
+	if err != nil {
+		return report, err
+	}
+	var from snapshotFile
+	for _, snapshot := range snapshots {
+		if !snapshot.time.After(options.ToTime) {
+			from = snapshot
+			report.Snapshot = snapshot.paths[len(snapshot.paths)-1]
+		}
+	}
+
+	var replay *replayer
+	if !options.DryRun {
+		if entries, err := ioutil.ReadDir(options.Target.DBDir); err == nil && len(entries) > 0 {
+			return report, errors.Errorf("restore target %s is not empty", options.Target.DBDir)
+		}
+		database, err := New(options.Target)
+		if err != nil {
+			return report, err
+		}
+		defer func() { _ = database.Close() }()
+		for i, file := range from.paths {
+			snapshotKeyring := keyring
+			if from.keys[i] != "" {
+				if snapshotKeyring, err = openBackupKeyring(from.keys[i], options.EncryptionKeyFile); err != nil {
+					return report, err
+				}
+			}
+			if err := loadSnapshotFile(ctx, database, file, snapshotKeyring); err != nil {
+				return report, err
+			}
+			if i == len(from.paths)-1 && from.functions != "" {
+				if err := loadFunctionsFile(database, from.functions, snapshotKeyring); err != nil {
+					return report, err
+				}
+			}
+		}
+		replay = newReplayer(database)
+	}
+
+	//a MULTI block is skipped or applied as a whole, its commands count once its EXEC is reached
+	var multi, skipMulti, done bool
+	var queued int64
+	replayEntry := func(uid UID, index int, args [][]byte) (bool, error) {
+		if !multi && uid.Time().After(options.ToTime) {
+			done = true
+			return false, nil
+		}
+		skip := skipMulti
+		if !multi {
+			skip = bytes.Compare(uid.Bytes(), from.watermark.Bytes()) < 0
+		}
+		overlap := from.legacy && !uid.Time().Before(from.time)
+		switch strings.ToUpper(string(args[0])) {
+		case executor.MULTI:
+			multi, skipMulti, queued = true, skip, 0
+		case executor.EXEC:
+			multi = false
+			if skip {
+				report.Skipped += queued
+				if overlap {
+					report.Overlap += queued
+				}
+			} else {
+				report.Applied += queued
+				report.LastApplied = uid.Time()
+			}
+		default:
+			switch {
+			case multi:
+				queued++
+			case skip:
+				report.Skipped++
+				if overlap {
+					report.Overlap++
+				}
+			default:
+				report.Applied++
+				report.LastApplied = uid.Time()
+			}
+		}
+		if skip || replay == nil {
+			return true, nil
+		}
+		if err := replay.Apply(index, args); err != nil {
+			return false, errors.Wrapf(err, "replay %s failed", uid)
+		}
+		return true, nil
+	}
+	//segments archived by aof rewrites hold the entries recorded before the aof
+	aofPath := path.Join(options.Source, "pidis.aof")
+	files, err := aofArchives(aofPath)
+	if err != nil {
+		return report, err
+	}
+	for _, file := range append(files, aofPath) {
+		if err := readAOF(file, keyring, replayEntry); err != nil {
+			return report, err
+		}
+		if done {
+			break
+		}
+	}
+	if replay != nil {
+		return report, replay.db.aofBus.Fsync()
+	}
+	return report, nil
+}
+
+// openSourceKeyring opens the keyring of a data dir restored from, nil when it isn't encrypted
+func openSourceKeyring(dir, keyFile string) (*Keyring, error) {
+	keyringPath := path.Join(dir, "pidis.keys")
+	if _, err := os.Stat(keyringPath); os.IsNotExist(err) {
+		return nil, nil
+	}
+	master, err := LoadMasterKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if master == nil {
+		return nil, errors.New("the source is encrypted, an encryption key is required")
+	}
+	return OpenKeyring(keyringPath, master, 0)
+}
+
+// openBackupKeyring opens the keyring saved along an encrypted backup
+func openBackupKeyring(file, keyFile string) (*Keyring, error) {
+	master, err := LoadMasterKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if master == nil {
+		return nil, errors.New("the backup is encrypted, an encryption key is required")
+	}
+	return OpenKeyring(file, master, 0)
+}
+
+// listSnapshots returns the snapshots of dir from the oldest. Snapshots of followers are named by the watermark
+// of their aof, or by their unix time before watermarks were kept, which are only listed with legacy.
+// Backups are described by their manifest
+func listSnapshots(dir string, legacy bool) ([]snapshotFile, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var snapshots []snapshotFile
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, snapshotExt) {
+			continue
+		}
+		base := strings.TrimSuffix(name, snapshotExt)
+		snapshot := snapshotFile{paths: []string{path.Join(dir, name)}, keys: []string{""}}
+		if strings.HasPrefix(base, followerSnapshotPrefix) {
+			watermark, err := UIDFromString(strings.TrimPrefix(base, followerSnapshotPrefix))
+			if err != nil {
+				continue
+			}
+			snapshot.time = watermark.Time()
+			snapshot.watermark = watermark
+			snapshot.functions = path.Join(dir, base+functionsExt)
+		} else {
+			//the aof is replayed after the second, replaying the entries held by the snapshot twice is worse
+			unix, err := strconv.ParseInt(base, 10, 64)
+			if err != nil || !legacy {
+				continue
+			}
+			snapshot.time = time.Unix(unix, 0)
+			snapshot.watermark = UIDFromTime(snapshot.time.Add(time.Second))
+			snapshot.legacy = true
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	manifests, err := LoadBackupManifests(&DirTarget{dir: dir})
+	if err != nil {
+		return nil, err
+	}
+	for _, manifest := range manifests {
+		chain, err := BackupChain(manifests, manifest.ID)
+		if err != nil {
+			logger.Warn("backup %s can't be restored: %v", manifest.ID, err)
+			continue
+		}
+		watermark, err := UIDFromString(manifest.ID)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid backup id %s", manifest.ID)
+		}
+		//the whole target second is restored, backups of that second are as well
+		snapshot := snapshotFile{time: manifest.Time.Truncate(time.Second), watermark: watermark}
+		for _, m := range chain {
+			snapshot.paths = append(snapshot.paths, path.Join(dir, m.ID+snapshotExt))
+			keys := ""
+			if m.Encrypted {
+				keys = path.Join(dir, m.ID+keysExt)
+			}
+			snapshot.keys = append(snapshot.keys, keys)
+		}
+		if manifest.Functions {
+			snapshot.functions = path.Join(dir, manifest.ID+functionsExt)
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	sort.SliceStable(snapshots, func(i, j int) bool {
+		return snapshots[i].time.Before(snapshots[j].time)
+	})
+	return snapshots, nil
+}
+
+func loadSnapshotFile(ctx context.Context, db *Database, file string, keyring *Keyring) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	return db.loadSnapshot(ctx, keyring.UnsealReader(bufio.NewReader(f)))
+}
+
+// loadFunctionsFile replaces the function libraries of db with the ones dumped into file
+func loadFunctionsFile(db *Database, file string, keyring *Keyring) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	payload, err := ioutil.ReadAll(keyring.UnsealReader(f))
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(db.functions.Restore(payload, "FLUSH"), "restore functions failed")
+}
+
+// readAOF calls fn with every entry of an aof file until it returns false,
+// an entry cut by a crash at the end of the file is ignored
+func readAOF(file string, keyring *Keyring, fn func(uid UID, index int, args [][]byte) (bool, error)) error {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	buf := make([]byte, aofSegmentSize)
+	var raw, buffer []byte
+	for {
+		size, readErr := f.Read(buf)
+		raw = append(raw, buf[:size]...)
+		plain, leftover, err := keyring.Unseal(raw)
+		if err != nil {
+			return err
+		}
+		raw = leftover
+		buffer = append(buffer, plain...)
+		for {
+			uid, index, args, leftover, err := DecodeAOF(buffer)
+			if err != nil {
+				return err
+			}
+			//uncompleted buffer
+			if uid == nil && args == nil {
+				break
+			}
+			buffer = leftover
+			id, err := UIDFromBytes(uid)
+			if err != nil {
+				return errors.Wrap(err, "invalid aof uid")
+			}
+			if ok, err := fn(id, index, args); err != nil || !ok {
+				return err
+			}
+		}
+		if readErr == io.EOF {
+			if len(raw) > 0 || len(buffer) > 0 {
+				logger.Warn("ignored %d bytes at the end of %s", len(raw)+len(buffer), file)
+			}
+			return nil
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+}
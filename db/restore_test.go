@@ -0,0 +1,228 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"github.com/joway/pidis/util"
+	"github.com/stretchr/testify/suite"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+type RestoreTestSuite struct {
+	suite.Suite
+
+	dir    string
+	source string
+	start  time.Time
+}
+
+func TestRestore(t *testing.T) {
+	suite.Run(t, new(RestoreTestSuite))
+}
+
+func (suite *RestoreTestSuite) SetupTest() {
+	suite.dir = "/tmp/pidis/restore"
+	_ = os.RemoveAll(suite.dir)
+	suite.source = path.Join(suite.dir, "source")
+	suite.Require().NoError(os.MkdirAll(suite.source, os.ModePerm))
+	suite.start = time.Unix(1767225600, 0)
+
+	//the aof is written with uids of chosen seconds
+	var content []byte
+	for _, entry := range []struct {
+		second int
+		cmd    string
+	}{
+		{0, "set a 1"},
+		{10, "set b 2"},
+		{20, "MULTI"},
+		{20, "set c 3"},
+		{20, "incr a"},
+		{21, "EXEC"},
+		{30, "del a"},
+	} {
+		uid := UIDFromTime(suite.start.Add(time.Duration(entry.second) * time.Second))
+		content = append(content, EncodeAOF(uid.Bytes(), 0, util.CommandToArgs(entry.cmd))...)
+	}
+	suite.Require().NoError(ioutil.WriteFile(path.Join(suite.source, "pidis.aof"), content, 0600))
+
+	//a snapshot of the first two commands
+	db, err := New(Options{DBDir: path.Join(suite.dir, "snapshot")})
+	suite.Require().NoError(err)
+	_, err = db.Exec(util.CommandToArgs("set a 1"))
+	suite.NoError(err)
+	_, err = db.Exec(util.CommandToArgs("set b 2"))
+	suite.NoError(err)
+	snapshot, err := os.Create(path.Join(suite.source, fmt.Sprintf("%d%s", suite.start.Unix()+15, snapshotExt)))
+	suite.Require().NoError(err)
+	suite.NoError(db.storage.Snapshot(context.Background(), snapshot))
+	suite.NoError(snapshot.Close())
+	_ = db.Close()
+}
+
+func (suite *RestoreTestSuite) restore(seconds int, dryRun bool) (RestoreReport, error) {
+	return Restore(context.Background(), RestoreOptions{
+		Source: suite.source,
+		ToTime: suite.start.Add(time.Duration(seconds) * time.Second),
+		DryRun: dryRun,
+		//the snapshot of the suite is a legacy one
+		LegacySnapshots: true,
+		Target:          Options{DBDir: path.Join(suite.dir, "target")},
+	})
+}
+
+func (suite *RestoreTestSuite) get(db *Database, key string) string {
+	result, err := db.Exec(util.CommandToArgs("get " + key))
+	suite.NoError(err)
+	return string(result.Output())
+}
+
+func (suite *RestoreTestSuite) TestDryRun() {
+	report, err := suite.restore(25, true)
+	suite.NoError(err)
+	suite.Equal(path.Join(suite.source, "1767225615.snapshot"), report.Snapshot)
+	suite.EqualValues(2, report.Skipped)
+	suite.EqualValues(2, report.Applied)
+	suite.Equal(suite.start.Add(21*time.Second), report.LastApplied)
+	_, err = os.Stat(path.Join(suite.dir, "target"))
+	suite.True(os.IsNotExist(err))
+
+	//the transaction is applied as a whole
+	report, err = suite.restore(20, true)
+	suite.NoError(err)
+	suite.EqualValues(2, report.Applied)
+	report, err = suite.restore(5, true)
+	suite.NoError(err)
+	suite.Empty(report.Snapshot)
+	suite.EqualValues(1, report.Applied)
+}
+
+func (suite *RestoreTestSuite) TestRestore() {
+	report, err := suite.restore(25, false)
+	suite.NoError(err)
+	suite.EqualValues(2, report.Applied)
+	db, err := New(Options{DBDir: path.Join(suite.dir, "target")})
+	suite.Require().NoError(err)
+	suite.Equal("$1\r\n2\r\n", suite.get(db, "a"))
+	suite.Equal("$1\r\n2\r\n", suite.get(db, "b"))
+	suite.Equal("$1\r\n3\r\n", suite.get(db, "c"))
+	_ = db.Close()
+
+	//the target has to be fresh
+	_, err = suite.restore(25, false)
+	suite.Error(err)
+	suite.NoError(os.RemoveAll(path.Join(suite.dir, "target")))
+
+	//the aof is replayed from scratch before the first snapshot
+	_, err = suite.restore(5, false)
+	suite.NoError(err)
+	db, err = New(Options{DBDir: path.Join(suite.dir, "target")})
+	suite.Require().NoError(err)
+	defer func() { _ = db.Close() }()
+	suite.Equal("$1\r\n1\r\n", suite.get(db, "a"))
+	suite.Equal("$-1\r\n", suite.get(db, "b"))
+}
+
+func (suite *RestoreTestSuite) TestLegacySnapshot() {
+	//legacy snapshots aren't loaded unless asked to
+	report, err := Restore(context.Background(), RestoreOptions{
+		Source: suite.source,
+		ToTime: suite.start.Add(25 * time.Second),
+		DryRun: true,
+	})
+	suite.NoError(err)
+	suite.Empty(report.Snapshot)
+	suite.Zero(report.Skipped)
+	suite.EqualValues(4, report.Applied)
+
+	//the commands of the snapshot second are skipped and reported
+	file := path.Join(suite.source, "pidis.aof")
+	content, err := ioutil.ReadFile(file)
+	suite.Require().NoError(err)
+	rest := content
+	for i := 0; i < 2; i++ {
+		_, _, _, rest, err = DecodeAOF(rest)
+		suite.Require().NoError(err)
+	}
+	uid := UIDFromTime(suite.start.Add(15 * time.Second))
+	entry := EncodeAOF(uid.Bytes(), 0, util.CommandToArgs("incr b"))
+	content = append(append(content[:len(content)-len(rest):len(content)-len(rest)], entry...), rest...)
+	suite.NoError(ioutil.WriteFile(file, content, 0600))
+	report, err = suite.restore(25, true)
+	suite.NoError(err)
+	suite.EqualValues(3, report.Skipped)
+	suite.EqualValues(1, report.Overlap)
+	suite.EqualValues(2, report.Applied)
+}
+
+func (suite *RestoreTestSuite) TestArchivedAOF() {
+	//the first two entries have been archived by an aof rewrite
+	file := path.Join(suite.source, "pidis.aof")
+	content, err := ioutil.ReadFile(file)
+	suite.Require().NoError(err)
+	rest := content
+	for i := 0; i < 2; i++ {
+		_, _, _, rest, err = DecodeAOF(rest)
+		suite.Require().NoError(err)
+	}
+	archive := path.Join(suite.source, "pidis-"+UIDFromTime(suite.start.Add(15*time.Second)).String()+".aof")
+	suite.NoError(ioutil.WriteFile(archive, content[:len(content)-len(rest)], 0600))
+	suite.NoError(ioutil.WriteFile(file, rest, 0600))
+
+	report, err := suite.restore(25, true)
+	suite.NoError(err)
+	suite.EqualValues(2, report.Skipped)
+	suite.EqualValues(2, report.Applied)
+	report, err = suite.restore(5, true)
+	suite.NoError(err)
+	suite.EqualValues(1, report.Applied)
+	suite.Equal(suite.start, report.LastApplied)
+}
+
+func (suite *RestoreTestSuite) TestWatermark() {
+	//an incr is recorded between the watermark and the snapshot taken at it
+	source := path.Join(suite.dir, "pinned")
+	db, err := New(Options{DBDir: source})
+	suite.Require().NoError(err)
+	_, err = db.Exec([][]byte{[]byte("function"), []byte("load"), []byte(testLibrary)})
+	suite.NoError(err)
+	_, err = db.Exec(util.CommandToArgs("incr n"))
+	suite.NoError(err)
+	pinned, err := db.pinSnapshot()
+	suite.Require().NoError(err)
+	_, err = db.Exec(util.CommandToArgs("incr n"))
+	suite.NoError(err)
+	name := path.Join(source, followerSnapshotPrefix+pinned.watermark.String())
+	snapshot, err := os.Create(name + snapshotExt)
+	suite.Require().NoError(err)
+	suite.NoError(pinned.write(context.Background(), snapshot, 0))
+	pinned.release()
+	suite.NoError(snapshot.Close())
+	functions, err := db.sealFunctions(pinned.functions)
+	suite.NoError(err)
+	suite.NoError(ioutil.WriteFile(name+functionsExt, functions, 0600))
+	_, err = db.Exec(util.CommandToArgs("incr n"))
+	suite.NoError(err)
+	_ = db.Close()
+
+	report, err := Restore(context.Background(), RestoreOptions{
+		Source: source,
+		ToTime: time.Now().Add(time.Hour),
+		Target: Options{DBDir: path.Join(suite.dir, "target")},
+	})
+	suite.NoError(err)
+	suite.Equal(name+snapshotExt, report.Snapshot)
+	suite.EqualValues(2, report.Skipped)
+	suite.EqualValues(2, report.Applied)
+	restored, err := New(Options{DBDir: path.Join(suite.dir, "target")})
+	suite.Require().NoError(err)
+	defer func() { _ = restored.Close() }()
+	suite.Equal("$1\r\n3\r\n", suite.get(restored, "n"))
+	result, err := restored.Exec(util.CommandToArgs("fcall test_get 1 n"))
+	suite.NoError(err)
+	suite.Equal("$1\r\n3\r\n", string(result.Output()))
+}
@@ -6,12 +6,29 @@ import (
 	"github.com/joway/pidis/proto"
 	"github.com/joway/pidis/util"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"time"
 )
 
 var rpcLogger = loki.New("pidis:db:rpc")
 
+// rpc metadata sent along a snapshot, the watermark of the aof and the function libraries at it
+const (
+	snapshotWatermarkKey = "pidis-watermark"
+	snapshotFunctionsKey = "pidis-functions-bin"
+)
+
 func NewRpcServer(database *Database) *grpc.Server {
-	server := grpc.NewServer()
+	opts := []grpc.ServerOption{
+		grpc.UnaryInterceptor(replicaAuthUnaryInterceptor(database)),
+		grpc.StreamInterceptor(replicaAuthStreamInterceptor(database)),
+	}
+	if database.rpcTLS != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(database.rpcTLS)))
+	}
+	server := grpc.NewServer(opts...)
 	proto.RegisterPidisServer(server, NewPidisService(database))
 
 	return server
@@ -32,13 +49,27 @@ func NewPidisService(database *Database) *PidisService {
 func (s *PidisService) Snapshot(req *proto.SnapshotReq, srv proto.Pidis_SnapshotServer) error {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+	defer s.db.replication.serving()()
 
+	//the follower requests the oplog from the watermark, the snapshot holds every entry recorded before
+	pinned, err := s.db.pinSnapshot()
+	if err != nil {
+		return err
+	}
+	header := metadata.Pairs(snapshotWatermarkKey, pinned.watermark.String())
+	header.Append(snapshotFunctionsKey, string(pinned.functions))
+	if err := srv.SendHeader(header); err != nil {
+		pinned.release()
+		return err
+	}
 	bus := util.NewStreamBus(1)
-	var err error = nil
 	go func() {
 		defer bus.Close()
+		defer pinned.release()
 		rpcLogger.Info("fetching snapshot")
-		err = s.db.storage.Snapshot(ctx, bus)
+		start := time.Now()
+		err = pinned.write(ctx, bus, 0)
+		s.db.latency.Since(LatencySnapshot, start)
 	}()
 	rpcLogger.Info("sending snapshot")
 	payloadMaxBytes := 1024 * 1024 // 1MB
@@ -58,6 +89,7 @@ func (s *PidisService) Snapshot(req *proto.SnapshotReq, srv proto.Pidis_Snapshot
 			if err := srv.Send(resp); err != nil {
 				return err
 			}
+			s.db.metrics.snapshotSentBytes.Add(float64(len(payload)))
 		}
 	}
 	if err != nil {
@@ -78,6 +110,13 @@ func (s *PidisService) Oplog(req *proto.OplogReq, srv proto.Pidis_OplogServer) e
 		rpcLogger.Info("fetching oplog")
 		syncErr <- s.db.Sync(ctx, bus, req.Offset)
 	}()
+	addr := "unknown"
+	if p, ok := peer.FromContext(srv.Context()); ok {
+		addr = p.Addr.String()
+	}
+	mark, base := s.db.aofBus.Mark()
+	follower := s.db.replication.AddFollower(addr, mark, base)
+	defer s.db.replication.RemoveFollower(follower.ID)
 	rpcLogger.Info("sending oplog")
 	for {
 		select {
@@ -95,6 +134,7 @@ func (s *PidisService) Oplog(req *proto.OplogReq, srv proto.Pidis_OplogServer) e
 			if err := srv.Send(resp); err != nil {
 				return err
 			}
+			follower.sentEntries(payload)
 		}
 	}
 }
@@ -0,0 +1,80 @@
+package db
+
+import (
+	"context"
+	"crypto/subtle"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// rpc metadata carrying the replication secret
+const masterAuthKey = "pidis-masterauth"
+
+func (db *Database) MasterAuth() string {
+	secret, _ := db.masterAuth.Load().(string)
+	return secret
+}
+
+// SetMasterAuth changes the secret required by the Pidis service and presented when following a master,
+// an empty secret disables replication auth
+func (db *Database) SetMasterAuth(secret string) {
+	db.masterAuth.Store(secret)
+}
+
+func (db *Database) authorizeReplica(ctx context.Context) error {
+	secret := db.MasterAuth()
+	if secret == "" {
+		return nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, presented := range md.Get(masterAuthKey) {
+		if subtle.ConstantTimeCompare([]byte(presented), []byte(secret)) == 1 {
+			return nil
+		}
+	}
+	address := "unknown"
+	if p, ok := peer.FromContext(ctx); ok {
+		address = p.Addr.String()
+	}
+	rpcLogger.Warn("rejected unauthenticated replica: %s", address)
+	return status.Error(codes.Unauthenticated, "invalid masterauth")
+}
+
+func replicaAuthUnaryInterceptor(database *Database) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if err := database.authorizeReplica(ctx); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+func replicaAuthStreamInterceptor(database *Database) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := database.authorizeReplica(ss.Context()); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
+
+// masterAuthCredentials presents the secret of a follower on every rpc to its master
+type masterAuthCredentials struct {
+	db *Database
+}
+
+func (c masterAuthCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	secret := c.db.MasterAuth()
+	if secret == "" {
+		return nil, nil
+	}
+	return map[string]string{masterAuthKey: secret}, nil
+}
+
+// the secret is sent in plaintext unless replication tls is enabled
+func (c masterAuthCredentials) RequireTransportSecurity() bool {
+	return false
+}
@@ -0,0 +1,446 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"github.com/joway/loki"
+	"github.com/joway/pidis/executor"
+	"github.com/joway/pidis/storage"
+	"github.com/joway/pidis/types"
+	"github.com/joway/pidis/util"
+	"github.com/pkg/errors"
+	"github.com/tidwall/redcon"
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var scriptLogger = loki.New("pidis:db:script")
+
+type scriptRun struct {
+	cancel context.CancelFunc
+	wrote  bool
+	killed bool
+}
+
+type ScriptCache struct {
+	lock    sync.Mutex
+	scripts map[string]*lua.FunctionProto
+	running *scriptRun
+}
+
+func NewScriptCache() *ScriptCache {
+	return &ScriptCache{
+		scripts: make(map[string]*lua.FunctionProto),
+	}
+}
+
+func (c *ScriptCache) Load(body []byte) (string, *lua.FunctionProto, error) {
+	sha := sha1hex(body)
+	if proto := c.Get(sha); proto != nil {
+		return sha, proto, nil
+	}
+	proto, err := compileScript(body, "@user_script")
+	if err != nil {
+		return "", nil, types.ReplyError(fmt.Sprintf("ERR Error compiling script (new function): %v", err))
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.scripts[sha] = proto
+	return sha, proto, nil
+}
+
+func (c *ScriptCache) Get(sha string) *lua.FunctionProto {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.scripts[strings.ToLower(sha)]
+}
+
+func (c *ScriptCache) Flush() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.scripts = make(map[string]*lua.FunctionProto)
+}
+
+func (c *ScriptCache) Kill() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.running == nil {
+		return types.ErrNotBusy
+	}
+	if c.running.wrote {
+		return types.ErrUnkillable
+	}
+	c.running.killed = true
+	c.running.cancel()
+	return nil
+}
+
+func (c *ScriptCache) setRunning(run *scriptRun) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.running = run
+}
+
+func (c *ScriptCache) setWrote(run *scriptRun) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	run.wrote = true
+}
+
+func (c *ScriptCache) isKilled(run *scriptRun) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return run.killed
+}
+
+func (db *Database) Script(args [][]byte) (*executor.Result, error) {
+	if len(args) < 2 {
+		return nil, types.ErrInvalidNumberOfArgs
+	}
+	switch strings.ToUpper(string(args[1])) {
+	case "LOAD":
+		if len(args) != 3 {
+			return nil, types.ErrInvalidNumberOfArgs
+		}
+		sha, _, err := db.scripts.Load(args[2])
+		if err != nil {
+			return nil, err
+		}
+		return executor.NewResult(util.Message([]byte(sha))), nil
+	case "EXISTS":
+		if len(args) < 3 {
+			return nil, types.ErrInvalidNumberOfArgs
+		}
+		output := redcon.AppendArray(nil, len(args)-2)
+		for _, sha := range args[2:] {
+			var existed int64 = 0
+			if db.scripts.Get(string(sha)) != nil {
+				existed = 1
+			}
+			output = redcon.AppendInt(output, existed)
+		}
+		return executor.NewResult(output), nil
+	case "FLUSH":
+		db.scripts.Flush()
+		return executor.NewResult(util.MessageOK()), nil
+	case "KILL":
+		if err := db.scripts.Kill(); err != nil {
+			return nil, err
+		}
+		return executor.NewResult(util.MessageOK()), nil
+	default:
+		return nil, types.ErrSyntaxError
+	}
+}
+
+func (db *Database) evalTxn(client *Client, txn storage.Storage, index int, args [][]byte, isInternal bool) ([]byte, []AOFEntry, error) {
+	if len(args) < 3 {
+		return nil, nil, types.ErrInvalidNumberOfArgs
+	}
+	var (
+		sha   string
+		proto *lua.FunctionProto
+		err   error
+	)
+	if strings.ToUpper(string(args[0])) == executor.EVAL {
+		sha, proto, err = db.scripts.Load(args[1])
+		if err != nil {
+			return nil, nil, err
+		}
+	} else {
+		sha = strings.ToLower(string(args[1]))
+		if proto = db.scripts.Get(sha); proto == nil {
+			return nil, nil, types.ErrNoScript
+		}
+	}
+
+	numKeys, err := strconv.Atoi(string(args[2]))
+	if err != nil {
+		return nil, nil, types.ErrNotInteger
+	}
+	if numKeys < 0 {
+		return nil, nil, types.ErrNegativeNumKeys
+	}
+	if numKeys > len(args)-3 {
+		return nil, nil, types.ErrTooManyNumKeys
+	}
+	keys := args[3 : 3+numKeys]
+	argv := args[3+numKeys:]
+
+	L := newLuaState()
+	defer L.Close()
+	L.SetGlobal("KEYS", luaArray(L, keys))
+	L.SetGlobal("ARGV", luaArray(L, argv))
+	output, writes, err := db.runScript(client, L, txn, index, L.NewFunctionFromProto(proto), nil, false, isInternal)
+	if err != nil {
+		return nil, writes, types.ReplyError(fmt.Sprintf("ERR Error running script (call to f_%s): %v", sha, err))
+	}
+	return output, writes, nil
+}
+
+// runScript calls fn with redis.call dispatching commands into the database index within txn,
+// each command is checked against the acl user of client like the script itself
+func (db *Database) runScript(client *Client, L *lua.LState, txn storage.Storage, index int, fn *lua.LFunction, fnArgs []lua.LValue, readOnly, isInternal bool) ([]byte, []AOFEntry, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	run := &scriptRun{cancel: cancel}
+	db.scripts.setRunning(run)
+	defer db.scripts.setRunning(nil)
+	L.SetContext(ctx)
+
+	var writes []AOFEntry
+	call := func(raise bool) lua.LGFunction {
+		return func(L *lua.LState) int {
+			top := L.GetTop()
+			if top == 0 {
+				L.RaiseError("Please specify at least one argument for redis.call()")
+				return 0
+			}
+			args := make([][]byte, top)
+			for i := 1; i <= top; i++ {
+				switch v := L.Get(i).(type) {
+				case lua.LString, lua.LNumber:
+					args[i-1] = []byte(v.String())
+				default:
+					L.RaiseError("Lua redis() command arguments must be strings or integers")
+					return 0
+				}
+			}
+
+			var (
+				output []byte
+				err    error
+			)
+			name := strings.ToUpper(string(args[0]))
+			command := executor.Lookup(name)
+			isWrite := command.IsWrite()
+			switch {
+			case command.HasFlag(executor.FlagNoScript):
+				err = types.ErrNotAllowedFromScript
+			case isWrite && readOnly:
+				err = types.ErrWriteFromReadOnlyScript
+			default:
+				if err = db.checkScriptACL(client, name, args); err != nil {
+					break
+				}
+				if isWrite {
+					db.scripts.setWrote(run)
+				}
+				var w []AOFEntry
+				output, w, err = db.execTxn(client, txn, index, args, isInternal)
+				writes = append(writes, w...)
+			}
+			if err != nil {
+				output = errorOutput(args, err)
+			}
+
+			val, _, err := replyToLua(L, output)
+			if err != nil {
+				L.RaiseError(err.Error())
+				return 0
+			}
+			if tbl, ok := val.(*lua.LTable); ok && raise {
+				if e := tbl.RawGetString("err"); e != lua.LNil {
+					L.RaiseError(e.String())
+					return 0
+				}
+			}
+			L.Push(val)
+			return 1
+		}
+	}
+	L.SetField(L.GetGlobal("redis"), "call", L.NewFunction(call(true)))
+	L.SetField(L.GetGlobal("redis"), "pcall", L.NewFunction(call(false)))
+
+	L.Push(fn)
+	for _, arg := range fnArgs {
+		L.Push(arg)
+	}
+	if err := L.PCall(len(fnArgs), 1, nil); err != nil {
+		if db.scripts.isKilled(run) {
+			return nil, writes, types.ErrScriptKilled
+		}
+		return nil, writes, err
+	}
+	ret := L.Get(-1)
+	L.Pop(1)
+	return luaToReply(ret), writes, nil
+}
+
+func compileScript(body []byte, name string) (*lua.FunctionProto, error) {
+	//skip the shebang line but keep line numbers
+	if bytes.HasPrefix(body, []byte("#!")) {
+		if i := bytes.IndexByte(body, '\n'); i >= 0 {
+			body = body[i:]
+		} else {
+			body = nil
+		}
+	}
+	chunk, err := parse.Parse(bytes.NewReader(body), name)
+	if err != nil {
+		return nil, err
+	}
+	return lua.Compile(chunk, name)
+}
+
+func sha1hex(body []byte) string {
+	sum := sha1.Sum(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// newLuaState creates a sandboxed lua vm with the redis module registered
+func newLuaState() *lua.LState {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	libs := []struct {
+		name string
+		fn   lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	}
+	for _, lib := range libs {
+		L.Push(L.NewFunction(lib.fn))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range []string{"dofile", "loadfile", "load", "loadstring", "require", "module"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+
+	redis := L.NewTable()
+	L.SetFuncs(redis, map[string]lua.LGFunction{
+		"sha1hex": func(L *lua.LState) int {
+			L.Push(lua.LString(sha1hex([]byte(L.CheckString(1)))))
+			return 1
+		},
+		"error_reply": func(L *lua.LState) int {
+			tbl := L.NewTable()
+			tbl.RawSetString("err", lua.LString(L.CheckString(1)))
+			L.Push(tbl)
+			return 1
+		},
+		"status_reply": func(L *lua.LState) int {
+			tbl := L.NewTable()
+			tbl.RawSetString("ok", lua.LString(L.CheckString(1)))
+			L.Push(tbl)
+			return 1
+		},
+		"log": func(L *lua.LState) int {
+			scriptLogger.Info("%s", L.CheckString(2))
+			return 0
+		},
+	})
+	for i, level := range []string{"LOG_DEBUG", "LOG_VERBOSE", "LOG_NOTICE", "LOG_WARNING"} {
+		redis.RawSetString(level, lua.LNumber(i))
+	}
+	L.SetGlobal("redis", redis)
+	return L
+}
+
+func luaArray(L *lua.LState, items [][]byte) *lua.LTable {
+	tbl := L.CreateTable(len(items), 0)
+	for _, item := range items {
+		tbl.Append(lua.LString(item))
+	}
+	return tbl
+}
+
+// luaToReply converts a lua value into redis protocol following the redis conversion rules
+func luaToReply(v lua.LValue) []byte {
+	switch v := v.(type) {
+	case lua.LNumber:
+		return util.MessageInt(int64(v))
+	case lua.LString:
+		return util.Message([]byte(v))
+	case lua.LBool:
+		if v {
+			return util.MessageInt(1)
+		}
+		return util.MessageNull()
+	case *lua.LTable:
+		if e, ok := v.RawGetString("err").(lua.LString); ok {
+			return util.MessageError(string(e))
+		}
+		if s, ok := v.RawGetString("ok").(lua.LString); ok {
+			return util.MessageString(string(s))
+		}
+		var items [][]byte
+		for i := 1; ; i++ {
+			item := v.RawGetInt(i)
+			if item == lua.LNil {
+				break
+			}
+			items = append(items, luaToReply(item))
+		}
+		output := redcon.AppendArray(nil, len(items))
+		for _, item := range items {
+			output = append(output, item...)
+		}
+		return output
+	default:
+		return util.MessageNull()
+	}
+}
+
+// replyToLua converts a redis protocol reply into a lua value
+func replyToLua(L *lua.LState, b []byte) (lua.LValue, []byte, error) {
+	end := bytes.Index(b, []byte("\r\n"))
+	if len(b) == 0 || end < 0 {
+		return nil, nil, errors.New("invalid reply")
+	}
+	line, rest := string(b[1:end]), b[end+2:]
+	switch b[0] {
+	case '+':
+		tbl := L.NewTable()
+		tbl.RawSetString("ok", lua.LString(line))
+		return tbl, rest, nil
+	case '-':
+		tbl := L.NewTable()
+		tbl.RawSetString("err", lua.LString(line))
+		return tbl, rest, nil
+	case ':':
+		n, err := strconv.ParseInt(line, 10, 64)
+		return lua.LNumber(n), rest, err
+	case '$':
+		n, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, nil, err
+		}
+		if n < 0 {
+			return lua.LFalse, rest, nil
+		}
+		if len(rest) < n+2 {
+			return nil, nil, errors.New("invalid reply")
+		}
+		return lua.LString(rest[:n]), rest[n+2:], nil
+	case '*':
+		n, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, nil, err
+		}
+		if n < 0 {
+			return lua.LFalse, rest, nil
+		}
+		tbl := L.CreateTable(n, 0)
+		for i := 0; i < n; i++ {
+			var item lua.LValue
+			item, rest, err = replyToLua(L, rest)
+			if err != nil {
+				return nil, nil, err
+			}
+			tbl.Append(item)
+		}
+		return tbl, rest, nil
+	default:
+		return nil, nil, errors.New("invalid reply")
+	}
+}
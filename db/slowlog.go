@@ -0,0 +1,200 @@
+package db
+
+import (
+	"fmt"
+	"github.com/joway/pidis/executor"
+	"github.com/joway/pidis/types"
+	"github.com/joway/pidis/util"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultSlowLogSlowerThan = 10000 // microseconds
+	DefaultSlowLogMaxLen     = 128
+
+	//long commands are truncated like redis does
+	slowLogMaxArgs      = 32
+	slowLogMaxArgLength = 128
+)
+
+type SlowLogEntry struct {
+	ID       int64
+	Time     time.Time
+	Duration time.Duration
+	Args     []string
+	Addr     string
+	Name     string
+}
+
+// SlowLog keeps the latest commands slower than a threshold in a ring buffer
+type SlowLog struct {
+	//slowerThan is in microseconds, negative disables the log and 0 logs every command
+	slowerThan int64
+
+	lock    sync.Mutex
+	nextID  int64
+	maxLen  int
+	entries []SlowLogEntry
+	//head is the index of the oldest entry once the buffer is full
+	head int
+}
+
+func NewSlowLog(slowerThan int64, maxLen int) *SlowLog {
+	return &SlowLog{slowerThan: slowerThan, maxLen: maxLen}
+}
+
+func (l *SlowLog) SetSlowerThan(usec int64) {
+	atomic.StoreInt64(&l.slowerThan, usec)
+}
+
+func (l *SlowLog) SetMaxLen(maxLen int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	entries := l.ordered()
+	if len(entries) > maxLen {
+		entries = entries[len(entries)-maxLen:]
+	}
+	l.entries = entries
+	l.head = 0
+	l.maxLen = maxLen
+}
+
+// Record logs a command if it ran longer than the threshold
+func (l *SlowLog) Record(args [][]byte, elapsed time.Duration, addr, name string) {
+	slowerThan := atomic.LoadInt64(&l.slowerThan)
+	if slowerThan < 0 || elapsed.Nanoseconds()/1000 < slowerThan {
+		return
+	}
+	entry := SlowLogEntry{Time: time.Now(), Duration: elapsed, Args: slowLogArgs(args), Addr: addr, Name: name}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.maxLen == 0 {
+		return
+	}
+	entry.ID = l.nextID
+	l.nextID++
+	if len(l.entries) < l.maxLen {
+		l.entries = append(l.entries, entry)
+		return
+	}
+	l.entries[l.head] = entry
+	l.head = (l.head + 1) % len(l.entries)
+}
+
+func slowLogArgs(args [][]byte) []string {
+	n := len(args)
+	if n > slowLogMaxArgs {
+		n = slowLogMaxArgs
+	}
+	logged := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		if i == slowLogMaxArgs-1 && len(args) > slowLogMaxArgs {
+			logged = append(logged, fmt.Sprintf("... (%d more arguments)", len(args)-slowLogMaxArgs+1))
+			break
+		}
+		arg := args[i]
+		if len(arg) > slowLogMaxArgLength {
+			logged = append(logged, fmt.Sprintf(
+				"%s... (%d more bytes)", arg[:slowLogMaxArgLength], len(arg)-slowLogMaxArgLength,
+			))
+			continue
+		}
+		logged = append(logged, string(arg))
+	}
+	return logged
+}
+
+// ordered returns the entries from the oldest to the newest
+func (l *SlowLog) ordered() []SlowLogEntry {
+	entries := make([]SlowLogEntry, 0, len(l.entries))
+	entries = append(entries, l.entries[l.head:]...)
+	return append(entries, l.entries[:l.head]...)
+}
+
+// Get returns up to count entries from the newest, all of them if count is negative
+func (l *SlowLog) Get(count int) []SlowLogEntry {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	entries := l.ordered()
+	if count < 0 || count > len(entries) {
+		count = len(entries)
+	}
+	latest := make([]SlowLogEntry, 0, count)
+	for i := len(entries) - 1; i >= len(entries)-count; i-- {
+		latest = append(latest, entries[i])
+	}
+	return latest
+}
+
+func (l *SlowLog) Len() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return len(l.entries)
+}
+
+func (l *SlowLog) Reset() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.entries = nil
+	l.head = 0
+}
+
+func execSlowLog(database *Database, client *Client, name string, args [][]byte) ([]byte, bool, error) {
+	if name != executor.SLOWLOG {
+		return nil, false, nil
+	}
+	if len(args) < 2 {
+		return nil, true, types.ErrInvalidNumberOfArgs
+	}
+	output, err := database.SlowLogCommand(client, strings.ToUpper(string(args[1])), args[2:])
+	return output, true, err
+}
+
+func (db *Database) SlowLogCommand(client *Client, sub string, args [][]byte) ([]byte, error) {
+	switch sub {
+	case "GET":
+		if len(args) > 1 {
+			return nil, types.ErrInvalidNumberOfArgs
+		}
+		count := 10
+		if len(args) == 1 {
+			n, err := strconv.Atoi(string(args[0]))
+			if err != nil || n < -1 {
+				return nil, types.ReplyError("ERR count should be greater than or equal to -1")
+			}
+			count = n
+		}
+		entries := db.slowLog.Get(count)
+		reply := util.NewReply(client.Proto()).Array(len(entries))
+		for _, e := range entries {
+			reply.Array(6).
+				Int(e.ID).
+				Int(e.Time.Unix()).
+				Int(e.Duration.Nanoseconds() / 1000).
+				Array(len(e.Args))
+			for _, arg := range e.Args {
+				reply.BulkString(arg)
+			}
+			reply.BulkString(e.Addr).BulkString(e.Name)
+		}
+		return reply.Bytes(), nil
+	case "LEN":
+		if len(args) != 0 {
+			return nil, types.ErrInvalidNumberOfArgs
+		}
+		return util.NewReply(client.Proto()).Int(int64(db.slowLog.Len())).Bytes(), nil
+	case "RESET":
+		if len(args) != 0 {
+			return nil, types.ErrInvalidNumberOfArgs
+		}
+		db.slowLog.Reset()
+		return util.MessageOK(), nil
+	default:
+		return nil, types.ReplyError(fmt.Sprintf("ERR unknown subcommand '%s'. Try SLOWLOG HELP.", strings.ToLower(sub)))
+	}
+}
@@ -0,0 +1,117 @@
+package db
+
+import (
+	"github.com/joway/pidis/executor"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stats counts server events since startup or the last CONFIG RESETSTAT
+type Stats struct {
+	Connections    int64
+	Commands       int64
+	KeyspaceHits   int64
+	KeyspaceMisses int64
+	ExpiredKeys    int64
+	EvictedKeys    int64
+	//ExpiredTimeCapReached counts the expire cycles stopped by their time budget
+	ExpiredTimeCapReached int64
+	ExpireCycleUsec       int64
+}
+
+func (s *Stats) incr(counter *int64) {
+	atomic.AddInt64(counter, 1)
+}
+
+func (s *Stats) add(counter *int64, n int64) {
+	atomic.AddInt64(counter, n)
+}
+
+func (s *Stats) Snapshot() Stats {
+	return Stats{
+		Connections:    atomic.LoadInt64(&s.Connections),
+		Commands:       atomic.LoadInt64(&s.Commands),
+		KeyspaceHits:   atomic.LoadInt64(&s.KeyspaceHits),
+		KeyspaceMisses: atomic.LoadInt64(&s.KeyspaceMisses),
+		ExpiredKeys:    atomic.LoadInt64(&s.ExpiredKeys),
+		EvictedKeys:    atomic.LoadInt64(&s.EvictedKeys),
+
+		ExpiredTimeCapReached: atomic.LoadInt64(&s.ExpiredTimeCapReached),
+		ExpireCycleUsec:       atomic.LoadInt64(&s.ExpireCycleUsec),
+	}
+}
+
+func (s *Stats) Reset() {
+	atomic.StoreInt64(&s.Connections, 0)
+	atomic.StoreInt64(&s.Commands, 0)
+	atomic.StoreInt64(&s.KeyspaceHits, 0)
+	atomic.StoreInt64(&s.KeyspaceMisses, 0)
+	atomic.StoreInt64(&s.ExpiredKeys, 0)
+	atomic.StoreInt64(&s.EvictedKeys, 0)
+	atomic.StoreInt64(&s.ExpiredTimeCapReached, 0)
+	atomic.StoreInt64(&s.ExpireCycleUsec, 0)
+}
+
+// commands are only accounted once known, so clients can't grow the stats with made up names
+func knownCommand(name string) bool {
+	return executor.Lookup(name) != nil
+}
+
+type CommandStat struct {
+	Name     string
+	Calls    int64
+	Usec     int64
+	Rejected int64
+	Failed   int64
+}
+
+// CommandStats accumulates calls and execution time per command
+type CommandStats struct {
+	lock     sync.Mutex
+	commands map[string]*CommandStat
+}
+
+func NewCommandStats() *CommandStats {
+	return &CommandStats{commands: make(map[string]*CommandStat)}
+}
+
+// Record counts a call of name, rejected calls were refused before being executed
+func (s *CommandStats) Record(name string, elapsed time.Duration, rejected, failed bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	stat, ok := s.commands[name]
+	if !ok {
+		stat = &CommandStat{Name: name}
+		s.commands[name] = stat
+	}
+	if rejected {
+		stat.Rejected++
+		return
+	}
+	stat.Calls++
+	stat.Usec += elapsed.Nanoseconds() / 1000
+	if failed {
+		stat.Failed++
+	}
+}
+
+func (s *CommandStats) List() []CommandStat {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	stats := make([]CommandStat, 0, len(s.commands))
+	for _, stat := range s.commands {
+		stats = append(stats, *stat)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Name < stats[j].Name
+	})
+	return stats
+}
+
+func (s *CommandStats) Reset() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.commands = make(map[string]*CommandStat)
+}
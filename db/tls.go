@@ -0,0 +1,80 @@
+package db
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/pkg/errors"
+	"io/ioutil"
+)
+
+type TLSOptions struct {
+	CertFile string
+	KeyFile  string
+	//CAFile verifies peer certificates, system roots are used for servers if empty
+	CAFile string
+	//AuthClients requires clients to present a certificate signed by CAFile
+	AuthClients bool
+}
+
+func (o TLSOptions) Enabled() bool {
+	return o.CertFile != "" || o.KeyFile != ""
+}
+
+// ServerConfig returns the tls config of a listener
+func (o TLSOptions) ServerConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "load tls certificate failed")
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if o.AuthClients {
+		if o.CAFile == "" {
+			return nil, errors.New("tls client authentication requires a CA certificate")
+		}
+		pool, err := loadCertPool(o.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// ClientConfig returns the tls config of a dialer,
+// the certificate is presented to servers which authenticate clients
+func (o TLSOptions) ClientConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	if o.Enabled() {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "load tls certificate failed")
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if o.CAFile != "" {
+		pool, err := loadCertPool(o.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "load tls CA certificate failed")
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.Errorf("no CA certificate found in %s", file)
+	}
+	return pool, nil
+}
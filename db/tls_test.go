@@ -0,0 +1,146 @@
+package db
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/joway/pidis/types"
+	"github.com/joway/pidis/util"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// writeTestCert generates a certificate signed by parent (self signed if nil) into dir/name.{crt,key}
+func writeTestCert(dir, name string, parent *testCert) (*testCert, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := ioutil.WriteFile(path.Join(dir, name+".crt"), certPem, 0644); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(path.Join(dir, name+".key"), keyPem, 0600); err != nil {
+		return nil, err
+	}
+	return &testCert{cert: cert, key: key}, nil
+}
+
+func (suite *DBTestSuite) TestReplicationTLS() {
+	ca, err := writeTestCert(suite.dir, "ca", nil)
+	suite.NoError(err)
+	_, err = writeTestCert(suite.dir, "leader", ca)
+	suite.NoError(err)
+	_, err = writeTestCert(suite.dir, "follower", ca)
+	suite.NoError(err)
+	tlsOptions := func(name string) TLSOptions {
+		return TLSOptions{
+			CertFile:    path.Join(suite.dir, name+".crt"),
+			KeyFile:     path.Join(suite.dir, name+".key"),
+			CAFile:      path.Join(suite.dir, "ca.crt"),
+			AuthClients: true,
+		}
+	}
+
+	_, err = New(Options{
+		DBDir:          path.Join(suite.dir, "invalid"),
+		ReplicationTLS: TLSOptions{CertFile: path.Join(suite.dir, "missing.crt")},
+	})
+	suite.Error(err)
+
+	leader, err := New(Options{
+		DBDir:          path.Join(suite.dir, "leader"),
+		ReplicationTLS: tlsOptions("leader"),
+	})
+	suite.NoError(err)
+	follower, err := New(Options{
+		DBDir:          path.Join(suite.dir, "follower"),
+		ReplicationTLS: tlsOptions("follower"),
+	})
+	suite.NoError(err)
+	//trusts the leader but presents no client certificate
+	anonymous, err := New(Options{
+		DBDir:          path.Join(suite.dir, "anonymous"),
+		ReplicationTLS: TLSOptions{CAFile: path.Join(suite.dir, "ca.crt")},
+	})
+	suite.NoError(err)
+	//presents no certificate and trusts nothing
+	plain, err := New(Options{
+		DBDir: path.Join(suite.dir, "plain"),
+	})
+	suite.NoError(err)
+	leader.Run()
+	follower.Run()
+	anonymous.Run()
+	plain.Run()
+
+	leaderListen, err := net.Listen("tcp", ":10002")
+	suite.NoError(err)
+	server := NewRpcServer(leader)
+	defer server.Stop()
+	go func() {
+		_ = server.Serve(leaderListen)
+	}()
+
+	_, err = leader.Exec(util.CommandToArgs("set k x"))
+	suite.NoError(err)
+
+	suite.Equal(types.ErrNodeConnectFailed, anonymous.SlaveOf("127.0.0.1", "10002"))
+	suite.Equal(types.ErrNodeConnectFailed, plain.SlaveOf("127.0.0.1", "10002"))
+
+	err = follower.SlaveOf("127.0.0.1", "10002")
+	suite.NoError(err)
+	time.Sleep(time.Second)
+
+	_, err = leader.Exec(util.CommandToArgs("set k1 xxx"))
+	suite.NoError(err)
+	time.Sleep(time.Second)
+
+	result, err := follower.Exec(util.CommandToArgs("get k"))
+	suite.NoError(err)
+	suite.Equal(byte('x'), result.Output()[4])
+	result, err = follower.Exec(util.CommandToArgs("get k1"))
+	suite.NoError(err)
+	suite.Equal("xxx", string(result.Output()[4:7]))
+}
@@ -0,0 +1,267 @@
+package db
+
+import (
+	"github.com/joway/pidis/executor"
+	"github.com/joway/pidis/util"
+	"github.com/tidwall/redcon"
+	"strings"
+	"sync"
+)
+
+const invalidateChannel = "__redis__:invalidate"
+
+// values of Client.caching, set by CLIENT CACHING for the next command only
+const (
+	cachingDefault = iota
+	cachingYes
+	cachingNo
+)
+
+type trackingOptions struct {
+	on       bool
+	redirect int64
+	bcast    bool
+	prefixes []string
+	optIn    bool
+	optOut   bool
+}
+
+// Tracking remembers the keys read by tracking clients, so they can be
+// told to drop them from their local cache once the keys are modified
+type Tracking struct {
+	lock sync.Mutex
+
+	keys     map[string]map[*Client]struct{}
+	prefixes map[string]map[*Client]struct{}
+	//keys tracked by each client, so they can be forgotten with the client
+	tracked map[*Client]map[string]struct{}
+}
+
+type invalidation struct {
+	client   *Client
+	redirect int64
+	keys     [][]byte
+}
+
+func NewTracking() *Tracking {
+	return &Tracking{
+		keys:     make(map[string]map[*Client]struct{}),
+		prefixes: make(map[string]map[*Client]struct{}),
+		tracked:  make(map[*Client]map[string]struct{}),
+	}
+}
+
+func (t *Tracking) Enable(c *Client, opts trackingOptions) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.disable(c)
+	if opts.bcast && len(opts.prefixes) == 0 {
+		//empty prefix matches every key
+		opts.prefixes = []string{""}
+	}
+	c.tracking = opts
+	if !opts.bcast {
+		return
+	}
+	for _, prefix := range opts.prefixes {
+		clients, ok := t.prefixes[prefix]
+		if !ok {
+			clients = make(map[*Client]struct{})
+			t.prefixes[prefix] = clients
+		}
+		clients[c] = struct{}{}
+	}
+}
+
+func (t *Tracking) Disable(c *Client) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.disable(c)
+}
+
+func (t *Tracking) disable(c *Client) {
+	for _, prefix := range c.tracking.prefixes {
+		delete(t.prefixes[prefix], c)
+		if len(t.prefixes[prefix]) == 0 {
+			delete(t.prefixes, prefix)
+		}
+	}
+	for key := range t.tracked[c] {
+		delete(t.keys[key], c)
+		if len(t.keys[key]) == 0 {
+			delete(t.keys, key)
+		}
+	}
+	delete(t.tracked, c)
+	c.tracking = trackingOptions{}
+}
+
+// Track remembers keys read by c according to its tracking mode
+// and the CLIENT CACHING value of the current command
+func (t *Tracking) Track(c *Client, keys [][]byte, caching int) {
+	if len(keys) == 0 {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	opts := c.tracking
+	if !opts.on || opts.bcast {
+		return
+	}
+	if opts.optIn && caching != cachingYes {
+		return
+	}
+	if opts.optOut && caching == cachingNo {
+		return
+	}
+	tracked, ok := t.tracked[c]
+	if !ok {
+		tracked = make(map[string]struct{})
+		t.tracked[c] = tracked
+	}
+	for _, key := range keys {
+		clients, ok := t.keys[string(key)]
+		if !ok {
+			clients = make(map[*Client]struct{})
+			t.keys[string(key)] = clients
+		}
+		clients[c] = struct{}{}
+		tracked[string(key)] = struct{}{}
+	}
+}
+
+// Invalidate forgets keys and returns the clients to be notified
+func (t *Tracking) Invalidate(keys [][]byte) []invalidation {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if len(t.keys) == 0 && len(t.prefixes) == 0 {
+		return nil
+	}
+	targets := make(map[*Client][][]byte)
+	for _, key := range keys {
+		for c := range t.keys[string(key)] {
+			targets[c] = append(targets[c], key)
+			delete(t.tracked[c], string(key))
+			if len(t.tracked[c]) == 0 {
+				delete(t.tracked, c)
+			}
+		}
+		delete(t.keys, string(key))
+		for prefix, clients := range t.prefixes {
+			if !strings.HasPrefix(string(key), prefix) {
+				continue
+			}
+			for c := range clients {
+				targets[c] = append(targets[c], key)
+			}
+		}
+	}
+	invalidations := make([]invalidation, 0, len(targets))
+	for c, keys := range targets {
+		invalidations = append(invalidations, invalidation{
+			client:   c,
+			redirect: c.tracking.redirect,
+			keys:     keys,
+		})
+	}
+	return invalidations
+}
+
+// Flush forgets every key and returns the tracking clients, notified with nil keys
+func (t *Tracking) Flush() []invalidation {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	targets := make(map[*Client]struct{})
+	for c := range t.tracked {
+		targets[c] = struct{}{}
+	}
+	for _, clients := range t.prefixes {
+		for c := range clients {
+			targets[c] = struct{}{}
+		}
+	}
+	t.keys = make(map[string]map[*Client]struct{})
+	t.tracked = make(map[*Client]map[string]struct{})
+	invalidations := make([]invalidation, 0, len(targets))
+	for c := range targets {
+		invalidations = append(invalidations, invalidation{client: c, redirect: c.tracking.redirect})
+	}
+	return invalidations
+}
+
+// invalidate sends invalidation messages of keys to tracking clients,
+// RESP2 clients receive them through the __redis__:invalidate channel
+func (db *Database) invalidate(keys [][]byte) {
+	db.sendInvalidations(db.tracking.Invalidate(keys))
+}
+
+// invalidateAll tells every tracking client to drop its whole cache, after a flush
+func (db *Database) invalidateAll() {
+	db.sendInvalidations(db.tracking.Flush())
+}
+
+func (db *Database) sendInvalidations(invalidations []invalidation) {
+	for _, inv := range invalidations {
+		target := inv.client
+		if inv.redirect != 0 {
+			if target = db.clientByID(inv.redirect); target == nil {
+				continue
+			}
+		}
+		if target.Proto() == util.RESP3 {
+			target.Push(invalidatePush(inv.keys))
+			continue
+		}
+		db.pubsub.Deliver(target, invalidateChannel, invalidateMessage(inv.keys))
+	}
+}
+
+func invalidateMessage(keys [][]byte) []byte {
+	output := redcon.AppendArray(nil, 3)
+	output = redcon.AppendBulkString(output, "message")
+	output = redcon.AppendBulkString(output, invalidateChannel)
+	//a null array flushes the whole cache
+	if keys == nil {
+		return append(output, "*-1\r\n"...)
+	}
+	output = redcon.AppendArray(output, len(keys))
+	for _, key := range keys {
+		output = redcon.AppendBulk(output, key)
+	}
+	return output
+}
+
+func invalidatePush(keys [][]byte) []byte {
+	reply := util.NewReply(util.RESP3).Push(2).BulkString("invalidate")
+	if keys == nil {
+		return reply.Null().Bytes()
+	}
+	reply.Array(len(keys))
+	for _, key := range keys {
+		reply.Bulk(key)
+	}
+	return reply.Bytes()
+}
+
+// readKeys returns the keys read by a command, queued commands are used for EXEC
+func readKeys(name string, args [][]byte, queue [][][]byte) [][]byte {
+	if name == executor.EXEC {
+		var keys [][]byte
+		for _, cmd := range queue {
+			if len(cmd) > 0 {
+				keys = append(keys, readKeys(strings.ToUpper(string(cmd[0])), cmd, nil)...)
+			}
+		}
+		return keys
+	}
+	//scripts may read any of their keys
+	if cmd := executor.Lookup(name); cmd.HasFlag(executor.FlagReadOnly) || (cmd != nil && cmd.NumKeys > 0) {
+		return cmd.Keys(args)
+	}
+	return nil
+}
+
+// commandKeys returns the key arguments of a command
+func commandKeys(name string, args [][]byte) [][]byte {
+	return executor.Lookup(name).Keys(args)
+}
@@ -1,7 +1,9 @@
 package db
 
 import (
+	"encoding/binary"
 	"github.com/rs/xid"
+	"strconv"
 	"time"
 )
 
@@ -17,6 +19,14 @@ func NewUID() UID {
 	}
 }
 
+func UIDFromBytes(b []byte) (UID, error) {
+	id, err := xid.FromBytes(b)
+	if err != nil {
+		return UID{}, err
+	}
+	return UID{id: id}, nil
+}
+
 func (u UID) Size() int {
 	return UIDSize
 }
@@ -26,7 +36,7 @@ func (u UID) Bytes() []byte {
 }
 
 func (u UID) String() string {
-	return u.String()
+	return u.id.String()
 }
 
 func (u UID) Time() time.Time {
@@ -34,5 +44,20 @@ func (u UID) Time() time.Time {
 }
 
 func (u UID) Timestamp() string {
-	return string(u.id.Time().Unix())
+	return strconv.FormatInt(u.id.Time().Unix(), 10)
+}
+
+// UIDFromTime returns the smallest uid of the second of t, every uid generated at t or later is greater or equal
+func UIDFromTime(t time.Time) UID {
+	var id xid.ID
+	binary.BigEndian.PutUint32(id[:4], uint32(t.Unix()))
+	return UID{id: id}
+}
+
+func UIDFromString(s string) (UID, error) {
+	id, err := xid.FromString(s)
+	if err != nil {
+		return UID{}, err
+	}
+	return UID{id: id}, nil
 }
@@ -0,0 +1,176 @@
+package executor_test
+
+import (
+	"github.com/go-redis/redis/v7"
+	"github.com/stretchr/testify/suite"
+	"strings"
+	"testing"
+)
+
+type ACLTestSuite struct {
+	suite.Suite
+
+	cli *redis.Client
+}
+
+func TestACLTestSuite(t *testing.T) {
+	suite.Run(t, new(ACLTestSuite))
+}
+
+func (suite *ACLTestSuite) SetupTest() {
+	cli, err := e2eGetRedisClient()
+	suite.cli = cli
+	suite.NoError(err)
+}
+
+func (suite *ACLTestSuite) TearDownTest() {
+	suite.NoError(suite.cli.Do("acl", "deluser", "alice").Err())
+	suite.NoError(suite.cli.Do("acl", "log", "reset").Err())
+	suite.NoError(e2eClearRedis(suite.cli))
+}
+
+func (suite *ACLTestSuite) TestSetUser() {
+	suite.NoError(suite.cli.Do(
+		"acl", "setuser", "alice", "on", ">secret", "~cache:*", "&news.*", "+@read", "+@write", "-del",
+	).Err())
+	user, err := suite.cli.Do("acl", "getuser", "alice").Result()
+	suite.NoError(err)
+	fields := user.([]interface{})
+	suite.Equal("flags", fields[0])
+	suite.Equal([]interface{}{"on"}, fields[1])
+	suite.Len(fields[3], 1)
+	suite.Equal("+@read +@write -del", fields[5])
+	suite.Equal("~cache:*", fields[7])
+	suite.Equal("&news.*", fields[9])
+
+	users, err := suite.cli.Do("acl", "users").Result()
+	suite.NoError(err)
+	suite.Equal([]interface{}{"alice", "default"}, users)
+	list, err := suite.cli.Do("acl", "list").Result()
+	suite.NoError(err)
+	suite.Contains(list, "user default on nopass ~* &* +@all")
+
+	suite.Error(suite.cli.Do("acl", "setuser", "alice", "+nosuchcommand").Err())
+	suite.Error(suite.cli.Do("acl", "setuser", "alice", "#123").Err())
+	suite.Error(suite.cli.Do("acl", "deluser", "default").Err())
+	cat, err := suite.cli.Do("acl", "cat", "read").Result()
+	suite.NoError(err)
+	suite.Contains(cat, "get")
+}
+
+func (suite *ACLTestSuite) TestPermissions() {
+	suite.NoError(suite.cli.Do(
+		"acl", "setuser", "alice", "on", ">secret", "~cache:*", "&news.*", "+@read", "+@write", "+@pubsub", "-del",
+	).Err())
+
+	conn := suite.cli.Conn()
+	defer func() {
+		suite.NoError(e2eDo(conn, "auth", "default", "").Err())
+		suite.NoError(conn.Close())
+	}()
+	err := e2eDo(conn, "auth", "alice", "wrong").Err()
+	suite.Error(err)
+	suite.True(strings.HasPrefix(err.Error(), "WRONGPASS"))
+	suite.NoError(e2eDo(conn, "auth", "alice", "secret").Err())
+	//ACL belongs to @admin
+	suite.Error(e2eDo(conn, "acl", "whoami").Err())
+
+	suite.NoError(e2eDo(conn, "set", "cache:1", "v").Err())
+	suite.NoError(e2eDo(conn, "get", "cache:1").Err())
+	err = e2eDo(conn, "set", "other", "v").Err()
+	suite.Error(err)
+	suite.Equal("NOPERM No permissions to access a key", err.Error())
+	err = e2eDo(conn, "del", "cache:1").Err()
+	suite.Error(err)
+	suite.Equal("NOPERM User alice has no permissions to run the 'del' command", err.Error())
+	suite.Error(e2eDo(conn, "shutdown").Err())
+	suite.Error(e2eDo(conn, "slaveof", "127.0.0.1", "1").Err())
+
+	suite.NoError(e2eDo(conn, "publish", "news.a", "x").Err())
+	err = e2eDo(conn, "publish", "other", "x").Err()
+	suite.Error(err)
+	suite.Equal("NOPERM No permissions to access a channel", err.Error())
+
+	log, err := suite.cli.Do("acl", "log").Result()
+	suite.NoError(err)
+	entries := log.([]interface{})
+	suite.Len(entries, 7)
+	entry := entries[0].([]interface{})
+	suite.Equal("reason", entry[2])
+	suite.Equal("channel", entry[3])
+	suite.Equal("object", entry[6])
+	suite.Equal("other", entry[7])
+}
+
+func (suite *ACLTestSuite) TestScriptPermissions() {
+	suite.NoError(suite.cli.Do(
+		"acl", "setuser", "alice", "on", ">secret", "~cache:*", "+@read", "+@write", "+@scripting", "-flushall",
+	).Err())
+	suite.NoError(suite.cli.Do("function", "load", `#!lua name=acllib
+redis.register_function('acl_flushall', function(keys, args) return redis.call('FLUSHALL') end)
+redis.register_function('acl_set', function(keys, args) return redis.call('SET', args[1], 'v') end)
+`).Err())
+	defer func() { suite.NoError(suite.cli.Do("function", "flush").Err()) }()
+	suite.NoError(suite.cli.Set("other", "v", 0).Err())
+
+	conn := suite.cli.Conn()
+	defer func() {
+		suite.NoError(e2eDo(conn, "auth", "default", "").Err())
+		suite.NoError(conn.Close())
+	}()
+	suite.NoError(e2eDo(conn, "auth", "alice", "secret").Err())
+
+	//commands called by scripts are checked against the user running them
+	for _, args := range [][]interface{}{
+		{"eval", "return redis.call('FLUSHALL')", 0},
+		{"fcall", "acl_flushall", 0},
+	} {
+		err := e2eDo(conn, args...).Err()
+		suite.Error(err)
+		suite.Contains(err.Error(), "NOPERM User alice has no permissions to run the 'flushall' command")
+	}
+	for _, args := range [][]interface{}{
+		{"eval", "return redis.call('SET', ARGV[1], 'v')", 0, "other"},
+		{"fcall", "acl_set", 0, "other"},
+	} {
+		err := e2eDo(conn, args...).Err()
+		suite.Error(err)
+		suite.Contains(err.Error(), "NOPERM No permissions to access a key")
+	}
+	suite.NoError(e2eDo(conn, "eval", "return redis.call('SET', ARGV[1], 'v')", 0, "cache:1").Err())
+	suite.NoError(e2eDo(conn, "fcall", "acl_set", 0, "cache:2").Err())
+	suite.EqualValues(1, suite.cli.Exists("other").Val())
+
+	log, err := suite.cli.Do("acl", "log").Result()
+	suite.NoError(err)
+	entry := log.([]interface{})[0].([]interface{})
+	suite.Equal("context", entry[4])
+	suite.Equal("lua", entry[5])
+}
+
+func (suite *ACLTestSuite) TestRequirePass() {
+	suite.NoError(suite.cli.Do("acl", "setuser", "default", "resetpass", ">pass").Err())
+	defer func() {
+		suite.NoError(suite.cli.Do("acl", "setuser", "default", "nopass").Err())
+	}()
+
+	conn, err := e2eDialRaw()
+	suite.Require().NoError(err)
+	defer conn.Close()
+	suite.NoError(conn.Send("get", "k"))
+	line, err := conn.ReadLine()
+	suite.NoError(err)
+	suite.Equal("-NOAUTH Authentication required.\r\n", line)
+	suite.NoError(conn.Send("hello", "3"))
+	line, err = conn.ReadLine()
+	suite.NoError(err)
+	suite.True(strings.HasPrefix(line, "-NOAUTH HELLO"))
+	suite.NoError(conn.Send("auth", "pass"))
+	line, err = conn.ReadLine()
+	suite.NoError(err)
+	suite.Equal("+OK\r\n", line)
+	suite.NoError(conn.Send("get", "k"))
+	line, err = conn.ReadLine()
+	suite.NoError(err)
+	suite.Equal("$-1\r\n", line)
+}
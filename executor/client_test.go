@@ -0,0 +1,188 @@
+package executor_test
+
+import (
+	"fmt"
+	"github.com/go-redis/redis/v7"
+	"github.com/stretchr/testify/suite"
+	"regexp"
+	"testing"
+	"time"
+)
+
+type ClientTestSuite struct {
+	suite.Suite
+
+	cli *redis.Client
+}
+
+func TestClientTestSuite(t *testing.T) {
+	suite.Run(t, new(ClientTestSuite))
+}
+
+func (suite *ClientTestSuite) SetupTest() {
+	cli, err := e2eGetRedisClient()
+	suite.cli = cli
+	suite.NoError(err)
+}
+
+func (suite *ClientTestSuite) TearDownTest() {
+	suite.NoError(suite.cli.Do("CLIENT", "UNPAUSE").Err())
+	suite.NoError(e2eClearRedis(suite.cli))
+}
+
+// dial returns a raw connection and its client id
+func (suite *ClientTestSuite) dial() (*e2eRawConn, int64) {
+	conn, err := e2eDialRaw()
+	suite.Require().NoError(err)
+	suite.NoError(conn.Send("CLIENT", "ID"))
+	line, err := conn.ReadLine()
+	suite.NoError(err)
+	var id int64
+	_, err = fmt.Sscanf(line, ":%d\r\n", &id)
+	suite.NoError(err)
+	return conn, id
+}
+
+func (suite *ClientTestSuite) TestName() {
+	suite.Equal(redis.Nil, suite.cli.Do("CLIENT", "GETNAME").Err())
+	suite.NoError(suite.cli.Do("CLIENT", "SETNAME", "worker-1").Err())
+	name, err := suite.cli.Do("CLIENT", "GETNAME").String()
+	suite.NoError(err)
+	suite.Equal("worker-1", name)
+	suite.Error(suite.cli.Do("CLIENT", "SETNAME", "with space").Err())
+	suite.NoError(suite.cli.Do("CLIENT", "SETNAME", "").Err())
+	suite.Equal(redis.Nil, suite.cli.Do("CLIENT", "GETNAME").Err())
+}
+
+func (suite *ClientTestSuite) TestListAndInfo() {
+	suite.NoError(suite.cli.Do("CLIENT", "SETNAME", "lister").Err())
+	id, err := suite.cli.Do("CLIENT", "ID").Int64()
+	suite.NoError(err)
+
+	info, err := suite.cli.Do("CLIENT", "INFO").String()
+	suite.NoError(err)
+	suite.Regexp(fmt.Sprintf(
+		`^id=%d addr=\S+ name=lister age=\d+ idle=0 flags=N db=0 sub=0 psub=0 ssub=0 multi=-1 watch=0 `+
+			`omem=0 cmd=client user=default redir=-1 resp=2\n$`, id,
+	), info)
+
+	list, err := suite.cli.Do("CLIENT", "LIST").String()
+	suite.NoError(err)
+	suite.Regexp(fmt.Sprintf(`(?m)^id=%d .*name=lister `, id), list)
+
+	list, err = suite.cli.Do("CLIENT", "LIST", "ID", id).String()
+	suite.NoError(err)
+	suite.Len(regexp.MustCompile("\n").FindAllString(list, -1), 1)
+
+	sub, subID := suite.dial()
+	defer sub.Close()
+	suite.NoError(sub.Send("SUBSCRIBE", "client:ch"))
+	_, err = sub.Read(len("*3\r\n$9\r\nsubscribe\r\n$9\r\nclient:ch\r\n:1\r\n"))
+	suite.NoError(err)
+	list, err = suite.cli.Do("CLIENT", "LIST", "TYPE", "pubsub").String()
+	suite.NoError(err)
+	suite.Regexp(fmt.Sprintf(`^id=%d .*flags=P .*sub=1 .*cmd=subscribe `, subID), list)
+	suite.NotContains(list, "name=lister")
+
+	suite.Error(suite.cli.Do("CLIENT", "LIST", "TYPE", "nope").Err())
+	suite.Error(suite.cli.Do("CLIENT", "LIST", "ID", "0").Err())
+}
+
+func (suite *ClientTestSuite) TestKill() {
+	victim, victimID := suite.dial()
+	defer victim.Close()
+	killed, err := suite.cli.Do("CLIENT", "KILL", "ID", victimID).Int64()
+	suite.NoError(err)
+	suite.EqualValues(1, killed)
+	_, err = victim.ReadLine()
+	suite.Error(err)
+
+	victim, victimID = suite.dial()
+	defer victim.Close()
+	list, err := suite.cli.Do("CLIENT", "LIST", "ID", victimID).String()
+	suite.NoError(err)
+	addr := regexp.MustCompile(`addr=(\S+)`).FindStringSubmatch(list)[1]
+	suite.NoError(suite.cli.Do("CLIENT", "KILL", addr).Err())
+	_, err = victim.ReadLine()
+	suite.Error(err)
+	//the victim is unregistered once its connection is released
+	suite.True(e2eEventually(func() bool {
+		return suite.cli.Do("CLIENT", "KILL", addr).Err() != nil
+	}, time.Second, time.Millisecond*10))
+
+	//the killer is skipped by default
+	killed, err = suite.cli.Do("CLIENT", "KILL", "USER", "default", "TYPE", "pubsub").Int64()
+	suite.NoError(err)
+	suite.EqualValues(0, killed)
+	suite.Error(suite.cli.Do("CLIENT", "KILL", "USER", "nobody").Err())
+	suite.Error(suite.cli.Do("CLIENT", "KILL", "TYPE", "nope").Err())
+
+	self, selfID := suite.dial()
+	defer self.Close()
+	suite.NoError(self.Send("CLIENT", "KILL", "ID", fmt.Sprint(selfID), "SKIPME", "no"))
+	line, err := self.ReadLine()
+	suite.NoError(err)
+	suite.Equal(":1\r\n", line)
+	_, err = self.ReadLine()
+	suite.Error(err)
+}
+
+func (suite *ClientTestSuite) TestPause() {
+	suite.NoError(suite.cli.Set("client:k", "v", 0).Err())
+	suite.NoError(suite.cli.Do("CLIENT", "PAUSE", "100000", "WRITE").Err())
+	suite.NoError(suite.cli.Get("client:k").Err())
+
+	writer, _ := suite.dial()
+	defer writer.Close()
+	suite.NoError(writer.Send("SET", "client:k", "paused"))
+	done := make(chan string)
+	go func() {
+		line, _ := writer.ReadLine()
+		done <- line
+	}()
+	select {
+	case <-done:
+		suite.Fail("write went through the pause")
+	case <-time.After(time.Millisecond * 100):
+	}
+	suite.NoError(suite.cli.Do("CLIENT", "UNPAUSE").Err())
+	suite.Equal("+OK\r\n", <-done)
+
+	suite.NoError(suite.cli.Do("CLIENT", "PAUSE", "50").Err())
+	start := time.Now()
+	suite.NoError(suite.cli.Ping().Err())
+	suite.True(time.Since(start) >= time.Millisecond*40)
+
+	suite.Error(suite.cli.Do("CLIENT", "PAUSE", "-1").Err())
+	suite.Error(suite.cli.Do("CLIENT", "PAUSE", "10", "READ").Err())
+}
+
+func (suite *ClientTestSuite) TestReply() {
+	conn, _ := suite.dial()
+	defer conn.Close()
+	//pipelined, as nothing is read until the last command
+	_, err := conn.Write([]byte("*3\r\n$6\r\nCLIENT\r\n$5\r\nREPLY\r\n$3\r\nOFF\r\n" +
+		"*1\r\n$4\r\nPING\r\n" +
+		"*3\r\n$6\r\nCLIENT\r\n$5\r\nREPLY\r\n$2\r\nON\r\n"))
+	suite.NoError(err)
+	line, err := conn.ReadLine()
+	suite.NoError(err)
+	suite.Equal("+OK\r\n", line)
+
+	_, err = conn.Write([]byte("*3\r\n$6\r\nCLIENT\r\n$5\r\nREPLY\r\n$4\r\nSKIP\r\n" +
+		"*1\r\n$4\r\nPING\r\n" +
+		"*2\r\n$4\r\nECHO\r\n$1\r\nx\r\n"))
+	suite.NoError(err)
+	reply, err := conn.Read(len("$1\r\nx\r\n"))
+	suite.NoError(err)
+	suite.Equal("$1\r\nx\r\n", reply)
+}
+
+func (suite *ClientTestSuite) TestNoEvict() {
+	suite.NoError(suite.cli.Do("CLIENT", "NO-EVICT", "ON").Err())
+	info, err := suite.cli.Do("CLIENT", "INFO").String()
+	suite.NoError(err)
+	suite.Contains(info, " flags=e ")
+	suite.NoError(suite.cli.Do("CLIENT", "NO-EVICT", "OFF").Err())
+	suite.Error(suite.cli.Do("CLIENT", "NO-EVICT", "maybe").Err())
+}
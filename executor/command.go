@@ -0,0 +1,407 @@
+package executor
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// command flags, reported by COMMAND INFO
+const (
+	FlagWrite        = "write"
+	FlagReadOnly     = "readonly"
+	FlagDenyOOM      = "denyoom"
+	FlagAdmin        = "admin"
+	FlagPubSub       = "pubsub"
+	FlagNoScript     = "noscript"
+	FlagFast         = "fast"
+	FlagNoAuth       = "no_auth"
+	FlagMayReplicate = "may_replicate"
+)
+
+// Command describes a command: how it is dispatched, validated, recorded and introspected
+type Command struct {
+	Name string
+	//Arity counts the command name, -N means at least N arguments
+	Arity int
+	Flags []string
+	//keys are the arguments from FirstKey to LastKey every KeyStep,
+	//a negative LastKey counts from the end and a 0 FirstKey means no keys
+	FirstKey int
+	LastKey  int
+	KeyStep  int
+	//NumKeys is the position of the number of keys of EVAL like commands, the keys follow it
+	NumKeys int
+	//Categories are the acl categories besides those implied by the flags
+	Categories []string
+
+	//documentation
+	Group   string
+	Since   string
+	Summary string
+
+	//executor runs the command against the storage, nil for commands handled by the database
+	executor func(base BaseExecutor) Executor
+}
+
+func systemExecutor(base BaseExecutor) Executor {
+	return SystemExecutor{base}
+}
+
+func kvExecutor(base BaseExecutor) Executor {
+	return KVExecutor{base}
+}
+
+var commandTable = []*Command{
+	//system
+	{
+		Name: PING, Arity: -1, Flags: []string{FlagFast}, Categories: []string{"connection"},
+		Group: "connection", Since: "1.0.0", Summary: "Returns the server's liveliness response.",
+		executor: systemExecutor,
+	},
+	{
+		Name: ECHO, Arity: 2, Flags: []string{FlagFast}, Categories: []string{"connection"},
+		Group: "connection", Since: "1.0.0", Summary: "Returns the given string.",
+		executor: systemExecutor,
+	},
+	{
+		Name: QUIT, Arity: -1, Flags: []string{FlagNoScript, FlagNoAuth}, Categories: []string{"connection"},
+		Group: "connection", Since: "1.0.0", Summary: "Closes the connection.",
+		executor: systemExecutor,
+	},
+	{
+		Name: SHUTDOWN, Arity: -1, Flags: []string{FlagAdmin, FlagNoScript},
+		Group: "server", Since: "1.0.0", Summary: "Synchronously saves the database(s) to disk and shuts down the server.",
+		executor: systemExecutor,
+	},
+	{
+		Name: SLAVEOF, Arity: 3, Flags: []string{FlagAdmin, FlagNoScript},
+		Group: "server", Since: "1.0.0", Summary: "Sets a server as a replica of another, or promotes it to being a master.",
+		executor: systemExecutor,
+	},
+	{
+		Name: CLIENT, Arity: -2, Flags: []string{FlagNoScript}, Categories: []string{"connection", "dangerous"},
+		Group: "connection", Since: "2.4.0", Summary: "A container for client connection commands.",
+	},
+	{
+		Name: HELLO, Arity: -1, Flags: []string{FlagNoScript, FlagNoAuth}, Categories: []string{"connection"},
+		Group: "connection", Since: "6.0.0", Summary: "Handshakes with the server.",
+	},
+	{
+		Name: AUTH, Arity: -2, Flags: []string{FlagNoScript, FlagNoAuth, FlagFast}, Categories: []string{"connection"},
+		Group: "connection", Since: "1.0.0", Summary: "Authenticates the connection.",
+	},
+	{
+		Name: ACL, Arity: -2, Flags: []string{FlagAdmin, FlagNoScript},
+		Group: "server", Since: "6.0.0", Summary: "A container for Access List Control commands.",
+	},
+	{
+		Name: CONFIG, Arity: -2, Flags: []string{FlagAdmin, FlagNoScript},
+		Group: "server", Since: "2.0.0", Summary: "A container for server configuration commands.",
+	},
+	{
+		Name: INFO, Arity: -1, Categories: []string{"dangerous"},
+		Group: "server", Since: "1.0.0", Summary: "Returns information and statistics about the server.",
+	},
+	{
+		Name: SLOWLOG, Arity: -2, Flags: []string{FlagAdmin},
+		Group: "server", Since: "2.2.12", Summary: "A container for slow log commands.",
+	},
+	{
+		Name: LATENCY, Arity: -2, Flags: []string{FlagAdmin},
+		Group: "server", Since: "2.8.13", Summary: "A container for latency diagnostics commands.",
+	},
+	{
+		Name: ENCRYPTION, Arity: -2, Flags: []string{FlagAdmin, FlagNoScript},
+		Group: "server", Since: "0.1.0", Summary: "A container for encryption at rest commands.",
+	},
+	{
+		Name: BGSAVE, Arity: -1, Flags: []string{FlagAdmin, FlagNoScript},
+		Group: "server", Since: "1.0.0", Summary: "Asynchronously saves the database(s) to disk.",
+	},
+	{
+		Name: LASTSAVE, Arity: 1, Flags: []string{FlagFast}, Categories: []string{"admin", "dangerous"},
+		Group: "server", Since: "1.0.0", Summary: "Returns the Unix timestamp of the last successful save to disk.",
+	},
+	{
+		Name: MONITOR, Arity: 1, Flags: []string{FlagAdmin, FlagNoScript},
+		Group: "server", Since: "1.0.0", Summary: "Listens for all requests received by the server in real-time.",
+	},
+	{
+		Name: COMMAND, Arity: -1, Categories: []string{"connection"},
+		Group: "server", Since: "2.8.13", Summary: "Returns detailed information about all commands.",
+	},
+
+	//kv
+	{
+		Name: GET, Arity: 2, Flags: []string{FlagReadOnly, FlagFast}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+		Categories: []string{"string"},
+		Group:      "string", Since: "1.0.0", Summary: "Returns the string value of a key.",
+		executor: kvExecutor,
+	},
+	{
+		Name: SET, Arity: -3, Flags: []string{FlagWrite, FlagDenyOOM, FlagFast}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+		Categories: []string{"string"},
+		Group:      "string", Since: "1.0.0", Summary: "Sets the string value of a key, ignoring its type.",
+		executor: kvExecutor,
+	},
+	{
+		Name: SETNX, Arity: 3, Flags: []string{FlagWrite, FlagDenyOOM, FlagFast}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+		Categories: []string{"string"},
+		Group:      "string", Since: "1.0.0", Summary: "Set the string value of a key only when the key doesn't exist.",
+		executor: kvExecutor,
+	},
+	{
+		Name: DEL, Arity: -2, Flags: []string{FlagWrite}, FirstKey: 1, LastKey: -1, KeyStep: 1,
+		Categories: []string{"keyspace"},
+		Group:      "generic", Since: "1.0.0", Summary: "Deletes one or more keys.",
+		executor: kvExecutor,
+	},
+	{
+		Name: KEYS, Arity: 2, Flags: []string{FlagReadOnly}, Categories: []string{"keyspace", "dangerous"},
+		Group: "generic", Since: "1.0.0", Summary: "Returns all key names that match a pattern.",
+		executor: kvExecutor,
+	},
+	{
+		Name: EXISTS, Arity: -2, Flags: []string{FlagReadOnly, FlagFast}, FirstKey: 1, LastKey: -1, KeyStep: 1,
+		Categories: []string{"keyspace"},
+		Group:      "generic", Since: "1.0.0", Summary: "Determines whether one or more keys exist.",
+		executor: kvExecutor,
+	},
+	{
+		Name: INCR, Arity: 2, Flags: []string{FlagWrite, FlagDenyOOM, FlagFast}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+		Categories: []string{"string"},
+		Group:      "string", Since: "1.0.0", Summary: "Increments the integer value of a key by one.",
+		executor: kvExecutor,
+	},
+	{
+		Name: TTL, Arity: 2, Flags: []string{FlagReadOnly, FlagFast}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+		Categories: []string{"keyspace"},
+		Group:      "generic", Since: "1.0.0", Summary: "Returns the expiration time in seconds of a key.",
+		executor: kvExecutor,
+	},
+
+	//database
+	{
+		Name: SELECT, Arity: 2, Flags: []string{FlagNoScript, FlagFast}, Categories: []string{"connection"},
+		Group: "connection", Since: "1.0.0", Summary: "Changes the selected database.",
+	},
+	{
+		Name: MOVE, Arity: 3, Flags: []string{FlagWrite, FlagFast}, FirstKey: 1, LastKey: 1, KeyStep: 1,
+		Categories: []string{"keyspace"},
+		Group:      "generic", Since: "1.0.0", Summary: "Moves a key to another database.",
+	},
+	{
+		Name: SWAPDB, Arity: 3, Flags: []string{FlagWrite, FlagFast}, Categories: []string{"keyspace", "dangerous"},
+		Group: "server", Since: "4.0.0", Summary: "Swaps two Redis databases.",
+	},
+	{
+		Name: FLUSHDB, Arity: -1, Flags: []string{FlagWrite}, Categories: []string{"keyspace", "dangerous"},
+		Group: "server", Since: "1.0.0", Summary: "Remove all keys from the current database.",
+	},
+	{
+		Name: FLUSHALL, Arity: -1, Flags: []string{FlagWrite}, Categories: []string{"keyspace", "dangerous"},
+		Group: "server", Since: "1.0.0", Summary: "Removes all keys from all databases.",
+	},
+
+	//transaction
+	{
+		Name: MULTI, Arity: 1, Flags: []string{FlagNoScript, FlagFast}, Categories: []string{"transaction"},
+		Group: "transactions", Since: "1.2.0", Summary: "Starts a transaction.",
+	},
+	{
+		Name: EXEC, Arity: 1, Flags: []string{FlagNoScript}, Categories: []string{"transaction"},
+		Group: "transactions", Since: "1.2.0", Summary: "Executes all commands in a transaction.",
+	},
+	{
+		Name: DISCARD, Arity: 1, Flags: []string{FlagNoScript, FlagFast}, Categories: []string{"transaction"},
+		Group: "transactions", Since: "2.0.0", Summary: "Discards a transaction.",
+	},
+	{
+		Name: WATCH, Arity: -2, Flags: []string{FlagNoScript, FlagFast}, FirstKey: 1, LastKey: -1, KeyStep: 1,
+		Categories: []string{"transaction"},
+		Group:      "transactions", Since: "2.2.0", Summary: "Monitors changes to keys to determine the execution of a transaction.",
+	},
+	{
+		Name: UNWATCH, Arity: 1, Flags: []string{FlagNoScript, FlagFast}, Categories: []string{"transaction"},
+		Group: "transactions", Since: "2.2.0", Summary: "Forgets about watched keys of a transaction.",
+	},
+
+	//script
+	{
+		Name: EVAL, Arity: -3, Flags: []string{FlagNoScript, FlagMayReplicate}, NumKeys: 2,
+		Categories: []string{"scripting"},
+		Group:      "scripting", Since: "2.6.0", Summary: "Executes a server-side Lua script.",
+	},
+	{
+		Name: EVALSHA, Arity: -3, Flags: []string{FlagNoScript, FlagMayReplicate}, NumKeys: 2,
+		Categories: []string{"scripting"},
+		Group:      "scripting", Since: "2.6.0", Summary: "Executes a server-side Lua script by SHA1 digest.",
+	},
+	{
+		Name: SCRIPT, Arity: -2, Flags: []string{FlagNoScript}, Categories: []string{"scripting"},
+		Group: "scripting", Since: "2.6.0", Summary: "A container for Lua scripts management commands.",
+	},
+
+	//function
+	{
+		Name: FUNCTION, Arity: -2, Flags: []string{FlagNoScript, FlagMayReplicate}, Categories: []string{"scripting"},
+		Group: "scripting", Since: "7.0.0", Summary: "A container for function commands.",
+	},
+	{
+		Name: FCALL, Arity: -3, Flags: []string{FlagNoScript, FlagMayReplicate}, NumKeys: 2,
+		Categories: []string{"scripting"},
+		Group:      "scripting", Since: "7.0.0", Summary: "Invokes a function.",
+	},
+	{
+		Name: FCALL_RO, Arity: -3, Flags: []string{FlagNoScript}, NumKeys: 2, Categories: []string{"scripting"},
+		Group: "scripting", Since: "7.0.0", Summary: "Invokes a read-only function.",
+	},
+
+	//pubsub
+	{
+		Name: SUBSCRIBE, Arity: -2, Flags: []string{FlagPubSub, FlagNoScript},
+		Group: "pubsub", Since: "2.0.0", Summary: "Listens for messages published to channels.",
+	},
+	{
+		Name: UNSUBSCRIBE, Arity: -1, Flags: []string{FlagPubSub, FlagNoScript},
+		Group: "pubsub", Since: "2.0.0", Summary: "Stops listening to messages posted to channels.",
+	},
+	{
+		Name: PSUBSCRIBE, Arity: -2, Flags: []string{FlagPubSub, FlagNoScript},
+		Group: "pubsub", Since: "2.0.0", Summary: "Listens for messages published to channels that match one or more patterns.",
+	},
+	{
+		Name: PUNSUBSCRIBE, Arity: -1, Flags: []string{FlagPubSub, FlagNoScript},
+		Group: "pubsub", Since: "2.0.0", Summary: "Stops listening to messages published to channels that match one or more patterns.",
+	},
+	{
+		Name: SSUBSCRIBE, Arity: -2, Flags: []string{FlagPubSub, FlagNoScript},
+		Group: "pubsub", Since: "7.0.0", Summary: "Listens for messages published to shard channels.",
+	},
+	{
+		Name: SUNSUBSCRIBE, Arity: -1, Flags: []string{FlagPubSub, FlagNoScript},
+		Group: "pubsub", Since: "7.0.0", Summary: "Stops listening to messages posted to shard channels.",
+	},
+	{
+		Name: PUBLISH, Arity: 3, Flags: []string{FlagPubSub, FlagFast},
+		Group: "pubsub", Since: "2.0.0", Summary: "Posts a message to a channel.",
+	},
+	{
+		Name: SPUBLISH, Arity: 3, Flags: []string{FlagPubSub, FlagFast},
+		Group: "pubsub", Since: "7.0.0", Summary: "Post a message to a shard channel.",
+	},
+	{
+		Name: PUBSUB, Arity: -2, Flags: []string{FlagPubSub},
+		Group: "pubsub", Since: "2.8.0", Summary: "A container for Pub/Sub commands.",
+	},
+}
+
+var commands = func() map[string]*Command {
+	m := make(map[string]*Command, len(commandTable))
+	for _, cmd := range commandTable {
+		m[cmd.Name] = cmd
+	}
+	return m
+}()
+
+// Lookup returns the command named name, nil if it doesn't exist
+func Lookup(name string) *Command {
+	return commands[strings.ToUpper(name)]
+}
+
+// Commands returns the command table sorted by name
+func Commands() []*Command {
+	sorted := make([]*Command, len(commandTable))
+	copy(sorted, commandTable)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Name < sorted[j].Name
+	})
+	return sorted
+}
+
+// the methods below accept a nil command, as returned by Lookup for unknown commands
+
+func (c *Command) HasFlag(flag string) bool {
+	if c == nil {
+		return false
+	}
+	for _, f := range c.Flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Command) IsWrite() bool {
+	return c.HasFlag(FlagWrite)
+}
+
+// CheckArity tells whether n arguments, the name included, are valid
+func (c *Command) CheckArity(n int) bool {
+	if c == nil {
+		return false
+	}
+	if c.Arity < 0 {
+		return n >= -c.Arity
+	}
+	return n == c.Arity
+}
+
+// Keys returns the key arguments of args
+func (c *Command) Keys(args [][]byte) [][]byte {
+	if c == nil {
+		return nil
+	}
+	if c.NumKeys > 0 {
+		if len(args) <= c.NumKeys {
+			return nil
+		}
+		numKeys, err := strconv.Atoi(string(args[c.NumKeys]))
+		first := c.NumKeys + 1
+		if err != nil || numKeys < 0 || first+numKeys > len(args) {
+			return nil
+		}
+		return args[first : first+numKeys]
+	}
+	if c.FirstKey == 0 || c.FirstKey >= len(args) {
+		return nil
+	}
+	last := c.LastKey
+	if last < 0 {
+		last += len(args)
+	}
+	if last >= len(args) {
+		last = len(args) - 1
+	}
+	var keys [][]byte
+	for i := c.FirstKey; i <= last; i += c.KeyStep {
+		keys = append(keys, args[i])
+	}
+	return keys
+}
+
+// AllCategories returns the acl categories of the command, including those implied by its flags
+func (c *Command) AllCategories() []string {
+	categories := append([]string(nil), c.Categories...)
+	if c.HasFlag(FlagWrite) {
+		categories = append(categories, "write")
+	}
+	if c.HasFlag(FlagReadOnly) {
+		categories = append(categories, "read")
+	}
+	if c.HasFlag(FlagAdmin) {
+		categories = append(categories, "admin", "dangerous")
+	}
+	if c.HasFlag(FlagPubSub) {
+		categories = append(categories, "pubsub")
+	}
+	if c.HasFlag(FlagFast) {
+		categories = append(categories, "fast")
+	} else {
+		categories = append(categories, "slow")
+	}
+	sort.Strings(categories)
+	return categories
+}
@@ -0,0 +1,132 @@
+package executor_test
+
+import (
+	"github.com/go-redis/redis/v7"
+	"github.com/joway/pidis/executor"
+	"github.com/stretchr/testify/suite"
+	"testing"
+)
+
+type CommandTestSuite struct {
+	suite.Suite
+
+	cli *redis.Client
+}
+
+func TestCommandTestSuite(t *testing.T) {
+	suite.Run(t, new(CommandTestSuite))
+}
+
+func (suite *CommandTestSuite) SetupTest() {
+	cli, err := e2eGetRedisClient()
+	suite.cli = cli
+	suite.NoError(err)
+}
+
+func (suite *CommandTestSuite) TearDownTest() {
+	suite.NoError(e2eClearRedis(suite.cli))
+}
+
+func (suite *CommandTestSuite) slice(cmd *redis.Cmd) ([]interface{}, error) {
+	val, err := cmd.Result()
+	if err != nil {
+		return nil, err
+	}
+	return val.([]interface{}), nil
+}
+
+func (suite *CommandTestSuite) TestTable() {
+	cmd := executor.Lookup("del")
+	suite.Require().NotNil(cmd)
+	suite.True(cmd.IsWrite())
+	suite.True(cmd.CheckArity(3))
+	suite.False(cmd.CheckArity(1))
+	suite.Equal([][]byte{[]byte("a"), []byte("b")}, cmd.Keys([][]byte{[]byte("DEL"), []byte("a"), []byte("b")}))
+
+	eval := executor.Lookup("EVAL")
+	suite.Equal(
+		[][]byte{[]byte("k")},
+		eval.Keys([][]byte{[]byte("EVAL"), []byte("return 1"), []byte("1"), []byte("k"), []byte("arg")}),
+	)
+	suite.Nil(eval.Keys([][]byte{[]byte("EVAL"), []byte("return 1"), []byte("2"), []byte("k")}))
+
+	suite.Nil(executor.Lookup("NOPE"))
+	suite.False(executor.Lookup("NOPE").IsWrite())
+	suite.Nil(executor.New("NOPE"))
+	suite.Nil(executor.New(executor.MULTI))
+}
+
+func (suite *CommandTestSuite) TestValidation() {
+	err := suite.cli.Do("NOPE").Err()
+	suite.EqualError(err, "ERR unknown command 'NOPE'")
+	suite.EqualError(suite.cli.Do("GET").Err(), "ERR invalid number of arguments")
+	suite.EqualError(suite.cli.Do("GET", "a", "b").Err(), "ERR invalid number of arguments")
+
+	//a refused command aborts the transaction
+	pipe := suite.cli.TxPipeline()
+	pipe.Set("command:k", "v", 0)
+	pipe.Do("GET")
+	_, err = pipe.Exec()
+	suite.Error(err)
+	suite.Equal(redis.Nil, suite.cli.Get("command:k").Err())
+}
+
+func (suite *CommandTestSuite) TestCount() {
+	count, err := suite.cli.Do("COMMAND", "COUNT").Int64()
+	suite.NoError(err)
+	suite.EqualValues(len(executor.Commands()), count)
+	all, err := suite.slice(suite.cli.Do("COMMAND"))
+	suite.NoError(err)
+	suite.Len(all, int(count))
+}
+
+func (suite *CommandTestSuite) TestInfo() {
+	info, err := suite.slice(suite.cli.Do("COMMAND", "INFO", "get", "nope", "eval"))
+	suite.NoError(err)
+	suite.Require().Len(info, 3)
+
+	get := info[0].([]interface{})
+	suite.Equal("get", get[0])
+	suite.EqualValues(2, get[1])
+	suite.Equal([]interface{}{"readonly", "fast"}, get[2])
+	suite.EqualValues([]interface{}{int64(1), int64(1), int64(1)}, get[3:6])
+	suite.Equal([]interface{}{"@fast", "@read", "@string"}, get[6])
+	specs := get[8].([]interface{})
+	suite.Require().Len(specs, 1)
+	suite.Equal([]interface{}{"RO"}, specs[0].([]interface{})[1])
+
+	suite.Nil(info[1])
+
+	eval := info[2].([]interface{})
+	suite.Contains(eval[2], "movablekeys")
+	suite.Contains(eval[2], "noscript")
+}
+
+func (suite *CommandTestSuite) TestDocs() {
+	docs, err := suite.slice(suite.cli.Do("COMMAND", "DOCS", "set", "nope"))
+	suite.NoError(err)
+	suite.Require().Len(docs, 2)
+	suite.Equal("set", docs[0])
+	suite.Equal([]interface{}{
+		"summary", "Sets the string value of a key, ignoring its type.",
+		"since", "1.0.0",
+		"group", "string",
+	}, docs[1])
+}
+
+func (suite *CommandTestSuite) TestGetKeys() {
+	keys, err := suite.slice(suite.cli.Do("COMMAND", "GETKEYS", "SET", "a", "1"))
+	suite.NoError(err)
+	suite.Equal([]interface{}{"a"}, keys)
+	keys, err = suite.slice(suite.cli.Do("COMMAND", "GETKEYS", "EVAL", "return 1", "2", "a", "b", "c"))
+	suite.NoError(err)
+	suite.Equal([]interface{}{"a", "b"}, keys)
+
+	suite.EqualError(suite.cli.Do("COMMAND", "GETKEYS", "NOPE", "a").Err(), "ERR Invalid command specified")
+	suite.EqualError(
+		suite.cli.Do("COMMAND", "GETKEYS", "GET").Err(),
+		"ERR Invalid number of arguments specified for command",
+	)
+	suite.EqualError(suite.cli.Do("COMMAND", "GETKEYS", "PING").Err(), "ERR The command has no key arguments")
+	suite.Error(suite.cli.Do("COMMAND", "NOPE").Err())
+}
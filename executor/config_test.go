@@ -0,0 +1,71 @@
+package executor_test
+
+import (
+	"github.com/go-redis/redis/v7"
+	"github.com/stretchr/testify/suite"
+	"testing"
+)
+
+type ConfigTestSuite struct {
+	suite.Suite
+
+	cli *redis.Client
+}
+
+func TestConfigTestSuite(t *testing.T) {
+	suite.Run(t, new(ConfigTestSuite))
+}
+
+func (suite *ConfigTestSuite) SetupTest() {
+	cli, err := e2eGetRedisClient()
+	suite.cli = cli
+	suite.NoError(err)
+}
+
+func (suite *ConfigTestSuite) TearDownTest() {
+	suite.NoError(e2eClearRedis(suite.cli))
+}
+
+func (suite *ConfigTestSuite) TestGetSet() {
+	values, err := suite.cli.ConfigGet("notify-keyspace-events").Result()
+	suite.NoError(err)
+	suite.Equal([]interface{}{"notify-keyspace-events", "AKE"}, values)
+
+	suite.NoError(suite.cli.ConfigSet("notify-keyspace-events", "Kx").Err())
+	values, err = suite.cli.ConfigGet("notify*").Result()
+	suite.NoError(err)
+	suite.Equal([]interface{}{"notify-keyspace-events", "xK"}, values)
+	suite.NoError(suite.cli.ConfigSet("notify-keyspace-events", "KEA").Err())
+
+	suite.NoError(suite.cli.ConfigSet("client-output-buffer-limit", "pubsub 64mb 16mb 30").Err())
+	values, err = suite.cli.ConfigGet("client-output-buffer-limit").Result()
+	suite.NoError(err)
+	suite.Equal([]interface{}{"client-output-buffer-limit", "pubsub 67108864 16777216 30"}, values)
+	suite.NoError(suite.cli.ConfigSet("client-output-buffer-limit", "pubsub 32mb 8mb 60").Err())
+
+	values, err = suite.cli.ConfigGet("*port").Result()
+	suite.NoError(err)
+	suite.Equal([]interface{}{"metrics-port", "", "port", "6380", "rpc-port", "6381"}, values)
+}
+
+func (suite *ConfigTestSuite) TestSetErrors() {
+	err := suite.cli.ConfigSet("port", "7000").Err()
+	suite.EqualError(err, "ERR CONFIG SET failed (possibly related to argument 'port') - can't set immutable config")
+	err = suite.cli.ConfigSet("appendfsync", "sometimes").Err()
+	suite.EqualError(err, "ERR CONFIG SET failed (possibly related to argument 'appendfsync') - argument must be one of always, everysec")
+	err = suite.cli.ConfigSet("no-such-config", "1").Err()
+	suite.EqualError(err, "ERR Unknown option or number of arguments for CONFIG SET - 'no-such-config'")
+
+	values, err := suite.cli.ConfigGet("appendfsync").Result()
+	suite.NoError(err)
+	suite.Equal([]interface{}{"appendfsync", "everysec"}, values)
+}
+
+func (suite *ConfigTestSuite) TestRewriteWithoutFile() {
+	err := suite.cli.ConfigRewrite().Err()
+	suite.EqualError(err, "ERR The server is running without a config file")
+}
+
+func (suite *ConfigTestSuite) TestResetStat() {
+	suite.NoError(suite.cli.ConfigResetStat().Err())
+}
@@ -0,0 +1,146 @@
+package executor_test
+
+import (
+	"github.com/go-redis/redis/v7"
+	"github.com/stretchr/testify/suite"
+	"strings"
+	"testing"
+	"time"
+)
+
+type DatabaseTestSuite struct {
+	suite.Suite
+
+	cli *redis.Client
+}
+
+func TestDatabaseTestSuite(t *testing.T) {
+	suite.Run(t, new(DatabaseTestSuite))
+}
+
+func (suite *DatabaseTestSuite) SetupTest() {
+	cli, err := e2eGetRedisClient()
+	suite.cli = cli
+	suite.NoError(err)
+}
+
+func (suite *DatabaseTestSuite) TearDownTest() {
+	suite.NoError(suite.cli.FlushAll().Err())
+}
+
+func (suite *DatabaseTestSuite) TestSelect() {
+	conn := suite.cli.Conn()
+	defer conn.Close()
+	suite.NoError(suite.cli.Set("dk", "0", 0).Err())
+	suite.NoError(conn.Select(1).Err())
+	suite.Equal(redis.Nil, conn.Get("dk").Err())
+	suite.NoError(conn.Set("dk", "1", 0).Err())
+	suite.Equal([]string{"dk"}, conn.Keys("*").Val())
+	suite.Equal("0", suite.cli.Get("dk").Val())
+	suite.Equal("1", conn.Get("dk").Val())
+	suite.Contains(e2eDo(conn, "CLIENT", "INFO").Val(), "db=1")
+
+	suite.EqualError(conn.Select(16).Err(), "ERR DB index is out of range")
+	suite.EqualError(e2eDo(conn, "SELECT", "x").Err(), "ERR invalid DB index")
+}
+
+func (suite *DatabaseTestSuite) TestMove() {
+	conn := suite.cli.Conn()
+	defer conn.Close()
+	suite.NoError(suite.cli.Set("mk", "v", time.Minute).Err())
+	suite.True(suite.cli.Move("mk", 2).Val())
+	suite.Equal(redis.Nil, suite.cli.Get("mk").Err())
+	suite.False(suite.cli.Move("mk", 2).Val())
+
+	suite.NoError(conn.Select(2).Err())
+	suite.Equal("v", conn.Get("mk").Val())
+	suite.True(conn.TTL("mk").Val() > 0)
+
+	//the destination key is kept
+	suite.NoError(suite.cli.Set("mk", "w", 0).Err())
+	suite.False(suite.cli.Move("mk", 2).Val())
+	suite.Equal("w", suite.cli.Get("mk").Val())
+
+	suite.EqualError(suite.cli.Move("mk", 0).Err(), "ERR source and destination objects are the same")
+	suite.EqualError(suite.cli.Move("mk", 99).Err(), "ERR DB index is out of range")
+}
+
+func (suite *DatabaseTestSuite) TestSwapDB() {
+	conn := suite.cli.Conn()
+	defer conn.Close()
+	suite.NoError(suite.cli.Set("sk", "0", 0).Err())
+	suite.NoError(conn.Select(3).Err())
+	suite.NoError(conn.Set("sk", "3", 0).Err())
+
+	suite.NoError(suite.cli.Do("SWAPDB", "0", "3").Err())
+	suite.Equal("3", suite.cli.Get("sk").Val())
+	suite.Equal("0", conn.Get("sk").Val())
+	suite.Error(suite.cli.Do("SWAPDB", "0", "16").Err())
+}
+
+func (suite *DatabaseTestSuite) TestFlush() {
+	conn := suite.cli.Conn()
+	defer conn.Close()
+	suite.NoError(suite.cli.Set("fk", "0", time.Minute).Err())
+	suite.NoError(conn.Select(4).Err())
+	suite.NoError(conn.Set("fk", "4", 0).Err())
+
+	suite.NoError(conn.FlushDB().Err())
+	suite.Equal(redis.Nil, conn.Get("fk").Err())
+	suite.Equal("0", suite.cli.Get("fk").Val())
+	suite.NoError(conn.Set("fk", "4", 0).Err())
+
+	suite.NoError(suite.cli.FlushAllAsync().Err())
+	suite.Equal(redis.Nil, suite.cli.Get("fk").Err())
+	suite.Equal(redis.Nil, conn.Get("fk").Err())
+	suite.EqualError(suite.cli.Do("FLUSHDB", "NOW").Err(), "ERR syntax error")
+}
+
+func (suite *DatabaseTestSuite) TestTransaction() {
+	conn := suite.cli.Conn()
+	defer conn.Close()
+	_, err := conn.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.Set("tk", "0", 0)
+		pipe.Select(5)
+		pipe.Set("tk", "5", 0)
+		return nil
+	})
+	suite.NoError(err)
+	//the database selected in the transaction stays selected
+	suite.Equal("5", conn.Get("tk").Val())
+	suite.Equal("0", suite.cli.Get("tk").Val())
+
+	pipe := conn.TxPipeline()
+	pipe.Select(99)
+	pipe.Set("tk", "x", 0)
+	_, err = pipe.Exec()
+	suite.Error(err)
+	suite.Equal("5", conn.Get("tk").Val())
+}
+
+func (suite *DatabaseTestSuite) TestNotifyAndInfo() {
+	conn := suite.cli.Conn()
+	defer conn.Close()
+	if isE2ERedis {
+		suite.NoError(suite.cli.ConfigSet("notify-keyspace-events", "KEA").Err())
+	}
+	sub := suite.cli.PSubscribe("__keyspace@6__:*")
+	defer sub.Close()
+	_, err := sub.Receive()
+	suite.NoError(err)
+
+	suite.NoError(conn.Select(6).Err())
+	suite.NoError(conn.Set("nk", "v", 0).Err())
+	msg, err := sub.ReceiveTimeout(time.Second * 3)
+	suite.NoError(err)
+	suite.Equal("__keyspace@6__:nk", msg.(*redis.Message).Channel)
+
+	info := suite.cli.Info("keyspace").Val()
+	var line string
+	for _, l := range strings.Split(info, "\r\n") {
+		if strings.HasPrefix(l, "db6:") {
+			line = l
+		}
+	}
+	suite.Equal("db6:keys=1,expires=0,avg_ttl=0", line)
+}
@@ -3,7 +3,6 @@ package executor
 import (
 	"github.com/joway/loki"
 	"github.com/joway/pidis/storage"
-	"strings"
 )
 
 var (
@@ -13,6 +12,20 @@ var (
 	SHUTDOWN = "SHUTDOWN"
 	QUIT     = "QUIT"
 	SLAVEOF  = "SLAVEOF"
+	CLIENT   = "CLIENT"
+	HELLO    = "HELLO"
+	AUTH     = "AUTH"
+	ACL      = "ACL"
+	CONFIG   = "CONFIG"
+	INFO     = "INFO"
+	SLOWLOG  = "SLOWLOG"
+	LATENCY  = "LATENCY"
+	MONITOR  = "MONITOR"
+	COMMAND  = "COMMAND"
+
+	ENCRYPTION = "ENCRYPTION"
+	BGSAVE     = "BGSAVE"
+	LASTSAVE   = "LASTSAVE"
 
 	//kv
 	GET    = "GET"
@@ -23,41 +36,71 @@ var (
 	EXISTS = "EXISTS"
 	INCR   = "INCR"
 	TTL    = "TTL"
-)
 
-const (
-	TypeSystem = 0
-	TypeRead   = 1
-	TypeWrite  = 2
+	//database
+	SELECT   = "SELECT"
+	MOVE     = "MOVE"
+	SWAPDB   = "SWAPDB"
+	FLUSHDB  = "FLUSHDB"
+	FLUSHALL = "FLUSHALL"
+
+	//transaction
+	MULTI   = "MULTI"
+	EXEC    = "EXEC"
+	DISCARD = "DISCARD"
+	WATCH   = "WATCH"
+	UNWATCH = "UNWATCH"
+
+	//script
+	EVAL    = "EVAL"
+	EVALSHA = "EVALSHA"
+	SCRIPT  = "SCRIPT"
+
+	//function
+	FUNCTION = "FUNCTION"
+	FCALL    = "FCALL"
+	FCALL_RO = "FCALL_RO"
+
+	//pubsub
+	SUBSCRIBE    = "SUBSCRIBE"
+	UNSUBSCRIBE  = "UNSUBSCRIBE"
+	PSUBSCRIBE   = "PSUBSCRIBE"
+	PUNSUBSCRIBE = "PUNSUBSCRIBE"
+	SSUBSCRIBE   = "SSUBSCRIBE"
+	SUNSUBSCRIBE = "SUNSUBSCRIBE"
+	PUBLISH      = "PUBLISH"
+	SPUBLISH     = "SPUBLISH"
+	PUBSUB       = "PUBSUB"
 )
 
 var logger = loki.New("pidis:executor")
 
+// New returns the executor of cmd, nil if cmd is unknown or handled by the database
 func New(cmd string) Executor {
-	switch strings.ToUpper(cmd) {
-	case QUIT, SHUTDOWN, PING, ECHO, SLAVEOF:
-		return SystemExecutor{BaseExecutor{cmd: cmd, kind: TypeSystem}}
-	case GET, KEYS, TTL, EXISTS:
-		return KVExecutor{BaseExecutor{cmd: cmd, kind: TypeRead}}
-	case SET, SETNX, DEL, INCR:
-		return KVExecutor{BaseExecutor{cmd: cmd, kind: TypeWrite}}
-	default:
-		return SystemExecutor{BaseExecutor{cmd: cmd, kind: TypeSystem}}
+	command := Lookup(cmd)
+	if command == nil || command.executor == nil {
+		return nil
 	}
+	return command.executor(BaseExecutor{cmd: command.Name, command: command})
 }
 
 type Executor interface {
 	IsWrite() bool
+	KeyArgs(args [][]byte) [][]byte
 	Exec(store storage.Storage, args [][]byte) (*Result, error)
 }
 
 type BaseExecutor struct {
 	Executor
 
-	cmd  string
-	kind int
+	cmd     string
+	command *Command
 }
 
 func (c BaseExecutor) IsWrite() bool {
-	return c.kind == TypeWrite
+	return c.command.IsWrite()
+}
+
+func (c BaseExecutor) KeyArgs(args [][]byte) [][]byte {
+	return c.command.Keys(args)
 }
@@ -1,6 +1,7 @@
 package executor_test
 
 import (
+	"bufio"
 	"context"
 	"github.com/akutz/memconn"
 	"github.com/go-redis/redis/v7"
@@ -8,13 +9,16 @@ import (
 	"github.com/joway/pidis/db"
 	"github.com/joway/pidis/util"
 	"github.com/tidwall/redcon"
+	"io"
 	"net"
 	"os"
+	"time"
 )
 
 var e2eEndpoint = util.EnvGet("E2E_ENDPOINT", "0.0.0.0:10001")
 var isE2ERedis = os.Getenv("E2E_REDIS_ENABLE") != ""
 var e2eListener net.Listener
+var e2eDatabase *db.Database
 
 func init() {
 	//e2e tests original redis server
@@ -24,12 +28,13 @@ func init() {
 
 	e2eListener, _ = memconn.Listen("memu", "mem")
 	dir := "/tmp/pidis/e2e"
-	database, _ := db.New(db.Options{DBDir: dir})
+	e2eDatabase, _ = db.New(db.Options{DBDir: dir, NotifyKeyspaceEvents: "KEA"})
+	e2eDatabase.Run()
 	redisServer := redcon.NewServer(
 		"",
-		db.GetRedisCmdHandler(database),
-		nil,
-		nil,
+		db.GetRedisCmdHandler(e2eDatabase),
+		db.GetRedisAcceptHandler(e2eDatabase),
+		db.GetRedisClosedHandler(e2eDatabase),
 	)
 	go func() {
 		if err := redisServer.Serve(e2eListener); err != nil {
@@ -62,3 +67,67 @@ func e2eGetRedisClient() (*redis.Client, error) {
 	_, err := client.Ping().Result()
 	return client, err
 }
+
+func e2eDo(conn *redis.Conn, args ...interface{}) *redis.Cmd {
+	cmd := redis.NewCmd(args...)
+	_ = conn.Process(cmd)
+	return cmd
+}
+
+// e2eEventually polls condition until it holds or timeout elapses, one call at a time unlike
+// the Eventually of testify, which may still be calling it once it has returned
+func e2eEventually(condition func() bool, timeout, tick time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(tick)
+	}
+	return true
+}
+
+// e2eRawConn speaks the redis protocol directly, for replies go-redis can't parse
+type e2eRawConn struct {
+	net.Conn
+
+	reader *bufio.Reader
+}
+
+func e2eDialRaw() (*e2eRawConn, error) {
+	var (
+		conn net.Conn
+		err  error
+	)
+	if isE2ERedis {
+		conn, err = net.Dial("tcp", e2eEndpoint)
+	} else {
+		conn, err = memconn.Dial("memu", "mem")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &e2eRawConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+func (c *e2eRawConn) Send(args ...string) error {
+	output := redcon.AppendArray(nil, len(args))
+	for _, arg := range args {
+		output = redcon.AppendBulkString(output, arg)
+	}
+	_, err := c.Write(output)
+	return err
+}
+
+// Read reads exactly n bytes of replies
+func (c *e2eRawConn) Read(n int) (string, error) {
+	_ = c.SetReadDeadline(time.Now().Add(time.Second * 3))
+	buf := make([]byte, n)
+	_, err := io.ReadFull(c.reader, buf)
+	return string(buf), err
+}
+
+func (c *e2eRawConn) ReadLine() (string, error) {
+	_ = c.SetReadDeadline(time.Now().Add(time.Second * 3))
+	return c.reader.ReadString('\n')
+}
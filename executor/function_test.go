@@ -0,0 +1,102 @@
+package executor_test
+
+import (
+	"github.com/go-redis/redis/v7"
+	"github.com/stretchr/testify/suite"
+	"testing"
+)
+
+const e2eLibrary = `#!lua name=e2elib
+redis.register_function('e2e_set', function(keys, args)
+	return redis.call('SET', keys[1], args[1])
+end)
+redis.register_function{
+	function_name = 'e2e_get',
+	callback = function(keys, args) return redis.call('GET', keys[1]) end,
+	flags = {'no-writes'},
+}
+redis.register_function{
+	function_name = 'e2e_bad',
+	callback = function(keys, args) return redis.call('SET', keys[1], 'x') end,
+	flags = {'no-writes'},
+}
+`
+
+type FunctionTestSuite struct {
+	suite.Suite
+
+	cli *redis.Client
+}
+
+func TestFunctionTestSuite(t *testing.T) {
+	suite.Run(t, new(FunctionTestSuite))
+}
+
+func (suite *FunctionTestSuite) SetupTest() {
+	cli, err := e2eGetRedisClient()
+	suite.cli = cli
+	suite.NoError(err)
+	suite.NoError(cli.Do("function", "flush").Err())
+}
+
+func (suite *FunctionTestSuite) TearDownTest() {
+	suite.NoError(suite.cli.Do("function", "flush").Err())
+	suite.NoError(e2eClearRedis(suite.cli))
+}
+
+func (suite *FunctionTestSuite) TestLoadAndCall() {
+	name, err := suite.cli.Do("function", "load", e2eLibrary).Result()
+	suite.NoError(err)
+	suite.Equal("e2elib", name)
+
+	err = suite.cli.Do("function", "load", e2eLibrary).Err()
+	suite.Error(err)
+	err = suite.cli.Do("function", "load", "replace", e2eLibrary).Err()
+	suite.NoError(err)
+
+	result, err := suite.cli.Do("fcall", "e2e_set", 1, "k1", "v1").Result()
+	suite.NoError(err)
+	suite.Equal("OK", result)
+	result, err = suite.cli.Do("fcall_ro", "e2e_get", 1, "k1").Result()
+	suite.NoError(err)
+	suite.Equal("v1", result)
+
+	//write inside read-only function
+	err = suite.cli.Do("fcall", "e2e_bad", 1, "k1").Err()
+	suite.Error(err)
+	//function without no-writes flag
+	err = suite.cli.Do("fcall_ro", "e2e_set", 1, "k1", "v2").Err()
+	suite.Error(err)
+	err = suite.cli.Do("fcall", "e2e_missing", 0).Err()
+	suite.Error(err)
+
+	//a function has to be named
+	err = suite.cli.Do("function", "load", "#!lua name=e2enoname\nredis.register_function{callback=function() return 1 end}").Err()
+	suite.Error(err)
+	err = suite.cli.Do("fcall", "nil", 0).Err()
+	suite.Error(err)
+}
+
+func (suite *FunctionTestSuite) TestListDumpRestore() {
+	suite.NoError(suite.cli.Do("function", "load", e2eLibrary).Err())
+
+	libs, err := suite.cli.Do("function", "list", "libraryname", "e2e*").Result()
+	suite.NoError(err)
+	suite.Len(libs, 1)
+	lib := libs.([]interface{})[0].([]interface{})
+	suite.Equal("e2elib", lib[1])
+	suite.Len(lib[5], 3)
+
+	payload, err := suite.cli.Do("function", "dump").Result()
+	suite.NoError(err)
+	suite.NoError(suite.cli.Do("function", "delete", "e2elib").Err())
+	suite.Error(suite.cli.Do("function", "delete", "e2elib").Err())
+
+	suite.NoError(suite.cli.Do("function", "restore", payload).Err())
+	suite.Error(suite.cli.Do("function", "restore", payload).Err())
+	suite.NoError(suite.cli.Do("function", "restore", payload, "replace").Err())
+
+	result, err := suite.cli.Do("fcall", "e2e_set", 1, "k1", "v1").Result()
+	suite.NoError(err)
+	suite.Equal("OK", result)
+}
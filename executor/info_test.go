@@ -0,0 +1,63 @@
+package executor_test
+
+import (
+	"github.com/go-redis/redis/v7"
+	"github.com/stretchr/testify/suite"
+	"strings"
+	"testing"
+)
+
+type InfoTestSuite struct {
+	suite.Suite
+
+	cli *redis.Client
+}
+
+func TestInfoTestSuite(t *testing.T) {
+	suite.Run(t, new(InfoTestSuite))
+}
+
+func (suite *InfoTestSuite) SetupTest() {
+	cli, err := e2eGetRedisClient()
+	suite.cli = cli
+	suite.NoError(err)
+}
+
+func (suite *InfoTestSuite) TearDownTest() {
+	suite.NoError(e2eClearRedis(suite.cli))
+}
+
+func (suite *InfoTestSuite) TestDefaultSections() {
+	info, err := suite.cli.Info().Result()
+	suite.NoError(err)
+	for _, section := range []string{"Server", "Clients", "Memory", "Persistence", "Stats", "Replication"} {
+		suite.Contains(info, "# "+section+"\r\n")
+	}
+	suite.NotContains(info, "# Commandstats")
+	suite.Contains(info, "role:master\r\n")
+	suite.Contains(info, "aof_enabled:1\r\n")
+}
+
+func (suite *InfoTestSuite) TestSections() {
+	suite.NoError(suite.cli.Set("info:k1", "v", 0).Err())
+	suite.NoError(suite.cli.Get("info:k1").Err())
+	suite.Equal(redis.Nil, suite.cli.Get("info:missing").Err())
+
+	info, err := suite.cli.Info("keyspace").Result()
+	suite.NoError(err)
+	suite.True(strings.HasPrefix(info, "# Keyspace\r\ndb0:keys="), info)
+	suite.NotContains(info, "# Server")
+
+	info, err = suite.cli.Info("commandstats").Result()
+	suite.NoError(err)
+	suite.Regexp(`cmdstat_get:calls=\d+,usec=\d+,usec_per_call=[\d.]+,rejected_calls=0,failed_calls=0`, info)
+
+	info, err = suite.cli.Info("stats").Result()
+	suite.NoError(err)
+	suite.Regexp(`keyspace_hits:[1-9]\d*\r\n`, info)
+	suite.Regexp(`keyspace_misses:[1-9]\d*\r\n`, info)
+
+	info, err = suite.cli.Info("everything").Result()
+	suite.NoError(err)
+	suite.Contains(info, "# Commandstats\r\n")
+}
@@ -0,0 +1,64 @@
+package executor_test
+
+import (
+	"github.com/go-redis/redis/v7"
+	"github.com/stretchr/testify/suite"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+)
+
+type MetricsTestSuite struct {
+	suite.Suite
+
+	cli *redis.Client
+}
+
+func TestMetricsTestSuite(t *testing.T) {
+	suite.Run(t, new(MetricsTestSuite))
+}
+
+func (suite *MetricsTestSuite) SetupTest() {
+	if isE2ERedis {
+		suite.T().Skip("metrics are served by pidis only")
+	}
+	cli, err := e2eGetRedisClient()
+	suite.cli = cli
+	suite.NoError(err)
+}
+
+func (suite *MetricsTestSuite) TearDownTest() {
+	suite.NoError(e2eClearRedis(suite.cli))
+}
+
+func (suite *MetricsTestSuite) scrape() string {
+	server := httptest.NewServer(e2eDatabase.MetricsHandler())
+	defer server.Close()
+	resp, err := server.Client().Get(server.URL)
+	suite.Require().NoError(err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	suite.NoError(err)
+	return string(body)
+}
+
+func (suite *MetricsTestSuite) TestScrape() {
+	suite.NoError(suite.cli.Set("metrics:k", "v", 0).Err())
+	suite.NoError(suite.cli.Get("metrics:k").Err())
+	suite.Error(suite.cli.Incr("metrics:k").Err())
+	suite.Error(suite.cli.Do("EXEC").Err())
+	suite.Error(suite.cli.Do("no-such-command").Err())
+
+	metrics := suite.scrape()
+	suite.Regexp(`pidis_commands_total\{command="get"\} [1-9]`, metrics)
+	suite.Regexp(`pidis_command_duration_seconds_count\{command="set"\} [1-9]`, metrics)
+	suite.Regexp(`pidis_command_errors_total\{command="exec",error="exec_without_multi"\} [1-9]`, metrics)
+	//errors replied as output aren't registered
+	suite.Regexp(`pidis_command_errors_total\{command="incr",error="other"\} [1-9]`, metrics)
+	suite.NotContains(metrics, "no-such-command")
+	suite.Regexp(`pidis_connected_clients [1-9]`, metrics)
+	suite.Regexp(`pidis_aof_written_bytes_total [1-9]`, metrics)
+	suite.Contains(metrics, "pidis_aof_flush_duration_seconds_bucket")
+	suite.Contains(metrics, "pidis_replication_connected_followers 0")
+	suite.Contains(metrics, "pidis_badger_puts_total")
+}
@@ -0,0 +1,81 @@
+package executor_test
+
+import (
+	"github.com/go-redis/redis/v7"
+	"github.com/stretchr/testify/suite"
+	"testing"
+)
+
+type MonitorTestSuite struct {
+	suite.Suite
+
+	cli *redis.Client
+}
+
+func TestMonitorTestSuite(t *testing.T) {
+	suite.Run(t, new(MonitorTestSuite))
+}
+
+func (suite *MonitorTestSuite) SetupTest() {
+	cli, err := e2eGetRedisClient()
+	suite.cli = cli
+	suite.NoError(err)
+}
+
+func (suite *MonitorTestSuite) TearDownTest() {
+	suite.NoError(e2eClearRedis(suite.cli))
+}
+
+func (suite *MonitorTestSuite) monitor() *e2eRawConn {
+	conn, err := e2eDialRaw()
+	suite.Require().NoError(err)
+	suite.NoError(conn.Send("MONITOR"))
+	line, err := conn.ReadLine()
+	suite.NoError(err)
+	suite.Equal("+OK\r\n", line)
+	return conn
+}
+
+func (suite *MonitorTestSuite) TestMonitor() {
+	conn := suite.monitor()
+	defer conn.Close()
+
+	suite.NoError(suite.cli.Set("monitor:k", "a \"quoted\"\nvalue", 0).Err())
+	line, err := conn.ReadLine()
+	suite.NoError(err)
+	suite.Regexp(`^\+\d+\.\d{6} \[0 \S+\] "set" "monitor:k" "a \\"quoted\\"\\nvalue"\r\n$`, line)
+
+	suite.NoError(suite.cli.Get("monitor:k").Err())
+	line, err = conn.ReadLine()
+	suite.NoError(err)
+	suite.Regexp(`"get" "monitor:k"\r\n$`, line)
+}
+
+func (suite *MonitorTestSuite) TestRedactAuth() {
+	conn := suite.monitor()
+	defer conn.Close()
+
+	suite.cli.Do("AUTH", "default", "secret")
+	line, err := conn.ReadLine()
+	suite.NoError(err)
+	suite.Regexp(`"AUTH" "\(redacted\)" "\(redacted\)"\r\n$`, line)
+	suite.NotContains(line, "secret")
+
+	suite.cli.Do("HELLO", "2", "AUTH", "default", "secret", "SETNAME", "monitored")
+	line, err = conn.ReadLine()
+	suite.NoError(err)
+	suite.Regexp(`"HELLO" "2" "AUTH" "\(redacted\)" "\(redacted\)" "SETNAME" "monitored"\r\n$`, line)
+}
+
+func (suite *MonitorTestSuite) TestUnmonitoredAfterClose() {
+	conn := suite.monitor()
+	suite.NoError(conn.Close())
+	suite.NoError(suite.cli.Ping().Err())
+
+	conn = suite.monitor()
+	defer conn.Close()
+	suite.NoError(suite.cli.Echo("after").Err())
+	line, err := conn.ReadLine()
+	suite.NoError(err)
+	suite.Regexp(`"echo" "after"\r\n$`, line)
+}
@@ -0,0 +1,71 @@
+package executor_test
+
+import (
+	"github.com/go-redis/redis/v7"
+	"github.com/stretchr/testify/suite"
+	"testing"
+	"time"
+)
+
+type NotifyTestSuite struct {
+	suite.Suite
+
+	cli *redis.Client
+}
+
+func TestNotifyTestSuite(t *testing.T) {
+	suite.Run(t, new(NotifyTestSuite))
+}
+
+func (suite *NotifyTestSuite) SetupTest() {
+	cli, err := e2eGetRedisClient()
+	suite.cli = cli
+	suite.NoError(err)
+	if isE2ERedis {
+		suite.NoError(cli.ConfigSet("notify-keyspace-events", "KEA").Err())
+	}
+}
+
+func (suite *NotifyTestSuite) TearDownTest() {
+	suite.NoError(e2eClearRedis(suite.cli))
+}
+
+func (suite *NotifyTestSuite) receive(sub *redis.PubSub) *redis.Message {
+	msg, err := sub.ReceiveTimeout(time.Second * 3)
+	suite.NoError(err)
+	m, ok := msg.(*redis.Message)
+	suite.Require().True(ok)
+	return m
+}
+
+func (suite *NotifyTestSuite) TestKeyspaceEvents() {
+	sub := suite.cli.PSubscribe("__keyspace@0__:nk*")
+	defer sub.Close()
+	_, err := sub.Receive()
+	suite.NoError(err)
+
+	suite.NoError(suite.cli.Set("nk1", "v", 0).Err())
+	suite.NoError(suite.cli.Incr("nk2").Err())
+	suite.NoError(suite.cli.Del("nk1", "nk3").Err())
+
+	msg := suite.receive(sub)
+	suite.Equal("__keyspace@0__:nk1", msg.Channel)
+	suite.Equal("set", msg.Payload)
+	msg = suite.receive(sub)
+	suite.Equal("__keyspace@0__:nk2", msg.Channel)
+	suite.Equal("incrby", msg.Payload)
+	msg = suite.receive(sub)
+	suite.Equal("__keyspace@0__:nk1", msg.Channel)
+	suite.Equal("del", msg.Payload)
+}
+
+func (suite *NotifyTestSuite) TestExpiredEvents() {
+	sub := suite.cli.Subscribe("__keyevent@0__:expired")
+	defer sub.Close()
+	_, err := sub.Receive()
+	suite.NoError(err)
+
+	suite.NoError(suite.cli.Set("ek1", "v", time.Millisecond*200).Err())
+	msg := suite.receive(sub)
+	suite.Equal("ek1", msg.Payload)
+}
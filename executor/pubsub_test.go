@@ -0,0 +1,105 @@
+package executor_test
+
+import (
+	"github.com/go-redis/redis/v7"
+	"github.com/stretchr/testify/suite"
+	"testing"
+	"time"
+)
+
+type PubSubTestSuite struct {
+	suite.Suite
+
+	cli *redis.Client
+}
+
+func TestPubSubTestSuite(t *testing.T) {
+	suite.Run(t, new(PubSubTestSuite))
+}
+
+func (suite *PubSubTestSuite) SetupTest() {
+	cli, err := e2eGetRedisClient()
+	suite.cli = cli
+	suite.NoError(err)
+}
+
+func (suite *PubSubTestSuite) TearDownTest() {
+	suite.NoError(e2eClearRedis(suite.cli))
+}
+
+func (suite *PubSubTestSuite) receive(sub *redis.PubSub) interface{} {
+	msg, err := sub.ReceiveTimeout(time.Second)
+	suite.NoError(err)
+	return msg
+}
+
+func (suite *PubSubTestSuite) TestSubscribe() {
+	sub := suite.cli.Subscribe("ch1", "ch2")
+	defer sub.Close()
+	suite.Equal(&redis.Subscription{Kind: "subscribe", Channel: "ch1", Count: 1}, suite.receive(sub))
+	suite.Equal(&redis.Subscription{Kind: "subscribe", Channel: "ch2", Count: 2}, suite.receive(sub))
+
+	receivers, err := suite.cli.Publish("ch1", "hello").Result()
+	suite.NoError(err)
+	suite.EqualValues(1, receivers)
+	msg := suite.receive(sub).(*redis.Message)
+	suite.Equal("ch1", msg.Channel)
+	suite.Equal("hello", msg.Payload)
+
+	receivers, err = suite.cli.Publish("ch3", "hello").Result()
+	suite.NoError(err)
+	suite.EqualValues(0, receivers)
+
+	suite.NoError(sub.Ping("p"))
+	suite.Equal(&redis.Pong{Payload: "p"}, suite.receive(sub))
+
+	suite.NoError(sub.Unsubscribe("ch1"))
+	suite.Equal(&redis.Subscription{Kind: "unsubscribe", Channel: "ch1", Count: 1}, suite.receive(sub))
+	receivers, err = suite.cli.Publish("ch1", "hello").Result()
+	suite.NoError(err)
+	suite.EqualValues(0, receivers)
+}
+
+func (suite *PubSubTestSuite) TestPSubscribe() {
+	sub := suite.cli.PSubscribe("news.*")
+	defer sub.Close()
+	suite.Equal(&redis.Subscription{Kind: "psubscribe", Channel: "news.*", Count: 1}, suite.receive(sub))
+
+	receivers, err := suite.cli.Publish("news.tech", "hello").Result()
+	suite.NoError(err)
+	suite.EqualValues(1, receivers)
+	msg := suite.receive(sub).(*redis.Message)
+	suite.Equal("news.*", msg.Pattern)
+	suite.Equal("news.tech", msg.Channel)
+	suite.Equal("hello", msg.Payload)
+
+	numPat, err := suite.cli.PubSubNumPat().Result()
+	suite.NoError(err)
+	suite.EqualValues(1, numPat)
+}
+
+func (suite *PubSubTestSuite) TestIntrospection() {
+	sub := suite.cli.Subscribe("intro.a", "intro.b")
+	defer sub.Close()
+	suite.receive(sub)
+	suite.receive(sub)
+
+	channels, err := suite.cli.PubSubChannels("intro.*").Result()
+	suite.NoError(err)
+	suite.Equal([]string{"intro.a", "intro.b"}, channels)
+
+	numSub, err := suite.cli.PubSubNumSub("intro.a", "intro.c").Result()
+	suite.NoError(err)
+	suite.Equal(map[string]int64{"intro.a": 1, "intro.c": 0}, numSub)
+}
+
+func (suite *PubSubTestSuite) TestSubscribedContext() {
+	conn := suite.cli.Conn()
+	defer conn.Close()
+	suite.NoError(e2eDo(conn, "subscribe", "ctx").Err())
+	err := e2eDo(conn, "get", "k1").Err()
+	suite.Error(err)
+	suite.Contains(err.Error(), "only (P|S)SUBSCRIBE")
+	suite.NoError(e2eDo(conn, "unsubscribe").Err())
+	suite.Equal(redis.Nil, e2eDo(conn, "get", "k1").Err())
+}
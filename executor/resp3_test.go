@@ -0,0 +1,114 @@
+package executor_test
+
+import (
+	"github.com/go-redis/redis/v7"
+	"github.com/stretchr/testify/suite"
+	"strings"
+	"testing"
+)
+
+type RESP3TestSuite struct {
+	suite.Suite
+
+	cli  *redis.Client
+	conn *e2eRawConn
+}
+
+func TestRESP3TestSuite(t *testing.T) {
+	suite.Run(t, new(RESP3TestSuite))
+}
+
+func (suite *RESP3TestSuite) SetupTest() {
+	cli, err := e2eGetRedisClient()
+	suite.cli = cli
+	suite.NoError(err)
+	suite.conn, err = e2eDialRaw()
+	suite.Require().NoError(err)
+}
+
+func (suite *RESP3TestSuite) TearDownTest() {
+	suite.NoError(suite.conn.Close())
+	suite.NoError(e2eClearRedis(suite.cli))
+}
+
+func (suite *RESP3TestSuite) expect(reply string) {
+	output, err := suite.conn.Read(len(reply))
+	suite.NoError(err)
+	suite.Equal(reply, output)
+}
+
+func (suite *RESP3TestSuite) hello3() {
+	suite.NoError(suite.conn.Send("hello", "3"))
+	line, err := suite.conn.ReadLine()
+	suite.NoError(err)
+	suite.Equal("%7\r\n", line)
+	//skip the properties of the server
+	for i := 0; i < 14; i++ {
+		line, err = suite.conn.ReadLine()
+		suite.NoError(err)
+		if strings.HasPrefix(line, "$") {
+			_, err = suite.conn.ReadLine()
+			suite.NoError(err)
+		}
+	}
+}
+
+func (suite *RESP3TestSuite) TestHello() {
+	suite.NoError(suite.conn.Send("hello", "4"))
+	suite.expect("-NOPROTO unsupported protocol version\r\n")
+
+	suite.NoError(suite.conn.Send("get", "r3k1"))
+	suite.expect("$-1\r\n")
+
+	suite.hello3()
+	suite.NoError(suite.conn.Send("get", "r3k1"))
+	suite.expect("_\r\n")
+	suite.NoError(suite.conn.Send("multi"))
+	suite.expect("+OK\r\n")
+	suite.NoError(suite.conn.Send("get", "r3k1"))
+	suite.expect("+QUEUED\r\n")
+	suite.NoError(suite.conn.Send("exec"))
+	suite.expect("*1\r\n_\r\n")
+
+	suite.NoError(suite.conn.Send("hello", "2"))
+	line, err := suite.conn.ReadLine()
+	suite.NoError(err)
+	suite.Equal("*14\r\n", line)
+}
+
+func (suite *RESP3TestSuite) TestPubSub() {
+	suite.hello3()
+	suite.NoError(suite.conn.Send("subscribe", "r3ch"))
+	suite.expect(">3\r\n$9\r\nsubscribe\r\n$4\r\nr3ch\r\n:1\r\n")
+
+	//RESP3 clients can issue any command while subscribed
+	suite.NoError(suite.conn.Send("get", "r3k1"))
+	suite.expect("_\r\n")
+	suite.NoError(suite.conn.Send("ping"))
+	suite.expect("+PONG\r\n")
+
+	suite.NoError(suite.cli.Publish("r3ch", "hello").Err())
+	suite.expect(">3\r\n$7\r\nmessage\r\n$4\r\nr3ch\r\n$5\r\nhello\r\n")
+}
+
+func (suite *RESP3TestSuite) TestTracking() {
+	suite.hello3()
+	suite.NoError(suite.conn.Send("client", "tracking", "on"))
+	suite.expect("+OK\r\n")
+	suite.NoError(suite.conn.Send("client", "trackinginfo"))
+	suite.expect("%3\r\n$5\r\nflags\r\n~1\r\n$2\r\non\r\n$8\r\nredirect\r\n:0\r\n$8\r\nprefixes\r\n*0\r\n")
+
+	suite.NoError(suite.conn.Send("get", "r3k2"))
+	suite.expect("_\r\n")
+	suite.NoError(suite.cli.Set("r3k2", "v", 0).Err())
+	suite.expect(">2\r\n$10\r\ninvalidate\r\n*1\r\n$4\r\nr3k2\r\n")
+}
+
+func (suite *RESP3TestSuite) TestVerbatim() {
+	suite.hello3()
+	suite.NoError(suite.conn.Send("info", "clients"))
+	line, err := suite.conn.ReadLine()
+	suite.NoError(err)
+	suite.True(strings.HasPrefix(line, "="), line)
+	suite.expect("txt:# Clients\r\n")
+}
@@ -6,6 +6,10 @@ type Result struct {
 	err    error
 }
 
+func NewResult(output []byte) *Result {
+	return &Result{output: output}
+}
+
 func (r Result) Err() error {
 	return r.err
 }
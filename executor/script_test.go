@@ -0,0 +1,107 @@
+package executor_test
+
+import (
+	"github.com/go-redis/redis/v7"
+	"github.com/stretchr/testify/suite"
+	"testing"
+	"time"
+)
+
+type ScriptTestSuite struct {
+	suite.Suite
+
+	cli *redis.Client
+}
+
+func TestScriptTestSuite(t *testing.T) {
+	suite.Run(t, new(ScriptTestSuite))
+}
+
+func (suite *ScriptTestSuite) SetupTest() {
+	cli, err := e2eGetRedisClient()
+	suite.cli = cli
+	suite.NoError(err)
+	suite.NoError(cli.ScriptFlush().Err())
+}
+
+func (suite *ScriptTestSuite) TearDownTest() {
+	suite.NoError(e2eClearRedis(suite.cli))
+}
+
+func (suite *ScriptTestSuite) TestEval() {
+	result, err := suite.cli.Eval("return {KEYS[1], ARGV[1], 10, true, false}", []string{"k"}, "v").Result()
+	suite.NoError(err)
+	suite.Equal([]interface{}{"k", "v", int64(10), int64(1), nil}, result)
+
+	result, err = suite.cli.Eval(`
+		redis.call("SET", KEYS[1], ARGV[1])
+		return redis.call("INCR", KEYS[1])
+	`, []string{"k1"}, "10").Result()
+	suite.NoError(err)
+	suite.Equal(int64(11), result)
+
+	val, err := suite.cli.Get("k1").Result()
+	suite.NoError(err)
+	suite.Equal("11", val)
+
+	result, err = suite.cli.Eval("return redis.call('GET', 'kn')", nil).Result()
+	suite.Equal(redis.Nil, err)
+	suite.Nil(result)
+}
+
+func (suite *ScriptTestSuite) TestEvalError() {
+	suite.NoError(suite.cli.Set("k1", "x", 0).Err())
+
+	_, err := suite.cli.Eval("return redis.call('INCR', KEYS[1])", []string{"k1"}).Result()
+	suite.Error(err)
+
+	result, err := suite.cli.Eval("return redis.pcall('INCR', KEYS[1])", []string{"k1"}).Result()
+	suite.Error(err)
+	suite.Nil(result)
+
+	_, err = suite.cli.Eval("return redis.call('EVAL', 'return 1', 0)", nil).Result()
+	suite.Error(err)
+
+	_, err = suite.cli.Eval("return +", nil).Result()
+	suite.Error(err)
+
+	result, err = suite.cli.Eval("return redis.status_reply('DONE')", nil).Result()
+	suite.NoError(err)
+	suite.Equal("DONE", result)
+}
+
+func (suite *ScriptTestSuite) TestEvalPublish() {
+	sub := suite.cli.Subscribe("ch1")
+	defer sub.Close()
+	_, err := sub.ReceiveTimeout(time.Second)
+	suite.NoError(err)
+
+	result, err := suite.cli.Eval("return redis.call('PUBLISH', KEYS[1], ARGV[1])", []string{"ch1"}, "hello").Result()
+	suite.NoError(err)
+	suite.Equal(int64(1), result)
+	msg, err := sub.ReceiveTimeout(time.Second)
+	suite.NoError(err)
+	suite.Equal(&redis.Message{Channel: "ch1", Payload: "hello"}, msg)
+}
+
+func (suite *ScriptTestSuite) TestEvalSha() {
+	script := "return redis.call('SET', KEYS[1], ARGV[1])"
+	sha, err := suite.cli.ScriptLoad(script).Result()
+	suite.NoError(err)
+	suite.Equal("d8f2fad9f8e86a53d2a6ebd960b33c4972cacc37", sha)
+
+	exists, err := suite.cli.ScriptExists(sha, "ffffffffffffffffffffffffffffffffffffffff").Result()
+	suite.NoError(err)
+	suite.Equal([]bool{true, false}, exists)
+
+	result, err := suite.cli.EvalSha(sha, []string{"k1"}, "v").Result()
+	suite.NoError(err)
+	suite.Equal("OK", result)
+
+	suite.NoError(suite.cli.ScriptFlush().Err())
+	_, err = suite.cli.EvalSha(sha, []string{"k1"}, "v").Result()
+	suite.Error(err)
+
+	err = suite.cli.ScriptKill().Err()
+	suite.Error(err)
+}
@@ -0,0 +1,140 @@
+package executor_test
+
+import (
+	"github.com/go-redis/redis/v7"
+	"github.com/joway/pidis/db"
+	"github.com/stretchr/testify/suite"
+	"strings"
+	"testing"
+	"time"
+)
+
+type SlowLogTestSuite struct {
+	suite.Suite
+
+	cli *redis.Client
+}
+
+func TestSlowLogTestSuite(t *testing.T) {
+	suite.Run(t, new(SlowLogTestSuite))
+}
+
+func (suite *SlowLogTestSuite) SetupTest() {
+	cli, err := e2eGetRedisClient()
+	suite.cli = cli
+	suite.NoError(err)
+	suite.NoError(suite.cli.Do("SLOWLOG", "RESET").Err())
+	suite.NoError(suite.cli.Do("LATENCY", "RESET").Err())
+}
+
+func (suite *SlowLogTestSuite) TearDownTest() {
+	suite.NoError(suite.cli.ConfigSet("slowlog-log-slower-than", "10000").Err())
+	suite.NoError(suite.cli.ConfigSet("slowlog-max-len", "128").Err())
+	suite.NoError(suite.cli.ConfigSet("latency-monitor-threshold", "0").Err())
+	suite.NoError(e2eClearRedis(suite.cli))
+}
+
+func (suite *SlowLogTestSuite) TestSlowLog() {
+	suite.NoError(suite.cli.Do("HELLO", "2", "SETNAME", "slowpoke").Err())
+	suite.NoError(suite.cli.ConfigSet("slowlog-log-slower-than", "0").Err())
+	suite.NoError(suite.cli.Set("slowlog:k", strings.Repeat("v", 200), 0).Err())
+	suite.NoError(suite.cli.Get("slowlog:k").Err())
+
+	entries, err := suite.cli.Do("SLOWLOG", "GET", "1").Result()
+	suite.NoError(err)
+	suite.Len(entries, 1)
+	entry := entries.([]interface{})[0].([]interface{})
+	suite.Len(entry, 6)
+	suite.Equal([]interface{}{"get", "slowlog:k"}, entry[3])
+	suite.NotEmpty(entry[4])
+	suite.Equal("slowpoke", entry[5])
+
+	entries, err = suite.cli.Do("SLOWLOG", "GET", "-1").Result()
+	suite.NoError(err)
+	set := slowLogEntry(entries, "set")
+	suite.Require().NotNil(set)
+	suite.Equal(strings.Repeat("v", 128)+"... (72 more bytes)", set[3].([]interface{})[2])
+
+	//transactions are recorded as their EXEC, commands run by the connection too
+	pipe := suite.cli.TxPipeline()
+	pipe.Incr("slowlog:n")
+	_, err = pipe.Exec()
+	suite.NoError(err)
+	suite.NoError(suite.cli.ConfigGet("slowlog-max-len").Err())
+	entries, err = suite.cli.Do("SLOWLOG", "GET", "-1").Result()
+	suite.NoError(err)
+	suite.NotNil(slowLogEntry(entries, "exec"))
+	suite.NotNil(slowLogEntry(entries, "config"))
+	suite.Nil(slowLogEntry(entries, "incr"))
+
+	suite.NoError(suite.cli.ConfigSet("slowlog-max-len", "2").Err())
+	for i := 0; i < 4; i++ {
+		suite.NoError(suite.cli.Ping().Err())
+	}
+	n, err := suite.cli.Do("SLOWLOG", "LEN").Int64()
+	suite.NoError(err)
+	suite.EqualValues(2, n)
+
+	suite.NoError(suite.cli.ConfigSet("slowlog-log-slower-than", "-1").Err())
+	suite.NoError(suite.cli.Do("SLOWLOG", "RESET").Err())
+	suite.NoError(suite.cli.Ping().Err())
+	n, err = suite.cli.Do("SLOWLOG", "LEN").Int64()
+	suite.NoError(err)
+	suite.EqualValues(0, n)
+
+	suite.Error(suite.cli.Do("SLOWLOG", "GET", "-2").Err())
+	suite.Error(suite.cli.Do("SLOWLOG", "NOPE").Err())
+}
+
+func (suite *SlowLogTestSuite) TestLatency() {
+	require := suite.Require()
+	doctor, err := suite.cli.Do("LATENCY", "DOCTOR").String()
+	require.NoError(err)
+	suite.Contains(doctor, "disabled")
+
+	require.NoError(suite.cli.ConfigSet("latency-monitor-threshold", "1").Err())
+	//a slow command is simulated so the sample doesn't depend on the speed of the machine
+	if isE2ERedis {
+		require.NoError(suite.cli.Do("DEBUG", "SLEEP", "0.01").Err())
+	} else {
+		e2eDatabase.LatencyMonitor().Observe(db.LatencyCommand, 10*time.Millisecond)
+	}
+
+	latest, err := suite.cli.Do("LATENCY", "LATEST").Result()
+	require.NoError(err)
+	var command []interface{}
+	for _, event := range latest.([]interface{}) {
+		if e := event.([]interface{}); e[0] == "command" {
+			command = e
+		}
+	}
+	require.NotNil(command)
+	require.Len(command, 4)
+	suite.True(command[2].(int64) >= 10)
+	suite.True(command[3].(int64) >= command[2].(int64))
+
+	history, err := suite.cli.Do("LATENCY", "HISTORY", "command").Result()
+	require.NoError(err)
+	suite.NotEmpty(history)
+
+	doctor, err = suite.cli.Do("LATENCY", "DOCTOR").String()
+	require.NoError(err)
+	suite.Contains(doctor, "command:")
+
+	n, err := suite.cli.Do("LATENCY", "RESET", "command", "unknown").Int64()
+	require.NoError(err)
+	suite.EqualValues(1, n)
+	history, err = suite.cli.Do("LATENCY", "HISTORY", "command").Result()
+	require.NoError(err)
+	suite.Empty(history)
+}
+
+func slowLogEntry(entries interface{}, name string) []interface{} {
+	for _, entry := range entries.([]interface{}) {
+		entry := entry.([]interface{})
+		if strings.EqualFold(entry[3].([]interface{})[0].(string), name) {
+			return entry
+		}
+	}
+	return nil
+}
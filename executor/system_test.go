@@ -3,7 +3,9 @@ package executor_test
 import (
 	"github.com/go-redis/redis/v7"
 	"github.com/stretchr/testify/suite"
+	"strings"
 	"testing"
+	"time"
 )
 
 type SystemTestSuite struct {
@@ -31,3 +33,21 @@ func (suite *SystemTestSuite) TestEcho() {
 	suite.NoError(err)
 	suite.Equal("hi", result)
 }
+
+func (suite *SystemTestSuite) TestBgsave() {
+	startup, err := suite.cli.LastSave().Result()
+	suite.NoError(err)
+	suite.NoError(suite.cli.Set("system:k", "v", 0).Err())
+	status, err := suite.cli.BgSave().Result()
+	suite.NoError(err)
+	suite.Equal("Background saving started", status)
+	suite.True(e2eEventually(func() bool {
+		info, err := suite.cli.Info("persistence").Result()
+		return err == nil && strings.Contains(info, "rdb_bgsave_in_progress:0") &&
+			strings.Contains(info, "rdb_last_bgsave_status:ok")
+	}, time.Second, time.Millisecond*10))
+	lastSave, err := suite.cli.LastSave().Result()
+	suite.NoError(err)
+	suite.GreaterOrEqual(lastSave, startup)
+	suite.Error(suite.cli.Do("bgsave", "now").Err())
+}
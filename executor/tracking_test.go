@@ -0,0 +1,138 @@
+package executor_test
+
+import (
+	"github.com/go-redis/redis/v7"
+	"github.com/stretchr/testify/suite"
+	"github.com/tidwall/redcon"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+type TrackingTestSuite struct {
+	suite.Suite
+
+	cli *redis.Client
+
+	//redirect target subscribed to __redis__:invalidate
+	target   *e2eRawConn
+	targetID int64
+}
+
+func TestTrackingTestSuite(t *testing.T) {
+	suite.Run(t, new(TrackingTestSuite))
+}
+
+func (suite *TrackingTestSuite) SetupTest() {
+	cli, err := e2eGetRedisClient()
+	suite.cli = cli
+	suite.NoError(err)
+
+	suite.target, err = e2eDialRaw()
+	suite.Require().NoError(err)
+
+	suite.write("client", "id")
+	line, err := suite.target.ReadLine()
+	suite.NoError(err)
+	suite.Equal(byte(':'), line[0])
+	suite.targetID, err = strconv.ParseInt(strings.TrimSpace(line[1:]), 10, 64)
+	suite.NoError(err)
+
+	suite.write("subscribe", "__redis__:invalidate")
+	suite.expect(redcon.AppendInt(
+		redcon.AppendBulkString(redcon.AppendBulkString(redcon.AppendArray(nil, 3), "subscribe"), "__redis__:invalidate"),
+		1,
+	))
+}
+
+func (suite *TrackingTestSuite) TearDownTest() {
+	suite.NoError(suite.target.Close())
+	suite.NoError(e2eClearRedis(suite.cli))
+}
+
+func (suite *TrackingTestSuite) write(args ...string) {
+	suite.NoError(suite.target.Send(args...))
+}
+
+func (suite *TrackingTestSuite) expect(output []byte) {
+	reply, err := suite.target.Read(len(output))
+	suite.NoError(err)
+	suite.Equal(string(output), reply)
+}
+
+func (suite *TrackingTestSuite) expectInvalidate(keys ...string) {
+	output := redcon.AppendArray(nil, 3)
+	output = redcon.AppendBulkString(output, "message")
+	output = redcon.AppendBulkString(output, "__redis__:invalidate")
+	output = redcon.AppendArray(output, len(keys))
+	for _, key := range keys {
+		output = redcon.AppendBulkString(output, key)
+	}
+	suite.expect(output)
+}
+
+func (suite *TrackingTestSuite) tracking(args ...interface{}) *redis.Conn {
+	conn := suite.cli.Conn()
+	args = append([]interface{}{"client", "tracking", "on", "redirect", suite.targetID}, args...)
+	suite.NoError(e2eDo(conn, args...).Err())
+	return conn
+}
+
+func (suite *TrackingTestSuite) untrack(conn *redis.Conn) {
+	suite.NoError(e2eDo(conn, "client", "tracking", "off").Err())
+	suite.NoError(conn.Close())
+}
+
+func (suite *TrackingTestSuite) TestDefault() {
+	conn := suite.tracking()
+	defer suite.untrack(conn)
+
+	redir, err := e2eDo(conn, "client", "getredir").Int64()
+	suite.NoError(err)
+	suite.Equal(suite.targetID, redir)
+
+	suite.Equal(redis.Nil, e2eDo(conn, "get", "tk1").Err())
+	suite.NoError(suite.cli.Set("tk1", "v", 0).Err())
+	suite.expectInvalidate("tk1")
+
+	//the key is not tracked anymore until it's read again
+	suite.NoError(suite.cli.Set("tk1", "v", 0).Err())
+	suite.Equal(redis.Nil, e2eDo(conn, "get", "tk2").Err())
+	suite.NoError(suite.cli.Del("tk2").Err())
+	suite.expectInvalidate("tk2")
+}
+
+func (suite *TrackingTestSuite) TestBcast() {
+	conn := suite.tracking("bcast", "prefix", "bc:")
+	defer suite.untrack(conn)
+
+	suite.NoError(suite.cli.Set("bc:1", "v", 0).Err())
+	suite.expectInvalidate("bc:1")
+	suite.NoError(suite.cli.Set("other", "v", 0).Err())
+	suite.NoError(suite.cli.Incr("bc:2").Err())
+	suite.expectInvalidate("bc:2")
+}
+
+func (suite *TrackingTestSuite) TestOptIn() {
+	conn := suite.tracking("optin")
+	defer suite.untrack(conn)
+
+	suite.Equal(redis.Nil, e2eDo(conn, "get", "oi1").Err())
+	suite.NoError(e2eDo(conn, "client", "caching", "yes").Err())
+	suite.Equal(redis.Nil, e2eDo(conn, "get", "oi2").Err())
+	suite.NoError(suite.cli.Set("oi1", "v", 0).Err())
+	suite.NoError(suite.cli.Set("oi2", "v", 0).Err())
+	suite.expectInvalidate("oi2")
+
+	suite.Error(e2eDo(conn, "client", "caching", "no").Err())
+}
+
+func (suite *TrackingTestSuite) TestInvalidOptions() {
+	conn := suite.cli.Conn()
+	defer func() { suite.NoError(conn.Close()) }()
+	suite.Error(e2eDo(conn, "client", "tracking", "on", "prefix", "x").Err())
+	suite.Error(e2eDo(conn, "client", "tracking", "on", "optin", "optout").Err())
+	suite.Error(e2eDo(conn, "client", "tracking", "on", "bcast", "optin").Err())
+	suite.Error(e2eDo(conn, "client", "tracking", "on", "redirect", 1<<40).Err())
+	suite.Error(e2eDo(conn, "client", "caching", "yes").Err())
+}
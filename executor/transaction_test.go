@@ -0,0 +1,87 @@
+package executor_test
+
+import (
+	"github.com/go-redis/redis/v7"
+	"github.com/stretchr/testify/suite"
+	"testing"
+)
+
+type TransactionTestSuite struct {
+	suite.Suite
+
+	cli *redis.Client
+}
+
+func TestTransactionTestSuite(t *testing.T) {
+	suite.Run(t, new(TransactionTestSuite))
+}
+
+func (suite *TransactionTestSuite) SetupTest() {
+	cli, err := e2eGetRedisClient()
+	suite.cli = cli
+	suite.NoError(err)
+}
+
+func (suite *TransactionTestSuite) TearDownTest() {
+	suite.NoError(e2eClearRedis(suite.cli))
+}
+
+func (suite *TransactionTestSuite) TestMultiExec() {
+	var (
+		incr *redis.IntCmd
+		get  *redis.StringCmd
+	)
+	_, err := suite.cli.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.Set("k1", "1", 0)
+		incr = pipe.Incr("k1")
+		get = pipe.Get("k1")
+		return nil
+	})
+	suite.NoError(err)
+	suite.Equal(int64(2), incr.Val())
+	suite.Equal("2", get.Val())
+}
+
+func (suite *TransactionTestSuite) TestDiscard() {
+	conn := suite.cli.Conn()
+	defer func() { suite.NoError(conn.Close()) }()
+
+	suite.NoError(e2eDo(conn, "multi").Err())
+	result, err := e2eDo(conn, "set", "k1", "v").Result()
+	suite.NoError(err)
+	suite.Equal("QUEUED", result)
+	suite.NoError(e2eDo(conn, "discard").Err())
+	suite.Error(e2eDo(conn, "exec").Err())
+
+	_, err = suite.cli.Get("k1").Result()
+	suite.Equal(redis.Nil, err)
+}
+
+func (suite *TransactionTestSuite) TestWatch() {
+	suite.NoError(suite.cli.Set("k1", "1", 0).Err())
+
+	//untouched watched key
+	err := suite.cli.Watch(func(tx *redis.Tx) error {
+		_, err := tx.TxPipelined(func(pipe redis.Pipeliner) error {
+			pipe.Incr("k1")
+			return nil
+		})
+		return err
+	}, "k1")
+	suite.NoError(err)
+
+	//watched key modified by another client
+	err = suite.cli.Watch(func(tx *redis.Tx) error {
+		suite.NoError(suite.cli.Set("k1", "10", 0).Err())
+		_, err := tx.TxPipelined(func(pipe redis.Pipeliner) error {
+			pipe.Incr("k1")
+			return nil
+		})
+		return err
+	}, "k1")
+	suite.Equal(redis.TxFailedErr, err)
+
+	result, err := suite.cli.Get("k1").Result()
+	suite.NoError(err)
+	suite.Equal("10", result)
+}
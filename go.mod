@@ -4,15 +4,17 @@ go 1.13
 
 require (
 	github.com/akutz/memconn v0.1.0
-	github.com/dgraph-io/badger v1.6.0
+	github.com/dgraph-io/badger/v2 v2.2007.4
 	github.com/go-redis/redis/v7 v7.0.0-beta.4
 	github.com/gobwas/glob v0.2.3
-	github.com/golang/protobuf v1.3.2
+	github.com/golang/protobuf v1.4.3
+	github.com/golang/snappy v0.0.3
 	github.com/joway/loki v0.2.4
-	github.com/kr/pretty v0.1.0 // indirect
+	github.com/klauspost/compress v1.12.3
 	github.com/onsi/ginkgo v1.10.2 // indirect
 	github.com/onsi/gomega v1.7.0 // indirect
-	github.com/pkg/errors v0.8.1
+	github.com/pkg/errors v0.9.1
+	github.com/prometheus/client_golang v1.11.1
 	github.com/rs/xid v1.2.1
 	github.com/stretchr/testify v1.4.0
 	github.com/tidwall/btree v0.0.0-20170113224114-9876f1454cf0 // indirect
@@ -23,11 +25,7 @@ require (
 	github.com/tidwall/rtree v0.0.0-20180113144539-6cd427091e0e // indirect
 	github.com/tidwall/tinyqueue v0.0.0-20180302190814-1e39f5511563 // indirect
 	github.com/urfave/cli v1.22.1
-	golang.org/x/net v0.0.0-20191014212845-da9a3fd4c582 // indirect
-	golang.org/x/sys v0.0.0-20191010194322-b09406accb47 // indirect
-	golang.org/x/text v0.3.2 // indirect
+	github.com/yuin/gopher-lua v0.0.0-20191220021717-ab39c6098bdb
 	google.golang.org/genproto v0.0.0-20191009194640-548a555dbc03 // indirect
 	google.golang.org/grpc v1.24.0
-	gopkg.in/check.v1 v1.0.0-20190902080502-41f04d3bba15 // indirect
-	gopkg.in/yaml.v2 v2.2.4 // indirect
 )
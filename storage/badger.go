@@ -1,48 +1,151 @@
 package storage
 
 import (
+	"bytes"
 	"context"
-	"github.com/dgraph-io/badger"
+	"encoding/binary"
+	"github.com/dgraph-io/badger/v2"
+	badgeroptions "github.com/dgraph-io/badger/v2/options"
+	"github.com/dgraph-io/badger/v2/pb"
 	"github.com/gobwas/glob"
+	"github.com/golang/protobuf/proto"
 	"github.com/joway/pidis/types"
 	"io"
 	"regexp"
 	"runtime"
+	"sync"
 	"time"
 )
 
+const (
+	//a value log file is rewritten when at least half of it can be discarded
+	badgerGCDiscardRatio = 0.5
+	//encrypted and compressed blocks are cached decoded
+	badgerBlockCache = 64 << 20
+	//values written with a compression header, older values are read as is
+	badgerMetaEncoded byte = 1
+
+	//meta bits of badger entries
+	badgerBitDelete                 byte = 1 << 0
+	badgerBitDiscardEarlierVersions byte = 1 << 2
+)
+
+var badgerCompressions = map[string]badgeroptions.CompressionType{
+	CompressionNone:   badgeroptions.None,
+	CompressionSnappy: badgeroptions.Snappy,
+	CompressionZSTD:   badgeroptions.ZSTD,
+}
+
 type BadgerStorage struct {
 	Storage
 
-	db *badger.DB
+	//lock guards db against being reopened by Rekey
+	lock    sync.RWMutex
+	db      *badger.DB
+	options Options
+}
+
+type BadgerTxn struct {
+	txn        *badger.Txn
+	compressor *Compressor
 }
 
 func NewBadgerStorage(options Options) (Storage, error) {
-	db, err := badger.Open(badger.DefaultOptions(options.Dir))
+	if options.Compressor == nil {
+		options.Compressor = NewCompressor()
+	}
+	db, err := badger.Open(badgerOptions(options))
 	if err != nil {
 		return nil, err
 	}
 
-	return &BadgerStorage{db: db}, nil
+	return &BadgerStorage{db: db, options: options}, nil
+}
+
+func badgerOptions(options Options) badger.Options {
+	opts := badger.DefaultOptions(options.Dir)
+	if compression, ok := badgerCompressions[options.BlockCompression]; ok && compression != badgeroptions.None {
+		opts = opts.WithCompression(compression).WithBlockCacheSize(badgerBlockCache)
+	}
+	if len(options.EncryptionKey) == 0 {
+		return opts
+	}
+	opts = opts.WithEncryptionKey(options.EncryptionKey).WithBlockCacheSize(badgerBlockCache)
+	if options.EncryptionKeyRotation > 0 {
+		opts = opts.WithEncryptionKeyRotationDuration(options.EncryptionKeyRotation)
+	}
+	return opts
+}
+
+// RekeyBadger encrypts the data keys of the closed badger in dir with key instead of old,
+// an empty key stores them in plaintext. Data written before encryption is enabled stays readable
+func RekeyBadger(dir string, old, key []byte) error {
+	opts := badger.KeyRegistryOptions{Dir: dir, ReadOnly: true, EncryptionKey: old}
+	registry, err := badger.OpenKeyRegistry(opts)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = registry.Close() }()
+	opts.EncryptionKey = key
+	return badger.WriteKeyRegistry(registry, opts)
+}
+
+// Rekey encrypts the data keys with a new master key, badger is reopened meanwhile
+func (storage *BadgerStorage) Rekey(key []byte) error {
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+	if err := storage.db.Close(); err != nil {
+		return err
+	}
+	options := storage.options
+	rekeyErr := RekeyBadger(options.Dir, options.EncryptionKey, key)
+	if rekeyErr == nil {
+		options.EncryptionKey = key
+	}
+	db, err := badger.Open(badgerOptions(options))
+	if err != nil {
+		return err
+	}
+	storage.db, storage.options = db, options
+	return rekeyErr
 }
 
 func (storage *BadgerStorage) Close() error {
+	storage.lock.RLock()
+	defer storage.lock.RUnlock()
 	return storage.db.Close()
 }
 
-func (storage *BadgerStorage) Get(key []byte) ([]byte, error) {
-	var output []byte = nil
-	err := storage.db.View(func(txn *badger.Txn) error {
-		item, err := txn.Get(key)
-		if err != nil {
-			return err
+// Size is refreshed by badger periodically
+func (storage *BadgerStorage) Size() (lsm, vlog int64) {
+	storage.lock.RLock()
+	defer storage.lock.RUnlock()
+	return storage.db.Size()
+}
+
+// RunGC rewrites value log files until none is worth rewriting
+func (storage *BadgerStorage) RunGC() error {
+	storage.lock.RLock()
+	defer storage.lock.RUnlock()
+	for {
+		err := storage.db.RunValueLogGC(badgerGCDiscardRatio)
+		if err == badger.ErrNoRewrite || err == badger.ErrRejected {
+			return nil
 		}
-		val, err := item.ValueCopy(nil)
 		if err != nil {
 			return err
 		}
+	}
+}
+
+func (storage *BadgerStorage) Get(key []byte) ([]byte, error) {
+	storage.lock.RLock()
+	defer storage.lock.RUnlock()
+	var output []byte = nil
+	err := storage.db.View(func(txn *badger.Txn) error {
+		val, err := badgerGet(txn, key, storage.options.Compressor)
 		output = val
-		return nil
+		return err
 	})
 	if err == badger.ErrKeyNotFound {
 		return nil, types.ErrKeyNotFound
@@ -52,133 +155,334 @@ func (storage *BadgerStorage) Get(key []byte) ([]byte, error) {
 }
 
 func (storage *BadgerStorage) Set(key, val []byte, ttl uint64) error {
+	storage.lock.RLock()
+	defer storage.lock.RUnlock()
 	return storage.db.Update(func(txn *badger.Txn) error {
-		if ttl == 0 {
-			return txn.Set(key, val)
-		} else {
-			e := badger.
-				NewEntry(key, val).
-				WithTTL(time.Millisecond * time.Duration(ttl))
-			return txn.SetEntry(e)
-		}
+		return badgerSet(txn, key, val, ttl, storage.options.Compressor)
 	})
 }
 
 func (storage *BadgerStorage) Del(keys [][]byte) error {
+	storage.lock.RLock()
+	defer storage.lock.RUnlock()
 	return storage.db.Update(func(txn *badger.Txn) error {
-		for _, key := range keys {
-			if err := txn.Delete(key); err != nil {
-				return err
-			}
-		}
-
-		return nil
+		return badgerDel(txn, keys)
 	})
 }
 
 func (storage *BadgerStorage) Scan(scanOpts ScanOptions) ([]KVPair, error) {
+	storage.lock.RLock()
+	defer storage.lock.RUnlock()
 	var output []KVPair
 	err := storage.db.View(func(txn *badger.Txn) error {
-		//TODO: tuning prefetchSize
-		opts := badger.IteratorOptions{
-			PrefetchValues: scanOpts.IncludeValue,
-			PrefetchSize:   runtime.GOMAXPROCS(0),
-			Reverse:        false,
-			AllVersions:    false,
-		}
-		it := txn.NewIterator(opts)
-		defer it.Close()
-
-		//check is prefix search
-		var prefix []byte
-		rePrefix := regexp.MustCompile(`^[\w]+\*$`)
-		if rePrefix.MatchString(scanOpts.Pattern) {
-			prefix = []byte(scanOpts.Pattern[:len(scanOpts.Pattern)-1])
-		}
-		globKey, err := glob.Compile(scanOpts.Pattern)
-		if err != nil {
-			return err
-		}
+		pairs, err := badgerScan(txn, scanOpts, storage.options.Compressor)
+		output = pairs
+		return err
+	})
+	return output, err
+}
 
-		start := func(it *badger.Iterator) {
-			if prefix == nil {
-				it.Rewind()
-			} else {
-				it.Seek(prefix)
-			}
-		}
-		valid := func(it *badger.Iterator) bool {
-			//hit prefix optimization
-			if prefix != nil {
-				return it.ValidForPrefix(prefix)
-			}
+func (storage *BadgerStorage) Snapshot(ctx context.Context, writer io.Writer) error {
+	version, release := storage.Pin()
+	defer release()
+	return storage.Backup(ctx, writer, 0, version)
+}
 
-			return it.Valid()
-		}
-		for start(it); valid(it); it.Next() {
-			if scanOpts.Limit > 0 && len(output) >= scanOpts.Limit {
-				return nil
+// Pin opens a read transaction so that compactions keep the versions it reads,
+// the storage can't be reopened until it's released
+func (storage *BadgerStorage) Pin() (uint64, func()) {
+	storage.lock.RLock()
+	txn := storage.db.NewTransaction(false)
+	return txn.ReadTs(), func() {
+		txn.Discard()
+		storage.lock.RUnlock()
+	}
+}
+
+// Backup writes the versions of the keys written in (since, until], deletions included,
+// loading it over the previous backups gives the data at version until. It's called while until is pinned
+func (storage *BadgerStorage) Backup(ctx context.Context, writer io.Writer, since, until uint64) error {
+	stream := storage.db.NewStream()
+	stream.LogPrefix = "BadgerStorage.Backup"
+	//the stream reads the latest versions, each key is written from its newest version up to until
+	stream.KeyToList = func(key []byte, itr *badger.Iterator) (*pb.KVList, error) {
+		list := &pb.KVList{}
+		for ; itr.Valid(); itr.Next() {
+			item := itr.Item()
+			if !bytes.Equal(item.Key(), key) || item.Version() <= since {
+				return list, nil
 			}
-			if scanOpts.Pattern != "" && !globKey.Match(string(it.Item().Key())) {
+			if item.Version() > until {
 				continue
 			}
-
-			var pair = KVPair{}
-			item := it.Item()
-			pair.SetKey(item.KeyCopy(nil))
-			if scanOpts.IncludeValue {
-				v, err := item.ValueCopy(nil)
-				if err != nil {
-					return err
-				}
-				pair.SetVal(v)
+			kv, err := badgerBackupKV(item)
+			if err != nil {
+				return nil, err
+			}
+			list.Kv = append(list.Kv, kv)
+			switch {
+			case item.DiscardEarlierVersions():
+				//earlier versions are hidden by a delete marker just below
+				list.Kv = append(list.Kv, &pb.KV{
+					Key:     item.KeyCopy(nil),
+					Version: item.Version() - 1,
+					Meta:    []byte{badgerBitDelete},
+				})
+				return list, nil
+			case item.IsDeletedOrExpired():
+				return list, nil
 			}
-			output = append(output, pair)
 		}
-		return nil
-	})
-	return output, err
+		return list, nil
+	}
+	stream.Send = func(list *pb.KVList) error {
+		//the framing of badger backups, so that they are loaded by badger
+		if err := binary.Write(writer, binary.LittleEndian, uint64(proto.Size(list))); err != nil {
+			return err
+		}
+		buf, err := proto.Marshal(list)
+		if err != nil {
+			return err
+		}
+		_, err = writer.Write(buf)
+		return err
+	}
+	return stream.Orchestrate(ctx)
 }
 
-func (storage *BadgerStorage) Snapshot(ctx context.Context, writer io.Writer) error {
-	_, err := storage.db.Backup(writer, 0)
-	if err != nil {
-		return err
+// badgerBackupKV copies an item the way badger backups do, the meta bits aren't exported by badger
+func badgerBackupKV(item *badger.Item) (*pb.KV, error) {
+	deleted := item.IsDeletedOrExpired()
+	if expiresAt := item.ExpiresAt(); expiresAt > 0 && expiresAt <= uint64(time.Now().Unix()) {
+		deleted = false
 	}
-	return nil
+	var meta byte
+	if deleted {
+		meta |= badgerBitDelete
+	}
+	if item.DiscardEarlierVersions() {
+		meta |= badgerBitDiscardEarlierVersions
+	}
+	var val []byte
+	if !item.IsDeletedOrExpired() {
+		var err error
+		if val, err = item.ValueCopy(nil); err != nil {
+			return nil, err
+		}
+	}
+	return &pb.KV{
+		Key:       item.KeyCopy(nil),
+		Value:     val,
+		UserMeta:  []byte{item.UserMeta()},
+		Version:   item.Version(),
+		ExpiresAt: item.ExpiresAt(),
+		Meta:      []byte{meta},
+	}, nil
 }
 
 func (storage *BadgerStorage) LoadSnapshot(ctx context.Context, reader io.Reader) error {
+	storage.lock.RLock()
+	defer storage.lock.RUnlock()
 	//TODO: custom maxPendingWrites
 	return storage.db.Load(reader, 256)
 }
 
 func (storage *BadgerStorage) TTL(key []byte) (uint64, error) {
+	storage.lock.RLock()
+	defer storage.lock.RUnlock()
 	var ttl uint64 = 0
 	err := storage.db.View(func(txn *badger.Txn) error {
-		item, err := txn.Get(key)
-		if err != nil {
+		t, err := badgerTTL(txn, key)
+		ttl = t
+		return err
+	})
+	if err == badger.ErrKeyNotFound {
+		return 0, types.ErrKeyNotFound
+	}
+	return ttl, err
+}
+
+func (storage *BadgerStorage) Transaction(fn func(txn Storage) error) error {
+	storage.lock.RLock()
+	defer storage.lock.RUnlock()
+	return storage.db.Update(func(txn *badger.Txn) error {
+		return fn(&BadgerTxn{txn: txn, compressor: storage.options.Compressor})
+	})
+}
+
+func (t *BadgerTxn) Get(key []byte) ([]byte, error) {
+	val, err := badgerGet(t.txn, key, t.compressor)
+	if err == badger.ErrKeyNotFound {
+		return nil, types.ErrKeyNotFound
+	}
+	return val, err
+}
+
+func (t *BadgerTxn) Set(key, val []byte, ttl uint64) error {
+	return badgerSet(t.txn, key, val, ttl, t.compressor)
+}
+
+func (t *BadgerTxn) Del(keys [][]byte) error {
+	return badgerDel(t.txn, keys)
+}
+
+func (t *BadgerTxn) Scan(scanOpts ScanOptions) ([]KVPair, error) {
+	return badgerScan(t.txn, scanOpts, t.compressor)
+}
+
+func (t *BadgerTxn) TTL(key []byte) (uint64, error) {
+	ttl, err := badgerTTL(t.txn, key)
+	if err == badger.ErrKeyNotFound {
+		return 0, types.ErrKeyNotFound
+	}
+	return ttl, err
+}
+
+func (t *BadgerTxn) Transaction(fn func(txn Storage) error) error {
+	//nested transactions are flattened into the outer one
+	return fn(t)
+}
+
+//the transaction is owned by the storage, which alone can be closed or snapshotted
+
+func (t *BadgerTxn) Close() error {
+	return types.ErrInTransaction
+}
+
+func (t *BadgerTxn) Snapshot(ctx context.Context, writer io.Writer) error {
+	return types.ErrInTransaction
+}
+
+func (t *BadgerTxn) LoadSnapshot(ctx context.Context, reader io.Reader) error {
+	return types.ErrInTransaction
+}
+
+func badgerGet(txn *badger.Txn, key []byte, compressor *Compressor) ([]byte, error) {
+	item, err := txn.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return badgerValue(item, compressor)
+}
+
+// badgerValue decodes the value of item if it has been written with a compression header
+func badgerValue(item *badger.Item, compressor *Compressor) ([]byte, error) {
+	val, err := item.ValueCopy(nil)
+	if err != nil || item.UserMeta()&badgerMetaEncoded == 0 {
+		return val, err
+	}
+	return compressor.Decode(val)
+}
+
+func badgerSet(txn *badger.Txn, key, val []byte, ttl uint64, compressor *Compressor) error {
+	e := badger.
+		NewEntry(key, compressor.Encode(val)).
+		WithMeta(badgerMetaEncoded)
+	if ttl > 0 {
+		e = e.WithTTL(time.Millisecond * time.Duration(ttl))
+	}
+	return txn.SetEntry(e)
+}
+
+func badgerDel(txn *badger.Txn, keys [][]byte) error {
+	for _, key := range keys {
+		if err := txn.Delete(key); err != nil {
 			return err
 		}
+	}
 
-		exp := item.ExpiresAt()
-		if exp == 0 {
-			//if not set ttl on key, return ttl = 0
-			return nil
+	return nil
+}
+
+func badgerScan(txn *badger.Txn, scanOpts ScanOptions, compressor *Compressor) ([]KVPair, error) {
+	var output []KVPair
+	//TODO: tuning prefetchSize
+	opts := badger.IteratorOptions{
+		PrefetchValues: scanOpts.IncludeValue,
+		PrefetchSize:   runtime.GOMAXPROCS(0),
+		Reverse:        false,
+		AllVersions:    false,
+	}
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	//check is prefix search
+	prefix := scanOpts.Prefix
+	rePrefix := regexp.MustCompile(`^[\w]+\*$`)
+	if rePrefix.MatchString(scanOpts.Pattern) {
+		prefix = append(append([]byte(nil), scanOpts.Prefix...), scanOpts.Pattern[:len(scanOpts.Pattern)-1]...)
+	}
+	globKey, err := glob.Compile(scanOpts.Pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	start := func(it *badger.Iterator) {
+		if prefix == nil {
+			it.Rewind()
+		} else {
+			it.Seek(prefix)
+		}
+	}
+	valid := func(it *badger.Iterator) bool {
+		//hit prefix optimization
+		if prefix != nil {
+			return it.ValidForPrefix(prefix)
 		}
 
-		now := time.Now().Unix()
-		//to milliseconds
-		t := (int64(exp) - now) * 1000
-		if t <= 0 {
-			//if key existed but ttl <= 0, return key not found error
-			return types.ErrKeyNotFound
+		return it.Valid()
+	}
+	for start(it); valid(it); it.Next() {
+		if scanOpts.Limit > 0 && len(output) >= scanOpts.Limit {
+			return output, nil
 		}
-		ttl = uint64(t)
-		return nil
-	})
-	if err == badger.ErrKeyNotFound {
+		if scanOpts.Skip != nil && bytes.HasPrefix(it.Item().Key(), scanOpts.Skip) {
+			end := prefixEnd(scanOpts.Skip)
+			if end == nil {
+				break
+			}
+			if it.Seek(end); !valid(it) {
+				break
+			}
+		}
+		key := it.Item().Key()[len(scanOpts.Prefix):]
+		if scanOpts.Pattern != "" && !globKey.Match(string(key)) {
+			continue
+		}
+
+		var pair = KVPair{}
+		item := it.Item()
+		pair.SetKey(item.KeyCopy(nil))
+		if scanOpts.IncludeValue {
+			v, err := badgerValue(item, compressor)
+			if err != nil {
+				return nil, err
+			}
+			pair.SetVal(v)
+		}
+		output = append(output, pair)
+	}
+	return output, nil
+}
+
+func badgerTTL(txn *badger.Txn, key []byte) (uint64, error) {
+	item, err := txn.Get(key)
+	if err != nil {
+		return 0, err
+	}
+
+	exp := item.ExpiresAt()
+	if exp == 0 {
+		//if not set ttl on key, return ttl = 0
+		return 0, nil
+	}
+
+	now := time.Now().Unix()
+	//to milliseconds
+	t := (int64(exp) - now) * 1000
+	if t <= 0 {
+		//if key existed but ttl <= 0, return key not found error
 		return 0, types.ErrKeyNotFound
 	}
-	return ttl, err
+	return uint64(t), nil
 }
@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"sync"
+	"sync/atomic"
+)
+
+// compression codecs of values and badger blocks
+const (
+	CompressionNone   = "none"
+	CompressionSnappy = "snappy"
+	CompressionZSTD   = "zstd"
+)
+
+const DefaultCompressionThreshold = 512
+
+// header byte of encoded values
+const (
+	codecNone byte = iota
+	codecSnappy
+	codecZSTD
+)
+
+var codecs = map[string]byte{
+	CompressionNone:   codecNone,
+	CompressionSnappy: codecSnappy,
+	CompressionZSTD:   codecZSTD,
+}
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+)
+
+// zstd encoders and decoders are safe for concurrent EncodeAll and DecodeAll
+func initZSTD() {
+	zstdOnce.Do(func() {
+		zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest))
+		zstdDecoder, _ = zstd.NewReader(nil)
+	})
+}
+
+// Compressor encodes values with a header byte telling their codec, so values stay readable
+// whatever the codec they have been written with. Values shorter than the threshold aren't compressed
+type Compressor struct {
+	codec     int32
+	threshold int64
+
+	//bytes of the values written since startup and of their encoding
+	raw    int64
+	stored int64
+}
+
+func NewCompressor() *Compressor {
+	return &Compressor{threshold: DefaultCompressionThreshold}
+}
+
+func (c *Compressor) SetCodec(name string) error {
+	codec, ok := codecs[name]
+	if !ok {
+		return errors.Errorf("unknown compression %s", name)
+	}
+	atomic.StoreInt32(&c.codec, int32(codec))
+	return nil
+}
+
+func (c *Compressor) Codec() string {
+	codec := byte(atomic.LoadInt32(&c.codec))
+	for name, b := range codecs {
+		if b == codec {
+			return name
+		}
+	}
+	return CompressionNone
+}
+
+func (c *Compressor) SetThreshold(threshold int64) {
+	atomic.StoreInt64(&c.threshold, threshold)
+}
+
+func (c *Compressor) Threshold() int64 {
+	return atomic.LoadInt64(&c.threshold)
+}
+
+// Stats returns the bytes of the values written since startup and the bytes they are stored with
+func (c *Compressor) Stats() (raw, stored int64) {
+	return atomic.LoadInt64(&c.raw), atomic.LoadInt64(&c.stored)
+}
+
+// Encode returns the header byte followed by val, compressed when it's long enough and compression pays off
+func (c *Compressor) Encode(val []byte) []byte {
+	codec := byte(atomic.LoadInt32(&c.codec))
+	encoded := append([]byte{codecNone}, val...)
+	if codec != codecNone && int64(len(val)) >= c.Threshold() {
+		var compressed []byte
+		switch codec {
+		case codecSnappy:
+			buf := make([]byte, 1+snappy.MaxEncodedLen(len(val)))
+			compressed = buf[:1+len(snappy.Encode(buf[1:], val))]
+		case codecZSTD:
+			initZSTD()
+			compressed = zstdEncoder.EncodeAll(val, make([]byte, 1, 1+len(val)))
+		}
+		if len(compressed) < len(encoded) {
+			compressed[0] = codec
+			encoded = compressed
+		}
+	}
+	atomic.AddInt64(&c.raw, int64(len(val)))
+	atomic.AddInt64(&c.stored, int64(len(encoded)))
+	return encoded
+}
+
+// Decode returns the value of an encoded one
+func (c *Compressor) Decode(encoded []byte) ([]byte, error) {
+	if len(encoded) == 0 {
+		return nil, errors.New("encoded value without header")
+	}
+	switch encoded[0] {
+	case codecNone:
+		return encoded[1:], nil
+	case codecSnappy:
+		return snappy.Decode(nil, encoded[1:])
+	case codecZSTD:
+		initZSTD()
+		return zstdDecoder.DecodeAll(encoded[1:], nil)
+	default:
+		return nil, errors.Errorf("unknown compression header %d", encoded[0])
+	}
+}
@@ -0,0 +1,148 @@
+package storage
+
+import (
+	"bytes"
+	"sort"
+	"strconv"
+)
+
+// KeyspaceMarker starts the keys of every keyspace but the first one and the internal keys,
+// keys of keyspace 0 are stored as is so data written before keyspaces existed stays readable,
+// unless they start with the marker. It can't start with NUL since glob patterns end there
+const KeyspaceMarker = "\x01ks"
+
+// escapedPrefix starts the keys of keyspace 0 which start with KeyspaceMarker themselves,
+// so that they can't be mistaken for the keys of other keyspaces or the internal ones
+var escapedPrefix = []byte(KeyspaceMarker + "0:")
+
+// KeyspacePrefix returns the prefix of the keys stored in slot
+func KeyspacePrefix(slot int) []byte {
+	if slot == 0 {
+		return nil
+	}
+	return []byte(KeyspaceMarker + strconv.Itoa(slot) + ":")
+}
+
+// SplitKeyspace returns the slot and the key of a stored key, ok is false for internal keys
+func SplitKeyspace(stored []byte) (slot int, key []byte, ok bool) {
+	if !bytes.HasPrefix(stored, []byte(KeyspaceMarker)) {
+		return 0, stored, true
+	}
+	rest := stored[len(KeyspaceMarker):]
+	end := bytes.IndexByte(rest, ':')
+	if end <= 0 {
+		return 0, nil, false
+	}
+	slot, err := strconv.Atoi(string(rest[:end]))
+	if err != nil || slot < 0 {
+		return 0, nil, false
+	}
+	return slot, rest[end+1:], true
+}
+
+// Keyspace isolates the keys of a slot inside a shared storage
+type Keyspace struct {
+	Storage
+
+	store  Storage
+	slot   int
+	prefix []byte
+}
+
+func NewKeyspace(store Storage, slot int) *Keyspace {
+	return &Keyspace{
+		Storage: store,
+		store:   store,
+		slot:    slot,
+		prefix:  KeyspacePrefix(slot),
+	}
+}
+
+func (k *Keyspace) Slot() int {
+	return k.slot
+}
+
+// Key returns the stored key of key
+func (k *Keyspace) Key(key []byte) []byte {
+	prefix := k.prefix
+	if prefix == nil {
+		if !bytes.HasPrefix(key, []byte(KeyspaceMarker)) {
+			return key
+		}
+		prefix = escapedPrefix
+	}
+	stored := make([]byte, 0, len(prefix)+len(key))
+	return append(append(stored, prefix...), key...)
+}
+
+func (k *Keyspace) Get(key []byte) ([]byte, error) {
+	return k.store.Get(k.Key(key))
+}
+
+func (k *Keyspace) Set(key, val []byte, ttl uint64) error {
+	return k.store.Set(k.Key(key), val, ttl)
+}
+
+func (k *Keyspace) Del(keys [][]byte) error {
+	stored := make([][]byte, len(keys))
+	for i, key := range keys {
+		stored[i] = k.Key(key)
+	}
+	return k.store.Del(stored)
+}
+
+func (k *Keyspace) TTL(key []byte) (uint64, error) {
+	return k.store.TTL(k.Key(key))
+}
+
+// Scan matches the pattern against the keys of the keyspace, returned without their prefix.
+// The keys of the other keyspaces are sought past, which are all stored after KeyspaceMarker
+func (k *Keyspace) Scan(scanOpts ScanOptions) ([]KVPair, error) {
+	opts := scanOpts
+	if k.prefix != nil {
+		opts.Prefix = k.prefix
+		return k.scan(opts)
+	}
+	opts.Skip = []byte(KeyspaceMarker)
+	pairs, err := k.scan(opts)
+	if err != nil {
+		return nil, err
+	}
+	//escaped keys sort among the keys around the marker
+	opts.Skip, opts.Prefix = nil, escapedPrefix
+	escaped, err := k.scan(opts)
+	if err != nil {
+		return nil, err
+	}
+	i := sort.Search(len(pairs), func(i int) bool {
+		return bytes.Compare(pairs[i].Key, []byte(KeyspaceMarker)) > 0
+	})
+	output := append(append(append([]KVPair(nil), pairs[:i]...), escaped...), pairs[i:]...)
+	if scanOpts.Limit > 0 && len(output) > scanOpts.Limit {
+		output = output[:scanOpts.Limit]
+	}
+	return output, nil
+}
+
+// scan returns the keys stored with opts.Prefix without it
+func (k *Keyspace) scan(opts ScanOptions) ([]KVPair, error) {
+	pairs, err := k.store.Scan(opts)
+	if err != nil {
+		return nil, err
+	}
+	for i := range pairs {
+		pairs[i].Key = pairs[i].Key[len(opts.Prefix):]
+	}
+	return pairs, nil
+}
+
+func (k *Keyspace) Transaction(fn func(txn Storage) error) error {
+	return k.store.Transaction(func(txn Storage) error {
+		return fn(NewKeyspace(txn, k.slot))
+	})
+}
+
+// Close leaves the shared storage open, it's closed by its owner
+func (k *Keyspace) Close() error {
+	return nil
+}
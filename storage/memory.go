@@ -1,21 +1,33 @@
 package storage
 
 import (
+	"context"
 	"github.com/gobwas/glob"
 	"github.com/joway/pidis/types"
 	"github.com/tidwall/buntdb"
+	"io"
+	"strings"
 	"time"
 )
 
 type MemoryStorage struct {
-	Storage
+	db         *buntdb.DB
+	compressor *Compressor
+}
 
-	db *buntdb.DB
+type MemoryTxn struct {
+	tx         *buntdb.Tx
+	compressor *Compressor
 }
 
+// NewMemoryStorage keeps no data written before, so every value is encoded with a compression header
 func NewMemoryStorage(options Options) (Storage, error) {
+	compressor := options.Compressor
+	if compressor == nil {
+		compressor = NewCompressor()
+	}
 	db, err := buntdb.Open(":memory:")
-	return &MemoryStorage{db: db}, err
+	return &MemoryStorage{db: db, compressor: compressor}, err
 }
 
 func (storage *MemoryStorage) Close() error {
@@ -25,17 +37,118 @@ func (storage *MemoryStorage) Close() error {
 func (storage *MemoryStorage) Get(key []byte) ([]byte, error) {
 	var output []byte
 	err := storage.db.View(func(tx *buntdb.Tx) error {
-		val, err := tx.Get(string(key))
-		if err == buntdb.ErrNotFound {
-			return types.ErrKeyNotFound
-		}
-		output = []byte(val)
+		val, err := memoryGet(tx, key, storage.compressor)
+		output = val
 		return err
 	})
 	return output, err
 }
 
 func (storage *MemoryStorage) Set(key, val []byte, ttl uint64) error {
+	return storage.db.Update(func(tx *buntdb.Tx) error {
+		return memorySet(tx, key, val, ttl, storage.compressor)
+	})
+}
+
+func (storage *MemoryStorage) Del(keys [][]byte) error {
+	for _, key := range keys {
+		err := storage.db.Update(func(tx *buntdb.Tx) error {
+			return memoryDel(tx, [][]byte{key})
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (storage *MemoryStorage) Scan(scanOpts ScanOptions) ([]KVPair, error) {
+	var output []KVPair
+	err := storage.db.View(func(tx *buntdb.Tx) error {
+		pairs, err := memoryScan(tx, scanOpts, storage.compressor)
+		output = pairs
+		return err
+	})
+
+	return output, err
+}
+
+func (storage *MemoryStorage) TTL(key []byte) (uint64, error) {
+	var ttl uint64
+	err := storage.db.View(func(tx *buntdb.Tx) error {
+		t, err := memoryTTL(tx, key)
+		ttl = t
+		return err
+	})
+	return ttl, err
+}
+
+// Snapshot writes every key with its ttl, writes wait until it's done
+func (storage *MemoryStorage) Snapshot(ctx context.Context, writer io.Writer) error {
+	return storage.db.Save(writer)
+}
+
+func (storage *MemoryStorage) LoadSnapshot(ctx context.Context, reader io.Reader) error {
+	return storage.db.Load(reader)
+}
+
+func (storage *MemoryStorage) Transaction(fn func(txn Storage) error) error {
+	return storage.db.Update(func(tx *buntdb.Tx) error {
+		return fn(&MemoryTxn{tx: tx, compressor: storage.compressor})
+	})
+}
+
+func (t *MemoryTxn) Get(key []byte) ([]byte, error) {
+	return memoryGet(t.tx, key, t.compressor)
+}
+
+func (t *MemoryTxn) Set(key, val []byte, ttl uint64) error {
+	return memorySet(t.tx, key, val, ttl, t.compressor)
+}
+
+func (t *MemoryTxn) Del(keys [][]byte) error {
+	return memoryDel(t.tx, keys)
+}
+
+func (t *MemoryTxn) Scan(scanOpts ScanOptions) ([]KVPair, error) {
+	return memoryScan(t.tx, scanOpts, t.compressor)
+}
+
+func (t *MemoryTxn) TTL(key []byte) (uint64, error) {
+	return memoryTTL(t.tx, key)
+}
+
+func (t *MemoryTxn) Transaction(fn func(txn Storage) error) error {
+	//nested transactions are flattened into the outer one
+	return fn(t)
+}
+
+//the transaction is owned by the storage, which alone can be closed or snapshotted
+
+func (t *MemoryTxn) Close() error {
+	return types.ErrInTransaction
+}
+
+func (t *MemoryTxn) Snapshot(ctx context.Context, writer io.Writer) error {
+	return types.ErrInTransaction
+}
+
+func (t *MemoryTxn) LoadSnapshot(ctx context.Context, reader io.Reader) error {
+	return types.ErrInTransaction
+}
+
+func memoryGet(tx *buntdb.Tx, key []byte, compressor *Compressor) ([]byte, error) {
+	val, err := tx.Get(string(key))
+	if err == buntdb.ErrNotFound {
+		return nil, types.ErrKeyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return compressor.Decode([]byte(val))
+}
+
+func memorySet(tx *buntdb.Tx, key, val []byte, ttl uint64, compressor *Compressor) error {
 	var opts *buntdb.SetOptions
 	if ttl == 0 {
 		opts = nil
@@ -45,76 +158,80 @@ func (storage *MemoryStorage) Set(key, val []byte, ttl uint64) error {
 			TTL:     time.Millisecond * time.Duration(ttl),
 		}
 	}
-	err := storage.db.Update(func(tx *buntdb.Tx) error {
-		_, _, err := tx.Set(string(key), string(val), opts)
-		return err
-	})
+	_, _, err := tx.Set(string(key), string(compressor.Encode(val)), opts)
 	return err
 }
 
-func (storage *MemoryStorage) Del(keys [][]byte) error {
+func memoryDel(tx *buntdb.Tx, keys [][]byte) error {
 	for _, key := range keys {
-		err := storage.db.Update(func(tx *buntdb.Tx) error {
-			_, err := tx.Delete(string(key))
-			return err
-		})
-		if err != nil {
+		if _, err := tx.Delete(string(key)); err != nil && err != buntdb.ErrNotFound {
 			return err
 		}
 	}
 	return nil
 }
 
-func (storage *MemoryStorage) Scan(scanOpts ScanOptions) ([]KVPair, error) {
+func memoryScan(tx *buntdb.Tx, scanOpts ScanOptions, compressor *Compressor) ([]KVPair, error) {
 	var output []KVPair
 	reGlob, err := glob.Compile(scanOpts.Pattern)
 	if err != nil {
 		return nil, err
 	}
-	err = storage.db.View(func(tx *buntdb.Tx) error {
-		err := tx.Ascend("", func(key, value string) bool {
-			if scanOpts.Limit > 0 && len(output) >= scanOpts.Limit {
-				return false
-			}
-			if scanOpts.Pattern != "" {
-				//skip
-				if !reGlob.Match(key) {
-					return true
-				}
+	var decodeErr error
+	iterator := func(key, value string) bool {
+		if scanOpts.Limit > 0 && len(output) >= scanOpts.Limit {
+			return false
+		}
+		if !strings.HasPrefix(key, string(scanOpts.Prefix)) {
+			return false
+		}
+		if scanOpts.Pattern != "" {
+			//skip
+			if !reGlob.Match(key[len(scanOpts.Prefix):]) {
+				return true
 			}
+		}
 
-			pair := KVPair{}
-			pair.SetKey([]byte(key))
-			if scanOpts.IncludeValue {
-				pair.SetVal([]byte(value))
+		pair := KVPair{}
+		pair.SetKey([]byte(key))
+		if scanOpts.IncludeValue {
+			val, err := compressor.Decode([]byte(value))
+			if err != nil {
+				decodeErr = err
+				return false
 			}
-			output = append(output, pair)
-			return true
-		})
-		return err
-	})
-
+			pair.SetVal(val)
+		}
+		output = append(output, pair)
+		return true
+	}
+	if scanOpts.Skip == nil {
+		err = tx.AscendGreaterOrEqual("", string(scanOpts.Prefix), iterator)
+	} else {
+		//the keys before the skipped ones, then the ones after
+		err = tx.AscendRange("", string(scanOpts.Prefix), string(scanOpts.Skip), iterator)
+		if end := prefixEnd(scanOpts.Skip); err == nil && decodeErr == nil && end != nil {
+			err = tx.AscendGreaterOrEqual("", string(end), iterator)
+		}
+	}
+	if err == nil {
+		err = decodeErr
+	}
 	return output, err
 }
 
-func (storage *MemoryStorage) TTL(key []byte) (uint64, error) {
-	var ttl uint64
-	err := storage.db.View(func(tx *buntdb.Tx) error {
-		exp, err := tx.TTL(string(key))
-		if err == buntdb.ErrNotFound {
-			return types.ErrKeyNotFound
-		}
-		if err != nil {
-			return err
-		}
-		if exp == 0 {
-			return types.ErrKeyNotFound
-		} else if exp < 0 {
-			ttl = 0
-		} else if exp > 0 {
-			ttl = uint64(exp.Milliseconds())
-		}
-		return err
-	})
-	return ttl, err
+func memoryTTL(tx *buntdb.Tx, key []byte) (uint64, error) {
+	exp, err := tx.TTL(string(key))
+	if err == buntdb.ErrNotFound {
+		return 0, types.ErrKeyNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	if exp == 0 {
+		return 0, types.ErrKeyNotFound
+	} else if exp < 0 {
+		return 0, nil
+	}
+	return uint64(exp.Milliseconds()), nil
 }
@@ -3,6 +3,7 @@ package storage
 import (
 	"context"
 	"io"
+	"time"
 )
 
 type Storage interface {
@@ -13,10 +14,37 @@ type Storage interface {
 	Scan(scanOpts ScanOptions) ([]KVPair, error)
 	Close() error
 
+	//Transaction runs fn against a transactional view of the storage,
+	//all writes made through txn are committed atomically when fn returns nil
+	Transaction(fn func(txn Storage) error) error
+
 	Snapshot(ctx context.Context, writer io.Writer) error
 	LoadSnapshot(ctx context.Context, reader io.Reader) error
 }
 
+// Sizer is implemented by storages which know their size on disk
+type Sizer interface {
+	Size() (lsm, vlog int64)
+}
+
+// Rekeyer is implemented by storages which encrypt their data keys with a master key
+type Rekeyer interface {
+	Rekey(key []byte) error
+}
+
+// Backuper is implemented by storages which snapshot only the writes made since a version.
+// Pin returns the version of the last committed write and keeps the data of that version
+// readable until release is called, Backup writes the versions in (since, until]
+type Backuper interface {
+	Pin() (version uint64, release func())
+	Backup(ctx context.Context, writer io.Writer, since, until uint64) error
+}
+
+// GarbageCollector is implemented by storages which reclaim disk space periodically
+type GarbageCollector interface {
+	RunGC() error
+}
+
 const (
 	TypeBadger = "badger"
 	TypeMemory = "memory"
@@ -25,6 +53,16 @@ const (
 type Options struct {
 	Storage string
 	Dir     string
+
+	//EncryptionKey is the AES master key of the data keys, the storage is plaintext without it
+	EncryptionKey []byte
+	//EncryptionKeyRotation is the lifetime of the data keys
+	EncryptionKeyRotation time.Duration
+
+	//Compressor encodes values, a default one without compression is used if nil
+	Compressor *Compressor
+	//BlockCompression is the codec of badger blocks
+	BlockCompression string
 }
 
 func NewStorage(options Options) (Storage, error) {
@@ -42,6 +80,22 @@ type ScanOptions struct {
 	Pattern      string
 	Limit        int
 	IncludeValue bool
+	//Prefix bounds the scan to the keys starting with it, the pattern is matched against the rest of them
+	Prefix []byte
+	//Skip leaves out the keys starting with it, the scan seeks past them
+	Skip []byte
+}
+
+// prefixEnd returns the first key after every key starting with prefix, nil if there is none
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
 }
 
 type KVPair struct {
@@ -1,10 +1,14 @@
 package storage
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"github.com/dgraph-io/badger/v2"
 	"github.com/joway/pidis/types"
 	"github.com/stretchr/testify/suite"
 	"os"
+	"path"
 	"testing"
 	"time"
 )
@@ -137,3 +141,231 @@ func testStorageScan(suite *StorageTestSuite, storage Storage) {
 	suite.NoError(err)
 	suite.Equal(11, len(pairs))
 }
+
+func (suite *StorageTestSuite) TestBadgerStorage_Transaction() {
+	badgerStorage, err := NewBadgerStorage(Options{Dir: suite.dir})
+	suite.NoError(err)
+	testStorageTransaction(suite, badgerStorage)
+}
+
+func (suite *StorageTestSuite) TestMemoryStorage_Transaction() {
+	memoryStorage, err := NewMemoryStorage(Options{})
+	suite.NoError(err)
+	testStorageTransaction(suite, memoryStorage)
+}
+
+func testStorageTransaction(suite *StorageTestSuite, storage Storage) {
+	err := storage.Transaction(func(txn Storage) error {
+		suite.NoError(txn.Set([]byte("k1"), []byte("v1"), 0))
+		suite.NoError(txn.Set([]byte("k2"), []byte("v2"), 0))
+		//read own writes
+		v, err := txn.Get([]byte("k1"))
+		suite.NoError(err)
+		suite.Equal("v1", string(v))
+		//the transaction view can't be closed nor snapshotted
+		suite.Equal(types.ErrInTransaction, txn.Close())
+		suite.Equal(types.ErrInTransaction, txn.Snapshot(context.Background(), &bytes.Buffer{}))
+		suite.Equal(types.ErrInTransaction, txn.LoadSnapshot(context.Background(), &bytes.Buffer{}))
+		return txn.Del([][]byte{[]byte("k2")})
+	})
+	suite.NoError(err)
+	v, err := storage.Get([]byte("k1"))
+	suite.NoError(err)
+	suite.Equal("v1", string(v))
+	_, err = storage.Get([]byte("k2"))
+	suite.Equal(types.ErrKeyNotFound, err)
+
+	//rollback
+	err = storage.Transaction(func(txn Storage) error {
+		suite.NoError(txn.Set([]byte("k3"), []byte("v3"), 0))
+		return types.ErrRuntimeError
+	})
+	suite.Equal(types.ErrRuntimeError, err)
+	_, err = storage.Get([]byte("k3"))
+	suite.Equal(types.ErrKeyNotFound, err)
+}
+
+func (suite *StorageTestSuite) TestCompressor() {
+	compressor := NewCompressor()
+	large := bytes.Repeat([]byte(`{"field":"value"}`), 64)
+	for _, codec := range []string{CompressionNone, CompressionSnappy, CompressionZSTD} {
+		suite.NoError(compressor.SetCodec(codec))
+		suite.Equal(codec, compressor.Codec())
+		encoded := compressor.Encode(large)
+		if codec == CompressionNone {
+			suite.Len(encoded, len(large)+1)
+		} else {
+			suite.Less(len(encoded), len(large)/4)
+		}
+		decoded, err := compressor.Decode(encoded)
+		suite.NoError(err)
+		suite.Equal(large, decoded)
+
+		//short values are only prefixed by the header
+		encoded = compressor.Encode([]byte("v"))
+		suite.Equal([]byte{codecNone, 'v'}, encoded)
+	}
+	suite.Error(compressor.SetCodec("lz4"))
+	raw, stored := compressor.Stats()
+	suite.EqualValues(3*len(large)+3, raw)
+	suite.Less(stored, raw)
+	_, err := compressor.Decode(nil)
+	suite.Error(err)
+	_, err = compressor.Decode([]byte{9, 'v'})
+	suite.Error(err)
+}
+
+func (suite *StorageTestSuite) TestBadgerStorage_Compression() {
+	compressor := NewCompressor()
+	suite.NoError(compressor.SetCodec(CompressionZSTD))
+	compressor.SetThreshold(16)
+	store, err := NewBadgerStorage(Options{
+		Dir:              suite.dir,
+		Compressor:       compressor,
+		BlockCompression: CompressionSnappy,
+	})
+	suite.Require().NoError(err)
+	defer func() { _ = store.Close() }()
+
+	//values written before compression are stored without header
+	suite.NoError(store.(*BadgerStorage).db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte("legacy"), []byte("plain"))
+	}))
+	large := bytes.Repeat([]byte("value"), 100)
+	suite.NoError(store.Set([]byte("k"), large, 0))
+	v, err := store.Get([]byte("legacy"))
+	suite.NoError(err)
+	suite.Equal("plain", string(v))
+	v, err = store.Get([]byte("k"))
+	suite.NoError(err)
+	suite.Equal(large, v)
+
+	//values written with another codec stay readable
+	suite.NoError(compressor.SetCodec(CompressionSnappy))
+	suite.NoError(store.Set([]byte("k2"), large, 0))
+	pairs, err := store.Scan(ScanOptions{Pattern: "*", IncludeValue: true})
+	suite.NoError(err)
+	suite.Len(pairs, 3)
+	for _, pair := range pairs {
+		if string(pair.Key) != "legacy" {
+			suite.Equal(large, pair.Val)
+		}
+	}
+}
+
+func (suite *StorageTestSuite) TestBadgerStorage_Backup() {
+	suite.Require().NoError(os.MkdirAll(suite.dir, os.ModePerm))
+	store, err := NewBadgerStorage(Options{Dir: path.Join(suite.dir, "source")})
+	suite.Require().NoError(err)
+	defer func() { _ = store.Close() }()
+	backuper := store.(Backuper)
+
+	suite.NoError(store.Set([]byte("a"), []byte("1"), 0))
+	suite.NoError(store.Set([]byte("b"), []byte("2"), 0))
+	suite.NoError(store.Set([]byte("ttl"), []byte("3"), uint64(time.Hour.Seconds())))
+	suite.NoError(store.Del([][]byte{[]byte("b")}))
+	version, release := backuper.Pin()
+	//writes made after the pin aren't part of the backup
+	suite.NoError(store.Set([]byte("a"), []byte("2"), 0))
+	suite.NoError(store.Set([]byte("c"), []byte("3"), 0))
+	var full bytes.Buffer
+	suite.NoError(backuper.Backup(context.Background(), &full, 0, version))
+	release()
+
+	next, release := backuper.Pin()
+	var incremental bytes.Buffer
+	suite.NoError(backuper.Backup(context.Background(), &incremental, version, next))
+	release()
+
+	restored, err := NewBadgerStorage(Options{Dir: path.Join(suite.dir, "target")})
+	suite.Require().NoError(err)
+	defer func() { _ = restored.Close() }()
+	suite.NoError(restored.LoadSnapshot(context.Background(), &full))
+	v, err := restored.Get([]byte("a"))
+	suite.NoError(err)
+	suite.Equal("1", string(v))
+	_, err = restored.Get([]byte("b"))
+	suite.Equal(types.ErrKeyNotFound, err)
+	_, err = restored.Get([]byte("c"))
+	suite.Equal(types.ErrKeyNotFound, err)
+	ttl, err := restored.TTL([]byte("ttl"))
+	suite.NoError(err)
+	suite.NotZero(ttl)
+
+	suite.NoError(restored.LoadSnapshot(context.Background(), &incremental))
+	v, err = restored.Get([]byte("a"))
+	suite.NoError(err)
+	suite.Equal("2", string(v))
+	v, err = restored.Get([]byte("c"))
+	suite.NoError(err)
+	suite.Equal("3", string(v))
+}
+
+func (suite *StorageTestSuite) TestBadgerStorage_Keyspace() {
+	badgerStorage, err := NewBadgerStorage(Options{Dir: suite.dir})
+	suite.NoError(err)
+	testKeyspace(suite, badgerStorage)
+}
+
+func (suite *StorageTestSuite) TestMemoryStorage_Keyspace() {
+	memoryStorage, err := NewMemoryStorage(Options{})
+	suite.NoError(err)
+	testKeyspace(suite, memoryStorage)
+}
+
+func testKeyspace(suite *StorageTestSuite, storage Storage) {
+	first, second := NewKeyspace(storage, 0), NewKeyspace(storage, 2)
+	suite.NoError(first.Set([]byte("k"), []byte("0"), 0))
+	suite.NoError(second.Set([]byte("k"), []byte("2"), 0))
+
+	v, err := second.Get([]byte("k"))
+	suite.NoError(err)
+	suite.Equal("2", string(v))
+	pairs, err := first.Scan(ScanOptions{Pattern: "*"})
+	suite.NoError(err)
+	suite.Len(pairs, 1)
+	suite.Equal("k", string(pairs[0].Key))
+	pairs, err = second.Scan(ScanOptions{Pattern: "k*"})
+	suite.NoError(err)
+	suite.Len(pairs, 1)
+	suite.Equal("k", string(pairs[0].Key))
+
+	//the keys of other keyspaces are sought past, the limit applies to the keys of the keyspace
+	suite.NoError(first.Set([]byte("~z"), []byte("0"), 0))
+	suite.NoError(NewKeyspace(storage, 3).Set([]byte("k"), []byte("3"), 0))
+	pairs, err = first.Scan(ScanOptions{Pattern: "*", Limit: 2})
+	suite.NoError(err)
+	suite.Len(pairs, 2)
+	suite.Equal([]string{"k", "~z"}, []string{string(pairs[0].Key), string(pairs[1].Key)})
+	pairs, err = second.Scan(ScanOptions{Pattern: "*"})
+	suite.NoError(err)
+	suite.Len(pairs, 1)
+	suite.NoError(first.Del([][]byte{[]byte("~z")}))
+
+	//keys of the first keyspace starting with the marker are escaped
+	suite.NoError(first.Set(second.Key([]byte("k")), []byte("0"), 0))
+	v, err = second.Get([]byte("k"))
+	suite.NoError(err)
+	suite.Equal("2", string(v))
+	pairs, err = first.Scan(ScanOptions{Pattern: KeyspaceMarker + "*"})
+	suite.NoError(err)
+	suite.Len(pairs, 1)
+	suite.Equal(second.Key([]byte("k")), pairs[0].Key)
+	slot, key, ok := SplitKeyspace(first.Key(pairs[0].Key))
+	suite.True(ok)
+	suite.Equal(0, slot)
+	suite.Equal(pairs[0].Key, key)
+	suite.NoError(first.Del([][]byte{pairs[0].Key}))
+
+	slot, key, ok = SplitKeyspace(second.Key([]byte("k")))
+	suite.True(ok)
+	suite.Equal(2, slot)
+	suite.Equal("k", string(key))
+	_, _, ok = SplitKeyspace([]byte(KeyspaceMarker + ":slots"))
+	suite.False(ok)
+
+	suite.NoError(second.Del([][]byte{[]byte("k")}))
+	v, err = first.Get([]byte("k"))
+	suite.NoError(err)
+	suite.Equal("0", string(v))
+}
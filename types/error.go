@@ -2,17 +2,104 @@ package types
 
 import "errors"
 
+// known are the errors of this package by name, replied to clients as they are
+var known = make(map[error]string)
+
+func newError(name string, message string) error {
+	err := errors.New(message)
+	known[err] = name
+	return err
+}
+
+// Known tells whether err is one of the errors of this package or a ReplyError
+func Known(err error) bool {
+	if _, ok := err.(ReplyError); ok {
+		return true
+	}
+	_, ok := known[err]
+	return ok
+}
+
+// Name returns the name err was registered with, "other" for any other error
+func Name(err error) string {
+	if name, ok := known[err]; ok {
+		return name
+	}
+	return "other"
+}
+
 var (
-	ErrUnknownCommand    = errors.New("ERR unknown command")
-	ErrNodeReadOnly      = errors.New("ERR node read only")
-	ErrNodeIsMaster      = errors.New("ERR node is master")
-	ErrNodeConnectFailed = errors.New("ERR node connect failed")
+	ErrUnknownCommand    = newError("unknown_command", "ERR unknown command")
+	ErrNodeReadOnly      = newError("node_read_only", "ERR node read only")
+	ErrNodeIsMaster      = newError("node_is_master", "ERR node is master")
+	ErrNodeConnectFailed = newError("node_connect_failed", "ERR node connect failed")
+
+	ErrInvalidAOFFormat = newError("invalid_aof_format", "ERR invalid aof format")
+	ErrInvalidKeyspaces = newError("invalid_keyspaces", "ERR invalid keyspaces mapping")
+
+	ErrSyntaxError         = newError("syntax_error", "ERR syntax error")
+	ErrRuntimeError        = newError("runtime_error", "ERR runtime error")
+	ErrInvalidNumberOfArgs = newError("invalid_number_of_args", "ERR invalid number of arguments")
+
+	ErrKeyNotFound   = newError("key_not_found", "ERR key not found")
+	ErrInTransaction = newError("in_transaction", "ERR not allowed inside a storage transaction")
+
+	ErrNestedMulti         = newError("nested_multi", "ERR MULTI calls can not be nested")
+	ErrExecWithoutMulti    = newError("exec_without_multi", "ERR EXEC without MULTI")
+	ErrDiscardWithoutMulti = newError("discard_without_multi", "ERR DISCARD without MULTI")
+	ErrWatchInsideMulti    = newError("watch_inside_multi", "ERR WATCH inside MULTI is not allowed")
+	ErrExecAbort           = newError("exec_abort", "EXECABORT Transaction discarded because of previous errors.")
+
+	ErrNotInteger           = newError("not_integer", "ERR value is not an integer or out of range")
+	ErrNegativeNumKeys      = newError("negative_num_keys", "ERR Number of keys can't be negative")
+	ErrTooManyNumKeys       = newError("too_many_num_keys", "ERR Number of keys can't be greater than number of args")
+	ErrNoScript             = newError("no_script", "NOSCRIPT No matching script. Please use EVAL.")
+	ErrNotBusy              = newError("not_busy", "NOTBUSY No scripts in execution right now.")
+	ErrUnkillable           = newError("unkillable", "UNKILLABLE Sorry the script already executed write commands against the dataset.")
+	ErrScriptKilled         = newError("script_killed", "ERR Script killed by user with SCRIPT KILL...")
+	ErrNotAllowedFromScript = newError("not_allowed_from_script", "ERR This Redis command is not allowed from scripts")
 
-	ErrInvalidAOFFormat = errors.New("ERR invalid aof format")
+	ErrWriteFromReadOnlyScript = newError("write_from_read_only_script", "ERR Write commands are not allowed from read-only scripts")
+	ErrFunctionNotFound        = newError("function_not_found", "ERR Function not found")
+	ErrLibraryNotFound         = newError("library_not_found", "ERR Library not found")
+	ErrInvalidFunctionPayload  = newError("invalid_function_payload", "ERR payload version or checksum are wrong")
 
-	ErrSyntaxError         = errors.New("ERR syntax error")
-	ErrRuntimeError        = errors.New("ERR runtime error")
-	ErrInvalidNumberOfArgs = errors.New("ERR invalid number of arguments")
+	ErrInvalidNotifyFlags = newError("invalid_notify_flags", "ERR Invalid event class character. Use 'Ag$lshzxeKEtmdn'.")
 
-	ErrKeyNotFound = errors.New("ERR key not found")
+	ErrTrackingRedirect = newError("tracking_redirect", "ERR The client ID you want redirect to does not exist")
+	ErrTrackingPrefix   = newError("tracking_prefix", "ERR PREFIX option requires BCAST mode to be enabled")
+	ErrTrackingOptInOut = newError("tracking_opt_in_out", "ERR You can't use OPTIN and OPTOUT at the same time")
+	ErrTrackingBcastOpt = newError("tracking_bcast_opt", "ERR OPTIN and OPTOUT are not compatible with BCAST")
+	ErrTrackingCaching  = newError("tracking_caching", "ERR CLIENT CACHING can be called only when the client is in tracking mode with OPTIN or OPTOUT mode enabled")
+
+	ErrNoAuth              = newError("no_auth", "NOAUTH Authentication required.")
+	ErrWrongPass           = newError("wrong_pass", "WRONGPASS invalid username-password pair or user is disabled.")
+	ErrAuthWithoutPassword = newError("auth_without_password", "ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?")
+	ErrNoPermKey           = newError("no_perm_key", "NOPERM No permissions to access a key")
+	ErrNoPermChannel       = newError("no_perm_channel", "NOPERM No permissions to access a channel")
+	ErrDeleteDefaultUser   = newError("delete_default_user", "ERR The 'default' user cannot be removed")
+	ErrHelloNoAuth         = newError("hello_no_auth", "NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time")
+
+	ErrNoProto         = newError("no_proto", "NOPROTO unsupported protocol version")
+	ErrProtocolVersion = newError("protocol_version", "ERR Protocol version is not an integer or out of range")
+
+	ErrNoConfigFile = newError("no_config_file", "ERR The server is running without a config file")
+
+	ErrInvalidDBIndex    = newError("invalid_db_index", "ERR invalid DB index")
+	ErrDBIndexOutOfRange = newError("db_index_out_of_range", "ERR DB index is out of range")
+	ErrSameObject        = newError("same_object", "ERR source and destination objects are the same")
+
+	ErrOOM       = newError("oom", "OOM command not allowed when used memory > 'maxmemory'.")
+	ErrDiskQuota = newError("disk_quota", "OOM command not allowed when disk usage > 'disk-quota'.")
+
+	ErrEncryptionDisabled = newError("encryption_disabled", "ERR encryption at rest is not enabled")
+
+	ErrBackupInProgress = newError("backup_in_progress", "ERR Background save already in progress")
 )
+
+// ReplyError is an error message replied to the client as is
+type ReplyError string
+
+func (e ReplyError) Error() string {
+	return string(e)
+}
@@ -10,6 +10,10 @@ func MessageNull() []byte {
 	return redcon.AppendNull(nil)
 }
 
+func MessageNullArray() []byte {
+	return []byte("*-1\r\n")
+}
+
 func MessageOK() []byte {
 	return redcon.AppendOK(nil)
 }
@@ -0,0 +1,228 @@
+package util
+
+import (
+	"bytes"
+	"github.com/tidwall/redcon"
+	"math"
+	"strconv"
+)
+
+// protocol versions negotiated by HELLO
+const (
+	RESP2 = 2
+	RESP3 = 3
+)
+
+// Reply builds a reply for the given protocol version, RESP3 only types
+// are downgraded to their RESP2 equivalent for RESP2 clients
+type Reply struct {
+	proto int
+	buf   []byte
+}
+
+func NewReply(proto int) *Reply {
+	return &Reply{proto: proto}
+}
+
+func (r *Reply) Bytes() []byte {
+	return r.buf
+}
+
+func (r *Reply) Raw(b []byte) *Reply {
+	r.buf = append(r.buf, b...)
+	return r
+}
+
+func (r *Reply) Array(n int) *Reply {
+	r.buf = redcon.AppendArray(r.buf, n)
+	return r
+}
+
+func (r *Reply) Map(n int) *Reply {
+	if r.proto < RESP3 {
+		return r.Array(n * 2)
+	}
+	r.buf = appendPrefix(r.buf, '%', int64(n))
+	return r
+}
+
+func (r *Reply) Set(n int) *Reply {
+	if r.proto < RESP3 {
+		return r.Array(n)
+	}
+	r.buf = appendPrefix(r.buf, '~', int64(n))
+	return r
+}
+
+func (r *Reply) Push(n int) *Reply {
+	if r.proto < RESP3 {
+		return r.Array(n)
+	}
+	r.buf = appendPrefix(r.buf, '>', int64(n))
+	return r
+}
+
+func (r *Reply) Null() *Reply {
+	if r.proto < RESP3 {
+		r.buf = redcon.AppendNull(r.buf)
+		return r
+	}
+	r.buf = append(r.buf, "_\r\n"...)
+	return r
+}
+
+func (r *Reply) NullArray() *Reply {
+	if r.proto < RESP3 {
+		r.buf = append(r.buf, "*-1\r\n"...)
+		return r
+	}
+	return r.Null()
+}
+
+func (r *Reply) Bulk(b []byte) *Reply {
+	r.buf = redcon.AppendBulk(r.buf, b)
+	return r
+}
+
+func (r *Reply) BulkString(s string) *Reply {
+	r.buf = redcon.AppendBulkString(r.buf, s)
+	return r
+}
+
+func (r *Reply) String(s string) *Reply {
+	r.buf = redcon.AppendString(r.buf, s)
+	return r
+}
+
+func (r *Reply) Error(s string) *Reply {
+	r.buf = redcon.AppendError(r.buf, s)
+	return r
+}
+
+func (r *Reply) Int(i int64) *Reply {
+	r.buf = redcon.AppendInt(r.buf, i)
+	return r
+}
+
+func (r *Reply) Double(f float64) *Reply {
+	var s string
+	switch {
+	case math.IsInf(f, 1):
+		s = "inf"
+	case math.IsInf(f, -1):
+		s = "-inf"
+	case math.IsNaN(f):
+		s = "nan"
+	default:
+		s = strconv.FormatFloat(f, 'g', -1, 64)
+	}
+	if r.proto < RESP3 {
+		return r.BulkString(s)
+	}
+	r.buf = append(r.buf, ',')
+	r.buf = append(r.buf, s...)
+	r.buf = append(r.buf, '\r', '\n')
+	return r
+}
+
+func (r *Reply) Bool(b bool) *Reply {
+	if r.proto < RESP3 {
+		if b {
+			return r.Int(1)
+		}
+		return r.Int(0)
+	}
+	if b {
+		r.buf = append(r.buf, "#t\r\n"...)
+	} else {
+		r.buf = append(r.buf, "#f\r\n"...)
+	}
+	return r
+}
+
+// Verbatim replies a string with a three bytes format such as txt or mkd
+func (r *Reply) Verbatim(format, s string) *Reply {
+	if r.proto < RESP3 {
+		return r.BulkString(s)
+	}
+	r.buf = appendPrefix(r.buf, '=', int64(len(format)+1+len(s)))
+	r.buf = append(r.buf, format...)
+	r.buf = append(r.buf, ':')
+	r.buf = append(r.buf, s...)
+	r.buf = append(r.buf, '\r', '\n')
+	return r
+}
+
+func (r *Reply) BigNumber(s string) *Reply {
+	if r.proto < RESP3 {
+		return r.BulkString(s)
+	}
+	r.buf = append(r.buf, '(')
+	r.buf = append(r.buf, s...)
+	r.buf = append(r.buf, '\r', '\n')
+	return r
+}
+
+func appendPrefix(b []byte, c byte, n int64) []byte {
+	b = append(b, c)
+	b = strconv.AppendInt(b, n, 10)
+	return append(b, '\r', '\n')
+}
+
+// UpgradeRESP3 rewrites the RESP2 null bulk and null array of a reply into the RESP3 null,
+// every other RESP2 type is valid RESP3 as is
+func UpgradeRESP3(reply []byte) []byte {
+	if !bytes.Contains(reply, []byte("-1\r\n")) {
+		return reply
+	}
+	output := make([]byte, 0, len(reply))
+	for len(reply) > 0 {
+		n := nextReply(reply)
+		if n <= 0 {
+			//not a valid reply, leave it untouched
+			return append(output, reply...)
+		}
+		//elements of aggregates are rewritten one by one after their header
+		if (reply[0] == '$' || reply[0] == '*') && n == 5 && string(reply[1:3]) == "-1" {
+			output = append(output, "_\r\n"...)
+		} else {
+			output = append(output, reply[:n]...)
+		}
+		reply = reply[n:]
+	}
+	return output
+}
+
+// lineEnd returns the length of the first line including \r\n, or 0
+func lineEnd(b []byte) int {
+	i := bytes.Index(b, []byte("\r\n"))
+	if i < 0 {
+		return 0
+	}
+	return i + 2
+}
+
+// nextReply returns the length of the first non aggregate reply, or of the
+// header only for aggregates, 0 if b is incomplete
+func nextReply(b []byte) int {
+	end := lineEnd(b)
+	if end == 0 {
+		return 0
+	}
+	switch b[0] {
+	case '$', '=', '!':
+		size, err := strconv.Atoi(string(b[1 : end-2]))
+		if err != nil {
+			return 0
+		}
+		if size < 0 {
+			return end
+		}
+		if len(b) < end+size+2 {
+			return 0
+		}
+		return end + size + 2
+	default:
+		return end
+	}
+}